@@ -22,9 +22,12 @@ export const useRoom = ({ diagnostics } = {}) => {
                 throw new Error(`Failed to fetch rooms: ${response.status}`);
             }
             const data = await response.json();
-            setRooms(data || []);
+            // 服务端返回 { rooms, truncated, total }
+            const roomList = data?.rooms || [];
+            setRooms(roomList);
             diagnostics?.recordEvent('rooms_loaded', {
-                roomCount: Array.isArray(data) ? data.length : 0
+                roomCount: roomList.length,
+                truncated: Boolean(data?.truncated)
             });
         } catch (err) {
             console.error('Failed to fetch rooms:', err);
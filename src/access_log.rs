@@ -0,0 +1,128 @@
+//! 可选的 HTTP 结构化访问日志中间件。
+
+use std::{
+    net::SocketAddr,
+    time::{Duration, Instant},
+};
+
+use axum::{
+    body::HttpBody,
+    extract::{ConnectInfo, Request},
+    http::header,
+    middleware::Next,
+    response::Response,
+};
+use tracing::info;
+
+/// 每个请求输出一行 JSON；WebSocket 升级单独标记为 `upgrade` 事件。
+pub(crate) async fn log_access(request: Request, next: Next) -> Response {
+    let started_at = Instant::now();
+    let record = AccessRecord::start(&request);
+
+    let response = next.run(request).await;
+
+    let entry = record.finish(&response, started_at.elapsed());
+    info!(target: "access_log", "{entry}");
+
+    response
+}
+
+/// 请求进入时记下的字段，响应返回后再补上状态码、字节数与耗时。
+struct AccessRecord {
+    method: String,
+    path: String,
+    client_ip: Option<String>,
+    is_upgrade: bool,
+}
+
+impl AccessRecord {
+    fn start(request: &Request) -> Self {
+        Self {
+            method: request.method().to_string(),
+            path: request.uri().path().to_string(),
+            client_ip: client_ip(request),
+            is_upgrade: request
+                .headers()
+                .get(header::UPGRADE)
+                .and_then(|value| value.to_str().ok())
+                .map(|value| value.eq_ignore_ascii_case("websocket"))
+                .unwrap_or(false),
+        }
+    }
+
+    fn finish(self, response: &Response, elapsed: Duration) -> serde_json::Value {
+        serde_json::json!({
+            "event": if self.is_upgrade { "upgrade" } else { "request" },
+            "method": self.method,
+            "path": self.path,
+            "status": response.status().as_u16(),
+            "bytes": response.body().size_hint().exact(),
+            "durationMs": elapsed.as_millis() as u64,
+            "clientIp": self.client_ip,
+        })
+    }
+}
+
+/// 优先取反向代理写入的 `X-Forwarded-For` 首项，否则使用 TCP 对端地址。
+fn client_ip(request: &Request) -> Option<String> {
+    request
+        .headers()
+        .get("x-forwarded-for")
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.split(',').next())
+        .map(|value| value.trim().to_string())
+        .filter(|value| !value.is_empty())
+        .or_else(|| {
+            request
+                .extensions()
+                .get::<ConnectInfo<SocketAddr>>()
+                .map(|ConnectInfo(addr)| addr.ip().to_string())
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::{body::Body, http::StatusCode};
+
+    #[test]
+    fn room_list_request_is_logged_with_status_size_duration_and_ip() {
+        let request = Request::builder()
+            .method("GET")
+            .uri("/api/rooms?tenant=acme")
+            .header("x-forwarded-for", "203.0.113.7, 10.0.0.1")
+            .body(Body::empty())
+            .expect("request");
+        let record = AccessRecord::start(&request);
+        let response = Response::builder()
+            .status(StatusCode::OK)
+            .body(Body::from(r#"{"rooms":[],"truncated":false,"total":0}"#))
+            .expect("response");
+
+        let entry = record.finish(&response, Duration::from_millis(12));
+        assert_eq!(
+            entry,
+            serde_json::json!({
+                "event": "request",
+                "method": "GET",
+                "path": "/api/rooms",
+                "status": 200,
+                "bytes": 40,
+                "durationMs": 12,
+                "clientIp": "203.0.113.7",
+            })
+        );
+    }
+
+    #[test]
+    fn client_ip_falls_back_to_the_peer_address() {
+        let mut request = Request::builder()
+            .uri("/api/rooms")
+            .body(Body::empty())
+            .expect("request");
+        request
+            .extensions_mut()
+            .insert(ConnectInfo(SocketAddr::from(([192, 0, 2, 1], 40_000))));
+        assert_eq!(client_ip(&request).as_deref(), Some("192.0.2.1"));
+    }
+}
@@ -0,0 +1,1272 @@
+//! 运维管理接口：仅在配置了 `ADMIN_TOKEN` 时挂载，并要求 Bearer 鉴权。
+
+use std::{
+    collections::HashMap,
+    sync::{atomic::Ordering, Arc},
+};
+
+use axum::{
+    extract::{Path, State},
+    http::{header, HeaderMap, StatusCode},
+    routing::{delete, get, post},
+    Json, Router,
+};
+use serde::Deserialize;
+use serde_json::Value;
+use tracing::info;
+
+use crate::{
+    api_error::ApiError,
+    app::{AppContext, LobbyEvent, OutboundMessage, RoomOptions, RoomState},
+    config::{AppConfig, OwnerLeavePolicy, RetentionPolicy},
+    session::room_password_hash,
+    transform::parse_transforms,
+    types::{
+        AdminClientInfo, RoomConfigResponse, RoomExport, RoomInfo, RoomLogResponse, SignalMessage,
+    },
+    utils::{now_ms, process_memory},
+    ws::{active_pump_count, broadcast_outbound, DetachedConnection},
+};
+
+type AdminError = ApiError;
+
+/// `POST /admin/rooms` 的请求体。
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct CreateRoomRequest {
+    id: String,
+    #[serde(default, rename = "private")]
+    is_private: bool,
+    owner_leave: Option<String>,
+    #[serde(default)]
+    allowed_origins: Vec<String>,
+    #[serde(default)]
+    require_approval: bool,
+    /// 为该房间开启调试消息日志。
+    #[serde(default)]
+    message_log: bool,
+    /// 房间的最长存活时间（毫秒），受 `ROOM_MAX_LIFETIME_MS` 约束。
+    max_lifetime_ms: Option<u64>,
+    /// 消息数据保留策略：`none` / `session` / 保留毫秒数。
+    retention: Option<String>,
+    /// 只作用于本房间的消息处理链，按顺序执行，如 `["redact_chat"]`。
+    #[serde(default)]
+    transforms: Vec<String>,
+    /// 房间密码；只保存 HMAC，建连前需先通过 `POST /api/rooms/{id}/verify` 换取入场令牌。
+    password: Option<String>,
+}
+
+/// `POST /admin/rooms/{id}/rename` 的请求体。
+#[derive(Debug, Deserialize)]
+struct RenameRoomRequest {
+    id: String,
+}
+
+/// `POST /admin/rooms/{id}/handoff` 的请求体。
+#[derive(Debug, Deserialize)]
+struct HandoffRoomRequest {
+    /// 新实例的地址提示，原样转发给客户端。
+    target: String,
+}
+
+/// `POST /admin/rooms/{id}/drain` 的请求体。
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct DrainRoomRequest {
+    /// 距关闭的宽限期（毫秒），缺省用 `ROOM_DRAIN_GRACE_MS`。
+    #[serde(default)]
+    grace_ms: Option<u64>,
+}
+
+/// `POST /admin/rooms/{id}/transforms` 的请求体；空列表表示清除处理链。
+#[derive(Debug, Deserialize)]
+struct TransformsRequest {
+    transforms: Vec<String>,
+}
+
+/// `POST /admin/rooms/{id}/log` 的请求体。
+#[derive(Debug, Deserialize)]
+struct MessageLogRequest {
+    enabled: bool,
+}
+
+/// `POST /admin/aliases` 的请求体。
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct AliasRequest {
+    alias: String,
+    room_id: String,
+}
+
+/// `POST /admin/maintenance` 的请求体。
+#[derive(Debug, Deserialize)]
+struct MaintenanceRequest {
+    enabled: bool,
+}
+
+/// 管理接口路由，由 `build_router` 按配置决定是否合并。
+pub(crate) fn admin_routes() -> Router<Arc<AppContext>> {
+    Router::new()
+        .route("/admin/rooms", post(create_room))
+        .route("/admin/rooms/{id}/rename", post(rename_room))
+        .route("/admin/rooms/{id}/handoff", post(handoff_room))
+        .route("/admin/rooms/{id}/drain", post(drain_room))
+        .route("/admin/rooms/{id}/config", get(get_room_config))
+        .route("/admin/rooms/{id}/clients", get(list_room_clients))
+        .route(
+            "/admin/rooms/{id}/log",
+            get(get_room_log).post(set_room_log),
+        )
+        .route(
+            "/admin/rooms/{id}/transforms",
+            get(get_room_transforms).post(set_room_transforms),
+        )
+        .route("/admin/aliases", get(list_aliases).post(set_alias))
+        .route("/admin/aliases/{alias}", delete(delete_alias))
+        .route(
+            "/admin/maintenance",
+            get(get_maintenance).post(set_maintenance),
+        )
+        .route("/admin/runtime", get(runtime_snapshot))
+}
+
+/// 运行时诊断路由，需同时配置 `ADMIN_TOKEN` 与 `DEBUG_ENDPOINTS=true` 才会挂载。
+pub(crate) fn debug_routes() -> Router<Arc<AppContext>> {
+    Router::new().route("/debug/runtime", get(runtime_snapshot))
+}
+
+/// 校验 `Authorization: Bearer <ADMIN_TOKEN>`。
+pub(crate) fn authorize_admin(config: &AppConfig, headers: &HeaderMap) -> Result<(), AdminError> {
+    let Some(expected) = config.admin_token.as_deref() else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "not_found"));
+    };
+    let provided = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("Bearer "))
+        .map(str::trim);
+
+    match provided {
+        Some(token) if constant_time_eq(token.as_bytes(), expected.as_bytes()) => Ok(()),
+        _ => Err(admin_error(StatusCode::UNAUTHORIZED, "unauthorized")),
+    }
+}
+
+fn admin_error(status: StatusCode, code: &'static str) -> AdminError {
+    ApiError::new(status, code)
+}
+
+/// 按字节做定长比较，避免通过响应时间猜测令牌。
+fn constant_time_eq(left: &[u8], right: &[u8]) -> bool {
+    if left.len() != right.len() {
+        return false;
+    }
+
+    left.iter()
+        .zip(right.iter())
+        .fold(0u8, |acc, (a, b)| acc | (a ^ b))
+        == 0
+}
+
+/// 预建一个房间，可附带只能在建房时设置的属性；预建房间在成员走空后仍保留。
+async fn create_room(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+    Json(request): Json<CreateRoomRequest>,
+) -> Result<(StatusCode, Json<RoomInfo>), AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let room_id = request.id.trim().to_string();
+    if room_id.is_empty() {
+        return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_room_id"));
+    }
+    let owner_leave_policy = match request.owner_leave.as_deref() {
+        Some(value) => OwnerLeavePolicy::parse(value)
+            .ok_or_else(|| admin_error(StatusCode::BAD_REQUEST, "invalid_owner_leave"))?,
+        None => context.config.owner_leave_policy,
+    };
+    let retention = match request.retention.as_deref() {
+        Some(value) => Some(
+            RetentionPolicy::parse(value)
+                .ok_or_else(|| admin_error(StatusCode::BAD_REQUEST, "invalid_retention"))?,
+        ),
+        None => context.config.room_retention,
+    };
+    let transforms = parse_transforms(&request.transforms)
+        .map_err(|_| admin_error(StatusCode::BAD_REQUEST, "invalid_transform"))?;
+
+    let mut state = context.state.write().await;
+    if state.rooms.contains_key(&room_id) {
+        return Err(admin_error(StatusCode::CONFLICT, "room_exists"));
+    }
+    if state.room_aliases.contains_key(&room_id) {
+        return Err(admin_error(StatusCode::CONFLICT, "alias_exists"));
+    }
+    if !state.tenant_has_room_slot(&context.config, &room_id) {
+        return Err(admin_error(
+            StatusCode::SERVICE_UNAVAILABLE,
+            "tenant_room_limit",
+        ));
+    }
+    if !state.reserve_room_slot(&context.config) {
+        return Err(admin_error(StatusCode::SERVICE_UNAVAILABLE, "room_limit"));
+    }
+
+    let mut room = RoomState::new(
+        room_id.clone(),
+        None,
+        RoomOptions {
+            is_private: request.is_private,
+            owner_leave_policy,
+            allowed_origins: request.allowed_origins,
+            persistent: true,
+            approval_required: request.require_approval,
+            message_log: request.message_log || context.config.room_message_log,
+            max_lifetime_ms: context.config.room_lifetime_ms(request.max_lifetime_ms),
+            retention,
+        },
+    );
+    room.transforms = transforms;
+    room.password_hash = request
+        .password
+        .as_deref()
+        .filter(|password| !password.is_empty())
+        .map(|password| room_password_hash(&context.config, password));
+    let info = RoomInfo {
+        id: room.id.clone(),
+        client_count: 0,
+        clients: Vec::new(),
+        created_at: room.created_at_ms,
+        is_private: room.is_private,
+        activity: None,
+    };
+    state.notify_lobby(&context.config, LobbyEvent::Created, &room);
+    state.rooms.insert(room_id.clone(), room);
+    info!("admin pre-created room {room_id}");
+
+    Ok((StatusCode::CREATED, Json(info)))
+}
+
+/// 把房间换到新的 ID 下，成员连接保持不变，并通知成员更新本地保存的房间号。
+async fn rename_room(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+    Json(request): Json<RenameRoomRequest>,
+) -> Result<Json<RoomInfo>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let new_room_id = request.id.trim().to_string();
+    if new_room_id.is_empty() {
+        return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_room_id"));
+    }
+
+    let (info, recipients) = {
+        let mut state = context.state.write().await;
+        if !state.rooms.contains_key(&room_id) {
+            return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+        }
+        if new_room_id == room_id {
+            return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_room_id"));
+        }
+        if state.rooms.contains_key(&new_room_id) {
+            return Err(admin_error(StatusCode::CONFLICT, "room_exists"));
+        }
+        if state.room_aliases.contains_key(&new_room_id) {
+            return Err(admin_error(StatusCode::CONFLICT, "alias_exists"));
+        }
+        // 指向旧房间号的别名跟着改名，用户收藏的链接继续有效。
+        for target in state.room_aliases.values_mut() {
+            if *target == room_id {
+                *target = new_room_id.clone();
+            }
+        }
+
+        // 房间表和连接表在同一把写锁内一起更新，路由不会看到中间状态。
+        let Some(mut room) = state.rooms.remove(&room_id) else {
+            return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+        };
+        state.notify_lobby(&context.config, LobbyEvent::Destroyed, &room);
+        room.id = new_room_id.clone();
+
+        let mut recipients = Vec::with_capacity(room.clients.len());
+        for connection_id in room.clients.values() {
+            if let Some(connection) = state.connections.get_mut(connection_id) {
+                connection.room_id = new_room_id.clone();
+                recipients.push(connection.sender.clone());
+            }
+        }
+
+        let clients = room.clients.keys().cloned().collect::<Vec<_>>();
+        let info = RoomInfo {
+            id: room.id.clone(),
+            client_count: clients.len(),
+            clients,
+            created_at: room.created_at_ms,
+            is_private: room.is_private,
+            activity: None,
+        };
+        state.notify_lobby(&context.config, LobbyEvent::Created, &room);
+        state.rooms.insert(new_room_id.clone(), room);
+        (info, recipients)
+    };
+
+    broadcast_outbound(
+        &recipients,
+        SignalMessage::server(
+            &context.config,
+            "room_renamed",
+            serde_json::json!({ "oldId": room_id, "roomId": new_room_id }),
+        ),
+    );
+    info!("admin renamed room {room_id} to {new_room_id}");
+
+    Ok(Json(info))
+}
+
+/// 把房间迁往其他实例：导出元数据，通知成员带着目标地址重连，然后清理本地房间。
+/// 活跃的 socket 无法迁移，成员需要自行重连到新实例。
+async fn handoff_room(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+    Json(request): Json<HandoffRoomRequest>,
+) -> Result<Json<RoomExport>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let target = request.target.trim().to_string();
+    if target.is_empty() {
+        return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_target"));
+    }
+
+    let (export, detached) = {
+        let mut state = context.state.write().await;
+        let Some(room) = state.rooms.remove(&room_id) else {
+            return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+        };
+        state.notify_lobby(&context.config, LobbyEvent::Destroyed, &room);
+
+        // 待审批的申请随房间一起作废，等待中的连接会收到拒绝。
+        for (_, decision) in room.pending_joins {
+            let _ = decision.send(false);
+        }
+
+        let members = room.clients.keys().cloned().collect::<Vec<_>>();
+        let detached = room
+            .clients
+            .values()
+            .filter_map(|connection_id| state.connections.remove(connection_id))
+            .map(|connection| DetachedConnection {
+                sender: connection.sender,
+                shutdown: connection.shutdown,
+            })
+            .collect::<Vec<_>>();
+
+        let export = RoomExport {
+            id: room.id,
+            is_private: room.is_private,
+            owner_leave: room.owner_leave_policy.as_str(),
+            allowed_origins: room.allowed_origins,
+            require_approval: room.approval_required,
+            retention: room.retention.map(RetentionPolicy::as_param),
+            transforms: room
+                .transforms
+                .iter()
+                .map(|transform| transform.name())
+                .collect(),
+            created_at: room.created_at_ms,
+            owner: room.owner,
+            read_only: room.read_only,
+            members,
+            target: target.clone(),
+        };
+        (export, detached)
+    };
+
+    let notice = SignalMessage::server(
+        &context.config,
+        "reconnect",
+        serde_json::json!({ "roomId": room_id, "target": target }),
+    );
+    for connection in &detached {
+        let _ = connection
+            .sender
+            .send(OutboundMessage::Json(notice.clone()));
+        connection.close();
+    }
+    info!(
+        "admin handed off room {room_id} to {target}; redirected {} members",
+        detached.len()
+    );
+
+    Ok(Json(export))
+}
+
+/// 开始排空房间：通知成员即将关闭并拒绝新成员，宽限期结束后由到期检查关闭房间。
+/// 重复调用只会把关闭时间提前，不会推迟。
+async fn drain_room(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+    Json(request): Json<DrainRoomRequest>,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let grace_ms = request
+        .grace_ms
+        .unwrap_or(context.config.room_drain_grace_ms);
+    let (closes_at, recipients) = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let Some(room) = state.rooms.get_mut(&room_id) else {
+            return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+        };
+        let deadline = now_ms().saturating_add(grace_ms);
+        let closes_at = room
+            .draining_until_ms
+            .map_or(deadline, |current| current.min(deadline));
+        room.draining_until_ms = Some(closes_at);
+        room.expires_at_ms = Some(
+            room.expires_at_ms
+                .map_or(closes_at, |expires_at| expires_at.min(closes_at)),
+        );
+        let recipients = room
+            .clients
+            .values()
+            .filter_map(|connection_id| state.connections.get(connection_id))
+            .map(|member| member.sender.clone())
+            .collect::<Vec<_>>();
+        (closes_at, recipients)
+    };
+
+    broadcast_outbound(
+        &recipients,
+        SignalMessage::server(
+            &context.config,
+            "room_draining",
+            serde_json::json!({ "roomId": room_id, "closesAt": closes_at }),
+        ),
+    );
+    info!("admin started draining room {room_id}; closing at {closes_at}");
+
+    Ok(Json(
+        serde_json::json!({ "roomId": room_id, "closesAt": closes_at }),
+    ))
+}
+
+/// 查看房间的全部设置与当前状态，是各个房间管理接口的只读对照。
+async fn get_room_config(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+) -> Result<Json<RoomConfigResponse>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let state = context.state.read().await;
+    let Some(room) = state.rooms.get(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+    let now = now_ms();
+
+    Ok(Json(RoomConfigResponse {
+        id: room.id.clone(),
+        is_private: room.is_private,
+        owner_leave: room.owner_leave_policy.as_str(),
+        allowed_origins: room.allowed_origins.clone(),
+        require_approval: room.approval_required,
+        persistent: room.persistent,
+        retention: room.retention.map(RetentionPolicy::as_param),
+        transforms: room
+            .transforms
+            .iter()
+            .map(|transform| transform.name())
+            .collect(),
+        message_log: room.message_log.is_some(),
+        floor_control: room.floor.is_some(),
+        owner: room.owner.clone(),
+        read_only: room.read_only,
+        awaiting_second_member: room.awaiting_second_member,
+        created_at: room.created_at_ms,
+        expires_at: room.expires_at_ms,
+        draining_until: room.draining_until_ms,
+        password_protected: room.password_hash.is_some(),
+        last_activity_at: room.last_activity_ms.load(Ordering::Relaxed),
+        age_ms: now.saturating_sub(room.created_at_ms),
+        idle_ms: now.saturating_sub(room.last_activity_ms.load(Ordering::Relaxed)),
+        client_count: room.clients.len(),
+        pending_joins: room.pending_joins.len(),
+        history_length: room.history.len(),
+        calls_in_progress: room.in_call.len().div_ceil(2),
+        activity: context
+            .config
+            .room_activity_summary
+            .then(|| room.activity.summary(now)),
+    }))
+}
+
+/// 列出房间内的连接详情，包括 `User-Agent` 等只供排障使用的客户端信息。
+async fn list_room_clients(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+) -> Result<Json<Vec<AdminClientInfo>>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let state = context.state.read().await;
+    let Some(room) = state.rooms.get(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+
+    let mut clients = room
+        .clients
+        .values()
+        .filter_map(|connection_id| state.connections.get(connection_id))
+        .map(|connection| AdminClientInfo {
+            client_id: connection.client_id.clone(),
+            real_client_id: connection.real_client_id.clone(),
+            group: connection.group.clone(),
+            role: connection.role.clone(),
+            display_name: connection.display_name.clone(),
+            spectator: connection.spectator,
+            joined_at: connection.joined_at_ms,
+            last_seen_at: connection.last_seen_ms.load(Ordering::Relaxed),
+            user_agent: connection.user_agent.clone(),
+            client_version: connection.client_version.clone(),
+            queue_capacity: connection.sender.capacity(),
+        })
+        .collect::<Vec<_>>();
+    clients.sort_by_key(|client| client.joined_at);
+
+    Ok(Json(clients))
+}
+
+/// 导出房间最近转发的消息日志，按转发顺序排列，用于复现信令问题。
+async fn get_room_log(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+) -> Result<Json<RoomLogResponse>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let state = context.state.read().await;
+    let Some(room) = state.rooms.get(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+
+    Ok(Json(RoomLogResponse {
+        room_id: room.id.clone(),
+        enabled: room.message_log.is_some(),
+        messages: room.message_log.iter().flatten().cloned().collect(),
+    }))
+}
+
+/// 按房间开关消息日志；关闭时丢弃已记录的内容。
+async fn set_room_log(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+    Json(request): Json<MessageLogRequest>,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let mut state = context.state.write().await;
+    let Some(room) = state.rooms.get_mut(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+
+    match (request.enabled, room.message_log.is_some()) {
+        (true, false) => room.message_log = Some(Default::default()),
+        (false, true) => room.message_log = None,
+        _ => {}
+    }
+    info!(
+        "admin turned message log {} for room {room_id}",
+        if request.enabled { "on" } else { "off" }
+    );
+
+    Ok(Json(serde_json::json!({ "enabled": request.enabled })))
+}
+
+/// 返回房间当前的消息处理链，按执行顺序排列。
+async fn get_room_transforms(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let state = context.state.read().await;
+    let Some(room) = state.rooms.get(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+    let names = room
+        .transforms
+        .iter()
+        .map(|transform| transform.name())
+        .collect::<Vec<_>>();
+
+    Ok(Json(serde_json::json!({ "transforms": names })))
+}
+
+/// 整体替换房间的消息处理链，对之后转发的消息立即生效。
+async fn set_room_transforms(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    headers: HeaderMap,
+    Json(request): Json<TransformsRequest>,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let transforms = parse_transforms(&request.transforms)
+        .map_err(|_| admin_error(StatusCode::BAD_REQUEST, "invalid_transform"))?;
+    let mut state = context.state.write().await;
+    let Some(room) = state.rooms.get_mut(&room_id) else {
+        return Err(admin_error(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+    room.transforms = transforms;
+    info!(
+        "admin set message transforms for room {room_id}: {:?}",
+        request.transforms
+    );
+
+    Ok(Json(
+        serde_json::json!({ "transforms": request.transforms }),
+    ))
+}
+
+/// 列出全部房间别名。
+async fn list_aliases(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+) -> Result<Json<HashMap<String, String>>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    Ok(Json(context.state.read().await.room_aliases.clone()))
+}
+
+/// 新增或改指一个房间别名；目标房间不必已存在，首个成员经别名进入时按规范房间号建房。
+/// 多租户模式下别名与目标都使用带租户前缀的房间键，如 `acme/standup`。
+async fn set_alias(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+    Json(request): Json<AliasRequest>,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let alias = request.alias.trim().to_string();
+    let room_id = request.room_id.trim().to_string();
+    if alias.is_empty() || room_id.is_empty() || alias == room_id {
+        return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_alias"));
+    }
+
+    let mut state = context.state.write().await;
+    // 与现有房间同名的别名会让那个房间再也进不去。
+    if state.rooms.contains_key(&alias) {
+        return Err(admin_error(StatusCode::CONFLICT, "room_exists"));
+    }
+    // 只解析一层，不允许别名指向另一个别名。
+    if state.room_aliases.contains_key(&room_id) {
+        return Err(admin_error(StatusCode::BAD_REQUEST, "invalid_alias_target"));
+    }
+    state.room_aliases.insert(alias.clone(), room_id.clone());
+    info!("admin pointed alias {alias} at room {room_id}");
+
+    Ok(Json(
+        serde_json::json!({ "alias": alias, "roomId": room_id }),
+    ))
+}
+
+/// 删除一个房间别名，房间本身不受影响。
+async fn delete_alias(
+    State(context): State<Arc<AppContext>>,
+    Path(alias): Path<String>,
+    headers: HeaderMap,
+) -> Result<StatusCode, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    if context
+        .state
+        .write()
+        .await
+        .room_aliases
+        .remove(&alias)
+        .is_none()
+    {
+        return Err(admin_error(StatusCode::NOT_FOUND, "alias_not_found"));
+    }
+    info!("admin removed alias {alias}");
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// 查看当前是否处于维护模式。
+async fn get_maintenance(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    Ok(Json(serde_json::json!({
+        "enabled": context.maintenance.load(Ordering::Relaxed),
+    })))
+}
+
+/// 开关维护模式；开启期间拒绝新的 WebSocket 升级，方便发布前排空连接。
+async fn set_maintenance(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+    Json(request): Json<MaintenanceRequest>,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    context
+        .maintenance
+        .store(request.enabled, Ordering::Relaxed);
+    info!(
+        "admin turned maintenance mode {}",
+        if request.enabled { "on" } else { "off" }
+    );
+
+    Ok(Json(serde_json::json!({ "enabled": request.enabled })))
+}
+
+/// 运行中实例的 tokio 调度器、读写循环、内存与注册表快照，用于排查任务泄漏或调度积压。
+/// 同时挂在 `/admin/runtime` 上：只需管理员令牌，不必为此打开 `DEBUG_ENDPOINTS`。
+/// Rust 没有内置的 pprof，CPU 火焰图需借助 perf 等外部工具采集。
+async fn runtime_snapshot(
+    State(context): State<Arc<AppContext>>,
+    headers: HeaderMap,
+) -> Result<Json<Value>, AdminError> {
+    authorize_admin(&context.config, &headers)?;
+
+    let metrics = tokio::runtime::Handle::current().metrics();
+    let state = context.state.read().await;
+
+    Ok(Json(serde_json::json!({
+        "workers": metrics.num_workers(),
+        "aliveTasks": metrics.num_alive_tasks(),
+        "globalQueueDepth": metrics.global_queue_depth(),
+        "rooms": state.rooms.len(),
+        "connections": state.connections.len(),
+        "subscribers": state.subscribers.len(),
+        "pendingDeliveries": state.pending_deliveries.len(),
+        "pendingResponses": state.pending_responses.len(),
+        "activePumps": active_pump_count(),
+        "memory": process_memory(),
+    })))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        app::test_context,
+        ws::{join_for_tests, route_for_tests},
+    };
+
+    fn admin_context() -> Arc<AppContext> {
+        let mut config = AppConfig::for_tests();
+        config.admin_token = Some("secret".to_string());
+        test_context(config)
+    }
+
+    fn admin_headers() -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert(header::AUTHORIZATION, "Bearer secret".parse().unwrap());
+        headers
+    }
+
+    /// 取出队列里眼下已排队的业务消息。
+    fn drain_json(queue: &crate::outbound::OutboundSender) -> Vec<SignalMessage> {
+        std::iter::from_fn(|| queue.try_recv_json()).collect()
+    }
+
+    async fn rename(
+        context: &Arc<AppContext>,
+        room_id: &str,
+        new_room_id: &str,
+    ) -> Result<Json<RoomInfo>, AdminError> {
+        rename_room(
+            State(context.clone()),
+            Path(room_id.to_string()),
+            admin_headers(),
+            Json(RenameRoomRequest {
+                id: new_room_id.to_string(),
+            }),
+        )
+        .await
+    }
+
+    #[tokio::test]
+    async fn renamed_room_keeps_its_members_and_routing() {
+        let context = admin_context();
+        let (alice_id, alice_queue) = join_for_tests(&context, "alice", "temp").await;
+        let (bob_id, bob_queue) = join_for_tests(&context, "bob", "temp").await;
+        drain_json(&alice_queue);
+        drain_json(&bob_queue);
+
+        let Ok(Json(info)) = rename(&context, "temp", "permanent").await else {
+            panic!("renaming to a free id must succeed");
+        };
+        assert_eq!(info.id, "permanent");
+        assert_eq!(info.client_count, 2);
+        {
+            let state = context.state.read().await;
+            assert!(!state.rooms.contains_key("temp"));
+            assert_eq!(state.rooms["permanent"].id, "permanent");
+            for connection_id in [alice_id, bob_id] {
+                assert_eq!(state.connections[&connection_id].room_id, "permanent");
+            }
+        }
+        for queue in [&alice_queue, &bob_queue] {
+            let renamed = drain_json(queue)
+                .into_iter()
+                .find(|message| message.kind == "room_renamed")
+                .expect("members are told about the rename");
+            assert_eq!(
+                renamed.payload,
+                serde_json::json!({ "oldId": "temp", "roomId": "permanent" })
+            );
+        }
+
+        let offer = serde_json::from_value(serde_json::json!({ "type": "offer", "to": "bob" }))
+            .expect("offer message");
+        route_for_tests(&context, alice_id, offer).await;
+        let relayed = drain_json(&bob_queue);
+        assert_eq!(relayed.len(), 1);
+        assert_eq!(relayed[0].kind, "offer");
+        assert_eq!(relayed[0].from, "alice");
+
+        // 之后用新房间号建连的成员进入的是同一个房间。
+        let (_, carol_queue) = join_for_tests(&context, "carol", "permanent").await;
+        let existing = drain_json(&carol_queue)
+            .into_iter()
+            .find(|message| message.kind == "existing_users")
+            .expect("carol sees the members already in the room");
+        let mut members = existing
+            .payload
+            .as_array()
+            .expect("existing users are listed")
+            .clone();
+        members.sort_by_key(|member| member.to_string());
+        assert_eq!(
+            members,
+            vec![serde_json::json!("alice"), serde_json::json!("bob")]
+        );
+        assert_eq!(
+            context.state.read().await.rooms["permanent"].clients.len(),
+            3
+        );
+    }
+
+    #[tokio::test]
+    async fn renaming_onto_an_existing_room_is_refused() {
+        let context = admin_context();
+        let (alice_id, _alice_queue) = join_for_tests(&context, "alice", "temp").await;
+        join_for_tests(&context, "bob", "taken").await;
+
+        let Err(err) = rename(&context, "temp", "taken").await else {
+            panic!("the target id is already in use");
+        };
+        assert_eq!(err.status(), StatusCode::CONFLICT);
+        assert_eq!(err.code(), "room_exists");
+
+        let state = context.state.read().await;
+        assert!(state.rooms["temp"].clients.contains_key("alice"));
+        assert!(!state.rooms["taken"].clients.contains_key("alice"));
+        assert_eq!(state.connections[&alice_id].room_id, "temp");
+    }
+
+    #[tokio::test]
+    async fn handoff_redirects_members_to_the_target_and_removes_the_room() {
+        let context = admin_context();
+        let (alice_id, alice_queue) = join_for_tests(&context, "alice", "moving").await;
+        let (bob_id, bob_queue) = join_for_tests(&context, "bob", "moving").await;
+        drain_json(&alice_queue);
+        drain_json(&bob_queue);
+
+        let Ok(Json(export)) = handoff_room(
+            State(context.clone()),
+            Path("moving".to_string()),
+            admin_headers(),
+            Json(HandoffRoomRequest {
+                target: "wss://b.example.com/ws".to_string(),
+            }),
+        )
+        .await
+        else {
+            panic!("handing off an existing room must succeed");
+        };
+        let mut members = export.members.clone();
+        members.sort();
+        assert_eq!(members, ["alice", "bob"]);
+        assert_eq!(export.target, "wss://b.example.com/ws");
+
+        {
+            let state = context.state.read().await;
+            assert!(!state.rooms.contains_key("moving"));
+            assert!(!state.connections.contains_key(&alice_id));
+            assert!(!state.connections.contains_key(&bob_id));
+        }
+        for queue in [&alice_queue, &bob_queue] {
+            let notice = queue
+                .try_recv_json()
+                .expect("members get a reconnect notice");
+            assert_eq!(notice.kind, "reconnect");
+            assert_eq!(
+                notice.payload,
+                serde_json::json!({ "roomId": "moving", "target": "wss://b.example.com/ws" })
+            );
+            assert!(matches!(queue.recv().await, Some(OutboundMessage::Close)));
+        }
+    }
+
+    #[tokio::test]
+    async fn admin_client_view_shows_the_user_agent() {
+        let context = admin_context();
+        let (alice_id, _) = join_for_tests(&context, "alice", "lobby").await;
+        context
+            .state
+            .write()
+            .await
+            .connections
+            .get_mut(&alice_id)
+            .expect("alice is connected")
+            .user_agent = Some("Firefox/128.0".to_string());
+
+        let Ok(Json(clients)) = list_room_clients(
+            State(context.clone()),
+            Path("lobby".to_string()),
+            admin_headers(),
+        )
+        .await
+        else {
+            panic!("the admin view lists the room's clients");
+        };
+        assert_eq!(clients.len(), 1);
+        assert_eq!(clients[0].user_agent.as_deref(), Some("Firefox/128.0"));
+
+        let Err(err) = list_room_clients(
+            State(context.clone()),
+            Path("lobby".to_string()),
+            HeaderMap::new(),
+        )
+        .await
+        else {
+            panic!("the admin view requires the admin token");
+        };
+        assert_eq!(err.status(), StatusCode::UNAUTHORIZED);
+    }
+
+    #[tokio::test]
+    async fn debug_runtime_snapshot_requires_the_admin_token() {
+        let context = admin_context();
+
+        let Err(err) = runtime_snapshot(State(context.clone()), HeaderMap::new()).await else {
+            panic!("the runtime snapshot requires the admin token");
+        };
+        assert_eq!(err.status(), StatusCode::UNAUTHORIZED);
+
+        let mut wrong = HeaderMap::new();
+        wrong.insert(header::AUTHORIZATION, "Bearer guess".parse().unwrap());
+        let Err(err) = runtime_snapshot(State(context.clone()), wrong).await else {
+            panic!("a wrong token is refused");
+        };
+        assert_eq!(err.status(), StatusCode::UNAUTHORIZED);
+
+        let Ok(Json(snapshot)) = runtime_snapshot(State(context), admin_headers()).await else {
+            panic!("the admin token unlocks the runtime snapshot");
+        };
+        assert!(snapshot["workers"].as_u64().is_some());
+    }
+
+    #[tokio::test]
+    async fn room_log_lists_relayed_messages_in_order_with_redacted_payloads() {
+        let context = admin_context();
+        let (alice_id, _) = join_for_tests(&context, "alice", "debugging").await;
+        let (bob_id, _) = join_for_tests(&context, "bob", "debugging").await;
+        let enabled = set_room_log(
+            State(context.clone()),
+            Path("debugging".to_string()),
+            admin_headers(),
+            Json(MessageLogRequest { enabled: true }),
+        )
+        .await;
+        assert!(enabled.is_ok());
+
+        for (sender, message) in [
+            (
+                alice_id,
+                serde_json::json!({ "type": "offer", "to": "bob", "payload": { "sdp": "o" } }),
+            ),
+            (
+                bob_id,
+                serde_json::json!({ "type": "answer", "to": "alice", "payload": { "sdp": "a" } }),
+            ),
+            (
+                alice_id,
+                serde_json::json!({ "type": "chat", "payload": "hi" }),
+            ),
+        ] {
+            let message = serde_json::from_value(message).expect("signal message");
+            route_for_tests(&context, sender, message).await;
+        }
+
+        let Ok(Json(log)) = get_room_log(
+            State(context.clone()),
+            Path("debugging".to_string()),
+            admin_headers(),
+        )
+        .await
+        else {
+            panic!("the admin can fetch the room log");
+        };
+        assert!(log.enabled);
+        let relayed: Vec<_> = log
+            .messages
+            .iter()
+            .map(|entry| {
+                (
+                    entry.kind.as_str(),
+                    entry.from.as_str(),
+                    entry.to.as_deref(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            relayed,
+            [
+                ("offer", "alice", Some("bob")),
+                ("answer", "bob", Some("alice")),
+                ("chat", "alice", None),
+            ]
+        );
+        assert!(log.messages.iter().all(|entry| entry.payload.is_none()));
+        assert!(log.messages.iter().all(|entry| entry.payload_bytes > 0));
+    }
+
+    async fn point_alias(context: &Arc<AppContext>, alias: &str, room_id: &str) {
+        let result = set_alias(
+            State(context.clone()),
+            admin_headers(),
+            Json(AliasRequest {
+                alias: alias.to_string(),
+                room_id: room_id.to_string(),
+            }),
+        )
+        .await;
+        assert!(result.is_ok(), "alias {alias} must be accepted");
+    }
+
+    #[tokio::test]
+    async fn two_aliases_join_the_same_room_and_an_unknown_alias_is_a_room_name() {
+        let context = admin_context();
+        point_alias(&context, "standup", "team-42").await;
+        point_alias(&context, "daily", "team-42").await;
+
+        for (client_id, alias) in [("alice", "standup"), ("bob", "daily"), ("carol", "retro")] {
+            let room_id = context
+                .state
+                .read()
+                .await
+                .canonical_room_id(alias.to_string());
+            join_for_tests(&context, client_id, &room_id).await;
+        }
+
+        let state = context.state.read().await;
+        let mut members: Vec<_> = state.rooms["team-42"].clients.keys().cloned().collect();
+        members.sort();
+        assert_eq!(members, ["alice", "bob"]);
+        assert!(!state.rooms.contains_key("standup"));
+        assert!(!state.rooms.contains_key("daily"));
+        assert!(state.rooms["retro"].clients.contains_key("carol"));
+    }
+
+    #[tokio::test]
+    async fn runtime_snapshot_reports_plausible_values() {
+        let context = admin_context();
+        for client_id in ["alice", "bob"] {
+            join_for_tests(&context, client_id, "standup").await;
+        }
+
+        let Ok(Json(snapshot)) = runtime_snapshot(State(context), admin_headers()).await else {
+            panic!("the admin token unlocks the runtime snapshot");
+        };
+        assert!(snapshot["workers"]
+            .as_u64()
+            .is_some_and(|workers| workers >= 1));
+        assert!(snapshot["aliveTasks"].as_u64().is_some());
+        assert_eq!(snapshot["rooms"], 1);
+        assert_eq!(snapshot["connections"], 2);
+        assert_eq!(snapshot["pendingDeliveries"], 0);
+        assert!(snapshot["activePumps"].as_u64().is_some());
+    }
+
+    #[tokio::test]
+    async fn transform_registered_for_one_room_leaves_another_untouched() {
+        let context = admin_context();
+        let mut listeners = Vec::new();
+        for room_id in ["moderated", "open"] {
+            let (speaker_id, _) =
+                join_for_tests(&context, &format!("{room_id}-speaker"), room_id).await;
+            let (_, listener) =
+                join_for_tests(&context, &format!("{room_id}-listener"), room_id).await;
+            drain_json(&listener);
+            listeners.push((speaker_id, listener));
+        }
+        let registered = set_room_transforms(
+            State(context.clone()),
+            Path("moderated".to_string()),
+            admin_headers(),
+            Json(TransformsRequest {
+                transforms: vec!["redact_chat".to_string()],
+            }),
+        )
+        .await;
+        assert!(registered.is_ok());
+
+        let mut received = Vec::new();
+        for (speaker_id, listener) in &listeners {
+            let chat = serde_json::from_value(serde_json::json!({
+                "type": "chat",
+                "payload": { "text": "call me at 555-0100" },
+            }))
+            .expect("chat message");
+            route_for_tests(&context, *speaker_id, chat).await;
+            let chat = drain_json(listener)
+                .into_iter()
+                .find(|message| message.kind == "chat")
+                .expect("the listener receives the chat");
+            received.push(chat.payload["text"].clone());
+        }
+        assert_eq!(received, ["[redacted]", "call me at 555-0100"]);
+    }
+
+    async fn room_config(context: &Arc<AppContext>, room_id: &str) -> RoomConfigResponse {
+        let Ok(Json(config)) = get_room_config(
+            State(context.clone()),
+            Path(room_id.to_string()),
+            admin_headers(),
+        )
+        .await
+        else {
+            panic!("{room_id} has a config view");
+        };
+        config
+    }
+
+    #[tokio::test]
+    async fn room_config_reflects_creation_options_and_later_admin_updates() {
+        let context = admin_context();
+        let request = serde_json::from_value(serde_json::json!({
+            "id": "studio",
+            "private": true,
+            "ownerLeave": "close",
+            "allowedOrigins": ["https://studio.example.com"],
+            "requireApproval": true,
+            "retention": "60000",
+            "transforms": ["redact_chat"],
+            "password": "hunter2",
+        }))
+        .expect("create room request");
+        let created = create_room(State(context.clone()), admin_headers(), Json(request)).await;
+        assert!(created.is_ok());
+
+        let config = room_config(&context, "studio").await;
+        assert!(config.is_private);
+        assert_eq!(config.owner_leave, "close");
+        assert_eq!(config.allowed_origins, ["https://studio.example.com"]);
+        assert!(config.require_approval);
+        assert!(config.persistent);
+        assert_eq!(config.retention.as_deref(), Some("60000"));
+        assert_eq!(config.transforms, ["redact_chat"]);
+        assert!(config.password_protected);
+        assert!(!config.message_log);
+        assert_eq!(config.draining_until, None);
+        assert_eq!(config.client_count, 0);
+
+        let logged = set_room_log(
+            State(context.clone()),
+            Path("studio".to_string()),
+            admin_headers(),
+            Json(MessageLogRequest { enabled: true }),
+        )
+        .await;
+        assert!(logged.is_ok());
+        let cleared = set_room_transforms(
+            State(context.clone()),
+            Path("studio".to_string()),
+            admin_headers(),
+            Json(TransformsRequest {
+                transforms: Vec::new(),
+            }),
+        )
+        .await;
+        assert!(cleared.is_ok());
+        let drained = drain_room(
+            State(context.clone()),
+            Path("studio".to_string()),
+            admin_headers(),
+            Json(DrainRoomRequest {
+                grace_ms: Some(60_000),
+            }),
+        )
+        .await;
+        assert!(drained.is_ok());
+
+        let config = room_config(&context, "studio").await;
+        assert!(config.message_log);
+        assert!(config.transforms.is_empty());
+        assert!(config.draining_until.is_some_and(|until| until > now_ms()));
+
+        let Err(err) = get_room_config(
+            State(context.clone()),
+            Path("studio".to_string()),
+            HeaderMap::new(),
+        )
+        .await
+        else {
+            panic!("the config view requires the admin token");
+        };
+        assert_eq!(err.status(), StatusCode::UNAUTHORIZED);
+    }
+
+    #[tokio::test]
+    async fn draining_room_delivers_the_notice_but_drops_normal_messages() {
+        let mut config = AppConfig::for_tests();
+        config.admin_token = Some("secret".to_string());
+        config.draining_room_drop_messages = true;
+        let context = test_context(config);
+        let (alice_id, alice_queue) = join_for_tests(&context, "alice", "closing").await;
+        let (_, bob_queue) = join_for_tests(&context, "bob", "closing").await;
+        drain_json(&alice_queue);
+        drain_json(&bob_queue);
+
+        let drained = drain_room(
+            State(context.clone()),
+            Path("closing".to_string()),
+            admin_headers(),
+            Json(DrainRoomRequest {
+                grace_ms: Some(60_000),
+            }),
+        )
+        .await;
+        assert!(drained.is_ok());
+        for queue in [&alice_queue, &bob_queue] {
+            let kinds = drain_json(queue)
+                .into_iter()
+                .map(|message| message.kind)
+                .collect::<Vec<_>>();
+            assert_eq!(kinds, ["room_draining"]);
+        }
+
+        let chat = serde_json::from_value(serde_json::json!({ "type": "chat", "payload": "hi" }))
+            .expect("chat message");
+        route_for_tests(&context, alice_id, chat).await;
+        assert!(drain_json(&bob_queue).is_empty());
+        let refusal = drain_json(&alice_queue);
+        assert_eq!(refusal.len(), 1);
+        assert_eq!(refusal[0].kind, "error");
+        assert_eq!(refusal[0].payload["code"], "room_draining");
+    }
+}
@@ -0,0 +1,141 @@
+//! HTTP 接口统一的错误响应体：客户端按稳定的 `code` 分支处理，不依赖提示文本。
+
+use axum::{
+    extract::{Request, State},
+    http::{header, StatusCode},
+    middleware::Next,
+    response::{IntoResponse, Response},
+    Json,
+};
+use serde_json::{Map, Value};
+
+/// 错误响应体的结构。
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub(crate) enum ErrorBodyFormat {
+    /// `{"error":"code", ...}`，与早期版本的接口保持兼容。
+    #[default]
+    Flat,
+    /// `{"error":{"code":"code","message":"...", ...}}`，提示文本缺省时使用状态码的标准原因。
+    Nested,
+}
+
+impl ErrorBodyFormat {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_ascii_lowercase().as_str() {
+            "flat" => Some(Self::Flat),
+            "nested" => Some(Self::Nested),
+            _ => None,
+        }
+    }
+}
+
+/// 路由层中间件：按 `ERROR_BODY_FORMAT` 重写 [`ApiError`] 生成的响应体，状态码与响应头保持不变。
+/// 没有经过这一层的错误响应使用 [`ErrorBodyFormat::Flat`]。
+pub(crate) async fn render_error_body(
+    State(format): State<ErrorBodyFormat>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let mut response = next.run(request).await;
+    if format == ErrorBodyFormat::Flat {
+        return response;
+    }
+    let Some(error) = response.extensions_mut().remove::<ApiError>() else {
+        return response;
+    };
+    let (mut parts, _) = response.into_parts();
+    parts.headers.remove(header::CONTENT_LENGTH);
+    let body = Json(error.body(format)).into_response().into_body();
+    Response::from_parts(parts, body)
+}
+
+/// 一次失败的 HTTP 请求：状态码、稳定的错误码，以及可选的提示文本与附加字段。
+#[derive(Debug, Clone)]
+pub(crate) struct ApiError {
+    status: StatusCode,
+    code: &'static str,
+    message: Option<String>,
+    details: Map<String, Value>,
+}
+
+impl ApiError {
+    pub(crate) fn new(status: StatusCode, code: &'static str) -> Self {
+        Self {
+            status,
+            code,
+            message: None,
+            details: Map::new(),
+        }
+    }
+
+    /// 只知道状态码时使用的通用错误码，例如自定义 `Authorizer` 返回的拒绝。
+    pub(crate) fn from_status(status: StatusCode) -> Self {
+        let code = match status {
+            StatusCode::BAD_REQUEST => "bad_request",
+            StatusCode::UNAUTHORIZED => "unauthorized",
+            StatusCode::FORBIDDEN => "forbidden",
+            StatusCode::NOT_FOUND => "not_found",
+            StatusCode::CONFLICT => "conflict",
+            StatusCode::TOO_MANY_REQUESTS => "rate_limited",
+            StatusCode::SERVICE_UNAVAILABLE => "unavailable",
+            status if status.is_client_error() => "request_rejected",
+            _ => "internal_error",
+        };
+        Self::new(status, code)
+    }
+
+    pub(crate) fn with_message(mut self, message: impl Into<String>) -> Self {
+        self.message = Some(message.into());
+        self
+    }
+
+    /// 附加的机器可读字段，如 `retryAfterMs`；嵌套格式下放进 `error` 对象里。
+    pub(crate) fn with_detail(mut self, key: &str, value: impl Into<Value>) -> Self {
+        self.details.insert(key.to_string(), value.into());
+        self
+    }
+
+    #[cfg(test)]
+    pub(crate) fn status(&self) -> StatusCode {
+        self.status
+    }
+
+    #[cfg(test)]
+    pub(crate) fn code(&self) -> &'static str {
+        self.code
+    }
+
+    pub(crate) fn body(&self, format: ErrorBodyFormat) -> Value {
+        let mut fields = Map::new();
+        match format {
+            ErrorBodyFormat::Flat => {
+                fields.insert("error".to_string(), Value::from(self.code));
+                if let Some(message) = &self.message {
+                    fields.insert("message".to_string(), Value::from(message.as_str()));
+                }
+                fields.extend(self.details.clone());
+            }
+            ErrorBodyFormat::Nested => {
+                let mut error = Map::new();
+                error.insert("code".to_string(), Value::from(self.code));
+                let message = self
+                    .message
+                    .as_deref()
+                    .or_else(|| self.status.canonical_reason())
+                    .unwrap_or(self.code);
+                error.insert("message".to_string(), Value::from(message));
+                error.extend(self.details.clone());
+                fields.insert("error".to_string(), Value::Object(error));
+            }
+        }
+        Value::Object(fields)
+    }
+}
+
+impl IntoResponse for ApiError {
+    fn into_response(self) -> Response {
+        let mut response = (self.status, Json(self.body(ErrorBodyFormat::Flat))).into_response();
+        response.extensions_mut().insert(self);
+        response
+    }
+}
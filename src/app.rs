@@ -1,15 +1,31 @@
 //! 应用级共享状态与运行时上下文。
 
 use std::{
-    collections::HashMap,
-    sync::{atomic::AtomicU64, Arc},
+    cmp::Reverse,
+    collections::{BinaryHeap, HashMap, HashSet, VecDeque},
+    ops::Deref,
+    sync::{
+        atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering},
+        Arc,
+    },
+    time::Instant,
 };
 
 use reqwest::Client;
-use tokio::sync::{mpsc, watch, RwLock};
+use tokio::sync::{mpsc, oneshot, watch, Notify, RwLock};
+use tracing::info;
 use uuid::Uuid;
 
-use crate::{config::AppConfig, types::SignalMessage};
+use crate::{
+    auth::Authorizer,
+    config::{AppConfig, OwnerLeavePolicy, RetentionPolicy, RoomEvictionPolicy},
+    dead_letter::DeadLetterSink,
+    outbound::OutboundSender,
+    recorder::Recording,
+    transform::MessageTransform,
+    types::{MessageLogEntry, RoomActivitySummary, RoomInfo, SignalMessage},
+    utils::{now_ms, tenant_room_key, TokenBucket},
+};
 
 /// 路由、WebSocket 和后台任务共享的总上下文。
 #[derive(Clone)]
@@ -20,34 +36,892 @@ pub(crate) struct AppContext {
     pub(crate) state: Arc<RwLock<AppState>>,
     /// 供 Cloudflare TURN 等外部请求复用的 HTTP 客户端。
     pub(crate) http_client: Client,
+    /// WebSocket 建连前的授权扩展点。
+    pub(crate) authorizer: Arc<dyn Authorizer>,
+    /// 维护模式：已有连接照常服务，新的 WebSocket 升级一律返回 503。
+    pub(crate) maintenance: Arc<AtomicBool>,
+    /// 进程启动时间，用于健康检查里的运行时长。
+    pub(crate) started_at: Instant,
+    /// 录制旁路队列的发送端；未配置 `RECORDER_URL` 时为 `None`。
+    pub(crate) recorder: Option<mpsc::Sender<Recording>>,
+    /// 死信队列的发送端；未开启 `DEAD_LETTERS` 时为 `None`。
+    pub(crate) dead_letters: Option<DeadLetterSink>,
 }
 
 /// 服务端当前维护的全部运行态数据。
 #[derive(Default)]
 pub(crate) struct AppState {
     pub(crate) rooms: HashMap<String, RoomState>,
-    pub(crate) connections: HashMap<Uuid, ConnectionHandle>,
+    pub(crate) connections: ConnectionTable,
+    /// 管理员监控连接，不属于任何房间，对成员不可见。
+    pub(crate) subscribers: HashMap<Uuid, Subscriber>,
+    /// 等待目标确认的单播消息：`(发送方连接, 目标 client_id, 消息 id) -> 确认通道`。
+    pub(crate) pending_deliveries: PendingTable,
+    /// 等待回复的请求：`(请求方连接, 目标 client_id, correlationId) -> 回复通知通道`。
+    pub(crate) pending_responses: PendingTable,
+    /// 房间别名：`别名 -> 规范房间号`，多个别名可以指向同一个房间。
+    pub(crate) room_aliases: HashMap<String, String>,
+    /// 全局建房限流桶，首次建房时按配置创建。
+    pub(crate) room_creation_bucket: Option<TokenBucket>,
+    /// 按 client_id 记录的近期建连，用于拦截重连风暴。
+    pub(crate) reconnects: HashMap<String, ReconnectHistory>,
+}
+
+/// 连接表：按连接 ID 保存句柄，同时维护租户内 `identity()` 到连接的索引。
+/// 只读访问直接解引用成 `HashMap`；增删都经过这里，索引不会和连接表脱节。
+#[derive(Default)]
+pub(crate) struct ConnectionTable {
+    by_id: HashMap<Uuid, ConnectionHandle>,
+    /// `(租户, identity()) -> 连接 ID`；同一身份可以同时在几个房间在线。
+    by_identity: HashMap<(Option<String>, String), HashSet<Uuid>>,
+}
+
+impl Deref for ConnectionTable {
+    type Target = HashMap<Uuid, ConnectionHandle>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.by_id
+    }
+}
+
+impl ConnectionTable {
+    pub(crate) fn insert(&mut self, connection_id: Uuid, connection: ConnectionHandle) {
+        self.by_identity
+            .entry(identity_key(&connection))
+            .or_default()
+            .insert(connection_id);
+        if let Some(replaced) = self.by_id.insert(connection_id, connection) {
+            self.unindex(connection_id, &replaced);
+        }
+    }
+
+    pub(crate) fn remove(&mut self, connection_id: &Uuid) -> Option<ConnectionHandle> {
+        let connection = self.by_id.remove(connection_id)?;
+        self.unindex(*connection_id, &connection);
+        Some(connection)
+    }
+
+    /// 可变访问只用于更新展示名、通话状态等字段，不能改动身份与租户，否则索引会失效。
+    pub(crate) fn get_mut(&mut self, connection_id: &Uuid) -> Option<&mut ConnectionHandle> {
+        self.by_id.get_mut(connection_id)
+    }
+
+    /// 该身份是否在同一租户的其他房间在线。
+    pub(crate) fn identity_in_other_room(
+        &self,
+        tenant: Option<&str>,
+        identity: &str,
+        room_id: &str,
+    ) -> bool {
+        self.by_identity
+            .get(&(tenant.map(str::to_string), identity.to_string()))
+            .is_some_and(|connection_ids| {
+                connection_ids
+                    .iter()
+                    .filter_map(|connection_id| self.by_id.get(connection_id))
+                    .any(|connection| connection.room_id != room_id)
+            })
+    }
+
+    fn unindex(&mut self, connection_id: Uuid, connection: &ConnectionHandle) {
+        let key = identity_key(connection);
+        if let Some(connection_ids) = self.by_identity.get_mut(&key) {
+            connection_ids.remove(&connection_id);
+            if connection_ids.is_empty() {
+                self.by_identity.remove(&key);
+            }
+        }
+    }
+}
+
+fn identity_key(connection: &ConnectionHandle) -> (Option<String>, String) {
+    (connection.tenant.clone(), connection.identity().to_string())
+}
+
+/// 待回应登记的键：`(登记方连接, 目标 client_id, 消息标识)`。
+pub(crate) type PendingKey = (Uuid, String, String);
+
+/// 等待对方回应的登记表，同时按登记方连接计数，检查单个连接的上限时不必遍历整张表。
+#[derive(Default)]
+pub(crate) struct PendingTable {
+    entries: HashMap<PendingKey, oneshot::Sender<()>>,
+    per_connection: HashMap<Uuid, usize>,
+}
+
+impl PendingTable {
+    /// 登记一条等待；同一个键重新登记时替换旧通道，计数不变。
+    pub(crate) fn insert(&mut self, key: PendingKey, notify: oneshot::Sender<()>) {
+        let connection_id = key.0;
+        if self.entries.insert(key, notify).is_none() {
+            *self.per_connection.entry(connection_id).or_default() += 1;
+        }
+    }
+
+    /// 收到回应、超时或登记方断开时撤销登记。
+    pub(crate) fn remove(&mut self, key: &PendingKey) -> Option<oneshot::Sender<()>> {
+        let notify = self.entries.remove(key)?;
+        if let Some(count) = self.per_connection.get_mut(&key.0) {
+            *count -= 1;
+            if *count == 0 {
+                self.per_connection.remove(&key.0);
+            }
+        }
+        Some(notify)
+    }
+
+    /// 某个连接名下仍在等待的登记数。
+    pub(crate) fn count_for(&self, connection_id: Uuid) -> usize {
+        self.per_connection
+            .get(&connection_id)
+            .copied()
+            .unwrap_or(0)
+    }
+
+    pub(crate) fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    #[cfg(test)]
+    pub(crate) fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+}
+
+/// 单个身份最近的建连时间、心跳超时断开时间与冷却截止时间。
+#[derive(Default)]
+pub(crate) struct ReconnectHistory {
+    attempts: VecDeque<u64>,
+    timeouts: VecDeque<u64>,
+    blocked_until_ms: u64,
+}
+
+/// 推送给大厅成员的房间生命周期事件。
+#[derive(Debug, Clone, Copy)]
+pub(crate) enum LobbyEvent {
+    Created,
+    Updated,
+    Destroyed,
+}
+
+impl LobbyEvent {
+    fn kind(self) -> &'static str {
+        match self {
+            Self::Created => "room_created",
+            Self::Updated => "room_updated",
+            Self::Destroyed => "room_destroyed",
+        }
+    }
+}
+
+/// 按房间号模式订阅广播副本的只读监控连接。
+pub(crate) struct Subscriber {
+    pub(crate) pattern: String,
+    pub(crate) sender: OutboundSender,
+}
+
+/// 开启多租户时房间号的租户前缀；未开启时所有房间同属一个默认租户。
+pub(crate) fn room_tenant<'a>(config: &AppConfig, room_id: &'a str) -> Option<&'a str> {
+    if !config.tenancy {
+        return None;
+    }
+    room_id.split_once('/').map(|(tenant, _)| tenant)
+}
+
+impl AppState {
+    /// 把别名解析成规范房间号；未登记的名字原样当作房间号。
+    pub(crate) fn canonical_room_id(&self, room_id: String) -> String {
+        self.room_aliases.get(&room_id).cloned().unwrap_or(room_id)
+    }
+
+    /// 登记一次建连；窗口内次数超限时进入冷却，返回还需等待的毫秒数。
+    pub(crate) fn admit_connection_attempt(
+        &mut self,
+        config: &AppConfig,
+        client_id: &str,
+        now: u64,
+    ) -> Result<(), u64> {
+        let history = self.reconnects.entry(client_id.to_string()).or_default();
+        if history.blocked_until_ms > now {
+            return Err(history.blocked_until_ms - now);
+        }
+        if config.reconnect_limit == 0 {
+            return Ok(());
+        }
+        while history
+            .attempts
+            .front()
+            .is_some_and(|at| at.saturating_add(config.reconnect_window_ms) <= now)
+        {
+            history.attempts.pop_front();
+        }
+        if history.attempts.len() >= config.reconnect_limit {
+            history.attempts.clear();
+            history.blocked_until_ms = now.saturating_add(config.reconnect_cooldown_ms);
+            return Err(config.reconnect_cooldown_ms);
+        }
+        history.attempts.push_back(now);
+        Ok(())
+    }
+
+    /// 记录一次心跳超时断开；窗口内次数达到上限时让该身份进入较长的冷却，返回是否刚进入冷却。
+    /// 正常关闭的连接不会走到这里，偶尔一次超时也不受影响。
+    pub(crate) fn record_read_timeout(
+        &mut self,
+        config: &AppConfig,
+        client_id: &str,
+        now: u64,
+    ) -> bool {
+        let history = self.reconnects.entry(client_id.to_string()).or_default();
+        while history
+            .timeouts
+            .front()
+            .is_some_and(|at| at.saturating_add(config.read_timeout_window_ms) <= now)
+        {
+            history.timeouts.pop_front();
+        }
+        history.timeouts.push_back(now);
+        if history.timeouts.len() < config.read_timeout_limit {
+            return false;
+        }
+        history.timeouts.clear();
+        history.blocked_until_ms = history
+            .blocked_until_ms
+            .max(now.saturating_add(config.read_timeout_cooldown_ms));
+        true
+    }
+
+    /// 丢掉窗口外且不在冷却中的记录，避免身份表随访问量无限增长。
+    pub(crate) fn prune_reconnect_history(&mut self, config: &AppConfig, now: u64) {
+        self.reconnects.retain(|_, history| {
+            history.blocked_until_ms > now
+                || history
+                    .attempts
+                    .back()
+                    .is_some_and(|at| at.saturating_add(config.reconnect_window_ms) > now)
+                || history
+                    .timeouts
+                    .back()
+                    .is_some_and(|at| at.saturating_add(config.read_timeout_window_ms) > now)
+        });
+    }
+
+    /// 统计某个用户当前担任房主的房间数。
+    pub(crate) fn owned_room_count(&self, client_id: &str) -> usize {
+        self.rooms
+            .values()
+            .filter(|room| {
+                room.owner
+                    .as_deref()
+                    .map(|owner| room.pseudonyms.get(owner).map_or(owner, String::as_str))
+                    == Some(client_id)
+            })
+            .count()
+    }
+
+    /// 该用户是否已在其他房间在线；同一房间内的重连不算重复。
+    pub(crate) fn client_active_elsewhere(&self, client_id: &str, room_id: &str) -> bool {
+        self.connections
+            .values()
+            .any(|connection| connection.identity() == client_id && connection.room_id != room_id)
+    }
+
+    /// 把公开房间的变化推给同一租户大厅房间里的成员；私密房间与大厅自身不推送。
+    /// 调用方持有写锁，事件与房间表的变化保持同一顺序。
+    pub(crate) fn notify_lobby(&self, config: &AppConfig, event: LobbyEvent, room: &RoomState) {
+        let Some(lobby_id) = config.lobby_room_id.as_deref() else {
+            return;
+        };
+        if room.is_private || room.awaiting_second_member {
+            return;
+        }
+
+        let (lobby_key, room_name) = match room.id.split_once('/') {
+            Some((tenant, name)) if config.tenancy => {
+                (tenant_room_key(Some(tenant), lobby_id), name)
+            }
+            _ => (lobby_id.to_string(), room.id.as_str()),
+        };
+        if room_name == lobby_id {
+            return;
+        }
+        let Some(lobby) = self.rooms.get(&lobby_key) else {
+            return;
+        };
+
+        let payload = match event {
+            LobbyEvent::Destroyed => serde_json::json!({ "roomId": room_name }),
+            LobbyEvent::Created | LobbyEvent::Updated => serde_json::json!({
+                "room": RoomInfo {
+                    id: room_name.to_string(),
+                    client_count: room.clients.len(),
+                    clients: room.clients.keys().cloned().collect(),
+                    created_at: room.created_at_ms,
+                    is_private: room.is_private,
+                    activity: config
+                        .room_activity_summary
+                        .then(|| room.activity.summary(now_ms())),
+                },
+            }),
+        };
+        let message = SignalMessage::server(config, event.kind(), payload);
+        for connection in lobby
+            .clients
+            .values()
+            .filter_map(|connection_id| self.connections.get(connection_id))
+        {
+            let _ = connection
+                .sender
+                .send(OutboundMessage::Json(message.clone()));
+        }
+    }
+
+    /// 所有房间保留的聊天历史与消息日志的估算字节数。
+    pub(crate) fn retained_bytes(&self) -> usize {
+        self.rooms.values().map(RoomState::retained_bytes).sum()
+    }
+
+    /// 保留数据超出预算时从全局最旧的条目开始丢弃：先丢聊天历史，仍超出再丢消息日志。
+    /// 只动已经保留下来的数据，不影响正在转发的信令。返回 `(丢弃的历史条数, 丢弃的日志条数, 丢弃后的字节数)`。
+    pub(crate) fn shed_retained_over_budget(&mut self, budget: usize) -> (usize, usize, usize) {
+        let mut total = self.retained_bytes();
+        let mut shed_history = 0;
+        let mut shed_log = 0;
+
+        // 按各房间队首的时间排成小顶堆，每次从最旧的房间弹一条。
+        let mut oldest = self
+            .rooms
+            .iter()
+            .filter_map(|(id, room)| {
+                room.history
+                    .front()
+                    .map(|(at, _)| Reverse((*at, id.clone())))
+            })
+            .collect::<BinaryHeap<_>>();
+        while total > budget {
+            let Some(Reverse((_, room_id))) = oldest.pop() else {
+                break;
+            };
+            let Some(room) = self.rooms.get_mut(&room_id) else {
+                continue;
+            };
+            if let Some((_, message)) = room.history.pop_front() {
+                total = total.saturating_sub(approx_message_bytes(&message));
+                shed_history += 1;
+            }
+            if let Some((at, _)) = room.history.front() {
+                oldest.push(Reverse((*at, room_id)));
+            }
+        }
+
+        let mut oldest = self
+            .rooms
+            .iter()
+            .filter_map(|(id, room)| {
+                room.message_log
+                    .as_ref()
+                    .and_then(|log| log.front())
+                    .map(|entry| Reverse((entry.at, id.clone())))
+            })
+            .collect::<BinaryHeap<_>>();
+        while total > budget {
+            let Some(Reverse((_, room_id))) = oldest.pop() else {
+                break;
+            };
+            let Some(log) = self
+                .rooms
+                .get_mut(&room_id)
+                .and_then(|room| room.message_log.as_mut())
+            else {
+                continue;
+            };
+            if let Some(entry) = log.pop_front() {
+                total = total.saturating_sub(approx_log_entry_bytes(&entry));
+                shed_log += 1;
+            }
+            if let Some(entry) = log.front() {
+                oldest.push(Reverse((entry.at, room_id)));
+            }
+        }
+
+        (shed_history, shed_log, total)
+    }
+
+    /// 新建房间前检查所属租户是否已达 `TENANT_MAX_ROOMS`；不带租户前缀的房间不受限制。
+    pub(crate) fn tenant_has_room_slot(&self, config: &AppConfig, room_id: &str) -> bool {
+        if config.tenant_max_rooms == 0 {
+            return true;
+        }
+        let Some(tenant) = room_tenant(config, room_id) else {
+            return true;
+        };
+        let prefix = format!("{tenant}/");
+        let count = self
+            .rooms
+            .keys()
+            .filter(|id| id.starts_with(&prefix))
+            .count();
+        count < config.tenant_max_rooms
+    }
+
+    /// 建连前检查 `MAX_CONNECTIONS` 与 `MAX_ANONYMOUS_CONNECTIONS`，超出时返回对应的错误码。
+    /// 同一身份的旧连接会被新连接挤掉，不占用名额，断线重连不会被自己的残留连接挡住。
+    pub(crate) fn connection_limit_reached(
+        &self,
+        config: &AppConfig,
+        identity: &str,
+        anonymous: bool,
+    ) -> Option<&'static str> {
+        let check_anonymous = anonymous && config.max_anonymous_connections > 0;
+        if config.max_connections == 0 && !check_anonymous {
+            return None;
+        }
+        let (total, anonymous_total) = self
+            .connections
+            .values()
+            .filter(|connection| connection.identity() != identity)
+            .fold((0, 0), |(total, anonymous_total), connection| {
+                (
+                    total + 1,
+                    anonymous_total + usize::from(connection.anonymous),
+                )
+            });
+        if config.max_connections > 0 && total >= config.max_connections {
+            return Some("connection_limit");
+        }
+        if check_anonymous && anonymous_total >= config.max_anonymous_connections {
+            return Some("anonymous_connection_limit");
+        }
+        None
+    }
+
+    /// 新建房间前检查 `MAX_ROOMS`；按策略回收空闲最久的空房间，仍无名额时返回 `false`。
+    pub(crate) fn reserve_room_slot(&mut self, config: &AppConfig) -> bool {
+        if config.max_rooms == 0 || self.rooms.len() < config.max_rooms {
+            return true;
+        }
+        if config.room_eviction_policy != RoomEvictionPolicy::EvictLruEmpty {
+            return false;
+        }
+
+        let Some(evicted_id) = self
+            .rooms
+            .values()
+            .filter(|room| room.clients.is_empty())
+            .min_by_key(|room| room.last_activity_ms.load(Ordering::Relaxed))
+            .map(|room| room.id.clone())
+        else {
+            return false;
+        };
+        if let Some(evicted) = self.rooms.remove(&evicted_id) {
+            self.notify_lobby(config, LobbyEvent::Destroyed, &evicted);
+        }
+        info!("evicted idle empty room {evicted_id} to make room for a new one");
+        true
+    }
 }
 
 /// 单个房间的成员信息。
 pub(crate) struct RoomState {
     pub(crate) id: String,
     pub(crate) created_at_ms: u64,
+    /// 最近一次有成员进出或转发消息的时间，房间数满时据此回收空闲房间。
+    pub(crate) last_activity_ms: AtomicU64,
+    /// 到期时间：到点后不论是否有人都会关闭房间并通知成员 `room_expired`。
+    pub(crate) expires_at_ms: Option<u64>,
+    /// 房间密码的 HMAC；设置后建连必须带上 `POST /api/rooms/{id}/verify` 签发的入场令牌。
+    pub(crate) password_hash: Option<Vec<u8>>,
+    /// 最近一分钟内密码校验失败的时间，用于限制猜测。
+    pub(crate) password_failures: VecDeque<u64>,
+    /// 管理接口开始排空后的关闭时间；排空中的房间不再接受新成员，到点随到期检查一起关闭。
+    pub(crate) draining_until_ms: Option<u64>,
+    /// 最近一位非旁观成员离开的时间，从未有过时取建房时间；用于回收只剩旁观者的房间。
+    pub(crate) participant_left_at_ms: u64,
+    /// 开启 `ROOM_PAIRING_TIMEOUT_MS` 后新建的房间先处于待配对状态，第二位成员到达后才正式对外可见。
+    pub(crate) awaiting_second_member: bool,
     pub(crate) is_private: bool,
+    /// 当前房主；默认是建房的成员，按 `owner_leave_policy` 处理其离开。
+    pub(crate) owner: Option<String>,
+    pub(crate) owner_leave_policy: OwnerLeavePolicy,
+    /// 房主离开且策略为 `ownerless` 后，房间不再转发任何业务消息。
+    pub(crate) read_only: bool,
     /// `client_id -> connection_id`，便于按用户查到实际连接。
     pub(crate) clients: HashMap<String, Uuid>,
+    /// 最近的聊天消息 `(记录时间, 消息)`，按时间顺序保存，容量由 `CHAT_HISTORY_LIMIT` 控制。
+    pub(crate) history: VecDeque<(u64, SignalMessage)>,
+    /// 允许加入本房间的前端 Origin；为空时只受全局白名单约束。
+    pub(crate) allowed_origins: Vec<String>,
+    /// 由管理接口预建的房间在成员走空后仍然保留。
+    pub(crate) persistent: bool,
+    /// 开启后，非房主成员要先经房主审批才会进入 `clients`。
+    pub(crate) approval_required: bool,
+    /// 待审批的入房申请：`client_id -> 审批结果通道`。
+    pub(crate) pending_joins: HashMap<String, oneshot::Sender<bool>>,
+    /// 刚掉线成员的暂存单播消息，重连后补发：`client_id -> 暂存队列`。
+    pub(crate) held_messages: HashMap<String, HeldMessages>,
+    /// 推迟广播 `user_left` 的掉线成员：`client_id -> 掉线的连接 ID`，宽限期内重连即撤销。
+    pub(crate) pending_leaves: HashMap<String, Uuid>,
+    /// 开启化名时登记过的成员：`化名 -> 真实 client_id`，供管理接口与跨房间统计反查。
+    pub(crate) pseudonyms: HashMap<String, String>,
+    /// 最近一次画质调整请求：`(请求方, 目标) -> 原始消息`。
+    pub(crate) quality_requests: HashMap<(String, String), SignalMessage>,
+    /// 调试用的消息日志，记录最近转发的全部类型消息；`None` 表示未开启。
+    pub(crate) message_log: Option<VecDeque<MessageLogEntry>>,
+    /// 聊天历史与消息日志的保留策略，`None` 表示随房间存在。
+    pub(crate) retention: Option<RetentionPolicy>,
+    /// 只作用于本房间的消息处理链，在记录历史与转发之前执行。
+    pub(crate) transforms: Vec<Arc<dyn MessageTransform>>,
+    /// 房主开启的发言权控制；`None` 表示所有成员都能自由发言。
+    pub(crate) floor: Option<FloorState>,
+    /// 最近一次 `call_state` 不是 `ended` 的成员，用于限制同时进行的通话数。
+    pub(crate) in_call: HashSet<String>,
+    /// 房间列表用的活跃度计数，只在开启 `ROOM_ACTIVITY_SUMMARY` 时更新。
+    pub(crate) activity: RoomActivity,
+}
+
+/// 统计窗口的秒数。
+const ACTIVITY_WINDOW_SECONDS: u64 = 60;
+
+/// 按秒聚合的消息计数与成员峰值，每个房间最多保留一分钟的桶。
+#[derive(Default)]
+pub(crate) struct RoomActivity {
+    /// `(秒级时间戳, 该秒的消息数)`，按时间顺序排列。
+    per_second: VecDeque<(u64, u64)>,
+    peak_members: usize,
+}
+
+impl RoomActivity {
+    pub(crate) fn record_message(&mut self, now: u64) {
+        let second = now / 1000;
+        match self.per_second.back_mut() {
+            Some((at, count)) if *at == second => *count += 1,
+            _ => self.per_second.push_back((second, 1)),
+        }
+        while self
+            .per_second
+            .front()
+            .is_some_and(|(at, _)| at + ACTIVITY_WINDOW_SECONDS <= second)
+        {
+            self.per_second.pop_front();
+        }
+    }
+
+    pub(crate) fn record_members(&mut self, members: usize) {
+        self.peak_members = self.peak_members.max(members);
+    }
+
+    /// 汇总最近一分钟的消息数；安静下来的房间不会再写入，这里按当前时间重新过滤。
+    pub(crate) fn summary(&self, now: u64) -> RoomActivitySummary {
+        let second = now / 1000;
+        RoomActivitySummary {
+            messages_last_minute: self
+                .per_second
+                .iter()
+                .filter(|(at, _)| at + ACTIVITY_WINDOW_SECONDS > second)
+                .map(|(_, count)| count)
+                .sum(),
+            peak_members: self.peak_members,
+        }
+    }
+}
+
+/// 每条保留数据除正文外的固定开销估算：时间戳、队列槽位与各字段的堆分配头。
+const RETAINED_ENTRY_OVERHEAD_BYTES: usize = 128;
+
+/// 粗略估算一条保留消息占用的内存，只用于预算判断，不追求精确。
+fn approx_message_bytes(message: &SignalMessage) -> usize {
+    let payload = serde_json::to_string(&message.payload)
+        .map(|text| text.len())
+        .unwrap_or(0);
+    RETAINED_ENTRY_OVERHEAD_BYTES + message.kind.len() + message.from.len() + payload
+}
+
+fn approx_log_entry_bytes(entry: &MessageLogEntry) -> usize {
+    let payload = if entry.payload.is_some() {
+        entry.payload_bytes
+    } else {
+        0
+    };
+    RETAINED_ENTRY_OVERHEAD_BYTES + entry.kind.len() + entry.from.len() + payload
+}
+
+/// 发言权控制下的当前发言人与排队申请。
+#[derive(Default)]
+pub(crate) struct FloorState {
+    pub(crate) speaker: Option<String>,
+    /// 申请发言的成员，按申请顺序排列，由房主决定下一位。
+    pub(crate) queue: VecDeque<String>,
+}
+
+impl FloorState {
+    /// 广播给房间的发言权状态。
+    pub(crate) fn snapshot(&self) -> serde_json::Value {
+        serde_json::json!({
+            "enabled": true,
+            "speaker": self.speaker,
+            "queue": self.queue,
+        })
+    }
+}
+
+/// 掉线成员在宽限期内收到的单播消息。
+pub(crate) struct HeldMessages {
+    /// 掉线时间，宽限期从这里开始计算。
+    pub(crate) departed_at_ms: u64,
+    /// `(过期时间, 消息)`，按到达顺序排列。
+    pub(crate) messages: VecDeque<(u64, SignalMessage)>,
+}
+
+/// 仅在房间首次创建时生效的房间属性。
+pub(crate) struct RoomOptions {
+    pub(crate) is_private: bool,
+    pub(crate) owner_leave_policy: OwnerLeavePolicy,
+    pub(crate) allowed_origins: Vec<String>,
+    pub(crate) persistent: bool,
+    pub(crate) approval_required: bool,
+    pub(crate) message_log: bool,
+    /// 房间的最长存活时间（毫秒），`None` 表示不限。
+    pub(crate) max_lifetime_ms: Option<u64>,
+    pub(crate) retention: Option<RetentionPolicy>,
+}
+
+impl RoomState {
+    pub(crate) fn new(id: String, owner: Option<String>, options: RoomOptions) -> Self {
+        Self {
+            id,
+            created_at_ms: now_ms(),
+            last_activity_ms: AtomicU64::new(now_ms()),
+            participant_left_at_ms: now_ms(),
+            expires_at_ms: options
+                .max_lifetime_ms
+                .map(|lifetime_ms| now_ms().saturating_add(lifetime_ms)),
+            awaiting_second_member: false,
+            is_private: options.is_private,
+            owner,
+            owner_leave_policy: options.owner_leave_policy,
+            read_only: false,
+            clients: HashMap::new(),
+            history: VecDeque::new(),
+            allowed_origins: options.allowed_origins,
+            persistent: options.persistent,
+            approval_required: options.approval_required,
+            pending_joins: HashMap::new(),
+            held_messages: HashMap::new(),
+            pending_leaves: HashMap::new(),
+            pseudonyms: HashMap::new(),
+            quality_requests: HashMap::new(),
+            message_log: options.message_log.then(VecDeque::new),
+            retention: options.retention,
+            transforms: Vec::new(),
+            floor: None,
+            in_call: HashSet::new(),
+            draining_until_ms: None,
+            password_hash: None,
+            password_failures: VecDeque::new(),
+            activity: RoomActivity::default(),
+        }
+    }
+
+    /// 本房间聊天历史与消息日志的估算字节数。
+    pub(crate) fn retained_bytes(&self) -> usize {
+        let history = self
+            .history
+            .iter()
+            .map(|(_, message)| approx_message_bytes(message))
+            .sum::<usize>();
+        let log = self
+            .message_log
+            .iter()
+            .flatten()
+            .map(approx_log_entry_bytes)
+            .sum::<usize>();
+        history + log
+    }
+
+    /// 保留策略为 `none` 的房间不记录聊天历史和消息日志。
+    pub(crate) fn retains_messages(&self) -> bool {
+        self.retention != Some(RetentionPolicy::Discard)
+    }
+
+    /// 清空房间保留的聊天历史与消息日志，日志本身保持开启。
+    pub(crate) fn purge_retained(&mut self) {
+        self.history.clear();
+        if let Some(log) = self.message_log.as_mut() {
+            log.clear();
+        }
+    }
+
+    fn retention_window_ms(&self) -> Option<u64> {
+        match self.retention {
+            Some(RetentionPolicy::Window(window_ms)) => Some(window_ms),
+            _ => None,
+        }
+    }
+
+    /// 聊天历史的有效保留时长：保留策略的时间窗口与 `CHAT_HISTORY_MAX_AGE_MS` 取较小者，
+    /// `None` 表示只受条数限制。
+    fn history_window_ms(&self, history_max_age_ms: u64) -> Option<u64> {
+        let max_age_ms = (history_max_age_ms > 0).then_some(history_max_age_ms);
+        match (self.retention_window_ms(), max_age_ms) {
+            (Some(window_ms), Some(max_age_ms)) => Some(window_ms.min(max_age_ms)),
+            (window_ms, max_age_ms) => window_ms.or(max_age_ms),
+        }
+    }
+
+    /// 仍在保留时长内的聊天历史；后台清理有几秒延迟，补发和历史接口都按当前时间再过滤一次。
+    pub(crate) fn recent_history(
+        &self,
+        now: u64,
+        history_max_age_ms: u64,
+    ) -> impl Iterator<Item = &SignalMessage> {
+        let window_ms = self.history_window_ms(history_max_age_ms);
+        self.history
+            .iter()
+            .filter(move |(at, _)| {
+                window_ms.is_none_or(|window_ms| at.saturating_add(window_ms) > now)
+            })
+            .map(|(_, message)| message)
+    }
+
+    /// 按保留时长判断是否有条目已过期，供后台清理先用读锁筛选。
+    pub(crate) fn has_expired_retained(&self, now: u64, history_max_age_ms: u64) -> bool {
+        let expired = |window_ms: Option<u64>, at: u64| {
+            window_ms.is_some_and(|window_ms| at.saturating_add(window_ms) <= now)
+        };
+        let history_window_ms = self.history_window_ms(history_max_age_ms);
+        let log_window_ms = self.retention_window_ms();
+        self.history
+            .front()
+            .is_some_and(|(at, _)| expired(history_window_ms, *at))
+            || self
+                .message_log
+                .as_ref()
+                .and_then(|log| log.front())
+                .is_some_and(|entry| expired(log_window_ms, entry.at))
+    }
+
+    /// 丢弃超过保留时长的历史与日志条目；两者都按时间顺序追加，从队首裁剪即可。
+    pub(crate) fn purge_expired_retained(&mut self, now: u64, history_max_age_ms: u64) {
+        let expired = |window_ms: Option<u64>, at: u64| {
+            window_ms.is_some_and(|window_ms| at.saturating_add(window_ms) <= now)
+        };
+        let history_window_ms = self.history_window_ms(history_max_age_ms);
+        while self
+            .history
+            .front()
+            .is_some_and(|(at, _)| expired(history_window_ms, *at))
+        {
+            self.history.pop_front();
+        }
+        let log_window_ms = self.retention_window_ms();
+        if let Some(log) = self.message_log.as_mut() {
+            while log
+                .front()
+                .is_some_and(|entry| expired(log_window_ms, entry.at))
+            {
+                log.pop_front();
+            }
+        }
+    }
+
+    /// 追加一条消息日志，并裁剪到配置的容量以内；未开启日志时忽略。
+    pub(crate) fn record_message_log(&mut self, config: &AppConfig, message: &SignalMessage) {
+        if !self.retains_messages() {
+            return;
+        }
+        let Some(log) = self.message_log.as_mut() else {
+            return;
+        };
+        if config.room_message_log_limit == 0 {
+            return;
+        }
+
+        log.push_back(MessageLogEntry {
+            at: now_ms(),
+            kind: message.kind.clone(),
+            from: message.from.clone(),
+            to: message.to.clone(),
+            to_group: message.to_group.clone(),
+            payload_bytes: serde_json::to_string(&message.payload)
+                .map(|text| text.len())
+                .unwrap_or(0),
+            payload: config
+                .room_message_log_payloads
+                .then(|| message.payload.clone()),
+        });
+        while log.len() > config.room_message_log_limit {
+            log.pop_front();
+        }
+    }
+
+    /// 清理宽限期已过的掉线成员及其暂存消息。
+    pub(crate) fn prune_held_messages(&mut self, ttl_ms: u64) {
+        let now = now_ms();
+        self.held_messages
+            .retain(|_, held| held.departed_at_ms.saturating_add(ttl_ms) > now);
+    }
+
+    /// 房间级 Origin 白名单；未配置时放行。
+    pub(crate) fn origin_allowed(&self, origin: Option<&str>) -> bool {
+        if self.allowed_origins.is_empty() {
+            return true;
+        }
+
+        origin
+            .map(|value| {
+                self.allowed_origins
+                    .iter()
+                    .any(|allowed| allowed.eq_ignore_ascii_case(value))
+            })
+            .unwrap_or(false)
+    }
 }
 
 /// 已注册 WebSocket 连接的服务端句柄。
 pub(crate) struct ConnectionHandle {
     pub(crate) client_id: String,
+    /// 开启化名时的真实身份；此时 `client_id` 是房间内的化名。
+    pub(crate) real_client_id: Option<String>,
     pub(crate) room_id: String,
+    /// 开启多租户时连接所属的租户，取自房间号前缀。
+    pub(crate) tenant: Option<String>,
+    /// 建连时声明的分组标签，用于房间内的分组广播。
+    pub(crate) group: Option<String>,
+    /// 建连时声明的角色，供 `toRole` 寻址。
+    pub(crate) role: Option<String>,
+    /// 房间内展示的名字，已按重名策略处理过。
+    pub(crate) display_name: Option<String>,
+    /// 旁观成员只能发单播信令，离开时也不影响只剩旁观者房间的计时。
+    pub(crate) spectator: bool,
+    /// 建连时协商的协议版本，决定服务端代答的成员列表格式。
+    pub(crate) protocol_version: u32,
+    /// 类型授权令牌限定的可发送消息类型，`None` 表示不限。
+    pub(crate) allowed_types: Option<HashSet<String>>,
+    /// 未经凭证确认的匿名身份，计入匿名连接上限。
+    pub(crate) anonymous: bool,
+    /// 注册时间，用于按加入顺序挑选新房主。
+    pub(crate) joined_at_ms: u64,
     /// 发送队列：业务线程把消息塞进去，单独的 writer 任务负责真正写 socket。
-    pub(crate) sender: mpsc::UnboundedSender<OutboundMessage>,
+    pub(crate) sender: OutboundSender,
     /// 最近一次活跃时间，用于超时回收。
     pub(crate) last_seen_ms: Arc<AtomicU64>,
+    /// 按客户端类别选定的心跳超时，超过后由后台任务回收。
+    pub(crate) heartbeat_timeout_ms: u64,
     /// 主动关闭连接时，通过 watch 通知读取循环退出。
     pub(crate) shutdown: watch::Sender<bool>,
+    /// 建连时的 `User-Agent` 与客户端自报版本，只在管理接口中展示。
+    pub(crate) user_agent: Option<String>,
+    pub(crate) client_version: Option<String>,
+    /// 最近一次通过 `call_state` 声明的通话状态，新成员加入时随引导消息下发。
+    pub(crate) call_state: Option<String>,
+    /// 本连接转发出去、仍在各接收方队列里没写出的消息数。
+    pub(crate) in_flight: Arc<AtomicUsize>,
+}
+
+impl ConnectionHandle {
+    /// 跨房间比对用的身份：开启化名时取真实 ID。
+    pub(crate) fn identity(&self) -> &str {
+        self.real_client_id.as_deref().unwrap_or(&self.client_id)
+    }
 }
 
 /// 发往客户端的统一出站消息类型。
@@ -56,4 +930,223 @@ pub(crate) enum OutboundMessage {
     Json(SignalMessage),
     Ping,
     Close,
+    /// 就绪检查的哨兵：不写入 socket，writer 处理到它时通知探测方。
+    Probe(Arc<Notify>),
+}
+
+/// 测试用的上下文：空的共享状态，配置由调用方按场景调整。
+#[cfg(test)]
+pub(crate) fn test_context(config: AppConfig) -> Arc<AppContext> {
+    Arc::new(AppContext {
+        config,
+        state: Arc::new(RwLock::new(AppState::default())),
+        http_client: Client::new(),
+        authorizer: Arc::new(crate::auth::SessionAuthorizer),
+        maintenance: Arc::new(AtomicBool::new(false)),
+        started_at: Instant::now(),
+        recorder: None,
+        dead_letters: None,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn reconnect_config(limit: usize, window_ms: u64, cooldown_ms: u64) -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.reconnect_limit = limit;
+        config.reconnect_window_ms = window_ms;
+        config.reconnect_cooldown_ms = cooldown_ms;
+        config
+    }
+
+    #[test]
+    fn reconnecting_too_often_is_refused_until_the_cooldown_ends() {
+        let config = reconnect_config(3, 1_000, 5_000);
+        let mut state = AppState::default();
+        for now in [0, 10, 20] {
+            assert!(state
+                .admit_connection_attempt(&config, "alice", now)
+                .is_ok());
+        }
+
+        assert_eq!(
+            state.admit_connection_attempt(&config, "alice", 30),
+            Err(5_000)
+        );
+        // 冷却期间每次尝试都只返回剩余的等待时间，不会延长冷却。
+        assert_eq!(
+            state.admit_connection_attempt(&config, "alice", 1_030),
+            Err(4_000)
+        );
+        assert!(state
+            .admit_connection_attempt(&config, "alice", 5_030)
+            .is_ok());
+    }
+
+    #[test]
+    fn reconnects_outside_the_window_are_forgotten() {
+        let config = reconnect_config(3, 1_000, 5_000);
+        let mut state = AppState::default();
+        for now in [0, 10, 20] {
+            assert!(state
+                .admit_connection_attempt(&config, "alice", now)
+                .is_ok());
+        }
+
+        assert!(state
+            .admit_connection_attempt(&config, "alice", 1_010)
+            .is_ok());
+    }
+
+    #[test]
+    fn reconnect_cooldown_only_applies_to_the_offending_id() {
+        let config = reconnect_config(1, 1_000, 5_000);
+        let mut state = AppState::default();
+        assert!(state.admit_connection_attempt(&config, "alice", 0).is_ok());
+        assert!(state.admit_connection_attempt(&config, "alice", 1).is_err());
+
+        assert!(state.admit_connection_attempt(&config, "bob", 2).is_ok());
+    }
+
+    #[test]
+    fn reconnects_are_unlimited_when_the_limit_is_off() {
+        let config = reconnect_config(0, 1_000, 5_000);
+        let mut state = AppState::default();
+        for now in 0..100 {
+            assert!(state
+                .admit_connection_attempt(&config, "alice", now)
+                .is_ok());
+        }
+    }
+
+    #[test]
+    fn repeated_read_timeouts_trigger_a_cooldown_while_clean_disconnects_do_not() {
+        let mut config = reconnect_config(0, 1_000, 5_000);
+        config.read_timeout_limit = 3;
+        config.read_timeout_window_ms = 1_000;
+        config.read_timeout_cooldown_ms = 60_000;
+        let mut state = AppState::default();
+
+        // alice 每次都是心跳超时被断开，第三次起进入冷却。
+        for now in [0, 10] {
+            assert!(!state.record_read_timeout(&config, "alice", now));
+            assert!(state
+                .admit_connection_attempt(&config, "alice", now + 1)
+                .is_ok());
+        }
+        assert!(state.record_read_timeout(&config, "alice", 20));
+        assert_eq!(
+            state.admit_connection_attempt(&config, "alice", 30),
+            Err(59_990)
+        );
+
+        // bob 每次都正常关闭，不会记入超时，随时可以重连。
+        for now in 0..10 {
+            assert!(state.admit_connection_attempt(&config, "bob", now).is_ok());
+        }
+
+        // 窗口外的零星超时不累计。
+        assert!(!state.record_read_timeout(&config, "carol", 0));
+        assert!(!state.record_read_timeout(&config, "carol", 1_000));
+        assert!(!state.record_read_timeout(&config, "carol", 2_000));
+        assert!(state
+            .admit_connection_attempt(&config, "carol", 2_001)
+            .is_ok());
+    }
+
+    fn room_with_origins(allowed_origins: &[&str]) -> RoomState {
+        RoomState::new(
+            "studio".to_string(),
+            None,
+            RoomOptions {
+                is_private: false,
+                owner_leave_policy: OwnerLeavePolicy::Transfer,
+                allowed_origins: allowed_origins
+                    .iter()
+                    .map(|origin| origin.to_string())
+                    .collect(),
+                persistent: true,
+                approval_required: false,
+                message_log: false,
+                max_lifetime_ms: None,
+                retention: None,
+            },
+        )
+    }
+
+    #[test]
+    fn room_origin_list_rejects_any_other_origin() {
+        let room = room_with_origins(&["https://studio.example.com"]);
+
+        assert!(room.origin_allowed(Some("https://studio.example.com")));
+        assert!(room.origin_allowed(Some("HTTPS://Studio.Example.com")));
+        assert!(!room.origin_allowed(Some("https://other.example.com")));
+        assert!(!room.origin_allowed(None));
+    }
+
+    #[test]
+    fn room_without_an_origin_list_admits_every_origin() {
+        let room = room_with_origins(&[]);
+
+        assert!(room.origin_allowed(Some("https://other.example.com")));
+        assert!(room.origin_allowed(None));
+    }
+
+    /// 房间数满时的候选：`members` 为空表示空房间，`idle_since_ms` 是最近一次活动的时间。
+    fn room_active_at(id: &str, idle_since_ms: u64, members: &[&str]) -> RoomState {
+        let mut room = room_with_origins(&[]);
+        room.id = id.to_string();
+        room.last_activity_ms = AtomicU64::new(idle_since_ms);
+        for member in members {
+            room.clients.insert(member.to_string(), Uuid::new_v4());
+        }
+        room
+    }
+
+    #[test]
+    fn room_cap_evicts_the_idlest_empty_room_but_never_a_populated_one() {
+        let mut config = AppConfig::for_tests();
+        config.max_rooms = 3;
+        config.room_eviction_policy = RoomEvictionPolicy::EvictLruEmpty;
+        let mut state = AppState::default();
+        for room in [
+            room_active_at("busy", 0, &["alice"]),
+            room_active_at("stale", 100, &[]),
+            room_active_at("recent", 500, &[]),
+        ] {
+            state.rooms.insert(room.id.clone(), room);
+        }
+
+        assert!(state.reserve_room_slot(&config));
+        assert!(!state.rooms.contains_key("stale"));
+        assert!(state.rooms.contains_key("busy"));
+        assert!(state.rooms.contains_key("recent"));
+
+        let fresh = room_active_at("fresh", 900, &["bob"]);
+        state.rooms.insert(fresh.id.clone(), fresh);
+        assert!(state.reserve_room_slot(&config));
+        assert!(!state.rooms.contains_key("recent"));
+
+        let full = room_active_at("full", 1_000, &["carol"]);
+        state.rooms.insert(full.id.clone(), full);
+        assert!(
+            !state.reserve_room_slot(&config),
+            "populated rooms are never evicted"
+        );
+        assert_eq!(state.rooms.len(), 3);
+    }
+
+    #[test]
+    fn room_cap_rejects_new_rooms_under_the_default_policy() {
+        let mut config = AppConfig::for_tests();
+        config.max_rooms = 1;
+        let mut state = AppState::default();
+        let idle = room_active_at("idle", 0, &[]);
+        state.rooms.insert(idle.id.clone(), idle);
+
+        assert!(!state.reserve_room_slot(&config));
+        assert!(state.rooms.contains_key("idle"));
+    }
 }
@@ -0,0 +1,125 @@
+//! WebSocket 建连前的身份与房间授权扩展点。
+
+use std::collections::HashSet;
+
+use axum::http::{HeaderMap, StatusCode};
+use tracing::warn;
+
+use crate::{
+    config::AppConfig,
+    session::{parse_session_cookie, verify_type_grant},
+    types::ConnectParams,
+    utils::{take_rate_limited_log_count, RateLimitedLogState},
+};
+
+const INVALID_SESSION_WARN_INTERVAL_MS: u64 = 30_000;
+static INVALID_SESSION_WARN_STATE: RateLimitedLogState = RateLimitedLogState::new();
+
+/// 授权通过后确定下来的连接身份。
+#[derive(Debug, Clone)]
+pub(crate) struct AuthorizedConnection {
+    pub(crate) client_id: String,
+    pub(crate) room_id: String,
+    /// 该身份允许发送的消息类型；`None` 表示不限。
+    pub(crate) allowed_types: Option<HashSet<String>>,
+    /// 没有经过任何凭证确认的身份，计入 `MAX_ANONYMOUS_CONNECTIONS`。
+    pub(crate) anonymous: bool,
+}
+
+/// 授权失败时返回给客户端的 HTTP 状态。
+#[derive(Debug, Clone)]
+pub(crate) struct AuthorizationError {
+    pub(crate) status: StatusCode,
+    pub(crate) reason: String,
+}
+
+impl AuthorizationError {
+    pub(crate) fn new(status: StatusCode, reason: impl Into<String>) -> Self {
+        Self {
+            status,
+            reason: reason.into(),
+        }
+    }
+}
+
+/// 在 WebSocket 升级前调用；不同部署可替换成 JWT、API Key、IP 白名单等实现。
+pub(crate) trait Authorizer: Send + Sync {
+    fn authorize(
+        &self,
+        config: &AppConfig,
+        headers: &HeaderMap,
+        params: &ConnectParams,
+    ) -> Result<AuthorizedConnection, AuthorizationError>;
+}
+
+/// 默认实现：从签名 Cookie 取匿名身份，从 query 取房间号。
+pub(crate) struct SessionAuthorizer;
+
+impl Authorizer for SessionAuthorizer {
+    fn authorize(
+        &self,
+        config: &AppConfig,
+        headers: &HeaderMap,
+        params: &ConnectParams,
+    ) -> Result<AuthorizedConnection, AuthorizationError> {
+        let Some(session) = parse_session_cookie(config, headers) else {
+            if let Some(suppressed_count) = take_rate_limited_log_count(
+                &INVALID_SESSION_WARN_STATE,
+                INVALID_SESSION_WARN_INTERVAL_MS,
+            ) {
+                if suppressed_count > 0 {
+                    warn!(
+                        "rejecting websocket upgrade without a valid anonymous session (suppressed {} similar events in the last {}s)",
+                        suppressed_count,
+                        INVALID_SESSION_WARN_INTERVAL_MS / 1000
+                    );
+                } else {
+                    warn!("rejecting websocket upgrade without a valid anonymous session");
+                }
+            }
+            return Err(AuthorizationError::new(
+                StatusCode::UNAUTHORIZED,
+                "missing or invalid anonymous session",
+            ));
+        };
+
+        let room_id = params
+            .room
+            .clone()
+            .filter(|value| !value.trim().is_empty())
+            .unwrap_or_else(|| "default".to_string());
+
+        // 类型授权令牌由业务后端为已识别的用户签发，带着有效令牌的连接不算匿名。
+        let anonymous = params.grant.as_deref().is_none_or(|value| value.is_empty())
+            || config.message_type_grant_secret.is_none();
+        // 类型授权令牌与会话身份绑定，别人的令牌拿来也用不了。
+        let allowed_types = if config.message_type_grant_secret.is_none() {
+            None
+        } else {
+            match params.grant.as_deref().filter(|value| !value.is_empty()) {
+                Some(token) => Some(
+                    verify_type_grant(config, token, &session.client_id).ok_or_else(|| {
+                        AuthorizationError::new(
+                            StatusCode::UNAUTHORIZED,
+                            "invalid message type grant",
+                        )
+                    })?,
+                ),
+                None if config.message_type_grant_required => {
+                    return Err(AuthorizationError::new(
+                        StatusCode::UNAUTHORIZED,
+                        "missing message type grant",
+                    ));
+                }
+                None => None,
+            }
+        };
+
+        Ok(AuthorizedConnection {
+            client_id: session.client_id,
+            room_id,
+            allowed_types,
+            anonymous,
+        })
+    }
+}
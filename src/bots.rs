@@ -0,0 +1,94 @@
+//! 服务端托管的虚拟机器人：替配置的机器人身份回答名单、对时与 ping 查询，机器人进程不必保持 WebSocket 连接。
+
+use serde_json::Value;
+
+use crate::{
+    app::RoomState,
+    config::{AppConfig, VirtualBot},
+    monitor::room_matches,
+    types::{SignalMessage, ROSTER_OBJECTS_MIN_VERSION},
+    utils::now_ms,
+};
+
+/// 找到房间里以 `target` 为身份的虚拟机器人；同名的真实连接在场时由真实连接自己处理。
+pub(crate) fn virtual_bot_for<'a>(
+    config: &'a AppConfig,
+    room: &RoomState,
+    target: &str,
+) -> Option<&'a VirtualBot> {
+    if room.clients.contains_key(target) {
+        return None;
+    }
+    config
+        .virtual_bots
+        .iter()
+        .find(|bot| bot.id == target && room_matches(&bot.rooms, &room.id))
+}
+
+/// 按机器人身份生成对查询的回复；不在 `VIRTUAL_BOT_ANSWERS` 里的类型返回 `None`，照常按离线目标处理。
+/// 名单按提问方的协议版本下发：新版客户端收到 `{id}` 对象数组，虚拟机器人额外带 `bot: true`。
+pub(crate) fn answer_as_bot(
+    config: &AppConfig,
+    bot: &VirtualBot,
+    room: &RoomState,
+    message: &SignalMessage,
+    protocol_version: u32,
+) -> Option<SignalMessage> {
+    if !config.virtual_bot_answers.contains(&message.kind) {
+        return None;
+    }
+    let client_ts = message.payload.get("clientTs").and_then(Value::as_u64);
+    let (kind, payload) = match message.kind.as_str() {
+        "get_roster" => {
+            // 和真实成员看到的一样：房间里的全部成员，外加同在本房间的虚拟机器人。
+            let mut members = room
+                .clients
+                .keys()
+                .map(|id| (id.clone(), false))
+                .chain(
+                    config
+                        .virtual_bots
+                        .iter()
+                        .filter(|bot| room_matches(&bot.rooms, &room.id))
+                        .filter(|bot| !room.clients.contains_key(&bot.id))
+                        .map(|bot| (bot.id.clone(), true)),
+                )
+                .collect::<Vec<_>>();
+            members.sort();
+            members.dedup_by(|a, b| a.0 == b.0);
+            let members = if protocol_version >= ROSTER_OBJECTS_MIN_VERSION {
+                members
+                    .into_iter()
+                    .map(|(id, is_bot)| {
+                        if is_bot {
+                            serde_json::json!({ "id": id, "bot": true })
+                        } else {
+                            serde_json::json!({ "id": id })
+                        }
+                    })
+                    .collect::<Vec<_>>()
+            } else {
+                members.into_iter().map(|(id, _)| Value::from(id)).collect()
+            };
+            ("roster", serde_json::json!({ "members": members }))
+        }
+        "time" => (
+            "time",
+            serde_json::json!({ "clientTs": client_ts, "serverTs": now_ms() }),
+        ),
+        "ping" => (
+            "pong",
+            serde_json::json!({ "clientTs": client_ts, "serverTs": now_ms() }),
+        ),
+        _ => return None,
+    };
+
+    Some(SignalMessage {
+        kind: kind.to_string(),
+        payload,
+        from: bot.id.clone(),
+        to: Some(message.from.clone()),
+        correlation_id: message.correlation_id.clone(),
+        ..Default::default()
+    })
+}
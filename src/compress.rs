@@ -0,0 +1,184 @@
+//! 不依赖外部库的 raw DEFLATE 编码（RFC 1951，固定哈夫曼表）。
+//! 浏览器可以直接用 `DecompressionStream("deflate-raw")` 解码。
+
+const WINDOW_SIZE: usize = 32 * 1024;
+const MIN_MATCH: usize = 3;
+const MAX_MATCH: usize = 258;
+const HASH_BITS: u32 = 15;
+/// 压缩级别的取值范围与默认值，含义与 zlib 的 1..=9 相同：级别越高越省带宽、越费 CPU。
+pub(crate) const MIN_COMPRESSION_LEVEL: u8 = 1;
+pub(crate) const MAX_COMPRESSION_LEVEL: u8 = 9;
+pub(crate) const DEFAULT_COMPRESSION_LEVEL: u8 = 5;
+/// 各级别下每个位置最多回溯的候选数，限制最坏情况下的 CPU 开销。
+const MAX_CHAIN_BY_LEVEL: [usize; 9] = [4, 8, 16, 24, 32, 64, 128, 256, 1024];
+
+/// 长度码 257..=285 对应的基础长度与附加位数。
+const LENGTH_BASE: [u16; 29] = [
+    3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131,
+    163, 195, 227, 258,
+];
+const LENGTH_EXTRA: [u8; 29] = [
+    0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0,
+];
+/// 距离码 0..=29 对应的基础距离与附加位数。
+const DIST_BASE: [u16; 30] = [
+    1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537,
+    2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577,
+];
+const DIST_EXTRA: [u8; 30] = [
+    0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13,
+    13,
+];
+
+/// 把压缩级别收敛到有效范围内。
+pub(crate) fn clamp_compression_level(level: u32) -> u8 {
+    level.clamp(
+        u32::from(MIN_COMPRESSION_LEVEL),
+        u32::from(MAX_COMPRESSION_LEVEL),
+    ) as u8
+}
+
+/// 把输入压缩成单个固定哈夫曼块的 raw DEFLATE 流；`level` 超出范围时按边界处理。
+pub(crate) fn deflate_raw(input: &[u8], level: u8) -> Vec<u8> {
+    let max_chain = MAX_CHAIN_BY_LEVEL[usize::from(clamp_compression_level(u32::from(level)) - 1)];
+    let mut writer = BitWriter::default();
+    // BFINAL = 1，BTYPE = 01（固定哈夫曼表）。
+    writer.write_bits(1, 1);
+    writer.write_bits(1, 2);
+
+    let mut head = vec![usize::MAX; 1 << HASH_BITS];
+    let mut prev = vec![usize::MAX; input.len()];
+    let mut pos = 0;
+    while pos < input.len() {
+        let (length, distance) = longest_match(input, pos, &head, &prev, max_chain);
+        let advance = if length >= MIN_MATCH {
+            write_match(&mut writer, length, distance);
+            length
+        } else {
+            write_literal(&mut writer, u16::from(input[pos]));
+            1
+        };
+        for inserted in pos..pos + advance {
+            insert_hash(input, inserted, &mut head, &mut prev);
+        }
+        pos += advance;
+    }
+
+    write_literal(&mut writer, 256);
+    writer.finish()
+}
+
+fn hash_at(input: &[u8], pos: usize) -> usize {
+    let value = (u32::from(input[pos]) << 16)
+        | (u32::from(input[pos + 1]) << 8)
+        | u32::from(input[pos + 2]);
+    (value.wrapping_mul(2_654_435_761) >> (32 - HASH_BITS)) as usize
+}
+
+fn insert_hash(input: &[u8], pos: usize, head: &mut [usize], prev: &mut [usize]) {
+    if pos + MIN_MATCH > input.len() {
+        return;
+    }
+    let hash = hash_at(input, pos);
+    prev[pos] = head[hash];
+    head[hash] = pos;
+}
+
+/// 沿哈希链在窗口内找最长匹配，返回 `(长度, 距离)`；找不到时长度为 0。
+fn longest_match(
+    input: &[u8],
+    pos: usize,
+    head: &[usize],
+    prev: &[usize],
+    max_chain: usize,
+) -> (usize, usize) {
+    if pos + MIN_MATCH > input.len() {
+        return (0, 0);
+    }
+
+    let max_length = MAX_MATCH.min(input.len() - pos);
+    let mut best = (0, 0);
+    let mut candidate = head[hash_at(input, pos)];
+    for _ in 0..max_chain {
+        if candidate == usize::MAX || pos - candidate > WINDOW_SIZE {
+            break;
+        }
+        let length = input[candidate..]
+            .iter()
+            .zip(&input[pos..pos + max_length])
+            .take_while(|(left, right)| left == right)
+            .count();
+        if length > best.0 {
+            best = (length, pos - candidate);
+            if length == max_length {
+                break;
+            }
+        }
+        candidate = prev[candidate];
+    }
+    best
+}
+
+fn write_literal(writer: &mut BitWriter, symbol: u16) {
+    let symbol = u32::from(symbol);
+    match symbol {
+        0..=143 => writer.write_code(0x30 + symbol, 8),
+        144..=255 => writer.write_code(0x190 + (symbol - 144), 9),
+        256..=279 => writer.write_code(symbol - 256, 7),
+        _ => writer.write_code(0xc0 + (symbol - 280), 8),
+    }
+}
+
+fn write_match(writer: &mut BitWriter, length: usize, distance: usize) {
+    let length_index = LENGTH_BASE
+        .iter()
+        .rposition(|base| usize::from(*base) <= length)
+        .unwrap_or(0);
+    write_literal(writer, 257 + length_index as u16);
+    writer.write_bits(
+        (length - usize::from(LENGTH_BASE[length_index])) as u32,
+        u32::from(LENGTH_EXTRA[length_index]),
+    );
+
+    let distance_index = DIST_BASE
+        .iter()
+        .rposition(|base| usize::from(*base) <= distance)
+        .unwrap_or(0);
+    writer.write_code(distance_index as u32, 5);
+    writer.write_bits(
+        (distance - usize::from(DIST_BASE[distance_index])) as u32,
+        u32::from(DIST_EXTRA[distance_index]),
+    );
+}
+
+/// DEFLATE 按 LSB 优先写入比特，哈夫曼码本身则按 MSB 优先。
+#[derive(Default)]
+struct BitWriter {
+    out: Vec<u8>,
+    buffer: u64,
+    count: u32,
+}
+
+impl BitWriter {
+    fn write_bits(&mut self, value: u32, count: u32) {
+        self.buffer |= u64::from(value) << self.count;
+        self.count += count;
+        while self.count >= 8 {
+            self.out.push(self.buffer as u8);
+            self.buffer >>= 8;
+            self.count -= 8;
+        }
+    }
+
+    fn write_code(&mut self, code: u32, length: u32) {
+        let reversed = (0..length).fold(0, |acc, bit| (acc << 1) | ((code >> bit) & 1));
+        self.write_bits(reversed, length);
+    }
+
+    fn finish(mut self) -> Vec<u8> {
+        if self.count > 0 {
+            self.out.push(self.buffer as u8);
+        }
+        self.out
+    }
+}
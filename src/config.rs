@@ -1,8 +1,8 @@
 //! 环境变量解析与服务端运行配置。
 
 use std::{
-    env,
-    net::{IpAddr, Ipv4Addr},
+    collections::{HashMap, HashSet},
+    net::{IpAddr, Ipv4Addr, SocketAddr},
     sync::Arc,
 };
 
@@ -10,17 +10,502 @@ use axum::http::{header, HeaderMap};
 use tracing::warn;
 use uuid::Uuid;
 
-use crate::utils::{env_bool, normalized_stun_urls, split_csv};
+use crate::{
+    api_error::ErrorBodyFormat,
+    compress::{clamp_compression_level, DEFAULT_COMPRESSION_LEVEL},
+    types::DEFAULT_SERVER_SENDER_ID,
+    utils::{env_bool, env_parse, env_var, normalized_stun_urls, split_csv},
+};
+
+/// 未配置 `BACKPRESSURE_STRATEGIES` 时使用的默认映射。
+const DEFAULT_BACKPRESSURE_STRATEGIES: &[&str] = &[
+    "offer:block",
+    "answer:block",
+    "chat:drop_oldest",
+    "typing:drop_newest",
+];
+
+/// 未配置 `FLOOR_GATED_TYPES` 时，开启发言权控制后只有当前发言人能发的消息类型。
+const DEFAULT_FLOOR_GATED_TYPES: &[&str] = &["chat", "unmute", "speaking"];
+/// 未配置 `VIRTUAL_BOT_ANSWERS` 时虚拟机器人代为回答的查询类型。
+const DEFAULT_VIRTUAL_BOT_ANSWERS: &[&str] = &["get_roster", "time", "ping"];
+/// 建连信令只对当时在场的成员有意义，即使配置了也不会进入历史。
+const NEVER_HISTORY_TYPES: &[&str] = &[
+    "offer",
+    "answer",
+    "candidate",
+    "ice_candidate",
+    "relay_data",
+    "heartbeat",
+    "ping",
+];
 
 /// 服务启动后长期持有的配置快照。
 #[derive(Debug, Clone)]
 pub(crate) struct AppConfig {
-    pub(crate) port: u16,
+    /// 信令与页面的监听地址：`--addr` 优先，其次 `ADDR`，都未设置时为 `0.0.0.0:APP_PORT`。
+    pub(crate) listen_addr: SocketAddr,
     pub(crate) allowed_origins: Vec<String>,
     pub(crate) ice_provider: IceProvider,
     pub(crate) filter_browser_unsafe_turn_urls: bool,
     pub(crate) session_secret: Arc<Vec<u8>>,
     pub(crate) session_ttl_seconds: u64,
+    /// 每个房间缓存的最近聊天条数；为 0 时不缓存任何消息正文。
+    pub(crate) chat_history_limit: usize,
+    /// 聊天历史条目的最长保留时间（毫秒），超过后不再补发；0 表示只按条数限制。
+    pub(crate) chat_history_max_age_ms: u64,
+    /// 进入历史缓存、补发给后加入成员的广播消息类型，默认只有 `chat`。
+    pub(crate) history_types: HashSet<String>,
+    /// 建房时未显式指定时使用的房主离开策略。
+    pub(crate) owner_leave_policy: OwnerLeavePolicy,
+    /// `relay_data` 兜底中转的单条载荷上限（字节）。
+    pub(crate) relay_data_max_bytes: usize,
+    /// `relay_data` 每个连接的令牌回填速率与突发上限。
+    pub(crate) relay_data_rate_per_second: f64,
+    pub(crate) relay_data_burst: f64,
+    /// 开启后，连接升级后必须先发 `hello` 才会加入房间。
+    pub(crate) require_hello: bool,
+    /// 等待 `hello` 的最长时间，独立于心跳超时。
+    pub(crate) hello_timeout_ms: u64,
+    /// 是否为每个 HTTP 请求输出 JSON 访问日志。
+    pub(crate) access_log: bool,
+    /// HTTP 错误响应体的结构。
+    pub(crate) error_body_format: ErrorBodyFormat,
+    /// 测试用的人为转发延迟区间（毫秒）；上限为 0 时关闭。
+    pub(crate) relay_delay_min_ms: u64,
+    pub(crate) relay_delay_max_ms: u64,
+    /// 管理接口的 Bearer 令牌；未配置时不挂载任何 `/admin` 路由。
+    pub(crate) admin_token: Option<String>,
+    /// 建连后是否先发送 `welcome`，告知客户端解析后的身份与服务端能力。
+    pub(crate) welcome_message: bool,
+    /// 每个连接出站队列可容纳的业务消息数，0 表示不限。
+    pub(crate) outbound_queue_capacity: usize,
+    /// 出站队列写满时按消息类型选择的背压策略。
+    pub(crate) backpressure: Arc<BackpressurePolicy>,
+    /// 需审批房间里，等待房主处理入房申请的最长时间。
+    pub(crate) join_approval_timeout_ms: u64,
+    /// 客户端支持时，优先返回内嵌的 `.br` / `.gz` 预压缩资源。
+    pub(crate) precompressed_assets: bool,
+    /// 启动时检查内嵌资源，列出缺少预压缩版本的文件。
+    pub(crate) precompressed_assets_check: bool,
+    /// 单个用户同时可以担任房主的房间数上限，0 表示不限。
+    pub(crate) max_owned_rooms: usize,
+    /// 成员掉线后为其暂存单播消息的时长（毫秒），0 表示不暂存。
+    pub(crate) offline_hold_ttl_ms: u64,
+    /// 每个掉线成员最多暂存的消息条数。
+    pub(crate) offline_hold_max_messages: usize,
+    /// 成员掉线后推迟广播 `user_left` 的时长（毫秒），期间重连则不再广播；0 表示立即广播。
+    pub(crate) leave_grace_ms: u64,
+    /// 单播目标不在本房间时回错误，并区分目标在别的房间还是根本不在线。
+    pub(crate) unicast_target_errors: bool,
+    /// 单个连接生命周期内允许使用的不同消息类型数，0 表示不限。
+    pub(crate) max_distinct_message_types: usize,
+    /// 超过上限时断开连接；关闭时只记录告警。
+    pub(crate) distinct_message_types_disconnect: bool,
+    /// 按消息类型的入站限流配置。
+    pub(crate) message_rate_limits: Arc<MessageRateLimits>,
+    /// 记住每对成员之间最近一次 `quality_request`，目标重连后补发。
+    pub(crate) quality_memory: bool,
+    /// `/api/rooms` 单次最多返回的房间数，0 表示不限；截断时响应里的 `truncated` 为 true。
+    pub(crate) room_list_max: usize,
+    /// 客户端在 `time` / `ping` 里报告的时间与服务端相差超过该毫秒数时告警，0 表示不检查。
+    pub(crate) clock_skew_warn_ms: u64,
+    /// 统计房间最近一分钟的消息数与成员峰值，并附在房间列表里。
+    pub(crate) room_activity_summary: bool,
+    /// 带 `id` 的单播消息在未收到 `ack` 时的重发次数，0 表示不开启至少一次投递。
+    pub(crate) delivery_retry_attempts: u32,
+    /// 每次等待 `ack` 的时长（毫秒）。
+    pub(crate) delivery_ack_timeout_ms: u64,
+    /// 单个连接同时等待确认的消息数上限。
+    pub(crate) delivery_max_pending: usize,
+    /// 请求方可声明的最长等待回复时间（毫秒），0 表示不跟踪请求/响应超时。
+    pub(crate) response_timeout_max_ms: u64,
+    /// 单个连接同时等待回复的请求数上限。
+    pub(crate) response_max_pending: usize,
+    /// 每条关联链最多暂存的乱序消息数，0 表示不做链内排序。
+    pub(crate) correlation_reorder_max: usize,
+    /// 关联链缺号时最多等待的时长（毫秒），超时后带 `seqGap` 放行。
+    pub(crate) correlation_reorder_timeout_ms: u64,
+    /// `chat` 消息 payload 的最大字节数，0 表示不单独限制。
+    pub(crate) chat_max_bytes: usize,
+    /// 聊天 payload 的内容校验策略。
+    pub(crate) chat_content_policy: ChatContentPolicy,
+    /// 同一房间内显示名重复时的处理方式。
+    pub(crate) display_name_policy: DisplayNamePolicy,
+    /// 房间开启发言权控制后，非发言人不能发送的消息类型。
+    pub(crate) floor_gated_types: HashSet<String>,
+    /// 每个房间同时进行的通话数上限，按 `call_state` 判断成员是否在通话中；0 表示不限。
+    pub(crate) max_concurrent_calls_per_room: usize,
+    /// 维护模式下 503 响应携带的 `Retry-After` 秒数。
+    pub(crate) maintenance_retry_after_seconds: u64,
+    /// 维护模式是否同时拒绝 `/api/rooms`。
+    pub(crate) maintenance_blocks_room_list: bool,
+    /// 多租户模式：房间号按租户隔离，建连和房间列表都必须带租户。
+    pub(crate) tenancy: bool,
+    /// 多租户模式下每个租户同时存在的房间数上限，0 表示只受 `MAX_ROOMS` 约束。
+    pub(crate) tenant_max_rooms: usize,
+    /// 带租户的 `/api/rooms` 单次最多返回的房间数，0 表示沿用 `ROOM_LIST_MAX`。
+    pub(crate) tenant_room_list_max: usize,
+    /// 同一成员在该窗口（毫秒）内重复发送完全相同的广播时只转发第一条，0 表示不去重。
+    pub(crate) broadcast_dedup_window_ms: u64,
+    /// 系统消息的 `from`，同时作为保留身份禁止客户端使用。
+    pub(crate) server_sender_id: String,
+    /// 单个 `batch` 最多可以携带的内层消息数，0 表示不拆包、按普通消息转发。
+    pub(crate) batch_max_messages: usize,
+    /// 向声明支持的客户端下发时，把已排队的消息合并成一个 `batch` 帧的最大条数，0 表示不合并。
+    pub(crate) outbound_batch_max_messages: usize,
+    /// 合并帧的累计字节上限，达到后剩余消息留给下一帧。
+    pub(crate) outbound_batch_max_bytes: usize,
+    /// 挂载 `/debug/runtime` 运行时诊断接口，同样要求管理员令牌。
+    pub(crate) debug_endpoints: bool,
+    /// 单个发送方在所有接收方队列里最多能有多少条未写出的转发消息，0 表示不限。
+    pub(crate) max_in_flight_per_sender: usize,
+    /// WebSocket 每个连接的读缓冲字节数，`None` 表示沿用底层库默认值。
+    pub(crate) ws_read_buffer_size: Option<usize>,
+    /// WebSocket 每个连接的写缓冲字节数，超过后立即写出；`None` 表示沿用默认值。
+    pub(crate) ws_write_buffer_size: Option<usize>,
+    /// `/readyz` 每次抽查的房间数，0 表示只检查共享状态锁。
+    pub(crate) readiness_probe_rooms: usize,
+    /// `/readyz` 等待状态锁与哨兵应答的最长时间（毫秒）。
+    pub(crate) readiness_probe_timeout_ms: u64,
+    /// 全局每秒可新建的房间数，0 表示不限。
+    pub(crate) room_creation_rate_per_second: f64,
+    pub(crate) room_creation_burst: f64,
+    /// 同时存在的房间数上限，0 表示不限。
+    pub(crate) max_rooms: usize,
+    /// 单个房间同时在线的成员数上限，0 表示不限。
+    pub(crate) max_clients_per_room: usize,
+    /// 同时在线的连接数上限，0 表示不限。
+    pub(crate) max_connections: usize,
+    /// 其中匿名连接的上限，通常低于 `max_connections`；0 表示不单独限制。
+    pub(crate) max_anonymous_connections: usize,
+    /// 房间数达到上限后新建房间的处理方式。
+    pub(crate) room_eviction_policy: RoomEvictionPolicy,
+    /// 为所有房间开启调试用的消息日志；关闭时仍可通过管理接口按房间开启。
+    pub(crate) room_message_log: bool,
+    /// 每个房间消息日志保留的最近条数。
+    pub(crate) room_message_log_limit: usize,
+    /// 日志中保留消息 payload；默认只记录类型、收发方与大小。
+    pub(crate) room_message_log_payloads: bool,
+    /// 所有房间的聊天历史与消息日志合计占用的估算字节上限，超出时从最旧的数据开始丢弃；0 表示不限。
+    pub(crate) retained_memory_budget_bytes: usize,
+    /// 未在建房时指定时采用的消息数据保留策略；`None` 表示数据随房间存在，不额外清理。
+    pub(crate) room_retention: Option<RetentionPolicy>,
+    /// 要求 client_id 在整个实例内唯一：已在其他房间在线的身份不能再建连。
+    pub(crate) unique_client_ids: bool,
+    /// 同一 client_id 在 `reconnect_window_ms` 内最多建连的次数，超过后冷却一段时间，0 表示不限。
+    pub(crate) reconnect_limit: usize,
+    pub(crate) reconnect_window_ms: u64,
+    pub(crate) reconnect_cooldown_ms: u64,
+    /// 同一 client_id 在 `read_timeout_window_ms` 内因心跳超时被断开达到该次数后，
+    /// 在 `read_timeout_cooldown_ms` 内拒绝重连，0 表示不跟踪。
+    pub(crate) read_timeout_limit: usize,
+    pub(crate) read_timeout_window_ms: u64,
+    pub(crate) read_timeout_cooldown_ms: u64,
+    /// 房间内用按房间派生的稳定化名代替真实 client_id，真实身份只留在服务端。
+    pub(crate) pseudonymous_ids: bool,
+    /// 按接收方协议版本改写消息类型：`版本 -> (原类型 -> 该版本使用的类型)`。
+    pub(crate) message_type_aliases: HashMap<u32, HashMap<String, String>>,
+    /// 房间只剩旁观成员超过该时长（毫秒）后按空房间回收，0 表示只要有人在就保留。
+    pub(crate) spectator_only_room_ttl_ms: u64,
+    /// 新房间在该时长（毫秒）内等不到第二位成员就关闭，等待期间不出现在房间列表里；0 表示关闭。
+    pub(crate) room_pairing_timeout_ms: u64,
+    /// 收到 SIGINT/SIGTERM 后，等待连接写完关闭通知、以及等待进行中的 HTTP 请求收尾的最长时间（毫秒）。
+    pub(crate) shutdown_timeout_ms: u64,
+    /// 单独监听 `/api/*` 与 `/admin/*` 的地址；未配置时与信令共用同一个监听地址。
+    pub(crate) api_listen_addr: Option<SocketAddr>,
+    /// 为每对成员下发确定性的 polite / impolite 角色，供客户端处理 offer 冲突。
+    pub(crate) peer_role_hints: bool,
+    /// 单个连接每秒最多下发的字节数，超出时先丢低优先级消息；0 表示不限。
+    pub(crate) client_egress_bytes_per_second: f64,
+    pub(crate) client_egress_burst_bytes: f64,
+    /// 单次广播的接收方数超过该值时输出一条结构化告警，0 表示关闭。
+    pub(crate) broadcast_fanout_warn_threshold: usize,
+    /// 单条 `toMany` 消息最多能列出的接收方数，超出时整条拒绝；0 表示不限。
+    pub(crate) max_recipients_per_message: usize,
+    /// `toMany` 列表里包含发送方自己时也投递给它，供回环测试使用；默认跳过。
+    pub(crate) to_many_self_echo: bool,
+    /// 把无法投递的单播副本连同原因转给匹配房间的管理员监控连接。
+    pub(crate) dead_letters: bool,
+    /// 待转交死信的队列容量，写满后新的死信直接丢弃。
+    pub(crate) dead_letter_queue_capacity: usize,
+    /// 录制服务的 webhook 地址；未配置时不录制。
+    pub(crate) recorder_url: Option<String>,
+    /// 需要录制的房间号模式，支持 `prefix-*` 前缀匹配。
+    pub(crate) recorder_rooms: Vec<String>,
+    /// 录制时也包含聊天消息；默认只录信令。
+    pub(crate) recorder_include_chat: bool,
+    /// 待投递录制记录的队列容量，写满后新记录直接丢弃。
+    pub(crate) recorder_queue_capacity: usize,
+    /// 单条记录投递失败后的重试次数。
+    pub(crate) recorder_retry_attempts: u32,
+    /// 由服务端代为应答的机器人身份。
+    pub(crate) virtual_bots: Vec<VirtualBot>,
+    /// 虚拟机器人会回答的查询类型。
+    pub(crate) virtual_bot_answers: HashSet<String>,
+    /// 为每条转发的消息打上全实例单调递增的 `serverTs`。
+    pub(crate) server_timestamps: bool,
+    /// 房间的默认最长存活时间（毫秒），同时是建房时可声明的上限；0 表示不限。
+    pub(crate) room_max_lifetime_ms: u64,
+    /// 排空房间时未指定宽限期所用的默认值（毫秒）。
+    pub(crate) room_drain_grace_ms: u64,
+    /// 排空中的房间不再转发成员消息，发送方收到 `room_draining` 错误。
+    pub(crate) draining_room_drop_messages: bool,
+    /// 房间密码校验通过后签发的入场令牌有效期（毫秒）。
+    pub(crate) room_pass_ttl_ms: u64,
+    /// payload 序列化后达到该字节数才考虑压缩转发，0 表示关闭按对端协商的压缩。
+    pub(crate) payload_compression_min_bytes: usize,
+    /// 客户端未声明时使用的压缩级别（1..=9）。
+    pub(crate) payload_compression_level: u8,
+    /// 按客户端类别选用的服务端 Ping 间隔与心跳超时，未列出的类别使用默认值。
+    pub(crate) ping_profiles: HashMap<String, PingProfile>,
+    /// 校验消息类型授权令牌的 HMAC 密钥；未配置时不启用按身份的类型限制。
+    pub(crate) message_type_grant_secret: Option<String>,
+    /// 启用后每个连接都必须携带有效的类型授权令牌。
+    pub(crate) message_type_grant_required: bool,
+    /// 大厅房间号：加入该房间的成员实时收到公开房间的创建、变化与销毁事件；未配置时关闭。
+    pub(crate) lobby_room_id: Option<String>,
+}
+
+/// `VIRTUAL_BOTS` 中的一项：机器人身份与它所在的房间号模式。
+#[derive(Debug, Clone)]
+pub(crate) struct VirtualBot {
+    pub(crate) id: String,
+    /// 支持 `prefix-*` 前缀匹配。
+    pub(crate) rooms: String,
+}
+
+/// 一个客户端类别的心跳参数。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct PingProfile {
+    /// 服务端发送 Ping 的间隔（毫秒）。
+    pub(crate) interval_ms: u64,
+    /// 超过该时长（毫秒）没有任何活动就视为掉线。
+    pub(crate) timeout_ms: u64,
+}
+
+impl PingProfile {
+    /// 解析 `interval_ms:timeout_ms`；超时必须大于间隔，否则连接会在两次 Ping 之间被误判掉线。
+    fn parse(value: &str) -> Option<Self> {
+        let (interval_ms, timeout_ms) = value.split_once(':')?;
+        let profile = Self {
+            interval_ms: interval_ms.trim().parse().ok()?,
+            timeout_ms: timeout_ms.trim().parse().ok()?,
+        };
+        (profile.interval_ms > 0 && profile.timeout_ms > profile.interval_ms).then_some(profile)
+    }
+}
+
+/// 单个令牌桶的速率与突发容量。
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct RateLimit {
+    pub(crate) rate_per_second: f64,
+    pub(crate) burst: f64,
+}
+
+impl RateLimit {
+    /// 解析 `rate:burst` 形式的配置。
+    fn parse(value: &str) -> Option<Self> {
+        let (rate, burst) = value.split_once(':')?;
+        Some(Self {
+            rate_per_second: rate.trim().parse().ok()?,
+            burst: burst.trim().parse().ok()?,
+        })
+    }
+}
+
+/// 入站消息的限流规则：单独配置的类型各用一个桶，其余类型共用默认桶。
+#[derive(Debug, Clone, Default)]
+pub(crate) struct MessageRateLimits {
+    pub(crate) default_limit: Option<RateLimit>,
+    pub(crate) per_type: HashMap<String, RateLimit>,
+}
+
+/// 出站队列写满时对新消息的处理方式。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum BackpressureStrategy {
+    /// 转发时按到达顺序等待空位，超时仍满则丢弃；适合 offer / answer 这类不能随便丢的消息。
+    Block,
+    /// 挤掉队列中最早的一条同类型消息；适合聊天这类以最新为准的消息。
+    DropOldest,
+    /// 直接丢弃新消息；适合输入状态、光标这类高频且可丢的消息。
+    DropNewest,
+}
+
+impl BackpressureStrategy {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "block" => Some(Self::Block),
+            "drop_oldest" | "drop-oldest" => Some(Self::DropOldest),
+            "drop_newest" | "drop-newest" => Some(Self::DropNewest),
+            _ => None,
+        }
+    }
+}
+
+/// 背压策略最终仍丢弃消息时，对整个连接的处理方式。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum OverflowAction {
+    /// 只丢这一条消息，连接继续保留。
+    Skip,
+    /// 认为客户端已跟不上，发送 Close 后断开连接。
+    Close,
+}
+
+impl OverflowAction {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "skip" => Some(Self::Skip),
+            "close" => Some(Self::Close),
+            _ => None,
+        }
+    }
+}
+
+/// 消息类型到背压策略的映射。
+#[derive(Debug, Clone)]
+pub(crate) struct BackpressurePolicy {
+    pub(crate) default_strategy: BackpressureStrategy,
+    pub(crate) per_type: HashMap<String, BackpressureStrategy>,
+    pub(crate) block_timeout_ms: u64,
+    pub(crate) overflow_action: OverflowAction,
+    /// 单个连接排队中与等待空位的消息总数上限，0 表示只受队列容量约束。
+    pub(crate) max_pending: usize,
+    /// 自适应队列的初始与最小容量，跟得上的连接逐步扩到 `OUTBOUND_QUEUE_CAPACITY`；0 表示固定容量。
+    pub(crate) adaptive_min_capacity: usize,
+}
+
+impl BackpressurePolicy {
+    pub(crate) fn strategy_for(&self, kind: &str) -> BackpressureStrategy {
+        self.per_type
+            .get(kind)
+            .copied()
+            .unwrap_or(self.default_strategy)
+    }
+
+    /// 非 `block` 策略的消息视为低优先级，需要削减流量时先丢它们。
+    pub(crate) fn is_low_priority(&self, kind: &str) -> bool {
+        self.strategy_for(kind) != BackpressureStrategy::Block
+    }
+}
+
+/// 聊天 payload 的内容策略，防止把 HTML、`data:` 链接之类的内容经服务端转给其他成员。
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) enum ChatContentPolicy {
+    /// 不检查内容。
+    Any,
+    /// payload 里的所有字符串都必须是纯文本，不能含标签或脚本类链接。
+    PlainText,
+    /// payload 必须是对象，只能包含白名单字段，且每个字段都是不超过上限的标量。
+    Fields {
+        allowed: HashSet<String>,
+        max_bytes: usize,
+    },
+}
+
+/// 同一房间内两位成员选了相同显示名（不区分大小写）时的处理方式。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum DisplayNamePolicy {
+    /// 允许重名。
+    Allow,
+    /// 拒绝已被占用的名字，客户端收到 `name_taken`。
+    Reject,
+    /// 自动加序号，如 `Alice (2)`。
+    Suffix,
+}
+
+impl DisplayNamePolicy {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "allow" => Some(Self::Allow),
+            "reject" => Some(Self::Reject),
+            "suffix" => Some(Self::Suffix),
+            _ => None,
+        }
+    }
+}
+
+/// 房主断开后房间的处理方式，在建房时确定。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum OwnerLeavePolicy {
+    /// 把房主身份移交给最早加入的剩余成员。
+    Transfer,
+    /// 直接关闭房间并断开所有成员。
+    Close,
+    /// 房间继续存在但不再有房主，并转为只读。
+    Ownerless,
+}
+
+impl OwnerLeavePolicy {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "transfer" => Some(Self::Transfer),
+            "close" => Some(Self::Close),
+            "ownerless" => Some(Self::Ownerless),
+            _ => None,
+        }
+    }
+
+    pub(crate) fn as_str(self) -> &'static str {
+        match self {
+            Self::Transfer => "transfer",
+            Self::Close => "close",
+            Self::Ownerless => "ownerless",
+        }
+    }
+}
+
+/// 房间数达到 `MAX_ROOMS` 后的处理方式。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum RoomEvictionPolicy {
+    /// 直接拒绝新建房间。
+    Reject,
+    /// 回收空闲最久的空房间腾出名额；有成员的房间从不回收。
+    EvictLruEmpty,
+}
+
+impl RoomEvictionPolicy {
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "reject" => Some(Self::Reject),
+            "evict-lru-empty" => Some(Self::EvictLruEmpty),
+            _ => None,
+        }
+    }
+}
+
+/// 房间内聊天历史与调试日志的保留策略，在建房时确定。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum RetentionPolicy {
+    /// 不保留任何消息数据。
+    Discard,
+    /// 只在有成员在线期间保留，最后一位成员离开时清空。
+    Session,
+    /// 按条保留指定时长（毫秒），过期的条目由后台周期清理。
+    Window(u64),
+}
+
+impl RetentionPolicy {
+    /// 取值为 `none`、`session` 或保留时长的毫秒数。
+    pub(crate) fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "none" => Some(Self::Discard),
+            "session" => Some(Self::Session),
+            other => other
+                .parse::<u64>()
+                .ok()
+                .filter(|window_ms| *window_ms > 0)
+                .map(Self::Window),
+        }
+    }
+
+    pub(crate) fn as_param(self) -> String {
+        match self {
+            Self::Discard => "none".to_string(),
+            Self::Session => "session".to_string(),
+            Self::Window(window_ms) => window_ms.to_string(),
+        }
+    }
 }
 
 /// ICE 服务来源。
@@ -45,20 +530,39 @@ pub(crate) enum IceProvider {
 }
 
 impl AppConfig {
+    /// 全部取缺省值的配置，不读取进程环境变量；测试在此基础上显式覆盖需要的字段。
+    #[cfg(test)]
+    pub(crate) fn for_tests() -> Self {
+        crate::utils::without_process_env(|| Self::from_env(None))
+    }
+
     /// 从进程环境变量读取配置；缺省值尽量保证本地开发即可运行。
-    pub(crate) fn from_env() -> Self {
-        let port = env::var("APP_PORT")
+    /// `addr_flag` 是启动参数 `--addr` 的值，由 `main` 解析后传入，优先于 `ADDR`。
+    pub(crate) fn from_env(addr_flag: Option<String>) -> Self {
+        let port = env_var("APP_PORT")
             .ok()
             .and_then(|value| value.parse::<u16>().ok())
             .unwrap_or(3456);
+        // 同一台机器上跑多个实例时按实例绑定不同地址；写错时直接拒绝启动，而不是等到 bind 才报错。
+        let listen_addr = match addr_flag.or_else(|| {
+            env_var("ADDR")
+                .ok()
+                .map(|value| value.trim().to_string())
+                .filter(|value| !value.is_empty())
+        }) {
+            Some(value) => value.parse::<SocketAddr>().unwrap_or_else(|_| {
+                panic!("listen address {value:?} must be a socket address such as 127.0.0.1:3456")
+            }),
+            None => SocketAddr::from(([0, 0, 0, 0], port)),
+        };
         let allowed_origins = split_csv("ALLOWED_ORIGINS");
         let filter_browser_unsafe_turn_urls =
             env_bool("FILTER_BROWSER_UNSAFE_TURN_URLS").unwrap_or(true);
-        let session_ttl_seconds = env::var("SESSION_TTL_SECONDS")
+        let session_ttl_seconds = env_var("SESSION_TTL_SECONDS")
             .ok()
             .and_then(|value| value.parse::<u64>().ok())
             .unwrap_or(30 * 24 * 60 * 60);
-        let session_secret = env::var("SESSION_SECRET")
+        let session_secret = env_var("SESSION_SECRET")
             .ok()
             .filter(|value| !value.trim().is_empty())
             .unwrap_or_else(|| {
@@ -68,8 +572,336 @@ impl AppConfig {
                 );
                 generated
             });
+        let chat_history_limit = env_parse::<usize>("CHAT_HISTORY_LIMIT").unwrap_or(0);
+        let chat_history_max_age_ms = env_parse::<u64>("CHAT_HISTORY_MAX_AGE_MS").unwrap_or(0);
+        let history_types = history_types_from(split_csv("HISTORY_MESSAGE_TYPES"));
+        let owner_leave_policy = env_var("OWNER_LEAVE_POLICY")
+            .ok()
+            .and_then(|value| OwnerLeavePolicy::parse(&value))
+            .unwrap_or(OwnerLeavePolicy::Transfer);
+        let relay_data_max_bytes = env_parse::<usize>("RELAY_DATA_MAX_BYTES").unwrap_or(2048);
+        let relay_data_rate_per_second =
+            env_parse::<f64>("RELAY_DATA_RATE_PER_SECOND").unwrap_or(1.0);
+        let relay_data_burst = env_parse::<f64>("RELAY_DATA_BURST").unwrap_or(5.0);
+        let require_hello = env_bool("REQUIRE_HELLO").unwrap_or(false);
+        let hello_timeout_ms = env_parse::<u64>("HELLO_TIMEOUT_MS").unwrap_or(5_000);
+        let access_log = env_bool("ACCESS_LOG").unwrap_or(false);
+        let error_body_format = match env_var("ERROR_BODY_FORMAT") {
+            Ok(value) => ErrorBodyFormat::parse(&value).unwrap_or_else(|| {
+                warn!("ignoring unknown ERROR_BODY_FORMAT {value:?}; using flat error bodies");
+                ErrorBodyFormat::Flat
+            }),
+            Err(_) => ErrorBodyFormat::Flat,
+        };
+        let relay_delay_min_ms = env_parse::<u64>("RELAY_DELAY_MIN_MS").unwrap_or(0);
+        let relay_delay_max_ms = env_parse::<u64>("RELAY_DELAY_MAX_MS")
+            .unwrap_or(0)
+            .max(relay_delay_min_ms);
+        let admin_token = env_var("ADMIN_TOKEN")
+            .ok()
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty());
+        let welcome_message = env_bool("WELCOME_MESSAGE").unwrap_or(false);
+        // 没有配置任何背压项时出站队列不限长度，和早期版本一样从不丢消息。
+        let backpressure_configured = [
+            "BACKPRESSURE_DEFAULT",
+            "BACKPRESSURE_STRATEGIES",
+            "BACKPRESSURE_BLOCK_TIMEOUT_MS",
+            "BACKPRESSURE_OVERFLOW",
+        ]
+        .iter()
+        .any(|key| env_var(key).is_ok());
+        let outbound_queue_capacity = env_parse::<usize>("OUTBOUND_QUEUE_CAPACITY")
+            .unwrap_or(if backpressure_configured { 256 } else { 0 });
+        let join_approval_timeout_ms =
+            env_parse::<u64>("JOIN_APPROVAL_TIMEOUT_MS").unwrap_or(60_000);
+        let precompressed_assets = env_bool("PRECOMPRESSED_ASSETS").unwrap_or(true);
+        let precompressed_assets_check = env_bool("PRECOMPRESSED_ASSETS_CHECK").unwrap_or(false);
+        let max_owned_rooms = env_parse::<usize>("MAX_OWNED_ROOMS").unwrap_or(0);
+        let offline_hold_ttl_ms = env_parse::<u64>("OFFLINE_HOLD_TTL_MS").unwrap_or(0);
+        let offline_hold_max_messages =
+            env_parse::<usize>("OFFLINE_HOLD_MAX_MESSAGES").unwrap_or(16);
+        let leave_grace_ms = env_parse::<u64>("LEAVE_GRACE_MS").unwrap_or(0);
+        let unicast_target_errors = env_bool("UNICAST_TARGET_ERRORS").unwrap_or(false);
+        let message_rate_limits = MessageRateLimits {
+            default_limit: env_var("MESSAGE_RATE_DEFAULT")
+                .ok()
+                .filter(|value| !value.trim().is_empty())
+                .and_then(|value| {
+                    let limit = RateLimit::parse(&value);
+                    if limit.is_none() {
+                        warn!("ignoring invalid MESSAGE_RATE_DEFAULT {value:?}");
+                    }
+                    limit
+                }),
+            per_type: split_csv("MESSAGE_RATE_LIMITS")
+                .into_iter()
+                .filter_map(|entry| {
+                    let (kind, limit) = entry.split_once(':')?;
+                    let limit = RateLimit::parse(limit);
+                    if limit.is_none() {
+                        warn!("ignoring invalid MESSAGE_RATE_LIMITS entry {entry:?}");
+                    }
+                    Some((kind.trim().to_string(), limit?))
+                })
+                .collect(),
+        };
+        let quality_memory = env_bool("QUALITY_MEMORY").unwrap_or(false);
+        let room_list_max = env_parse::<usize>("ROOM_LIST_MAX").unwrap_or(0);
+        let room_activity_summary = env_bool("ROOM_ACTIVITY_SUMMARY").unwrap_or(false);
+        let clock_skew_warn_ms = env_parse::<u64>("CLOCK_SKEW_WARN_MS").unwrap_or(0);
+        let delivery_retry_attempts = env_parse::<u32>("DELIVERY_RETRY_ATTEMPTS").unwrap_or(0);
+        let delivery_ack_timeout_ms = env_parse::<u64>("DELIVERY_ACK_TIMEOUT_MS").unwrap_or(2_000);
+        let delivery_max_pending = env_parse::<usize>("DELIVERY_MAX_PENDING").unwrap_or(64);
+        let response_timeout_max_ms = env_parse::<u64>("RESPONSE_TIMEOUT_MAX_MS").unwrap_or(0);
+        let response_max_pending = env_parse::<usize>("RESPONSE_MAX_PENDING").unwrap_or(64);
+        let correlation_reorder_max = env_parse::<usize>("CORRELATION_REORDER_MAX").unwrap_or(0);
+        let correlation_reorder_timeout_ms = env_parse::<u64>("CORRELATION_REORDER_TIMEOUT_MS")
+            .unwrap_or(2_000)
+            .max(1);
+        let chat_max_bytes = env_parse::<usize>("CHAT_MAX_BYTES").unwrap_or(0);
+        let floor_gated_types = if env_var("FLOOR_GATED_TYPES").is_ok() {
+            split_csv("FLOOR_GATED_TYPES").into_iter().collect()
+        } else {
+            DEFAULT_FLOOR_GATED_TYPES
+                .iter()
+                .map(|kind| kind.to_string())
+                .collect()
+        };
+        let max_concurrent_calls_per_room =
+            env_parse::<usize>("MAX_CONCURRENT_CALLS_PER_ROOM").unwrap_or(0);
+        let display_name_policy = env_var("DISPLAY_NAME_POLICY")
+            .ok()
+            .and_then(|value| DisplayNamePolicy::parse(&value))
+            .unwrap_or(DisplayNamePolicy::Allow);
+        let chat_content_policy = match env_var("CHAT_CONTENT_POLICY")
+            .unwrap_or_default()
+            .trim()
+            .to_lowercase()
+            .as_str()
+        {
+            "plain_text" => ChatContentPolicy::PlainText,
+            "fields" => ChatContentPolicy::Fields {
+                allowed: split_csv("CHAT_ALLOWED_FIELDS").into_iter().collect(),
+                max_bytes: env_parse::<usize>("CHAT_FIELD_MAX_BYTES").unwrap_or(2000),
+            },
+            "" | "any" => ChatContentPolicy::Any,
+            other => {
+                warn!(
+                    "ignoring unknown CHAT_CONTENT_POLICY {other:?}; chat content is not checked"
+                );
+                ChatContentPolicy::Any
+            }
+        };
+        let maintenance_retry_after_seconds =
+            env_parse::<u64>("MAINTENANCE_RETRY_AFTER_SECONDS").unwrap_or(30);
+        let maintenance_blocks_room_list =
+            env_bool("MAINTENANCE_BLOCKS_ROOM_LIST").unwrap_or(false);
+        let tenancy = env_bool("TENANCY").unwrap_or(false);
+        let tenant_max_rooms = env_parse::<usize>("TENANT_MAX_ROOMS").unwrap_or(0);
+        let tenant_room_list_max = env_parse::<usize>("TENANT_ROOM_LIST_MAX").unwrap_or(0);
+        let broadcast_dedup_window_ms = env_parse::<u64>("BROADCAST_DEDUP_WINDOW_MS").unwrap_or(0);
+        let server_sender_id = env_var("SERVER_SENDER_ID")
+            .ok()
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty())
+            .unwrap_or_else(|| DEFAULT_SERVER_SENDER_ID.to_string());
+        let batch_max_messages = env_parse::<usize>("BATCH_MAX_MESSAGES").unwrap_or(0);
+        let outbound_batch_max_messages =
+            env_parse::<usize>("OUTBOUND_BATCH_MAX_MESSAGES").unwrap_or(0);
+        let outbound_batch_max_bytes =
+            env_parse::<usize>("OUTBOUND_BATCH_MAX_BYTES").unwrap_or(16 * 1024);
+        let debug_endpoints = env_bool("DEBUG_ENDPOINTS").unwrap_or(false);
+        let max_in_flight_per_sender = env_parse::<usize>("MAX_IN_FLIGHT_PER_SENDER").unwrap_or(0);
+        let ws_read_buffer_size =
+            env_parse::<usize>("WS_READ_BUFFER_SIZE").filter(|size| *size > 0);
+        let ws_write_buffer_size =
+            env_parse::<usize>("WS_WRITE_BUFFER_SIZE").filter(|size| *size > 0);
+        let readiness_probe_rooms = env_parse::<usize>("READINESS_PROBE_ROOMS").unwrap_or(0);
+        let readiness_probe_timeout_ms = env_parse::<u64>("READINESS_PROBE_TIMEOUT_MS")
+            .unwrap_or(1_000)
+            .max(1);
+        let room_creation_rate_per_second =
+            env_parse::<f64>("ROOM_CREATION_RATE_PER_SECOND").unwrap_or(0.0);
+        let room_creation_burst = env_parse::<f64>("ROOM_CREATION_BURST").unwrap_or(20.0);
+        let max_rooms = env_parse::<usize>("MAX_ROOMS").unwrap_or(0);
+        let max_clients_per_room = env_parse::<usize>("MAX_CLIENTS_PER_ROOM").unwrap_or(50);
+        let max_connections = env_parse::<usize>("MAX_CONNECTIONS").unwrap_or(0);
+        let max_anonymous_connections =
+            env_parse::<usize>("MAX_ANONYMOUS_CONNECTIONS").unwrap_or(0);
+        let room_eviction_policy = env_var("ROOM_EVICTION_POLICY")
+            .ok()
+            .and_then(|value| RoomEvictionPolicy::parse(&value))
+            .unwrap_or(RoomEvictionPolicy::Reject);
+        let room_message_log = env_bool("ROOM_MESSAGE_LOG").unwrap_or(false);
+        let room_message_log_limit = env_parse::<usize>("ROOM_MESSAGE_LOG_LIMIT").unwrap_or(200);
+        let retained_memory_budget_bytes =
+            env_parse::<usize>("RETAINED_MEMORY_BUDGET_BYTES").unwrap_or(0);
+        let room_message_log_payloads = env_bool("ROOM_MESSAGE_LOG_PAYLOADS").unwrap_or(false);
+        let room_retention = env_var("ROOM_RETENTION")
+            .ok()
+            .and_then(|value| RetentionPolicy::parse(&value));
+        let unique_client_ids = env_bool("UNIQUE_CLIENT_IDS").unwrap_or(false);
+        let reconnect_limit = env_parse::<usize>("RECONNECT_LIMIT").unwrap_or(0);
+        let reconnect_window_ms = env_parse::<u64>("RECONNECT_WINDOW_MS").unwrap_or(60_000);
+        let reconnect_cooldown_ms = env_parse::<u64>("RECONNECT_COOLDOWN_MS").unwrap_or(30_000);
+        let read_timeout_limit = env_parse::<usize>("READ_TIMEOUT_LIMIT").unwrap_or(0);
+        let read_timeout_window_ms = env_parse::<u64>("READ_TIMEOUT_WINDOW_MS").unwrap_or(300_000);
+        let read_timeout_cooldown_ms =
+            env_parse::<u64>("READ_TIMEOUT_COOLDOWN_MS").unwrap_or(120_000);
+        let pseudonymous_ids = env_bool("PSEUDONYMOUS_IDS").unwrap_or(false);
+        // 写错地址时若悄悄退回单端口，管理接口就会暴露在公开端口上，所以直接拒绝启动。
+        let api_listen_addr = env_var("API_LISTEN_ADDR")
+            .ok()
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty())
+            .map(|value| {
+                value
+                    .parse::<SocketAddr>()
+                    .expect("API_LISTEN_ADDR must be a socket address such as 127.0.0.1:3457")
+            });
+        let shutdown_timeout_ms = env_parse::<u64>("SHUTDOWN_TIMEOUT_MS").unwrap_or(10_000);
+        let peer_role_hints = env_bool("PEER_ROLE_HINTS").unwrap_or(false);
+        let server_timestamps = env_bool("SERVER_TIMESTAMPS").unwrap_or(false);
+        let room_max_lifetime_ms = env_parse::<u64>("ROOM_MAX_LIFETIME_MS").unwrap_or(0);
+        let room_drain_grace_ms = env_parse::<u64>("ROOM_DRAIN_GRACE_MS").unwrap_or(30_000);
+        let draining_room_drop_messages = env_bool("DRAINING_ROOM_DROP_MESSAGES").unwrap_or(false);
+        let room_pass_ttl_ms = env_parse::<u64>("ROOM_PASS_TTL_MS")
+            .unwrap_or(60_000)
+            .max(1);
+        let message_type_grant_secret = env_var("MESSAGE_TYPE_GRANT_SECRET")
+            .ok()
+            .filter(|value| !value.trim().is_empty());
+        let message_type_grant_required = env_bool("MESSAGE_TYPE_GRANT_REQUIRED").unwrap_or(false);
+        let lobby_room_id = env_var("LOBBY_ROOM_ID")
+            .ok()
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty());
+        let payload_compression_min_bytes =
+            env_parse::<usize>("PAYLOAD_COMPRESSION_MIN_BYTES").unwrap_or(0);
+        let payload_compression_level = env_parse::<u32>("PAYLOAD_COMPRESSION_LEVEL")
+            .map(clamp_compression_level)
+            .unwrap_or(DEFAULT_COMPRESSION_LEVEL);
+        let ping_profiles = split_csv("PING_PROFILES")
+            .into_iter()
+            .filter_map(|entry| {
+                let profile = entry.split_once(':').and_then(|(class, profile)| {
+                    let class = class.trim().to_ascii_lowercase();
+                    let profile = PingProfile::parse(profile)?;
+                    (!class.is_empty()).then_some((class, profile))
+                });
+                if profile.is_none() {
+                    warn!("ignoring invalid PING_PROFILES entry {entry:?}");
+                }
+                profile
+            })
+            .collect::<HashMap<_, _>>();
+        let broadcast_fanout_warn_threshold =
+            env_parse::<usize>("BROADCAST_FANOUT_WARN_THRESHOLD").unwrap_or(0);
+        let max_recipients_per_message =
+            env_parse::<usize>("MAX_RECIPIENTS_PER_MESSAGE").unwrap_or(0);
+        let to_many_self_echo = env_bool("TO_MANY_SELF_ECHO").unwrap_or(false);
+        let dead_letters = env_bool("DEAD_LETTERS").unwrap_or(false);
+        let dead_letter_queue_capacity =
+            env_parse::<usize>("DEAD_LETTER_QUEUE_CAPACITY").unwrap_or(1024);
+        let recorder_url = env_var("RECORDER_URL")
+            .ok()
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty());
+        let recorder_rooms = split_csv("RECORDER_ROOMS");
+        let recorder_include_chat = env_bool("RECORDER_INCLUDE_CHAT").unwrap_or(false);
+        let recorder_queue_capacity = env_parse::<usize>("RECORDER_QUEUE_CAPACITY").unwrap_or(1024);
+        let recorder_retry_attempts = env_parse::<u32>("RECORDER_RETRY_ATTEMPTS").unwrap_or(3);
+        let virtual_bots = split_csv("VIRTUAL_BOTS")
+            .into_iter()
+            .filter_map(|entry| {
+                let bot = entry
+                    .split_once(':')
+                    .map(|(id, rooms)| (id.trim(), rooms.trim()))
+                    .filter(|(id, rooms)| !id.is_empty() && !rooms.is_empty())
+                    .map(|(id, rooms)| VirtualBot {
+                        id: id.to_string(),
+                        rooms: rooms.to_string(),
+                    });
+                if bot.is_none() {
+                    warn!("ignoring invalid VIRTUAL_BOTS entry {entry:?}");
+                }
+                bot
+            })
+            .collect::<Vec<_>>();
+        let virtual_bot_answers = if env_var("VIRTUAL_BOT_ANSWERS").is_ok() {
+            split_csv("VIRTUAL_BOT_ANSWERS").into_iter().collect()
+        } else {
+            DEFAULT_VIRTUAL_BOT_ANSWERS
+                .iter()
+                .map(|kind| kind.to_string())
+                .collect()
+        };
+        let client_egress_bytes_per_second =
+            env_parse::<f64>("CLIENT_EGRESS_BYTES_PER_SECOND").unwrap_or(0.0);
+        let client_egress_burst_bytes =
+            env_parse::<f64>("CLIENT_EGRESS_BURST_BYTES").unwrap_or(256.0 * 1024.0);
+        let spectator_only_room_ttl_ms =
+            env_parse::<u64>("SPECTATOR_ONLY_ROOM_TTL_MS").unwrap_or(0);
+        let room_pairing_timeout_ms = env_parse::<u64>("ROOM_PAIRING_TIMEOUT_MS").unwrap_or(0);
+        let mut message_type_aliases: HashMap<u32, HashMap<String, String>> = HashMap::new();
+        for entry in split_csv("MESSAGE_TYPE_ALIASES") {
+            let parsed = entry.split_once(':').and_then(|(version, rename)| {
+                let (from, to) = rename.split_once('=')?;
+                Some((version.trim().parse::<u32>().ok()?, from.trim(), to.trim()))
+            });
+            match parsed {
+                Some((version, from, to)) if !from.is_empty() && !to.is_empty() => {
+                    message_type_aliases
+                        .entry(version)
+                        .or_default()
+                        .insert(from.to_string(), to.to_string());
+                }
+                _ => warn!("ignoring invalid MESSAGE_TYPE_ALIASES entry {entry:?}"),
+            }
+        }
+        let max_distinct_message_types =
+            env_parse::<usize>("MAX_DISTINCT_MESSAGE_TYPES").unwrap_or(0);
+        let distinct_message_types_disconnect =
+            env_bool("DISTINCT_MESSAGE_TYPES_DISCONNECT").unwrap_or(true);
+        let backpressure = BackpressurePolicy {
+            default_strategy: env_var("BACKPRESSURE_DEFAULT")
+                .ok()
+                .and_then(|value| BackpressureStrategy::parse(&value))
+                .unwrap_or(BackpressureStrategy::DropNewest),
+            per_type: if env_var("BACKPRESSURE_STRATEGIES").is_ok() {
+                split_csv("BACKPRESSURE_STRATEGIES")
+            } else {
+                DEFAULT_BACKPRESSURE_STRATEGIES
+                    .iter()
+                    .map(|entry| entry.to_string())
+                    .collect()
+            }
+            .into_iter()
+            .filter_map(|entry| {
+                let (kind, strategy) = entry.split_once(':')?;
+                let strategy = BackpressureStrategy::parse(strategy);
+                if strategy.is_none() {
+                    warn!("ignoring invalid BACKPRESSURE_STRATEGIES entry {entry:?}");
+                }
+                Some((kind.trim().to_string(), strategy?))
+            })
+            .collect(),
+            block_timeout_ms: env_parse::<u64>("BACKPRESSURE_BLOCK_TIMEOUT_MS").unwrap_or(200),
+            overflow_action: env_var("BACKPRESSURE_OVERFLOW")
+                .ok()
+                .and_then(|value| OverflowAction::parse(&value))
+                .unwrap_or(OverflowAction::Skip),
+            max_pending: env_parse::<usize>("CLIENT_MAX_PENDING_MESSAGES").unwrap_or(0),
+            adaptive_min_capacity: env_parse::<usize>("OUTBOUND_QUEUE_ADAPTIVE_MIN").unwrap_or(0),
+        };
+        if relay_delay_max_ms > 0 {
+            warn!(
+                "relay delay is enabled ({relay_delay_min_ms}-{relay_delay_max_ms}ms); this is meant for testing only"
+            );
+        }
 
-        let ice_provider_name = env::var("ICE_PROVIDER")
+        let ice_provider_name = env_var("ICE_PROVIDER")
             .unwrap_or_else(|_| "stun-only".to_string())
             .to_lowercase();
         let stun_urls = split_csv("STUN_URLS");
@@ -78,9 +910,9 @@ impl AppConfig {
         // 这样至少还能保证局域网或可直连环境可用。
         let ice_provider = match ice_provider_name.as_str() {
             "cloudflare" => {
-                let key_id = env::var("CLOUDFLARE_TURN_KEY_ID").unwrap_or_default();
-                let api_token = env::var("CLOUDFLARE_TURN_API_TOKEN").unwrap_or_default();
-                let ttl_seconds = env::var("CLOUDFLARE_TURN_TTL_SECONDS")
+                let key_id = env_var("CLOUDFLARE_TURN_KEY_ID").unwrap_or_default();
+                let api_token = env_var("CLOUDFLARE_TURN_API_TOKEN").unwrap_or_default();
+                let ttl_seconds = env_var("CLOUDFLARE_TURN_TTL_SECONDS")
                     .ok()
                     .and_then(|value| value.parse::<u64>().ok())
                     .unwrap_or(86_400);
@@ -101,8 +933,8 @@ impl AppConfig {
             }
             "static" => {
                 let turn_urls = split_csv("TURN_URLS");
-                let username = env::var("TURN_USERNAME").unwrap_or_default();
-                let credential = env::var("TURN_CREDENTIAL").unwrap_or_default();
+                let username = env_var("TURN_USERNAME").unwrap_or_default();
+                let credential = env_var("TURN_CREDENTIAL").unwrap_or_default();
 
                 if turn_urls.is_empty() || username.is_empty() || credential.is_empty() {
                     warn!("ICE_PROVIDER=static but TURN_URLS / TURN_USERNAME / TURN_CREDENTIAL are incomplete; falling back to STUN only");
@@ -124,12 +956,143 @@ impl AppConfig {
         };
 
         Self {
-            port,
+            listen_addr,
             allowed_origins,
             ice_provider,
             filter_browser_unsafe_turn_urls,
             session_secret: Arc::new(session_secret.into_bytes()),
             session_ttl_seconds,
+            chat_history_limit,
+            chat_history_max_age_ms,
+            history_types,
+            owner_leave_policy,
+            relay_data_max_bytes,
+            relay_data_rate_per_second,
+            relay_data_burst,
+            require_hello,
+            hello_timeout_ms,
+            access_log,
+            error_body_format,
+            relay_delay_min_ms,
+            relay_delay_max_ms,
+            admin_token,
+            welcome_message,
+            outbound_queue_capacity,
+            backpressure: Arc::new(backpressure),
+            join_approval_timeout_ms,
+            precompressed_assets,
+            precompressed_assets_check,
+            max_owned_rooms,
+            offline_hold_ttl_ms,
+            offline_hold_max_messages,
+            leave_grace_ms,
+            unicast_target_errors,
+            max_distinct_message_types,
+            distinct_message_types_disconnect,
+            message_rate_limits: Arc::new(message_rate_limits),
+            quality_memory,
+            room_list_max,
+            room_activity_summary,
+            clock_skew_warn_ms,
+            delivery_retry_attempts,
+            delivery_ack_timeout_ms,
+            delivery_max_pending,
+            response_timeout_max_ms,
+            response_max_pending,
+            correlation_reorder_max,
+            correlation_reorder_timeout_ms,
+            chat_max_bytes,
+            chat_content_policy,
+            display_name_policy,
+            floor_gated_types,
+            max_concurrent_calls_per_room,
+            maintenance_retry_after_seconds,
+            maintenance_blocks_room_list,
+            tenancy,
+            tenant_max_rooms,
+            tenant_room_list_max,
+            broadcast_dedup_window_ms,
+            server_sender_id,
+            batch_max_messages,
+            outbound_batch_max_messages,
+            outbound_batch_max_bytes,
+            debug_endpoints,
+            max_in_flight_per_sender,
+            ws_read_buffer_size,
+            ws_write_buffer_size,
+            readiness_probe_rooms,
+            readiness_probe_timeout_ms,
+            room_creation_rate_per_second,
+            room_creation_burst,
+            max_rooms,
+            max_clients_per_room,
+            max_connections,
+            max_anonymous_connections,
+            room_eviction_policy,
+            room_message_log,
+            room_retention,
+            room_message_log_limit,
+            retained_memory_budget_bytes,
+            room_message_log_payloads,
+            unique_client_ids,
+            reconnect_limit,
+            reconnect_window_ms,
+            reconnect_cooldown_ms,
+            read_timeout_limit,
+            read_timeout_window_ms,
+            read_timeout_cooldown_ms,
+            pseudonymous_ids,
+            message_type_aliases,
+            spectator_only_room_ttl_ms,
+            room_pairing_timeout_ms,
+            shutdown_timeout_ms,
+            api_listen_addr,
+            peer_role_hints,
+            client_egress_bytes_per_second,
+            client_egress_burst_bytes,
+            broadcast_fanout_warn_threshold,
+            max_recipients_per_message,
+            to_many_self_echo,
+            dead_letters,
+            dead_letter_queue_capacity,
+            recorder_url,
+            recorder_rooms,
+            recorder_include_chat,
+            recorder_queue_capacity,
+            recorder_retry_attempts,
+            virtual_bots,
+            virtual_bot_answers,
+            server_timestamps,
+            room_max_lifetime_ms,
+            room_drain_grace_ms,
+            draining_room_drop_messages,
+            room_pass_ttl_ms,
+            payload_compression_min_bytes,
+            payload_compression_level,
+            ping_profiles,
+            message_type_grant_secret,
+            message_type_grant_required,
+            lobby_room_id,
+        }
+    }
+
+    /// 未配置 `ADMIN_TOKEN` 时整组 `/admin/*` 都不挂载，请求直接落到 404。
+    pub(crate) fn admin_endpoints_enabled(&self) -> bool {
+        self.admin_token.is_some()
+    }
+
+    /// `/debug/*` 要同时满足管理员令牌与 `DEBUG_ENDPOINTS=true` 才挂载。
+    pub(crate) fn debug_endpoints_enabled(&self) -> bool {
+        self.admin_endpoints_enabled() && self.debug_endpoints
+    }
+
+    /// 建房时声明的存活时间与全局上限取较小的一个；两者都未设置时返回 `None`。
+    pub(crate) fn room_lifetime_ms(&self, requested_ms: Option<u64>) -> Option<u64> {
+        let requested_ms = requested_ms.filter(|value| *value > 0);
+        let limit_ms = Some(self.room_max_lifetime_ms).filter(|value| *value > 0);
+        match (requested_ms, limit_ms) {
+            (Some(requested_ms), Some(limit_ms)) => Some(requested_ms.min(limit_ms)),
+            (requested_ms, limit_ms) => requested_ms.or(limit_ms),
         }
     }
 
@@ -148,6 +1111,31 @@ impl AppConfig {
             .unwrap_or(false)
     }
 
+    /// 多租户模式下校验并返回请求携带的租户；未开启时总是返回 `None`。
+    pub(crate) fn resolve_tenant(
+        &self,
+        tenant: Option<&str>,
+    ) -> Result<Option<String>, &'static str> {
+        if !self.tenancy {
+            return Ok(None);
+        }
+
+        let tenant = tenant.map(str::trim).unwrap_or_default();
+        if tenant.is_empty() {
+            return Err("tenant_required");
+        }
+        // 只允许常见的 slug 字符，避免和房间键里的分隔符混淆。
+        let valid = tenant.len() <= 64
+            && tenant
+                .chars()
+                .all(|ch| ch.is_ascii_alphanumeric() || ch == '-' || ch == '_');
+        if !valid {
+            return Err("invalid_tenant");
+        }
+
+        Ok(Some(tenant.to_string()))
+    }
+
     /// 优先按白名单校验来源；若请求本身就是同源访问，也允许通过。
     pub(crate) fn request_origin_allowed(&self, headers: &HeaderMap) -> bool {
         if self.allowed_origins.is_empty() {
@@ -176,6 +1164,22 @@ impl AppConfig {
     }
 }
 
+/// 按 `HISTORY_MESSAGE_TYPES` 得到进入历史缓存的类型：未配置时只有 `chat`，建连信令一律剔除。
+pub(crate) fn history_types_from(kinds: Vec<String>) -> HashSet<String> {
+    let mut history_types = kinds.into_iter().collect::<HashSet<_>>();
+    if history_types.is_empty() {
+        history_types.insert("chat".to_string());
+    }
+    history_types.retain(|kind| {
+        let allowed = !NEVER_HISTORY_TYPES.contains(&kind.as_str());
+        if !allowed {
+            warn!("HISTORY_MESSAGE_TYPES ignores signaling type {kind}");
+        }
+        allowed
+    });
+    history_types
+}
+
 fn extract_origin_authority(origin: &str) -> Option<&str> {
     let (_, remainder) = origin.split_once("://")?;
     let authority = remainder.split('/').next()?.trim();
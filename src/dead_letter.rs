@@ -0,0 +1,129 @@
+//! 无法投递的单播消息：开启后把副本连同原因转给匹配房间的管理员监控连接，便于排查或重放。
+
+use std::sync::Arc;
+
+use tokio::sync::mpsc;
+use tracing::warn;
+
+use crate::{
+    app::{AppContext, OutboundMessage},
+    config::AppConfig,
+    monitor::room_matches,
+    types::SignalMessage,
+    utils::{take_rate_limited_log_count, RateLimitedLogState},
+};
+
+/// 转发任务每次持锁最多处理的死信条数。
+const DEAD_LETTER_BATCH: usize = 64;
+const DEAD_LETTER_DROP_WARN_INTERVAL_MS: u64 = 30_000;
+static DEAD_LETTER_DROP_WARN_STATE: RateLimitedLogState = RateLimitedLogState::new();
+
+/// 死信队列的发送端，挂在 `AppContext` 上，由转发路径与各连接的 writer 共用。
+pub(crate) type DeadLetterSink = mpsc::Sender<DeadLetter>;
+
+/// 单播消息没能送达的原因。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum DeadLetterReason {
+    /// 目标不在房间里，也没有可用的掉线暂存。
+    TargetOffline,
+    /// 目标的出站队列已满，按背压策略丢弃。
+    QueueFull,
+    /// 在队列里排到时已超过消息声明的 `expiresAt`。
+    Expired,
+}
+
+impl DeadLetterReason {
+    fn as_str(self) -> &'static str {
+        match self {
+            Self::TargetOffline => "target_offline",
+            Self::QueueFull => "queue_full",
+            Self::Expired => "expired",
+        }
+    }
+}
+
+/// 一条待转交的死信。
+pub(crate) struct DeadLetter {
+    room_id: String,
+    target: String,
+    reason: DeadLetterReason,
+    message: SignalMessage,
+}
+
+/// 开启 `DEAD_LETTERS` 时创建有界的死信队列：发送端挂在 `AppContext` 上，接收端交给 [`run_dead_letter_forwarder`]。
+pub(crate) fn dead_letter_queue(
+    config: &AppConfig,
+) -> Option<(DeadLetterSink, mpsc::Receiver<DeadLetter>)> {
+    config
+        .dead_letters
+        .then(|| mpsc::channel(config.dead_letter_queue_capacity.max(1)))
+}
+
+/// 记录一条无法投递的单播；未开启死信时直接忽略，队列写满时丢弃，不拖慢转发。
+pub(crate) fn report_dead_letter(
+    sink: Option<&DeadLetterSink>,
+    room_id: &str,
+    target: &str,
+    reason: DeadLetterReason,
+    message: &SignalMessage,
+) {
+    let Some(sink) = sink else {
+        return;
+    };
+    let letter = DeadLetter {
+        room_id: room_id.to_string(),
+        target: target.to_string(),
+        reason,
+        message: message.clone(),
+    };
+    if let Err(mpsc::error::TrySendError::Full(_)) = sink.try_send(letter) {
+        if let Some(suppressed) = take_rate_limited_log_count(
+            &DEAD_LETTER_DROP_WARN_STATE,
+            DEAD_LETTER_DROP_WARN_INTERVAL_MS,
+        ) {
+            warn!(
+                suppressed,
+                "dead letter queue is full; dropping dead letters until the forwarder catches up"
+            );
+        }
+    }
+}
+
+/// 后台任务：把死信以 `dead_letter` 消息转给订阅了对应房间的监控连接。
+/// 每次取走一批再加一次读锁，避免逐条抢锁。
+pub(crate) async fn run_dead_letter_forwarder(
+    context: Arc<AppContext>,
+    mut receiver: mpsc::Receiver<DeadLetter>,
+) {
+    let mut letters = Vec::with_capacity(DEAD_LETTER_BATCH);
+    while receiver.recv_many(&mut letters, DEAD_LETTER_BATCH).await > 0 {
+        let notices: Vec<_> = letters
+            .drain(..)
+            .map(|letter| {
+                let notice = SignalMessage::server(
+                    &context.config,
+                    "dead_letter",
+                    serde_json::json!({
+                        "roomId": letter.room_id,
+                        "target": letter.target,
+                        "reason": letter.reason.as_str(),
+                        "message": letter.message,
+                    }),
+                );
+                (letter.room_id, notice)
+            })
+            .collect();
+        let state = context.state.read().await;
+        for (room_id, notice) in notices {
+            for subscriber in state
+                .subscribers
+                .values()
+                .filter(|subscriber| room_matches(&subscriber.pattern, &room_id))
+            {
+                let _ = subscriber
+                    .sender
+                    .send(OutboundMessage::Json(notice.clone()));
+            }
+        }
+    }
+}
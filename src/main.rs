@@ -1,24 +1,44 @@
 //! 服务端启动入口。
 //! 这里只负责装配依赖、创建共享上下文并启动 Axum 服务。
 
+mod access_log;
+mod admin;
+mod api_error;
 mod app;
+mod auth;
+mod bots;
+mod compress;
 mod config;
+mod dead_letter;
 mod ice;
+mod monitor;
+mod outbound;
+mod recorder;
+mod reorder;
 mod routes;
 mod session;
 mod static_files;
+mod transform;
 mod types;
 mod utils;
 mod ws;
 
-use std::{net::SocketAddr, sync::Arc, time::Duration};
+use std::{
+    future::IntoFuture,
+    net::SocketAddr,
+    sync::{atomic::AtomicBool, Arc},
+    time::{Duration, Instant},
+};
 
 use app::{AppContext, AppState};
+use auth::SessionAuthorizer;
 use config::AppConfig;
+use dead_letter::{dead_letter_queue, run_dead_letter_forwarder};
+use recorder::{recorder_queue, run_recorder};
 use reqwest::Client;
-use tokio::sync::RwLock;
-use tracing::info;
-use ws::run_stale_connection_reaper;
+use tokio::sync::{watch, RwLock};
+use tracing::{info, warn};
+use ws::{run_stale_connection_reaper, shutdown_connections};
 
 #[tokio::main]
 async fn main() {
@@ -34,8 +54,15 @@ async fn main() {
         )
         .init();
 
-    let config = AppConfig::from_env();
-    let port = config.port;
+    let addr_flag = addr_flag(std::env::args().skip(1)).unwrap_or_else(|err| panic!("{err}"));
+    let config = AppConfig::from_env(addr_flag);
+    if config.precompressed_assets && config.precompressed_assets_check {
+        static_files::warn_missing_precompressed_assets();
+    }
+    let listen_addr = config.listen_addr;
+    let api_listen_addr = config.api_listen_addr;
+    let (recorder, recorder_receiver) = recorder_queue(&config).unzip();
+    let (dead_letters, dead_letter_receiver) = dead_letter_queue(&config).unzip();
     // 全局上下文集中放配置、共享状态和 HTTP 客户端，便于路由层注入。
     let context = Arc::new(AppContext {
         config,
@@ -44,17 +71,166 @@ async fn main() {
             .timeout(Duration::from_secs(10))
             .build()
             .expect("failed to build HTTP client"),
+        authorizer: Arc::new(SessionAuthorizer),
+        maintenance: Arc::new(AtomicBool::new(false)),
+        started_at: Instant::now(),
+        recorder,
+        dead_letters,
     });
     // 后台任务：定期清理长时间没有心跳的 WebSocket 连接。
     tokio::spawn(run_stale_connection_reaper(context.clone()));
+    if let Some(receiver) = dead_letter_receiver {
+        tokio::spawn(run_dead_letter_forwarder(context.clone(), receiver));
+    }
+    if let Some(receiver) = recorder_receiver {
+        tokio::spawn(run_recorder(context.clone(), receiver));
+    }
 
-    let app = routes::build_router(context);
-    let listener = tokio::net::TcpListener::bind(SocketAddr::from(([0, 0, 0, 0], port)))
+    let listener = tokio::net::TcpListener::bind(listen_addr)
         .await
-        .expect("failed to bind TCP listener");
+        .unwrap_or_else(|err| panic!("failed to bind TCP listener on {listen_addr}: {err}"));
 
-    info!("starting Rust signaling server on 0.0.0.0:{port}");
-    axum::serve(listener, app)
+    // 收到退出信号后先通知并关闭所有 WebSocket 连接，之后才让 HTTP 服务停止监听。
+    let shutdown_timeout = Duration::from_millis(context.config.shutdown_timeout_ms);
+    let (shutdown_sender, shutdown_receiver) = watch::channel(false);
+    {
+        let context = context.clone();
+        tokio::spawn(async move {
+            shutdown_signal().await;
+            info!("shutdown signal received; closing websocket connections");
+            shutdown_connections(&context, shutdown_timeout).await;
+            let _ = shutdown_sender.send(true);
+        });
+    }
+
+    let Some(api_listen_addr) = api_listen_addr else {
+        let app = routes::build_router(context);
+        info!("starting Rust signaling server on {listen_addr}");
+        let server = axum::serve(
+            listener,
+            app.into_make_service_with_connect_info::<SocketAddr>(),
+        )
+        .with_graceful_shutdown(shutdown_requested(shutdown_receiver.clone()));
+        tokio::select! {
+            result = server.into_future() => result.expect("axum server exited unexpectedly"),
+            _ = shutdown_deadline(shutdown_receiver, shutdown_timeout) => {
+                warn!("HTTP requests still in flight after the shutdown timeout; exiting");
+            }
+        }
+        return;
+    };
+
+    // 分端口部署：两个服务共享同一份房间状态，任一退出都视为异常。
+    let (public_app, internal_app) = routes::build_split_routers(context);
+    let api_listener = tokio::net::TcpListener::bind(api_listen_addr)
         .await
-        .expect("axum server exited unexpectedly");
+        .expect("failed to bind API listener");
+
+    info!("starting Rust signaling server on {listen_addr}, API on {api_listen_addr}");
+    let public_server = axum::serve(
+        listener,
+        public_app.into_make_service_with_connect_info::<SocketAddr>(),
+    )
+    .with_graceful_shutdown(shutdown_requested(shutdown_receiver.clone()));
+    let internal_server = axum::serve(
+        api_listener,
+        internal_app.into_make_service_with_connect_info::<SocketAddr>(),
+    )
+    .with_graceful_shutdown(shutdown_requested(shutdown_receiver.clone()));
+    tokio::select! {
+        result = async {
+            tokio::try_join!(public_server.into_future(), internal_server.into_future())
+        } => {
+            result.expect("axum server exited unexpectedly");
+        }
+        _ = shutdown_deadline(shutdown_receiver, shutdown_timeout) => {
+            warn!("HTTP requests still in flight after the shutdown timeout; exiting");
+        }
+    }
+}
+
+/// 启动参数里的 `--addr <地址>` 或 `--addr=<地址>`，其余参数忽略。
+/// 写了 `--addr` 却没有给出地址时直接报错，不悄悄回退到 `ADDR` 或默认端口。
+fn addr_flag(args: impl IntoIterator<Item = String>) -> Result<Option<String>, String> {
+    let mut args = args.into_iter();
+    while let Some(arg) = args.next() {
+        let value = if arg == "--addr" {
+            args.next()
+        } else if let Some(value) = arg.strip_prefix("--addr=") {
+            Some(value.to_string())
+        } else {
+            continue;
+        };
+        return match value.map(|value| value.trim().to_string()) {
+            Some(value) if !value.is_empty() && !value.starts_with("--") => Ok(Some(value)),
+            _ => Err("--addr needs a socket address such as 127.0.0.1:3456".to_string()),
+        };
+    }
+    Ok(None)
+}
+
+/// 等待 SIGINT（Ctrl+C）或 SIGTERM（容器编排停止实例时发送）。
+async fn shutdown_signal() {
+    let ctrl_c = async {
+        tokio::signal::ctrl_c()
+            .await
+            .expect("failed to listen for Ctrl+C");
+    };
+    #[cfg(unix)]
+    let terminate = async {
+        tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate())
+            .expect("failed to listen for SIGTERM")
+            .recv()
+            .await;
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        _ = ctrl_c => {}
+        _ = terminate => {}
+    }
+}
+
+/// WebSocket 连接全部处理完后返回，交给 axum 开始停止监听。
+/// 信号监听任务意外退出时不当作退出请求，服务照常运行。
+async fn shutdown_requested(mut receiver: watch::Receiver<bool>) {
+    if receiver.wait_for(|done| *done).await.is_err() {
+        std::future::pending::<()>().await;
+    }
+}
+
+/// 停止监听后再给进行中的 HTTP 请求一段时间，超时仍未结束就直接退出。
+async fn shutdown_deadline(receiver: watch::Receiver<bool>, timeout: Duration) {
+    shutdown_requested(receiver).await;
+    tokio::time::sleep(timeout).await;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn args(values: &[&str]) -> Vec<String> {
+        values.iter().map(|value| value.to_string()).collect()
+    }
+
+    #[test]
+    fn addr_flag_accepts_both_spellings() {
+        assert_eq!(
+            addr_flag(args(&["--addr", "127.0.0.1:3457"])),
+            Ok(Some("127.0.0.1:3457".to_string()))
+        );
+        assert_eq!(
+            addr_flag(args(&["--verbose", "--addr=127.0.0.1:3458"])),
+            Ok(Some("127.0.0.1:3458".to_string()))
+        );
+        assert_eq!(addr_flag(args(&["--verbose"])), Ok(None));
+    }
+
+    #[test]
+    fn addr_flag_without_a_value_is_an_error() {
+        assert!(addr_flag(args(&["--addr"])).is_err());
+        assert!(addr_flag(args(&["--addr="])).is_err());
+        assert!(addr_flag(args(&["--addr", "--verbose"])).is_err());
+    }
 }
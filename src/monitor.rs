@@ -0,0 +1,102 @@
+//! 管理员监控连接：按房间号模式订阅房间广播的只读副本。
+
+use std::{sync::Arc, time::Duration};
+
+use axum::extract::ws::{Message as WsMessage, WebSocket};
+use futures_util::{SinkExt, StreamExt};
+use tracing::{error, info};
+use uuid::Uuid;
+
+use crate::{
+    app::{AppContext, OutboundMessage, Subscriber},
+    outbound::OutboundQueue,
+    ws::WS_SERVER_PING_INTERVAL_MS,
+};
+
+/// `prefix-*` 按前缀匹配，单独的 `*` 匹配全部房间，其余按房间号精确匹配。
+pub(crate) fn room_matches(pattern: &str, room_id: &str) -> bool {
+    match pattern.strip_suffix('*') {
+        Some(prefix) => room_id.starts_with(prefix),
+        None => room_id == pattern,
+    }
+}
+
+/// 监控连接的生命周期：只接收抄送的广播，客户端发来的业务消息一律丢弃。
+pub(crate) async fn handle_subscriber(
+    context: Arc<AppContext>,
+    socket: WebSocket,
+    pattern: String,
+) {
+    let subscriber_id = Uuid::new_v4();
+    let (mut sink, mut stream) = socket.split();
+    let sender = OutboundQueue::new(
+        context.config.outbound_queue_capacity,
+        context.config.backpressure.clone(),
+    );
+    let receiver = sender.clone();
+
+    context.state.write().await.subscribers.insert(
+        subscriber_id,
+        Subscriber {
+            pattern: pattern.clone(),
+            sender: sender.clone(),
+        },
+    );
+    info!("monitor {subscriber_id} subscribed to rooms matching {pattern}");
+
+    let writer = tokio::spawn(async move {
+        while let Some(message) = receiver.recv().await {
+            let frame = match message {
+                OutboundMessage::Json(payload) => match serde_json::to_string(&payload) {
+                    Ok(text) => WsMessage::Text(text.into()),
+                    Err(err) => {
+                        error!("failed to serialize monitor payload: {err}");
+                        continue;
+                    }
+                },
+                OutboundMessage::Ping => WsMessage::Ping(Vec::new().into()),
+                OutboundMessage::Probe(ack) => {
+                    ack.notify_one();
+                    continue;
+                }
+                OutboundMessage::Close => {
+                    let _ = sink.send(WsMessage::Close(None)).await;
+                    break;
+                }
+            };
+            if sink.send(frame).await.is_err() {
+                break;
+            }
+        }
+    });
+
+    let mut ping_interval =
+        tokio::time::interval(Duration::from_millis(WS_SERVER_PING_INTERVAL_MS));
+    ping_interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Skip);
+
+    loop {
+        tokio::select! {
+            result = stream.next() => {
+                match result {
+                    None | Some(Err(_)) | Some(Ok(WsMessage::Close(_))) => break,
+                    Some(Ok(_)) => {}
+                }
+            }
+            _ = ping_interval.tick() => {
+                if sender.send(OutboundMessage::Ping).is_err() {
+                    break;
+                }
+            }
+        }
+    }
+
+    writer.abort();
+    sender.close();
+    context
+        .state
+        .write()
+        .await
+        .subscribers
+        .remove(&subscriber_id);
+    info!("monitor {subscriber_id} unsubscribed");
+}
@@ -0,0 +1,583 @@
+//! 单个连接的有界出站队列与按消息类型的背压策略。
+
+use std::{
+    collections::VecDeque,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc, Mutex, MutexGuard,
+    },
+    time::Duration,
+};
+
+use tokio::{sync::Notify, time::Instant};
+use tracing::debug;
+
+use crate::{
+    app::OutboundMessage,
+    config::{BackpressurePolicy, BackpressureStrategy, OverflowAction},
+    types::SignalMessage,
+};
+
+/// 业务代码持有的发送端；writer 任务持有同一个队列的另一份引用。
+pub(crate) type OutboundSender = Arc<OutboundQueue>;
+
+/// 入队失败的原因。
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum SendError {
+    /// 连接已经结束，不会再有 writer 消费。
+    Closed,
+    /// 队列已满，按背压策略丢弃了本条消息。
+    Dropped,
+}
+
+struct QueueState {
+    items: VecDeque<OutboundMessage>,
+    /// 正在等待空位的 `block` 消息的票号，按到达顺序排列，只有队首可以占用空出来的位置。
+    waiters: VecDeque<u64>,
+    next_ticket: u64,
+    closed: bool,
+    /// 当前容量；开启自适应时在 `[min_capacity, max_capacity]` 之间调整。
+    capacity: usize,
+    /// 上次调整容量后 writer 是否把队列清空过，据此区分突发流量与持续跟不上。
+    drained_since_resize: bool,
+}
+
+/// 一次入队尝试的结果：`Wait` 表示 `block` 消息暂时没有空位，交回调用方决定等待还是丢弃。
+enum Attempt<'a> {
+    Done(Result<(), SendError>),
+    Wait(MutexGuard<'a, QueueState>, OutboundMessage),
+}
+
+/// 有界出站队列：业务消息受容量约束，Ping / Close 等控制帧始终可以入队。
+/// 容量为 0 时不限长度，和早期的无界队列一样从不丢消息。
+pub(crate) struct OutboundQueue {
+    state: Mutex<QueueState>,
+    /// 有新消息时唤醒 writer。
+    readable: Notify,
+    /// writer 取走消息后唤醒等待空位的 `block` 消息。
+    writable: Notify,
+    min_capacity: usize,
+    max_capacity: usize,
+    policy: Arc<BackpressurePolicy>,
+}
+
+impl OutboundQueue {
+    pub(crate) fn new(capacity: usize, policy: Arc<BackpressurePolicy>) -> OutboundSender {
+        let max_capacity = match capacity {
+            0 => usize::MAX,
+            capacity => capacity,
+        };
+        let min_capacity = match policy.adaptive_min_capacity {
+            0 => max_capacity,
+            _ if capacity == 0 => max_capacity,
+            min => min.min(max_capacity),
+        };
+        Arc::new(Self {
+            state: Mutex::new(QueueState {
+                items: VecDeque::new(),
+                waiters: VecDeque::new(),
+                next_ticket: 0,
+                closed: false,
+                capacity: min_capacity,
+                drained_since_resize: false,
+            }),
+            readable: Notify::new(),
+            writable: Notify::new(),
+            min_capacity,
+            max_capacity,
+            policy,
+        })
+    }
+
+    /// 当前的队列容量，供管理接口观察自适应调整的结果；不限容量时返回 `None`。
+    pub(crate) fn capacity(&self) -> Option<usize> {
+        Some(self.lock_state().capacity).filter(|capacity| *capacity != usize::MAX)
+    }
+
+    /// 非阻塞入队；队列满时按消息类型对应的策略处理。
+    /// 同步调用方无法等待，`block` 消息没有空位时同样按溢出处理；转发路径用 [`Self::send_or_wait`]。
+    pub(crate) fn send(self: &Arc<Self>, message: OutboundMessage) -> Result<(), SendError> {
+        let Some(strategy) = self.strategy_of(&message) else {
+            return self.push_unbounded(message);
+        };
+        match self.attempt(self.lock_state(), message, strategy, None) {
+            Attempt::Done(result) => result,
+            Attempt::Wait(state, _) => self.overflow(state),
+        }
+    }
+
+    /// 转发路径的入队：`block` 消息在队列满时按到达顺序排队等待空位，
+    /// 最多等 `block_timeout_ms`，仍然没有空位就按溢出处理并返回 `Dropped`；其他策略与 [`Self::send`] 相同。
+    pub(crate) async fn send_or_wait(
+        self: &Arc<Self>,
+        message: OutboundMessage,
+    ) -> Result<(), SendError> {
+        let Some(strategy) = self.strategy_of(&message) else {
+            return self.push_unbounded(message);
+        };
+        let (ticket, mut message) = match self.attempt(self.lock_state(), message, strategy, None) {
+            Attempt::Done(result) => return result,
+            Attempt::Wait(mut state, message) => {
+                let ticket = state.next_ticket;
+                state.next_ticket += 1;
+                state.waiters.push_back(ticket);
+                (ticket, message)
+            }
+        };
+
+        let deadline = Instant::now() + Duration::from_millis(self.policy.block_timeout_ms);
+        loop {
+            // 先登记唤醒再检查空位，避免 writer 在两者之间取走消息时漏掉通知。
+            let writable = self.writable.notified();
+            tokio::pin!(writable);
+            writable.as_mut().enable();
+            message = match self.attempt(self.lock_state(), message, strategy, Some(ticket)) {
+                Attempt::Done(result) => return result,
+                Attempt::Wait(_, message) => message,
+            };
+            if tokio::time::timeout_at(deadline, writable).await.is_err() {
+                let mut state = self.lock_state();
+                state.waiters.retain(|waiter| *waiter != ticket);
+                // 排在后面的消息可能已经等到空位了。
+                self.writable.notify_waiters();
+                debug!(
+                    "dropping blocked outbound message after {}ms",
+                    self.policy.block_timeout_ms
+                );
+                return self.overflow(state);
+            }
+        }
+    }
+
+    /// 在持锁状态下尝试入队一次。`ticket` 是已在排队等空位的 `block` 消息的票号，
+    /// 还有消息在排队时，新来的消息不能抢先占用空出来的位置。
+    fn attempt<'a>(
+        &'a self,
+        mut state: MutexGuard<'a, QueueState>,
+        message: OutboundMessage,
+        strategy: BackpressureStrategy,
+        ticket: Option<u64>,
+    ) -> Attempt<'a> {
+        if state.closed {
+            if let Some(ticket) = ticket {
+                state.waiters.retain(|waiter| *waiter != ticket);
+            }
+            return Attempt::Done(Err(SendError::Closed));
+        }
+
+        if ticket.is_none() {
+            // 总量超限时先丢低优先级消息：优先挤掉最早排队的非 block 消息，
+            // 其次丢弃新的低优先级消息；全是高优先级时说明客户端已跟不上，直接断开。
+            if self.policy.max_pending > 0
+                && state.items.len() + state.waiters.len() >= self.policy.max_pending
+            {
+                let oldest_low_priority = state.items.iter().position(|queued| {
+                    message_kind(queued).is_some_and(|kind| self.policy.is_low_priority(kind))
+                });
+                match oldest_low_priority {
+                    Some(index) => {
+                        state.items.remove(index);
+                    }
+                    None if strategy != BackpressureStrategy::Block => {
+                        return Attempt::Done(Err(SendError::Dropped));
+                    }
+                    None => {
+                        debug!("closing websocket connection over the pending message limit");
+                        return Attempt::Done(self.disconnect(state));
+                    }
+                }
+            }
+            if state.items.len() >= state.capacity {
+                self.resize_when_full(&mut state);
+            }
+        }
+
+        let turn = match ticket {
+            Some(ticket) => state.waiters.front() == Some(&ticket),
+            None => state.waiters.is_empty(),
+        };
+        if turn && state.items.len() < state.capacity {
+            if ticket.is_some() {
+                state.waiters.pop_front();
+            }
+            state.items.push_back(message);
+            drop(state);
+            self.readable.notify_one();
+            if ticket.is_some() {
+                self.writable.notify_waiters();
+            }
+            return Attempt::Done(Ok(()));
+        }
+
+        match strategy {
+            BackpressureStrategy::DropNewest => Attempt::Done(self.overflow(state)),
+            BackpressureStrategy::DropOldest => {
+                let kind = message_kind(&message).map(str::to_string);
+                let oldest_same_kind = state
+                    .items
+                    .iter()
+                    .position(|queued| message_kind(queued) == kind.as_deref());
+                let Some(index) = oldest_same_kind else {
+                    return Attempt::Done(self.overflow(state));
+                };
+                state.items.remove(index);
+                state.items.push_back(message);
+                Attempt::Done(Ok(()))
+            }
+            BackpressureStrategy::Block => Attempt::Wait(state, message),
+        }
+    }
+
+    /// 取出下一条待发送消息；队列关闭且为空时返回 `None`。
+    pub(crate) async fn recv(&self) -> Option<OutboundMessage> {
+        loop {
+            {
+                let mut state = self.state.lock().unwrap_or_else(|err| err.into_inner());
+                if let Some(message) = state.items.pop_front() {
+                    if state.items.is_empty() {
+                        state.drained_since_resize = true;
+                    }
+                    drop(state);
+                    self.writable.notify_waiters();
+                    return Some(message);
+                }
+                if state.closed {
+                    return None;
+                }
+            }
+            self.readable.notified().await;
+        }
+    }
+
+    /// 不等待地取出队首的业务消息，供 writer 合并下发；队首是控制帧或队列为空时返回 `None`。
+    pub(crate) fn try_recv_json(&self) -> Option<SignalMessage> {
+        let mut state = self.state.lock().unwrap_or_else(|err| err.into_inner());
+        if !matches!(state.items.front(), Some(OutboundMessage::Json(_))) {
+            return None;
+        }
+        let Some(OutboundMessage::Json(message)) = state.items.pop_front() else {
+            return None;
+        };
+        if state.items.is_empty() {
+            state.drained_since_resize = true;
+        }
+        drop(state);
+        self.writable.notify_waiters();
+        Some(message)
+    }
+
+    /// 连接结束后关闭队列，之后的入队都会返回 `Closed`。
+    pub(crate) fn close(&self) {
+        let mut state = self.state.lock().unwrap_or_else(|err| err.into_inner());
+        state.closed = true;
+        state.items.clear();
+        drop(state);
+        self.readable.notify_one();
+        self.writable.notify_waiters();
+    }
+
+    /// 在已排队的消息之后追加 Close 并关闭队列：积压照常写完，之后的入队都返回 `Closed`。
+    pub(crate) fn close_after_pending(&self) {
+        let mut state = self.state.lock().unwrap_or_else(|err| err.into_inner());
+        if state.closed {
+            return;
+        }
+        state.items.push_back(OutboundMessage::Close);
+        state.closed = true;
+        drop(state);
+        self.readable.notify_one();
+    }
+
+    #[cfg(test)]
+    pub(crate) fn is_closed(&self) -> bool {
+        self.state
+            .lock()
+            .unwrap_or_else(|err| err.into_inner())
+            .closed
+    }
+
+    /// 队列写满时调整容量：上次调整后清空过说明只是突发，容量翻倍；
+    /// 一直没清空说明客户端持续跟不上，容量减半，少占内存也更早触发背压。
+    fn resize_when_full(&self, state: &mut QueueState) {
+        if self.min_capacity == self.max_capacity {
+            return;
+        }
+        let resized = if state.drained_since_resize {
+            (state.capacity * 2).min(self.max_capacity)
+        } else {
+            (state.capacity / 2).max(self.min_capacity)
+        };
+        if resized != state.capacity {
+            debug!(
+                "resizing outbound queue from {} to {resized} messages",
+                state.capacity
+            );
+            state.capacity = resized;
+        }
+        state.drained_since_resize = false;
+    }
+
+    /// 消息被丢弃时按 `overflow_action` 决定是否顺带断开连接。
+    fn overflow(&self, state: MutexGuard<'_, QueueState>) -> Result<(), SendError> {
+        if self.policy.overflow_action == OverflowAction::Close {
+            debug!("closing slow websocket connection after outbound queue overflow");
+            return self.disconnect(state);
+        }
+        Err(SendError::Dropped)
+    }
+
+    /// 清掉积压，只留下 Close，writer 发完就退出。
+    fn disconnect(&self, mut state: MutexGuard<'_, QueueState>) -> Result<(), SendError> {
+        if !state.closed {
+            state.items.clear();
+            state.items.push_back(OutboundMessage::Close);
+            state.closed = true;
+            drop(state);
+            self.readable.notify_one();
+            self.writable.notify_waiters();
+        }
+        Err(SendError::Dropped)
+    }
+
+    fn lock_state(&self) -> MutexGuard<'_, QueueState> {
+        self.state.lock().unwrap_or_else(|err| err.into_inner())
+    }
+
+    /// 业务消息按类型取背压策略；控制帧返回 `None`，不受容量约束。
+    fn strategy_of(&self, message: &OutboundMessage) -> Option<BackpressureStrategy> {
+        message_kind(message).map(|kind| self.policy.strategy_for(kind))
+    }
+
+    fn push_unbounded(&self, message: OutboundMessage) -> Result<(), SendError> {
+        let mut state = self.state.lock().unwrap_or_else(|err| err.into_inner());
+        if state.closed {
+            return Err(SendError::Closed);
+        }
+        state.items.push_back(message);
+        drop(state);
+        self.readable.notify_one();
+        Ok(())
+    }
+}
+
+/// 随转发副本一起排队的计数凭证：入队时给发送方的在途计数加一，
+/// 副本被写出、丢弃或随队列清空而释放时减一。
+#[derive(Debug)]
+pub(crate) struct InFlightToken(Arc<AtomicUsize>);
+
+impl InFlightToken {
+    pub(crate) fn acquire(counter: &Arc<AtomicUsize>) -> Self {
+        counter.fetch_add(1, Ordering::Relaxed);
+        Self(counter.clone())
+    }
+}
+
+impl Clone for InFlightToken {
+    fn clone(&self) -> Self {
+        Self::acquire(&self.0)
+    }
+}
+
+impl Drop for InFlightToken {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+fn message_kind(message: &OutboundMessage) -> Option<&str> {
+    match message {
+        OutboundMessage::Json(payload) => Some(payload.kind.as_str()),
+        OutboundMessage::Ping | OutboundMessage::Close | OutboundMessage::Probe(_) => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::HashMap;
+
+    use super::*;
+
+    fn policy(
+        default_strategy: BackpressureStrategy,
+        block_timeout_ms: u64,
+    ) -> Arc<BackpressurePolicy> {
+        Arc::new(BackpressurePolicy {
+            default_strategy,
+            per_type: HashMap::new(),
+            block_timeout_ms,
+            overflow_action: OverflowAction::Skip,
+            max_pending: 0,
+            adaptive_min_capacity: 0,
+        })
+    }
+
+    fn message(kind: &str, index: u64) -> OutboundMessage {
+        OutboundMessage::Json(SignalMessage {
+            kind: kind.to_string(),
+            payload: serde_json::json!(index),
+            ..Default::default()
+        })
+    }
+
+    /// 依次取出已排队的业务消息的 payload。
+    fn drain(queue: &OutboundQueue) -> Vec<u64> {
+        std::iter::from_fn(|| queue.try_recv_json())
+            .filter_map(|message| message.payload.as_u64())
+            .collect()
+    }
+
+    #[test]
+    fn zero_capacity_never_drops() {
+        let queue = OutboundQueue::new(0, policy(BackpressureStrategy::DropNewest, 0));
+        for index in 0..1000 {
+            assert_eq!(queue.send(message("typing", index)), Ok(()));
+        }
+        assert_eq!(drain(&queue).len(), 1000);
+        assert_eq!(queue.capacity(), None);
+    }
+
+    #[test]
+    fn drop_newest_rejects_messages_once_full() {
+        let queue = OutboundQueue::new(2, policy(BackpressureStrategy::DropNewest, 0));
+        assert_eq!(queue.send(message("typing", 1)), Ok(()));
+        assert_eq!(queue.send(message("typing", 2)), Ok(()));
+        assert_eq!(queue.send(message("typing", 3)), Err(SendError::Dropped));
+        assert_eq!(drain(&queue), [1, 2]);
+    }
+
+    #[test]
+    fn drop_oldest_replaces_the_oldest_message_of_the_same_type() {
+        let queue = OutboundQueue::new(2, policy(BackpressureStrategy::DropOldest, 0));
+        assert_eq!(queue.send(message("chat", 1)), Ok(()));
+        assert_eq!(queue.send(message("chat", 2)), Ok(()));
+        assert_eq!(queue.send(message("chat", 3)), Ok(()));
+        assert_eq!(drain(&queue), [2, 3]);
+    }
+
+    #[tokio::test]
+    async fn blocked_messages_enter_the_queue_in_arrival_order() {
+        let queue = OutboundQueue::new(1, policy(BackpressureStrategy::Block, 1_000));
+        assert_eq!(queue.send_or_wait(message("offer", 1)).await, Ok(()));
+        let mut waiters = Vec::new();
+        for index in 2..=4 {
+            let queue = queue.clone();
+            waiters.push(tokio::spawn(async move {
+                queue.send_or_wait(message("offer", index)).await
+            }));
+            // 让前一个等待者先拿到票号。
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+
+        let mut received = Vec::new();
+        while received.len() < 4 {
+            if let Some(OutboundMessage::Json(message)) = queue.recv().await {
+                received.extend(message.payload.as_u64());
+            }
+        }
+        assert_eq!(received, [1, 2, 3, 4]);
+        for waiter in waiters {
+            assert_eq!(waiter.await.unwrap(), Ok(()));
+        }
+    }
+
+    #[tokio::test]
+    async fn blocked_message_is_dropped_and_reported_after_the_timeout() {
+        let queue = OutboundQueue::new(1, policy(BackpressureStrategy::Block, 20));
+        assert_eq!(queue.send_or_wait(message("offer", 1)).await, Ok(()));
+
+        let started = Instant::now();
+        assert_eq!(
+            queue.send_or_wait(message("offer", 2)).await,
+            Err(SendError::Dropped)
+        );
+        assert!(started.elapsed() >= Duration::from_millis(20));
+        // 同步入队不会等待，写满时直接报告丢弃。
+        assert_eq!(queue.send(message("offer", 3)), Err(SendError::Dropped));
+        assert_eq!(drain(&queue), [1]);
+    }
+
+    #[test]
+    fn skip_overflow_keeps_the_connection_and_delivers_later_messages() {
+        let queue = OutboundQueue::new(1, policy(BackpressureStrategy::DropNewest, 0));
+        assert_eq!(queue.send(message("typing", 1)), Ok(()));
+        assert_eq!(queue.send(message("typing", 2)), Err(SendError::Dropped));
+        assert!(!queue.is_closed());
+
+        // 客户端跟上之后，后续消息照常入队。
+        assert_eq!(drain(&queue), [1]);
+        assert_eq!(queue.send(message("typing", 3)), Ok(()));
+        assert_eq!(drain(&queue), [3]);
+    }
+
+    #[test]
+    fn close_overflow_disconnects_the_client() {
+        let mut close = (*policy(BackpressureStrategy::DropNewest, 0)).clone();
+        close.overflow_action = OverflowAction::Close;
+        let queue = OutboundQueue::new(1, Arc::new(close));
+        assert_eq!(queue.send(message("typing", 1)), Ok(()));
+        assert_eq!(queue.send(message("typing", 2)), Err(SendError::Dropped));
+
+        assert!(queue.is_closed());
+        assert_eq!(queue.send(message("typing", 3)), Err(SendError::Closed));
+        assert!(drain(&queue).is_empty());
+    }
+
+    #[test]
+    fn pending_limit_sheds_low_priority_messages_before_disconnecting() {
+        let mut limited = (*policy(BackpressureStrategy::DropNewest, 0)).clone();
+        limited
+            .per_type
+            .insert("offer".to_string(), BackpressureStrategy::Block);
+        limited.max_pending = 3;
+        let queue = OutboundQueue::new(0, Arc::new(limited));
+
+        assert_eq!(queue.send(message("typing", 1)), Ok(()));
+        assert_eq!(queue.send(message("offer", 2)), Ok(()));
+        assert_eq!(queue.send(message("offer", 3)), Ok(()));
+        // 超出总量时先挤掉最早的低优先级消息，连接保持。
+        assert_eq!(queue.send(message("offer", 4)), Ok(()));
+        assert!(!queue.is_closed());
+        assert_eq!(drain(&queue), [2, 3, 4]);
+
+        for index in 5..=7 {
+            assert_eq!(queue.send(message("offer", index)), Ok(()));
+        }
+        // 新来的低优先级消息在没有可挤掉的消息时被丢弃。
+        assert_eq!(queue.send(message("typing", 8)), Err(SendError::Dropped));
+        assert!(!queue.is_closed());
+        // 全是高优先级消息仍然超限时才断开。
+        assert_eq!(queue.send(message("offer", 9)), Err(SendError::Dropped));
+        assert!(queue.is_closed());
+    }
+
+    fn adaptive_queue() -> OutboundSender {
+        let mut adaptive = (*policy(BackpressureStrategy::DropNewest, 0)).clone();
+        adaptive.adaptive_min_capacity = 4;
+        OutboundQueue::new(32, Arc::new(adaptive))
+    }
+
+    #[test]
+    fn adaptive_capacity_grows_for_a_client_that_keeps_draining() {
+        let queue = adaptive_queue();
+        assert_eq!(queue.capacity(), Some(4));
+        // 每轮突发刚好比当前容量多一条，随后客户端把队列读空。
+        for _ in 0..4 {
+            let capacity = queue.capacity().expect("bounded queue");
+            for index in 0..=capacity as u64 {
+                let _ = queue.send(message("typing", index));
+            }
+            drain(&queue);
+        }
+        assert_eq!(queue.capacity(), Some(32));
+    }
+
+    #[test]
+    fn adaptive_capacity_stays_at_the_minimum_for_a_slow_client() {
+        let queue = adaptive_queue();
+        for index in 0..100 {
+            let _ = queue.send(message("typing", index));
+        }
+        assert_eq!(queue.capacity(), Some(4));
+        assert_eq!(drain(&queue).len(), 4);
+    }
+}
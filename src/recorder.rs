@@ -0,0 +1,164 @@
+//! 录制旁路：把指定房间转发的信令复制一份，异步投递给外部录制服务的 webhook。
+
+use std::{sync::Arc, time::Duration};
+
+use serde_json::Value;
+use tokio::sync::mpsc;
+use tracing::warn;
+
+use crate::{
+    app::AppContext,
+    config::AppConfig,
+    monitor::room_matches,
+    types::SignalMessage,
+    utils::{now_ms, take_rate_limited_log_count, RateLimitedLogState},
+};
+
+const RECORDER_RETRY_BASE_MS: u64 = 500;
+const RECORDER_DROP_WARN_INTERVAL_MS: u64 = 30_000;
+static RECORDER_DROP_WARN_STATE: RateLimitedLogState = RateLimitedLogState::new();
+
+/// 一条待投递的录制记录。
+pub(crate) struct Recording {
+    room_id: String,
+    at: u64,
+    message: SignalMessage,
+}
+
+/// 配置了 `RECORDER_URL` 时创建录制队列：发送端挂在 `AppContext` 上，接收端交给 [`run_recorder`]。
+pub(crate) fn recorder_queue(
+    config: &AppConfig,
+) -> Option<(mpsc::Sender<Recording>, mpsc::Receiver<Recording>)> {
+    config.recorder_url.as_ref()?;
+    Some(mpsc::channel(config.recorder_queue_capacity.max(1)))
+}
+
+/// 端到端加密的 payload 对服务端不透明，交给录制方也没有意义，一律不录。
+fn is_e2e_opaque(message: &SignalMessage) -> bool {
+    message.kind == "relay_data"
+        || message.payload.get("e2e").and_then(Value::as_bool) == Some(true)
+}
+
+/// 按配置决定是否录制这条消息，并以非阻塞方式入队；队列满时直接丢弃，不拖慢转发。
+pub(crate) fn tap_message(context: &AppContext, room_id: &str, message: &SignalMessage) {
+    let Some(queue) = context.recorder.as_ref() else {
+        return;
+    };
+    let config = &context.config;
+    if !config
+        .recorder_rooms
+        .iter()
+        .any(|pattern| room_matches(pattern, room_id))
+    {
+        return;
+    }
+    if is_e2e_opaque(message) || (message.kind == "chat" && !config.recorder_include_chat) {
+        return;
+    }
+
+    let recording = Recording {
+        room_id: room_id.to_string(),
+        at: now_ms(),
+        message: message.clone(),
+    };
+    if queue.try_send(recording).is_err() {
+        if let Some(suppressed) =
+            take_rate_limited_log_count(&RECORDER_DROP_WARN_STATE, RECORDER_DROP_WARN_INTERVAL_MS)
+        {
+            warn!(
+                suppressed,
+                "recorder queue is full; dropping recordings until the recorder catches up"
+            );
+        }
+    }
+}
+
+/// 后台任务：逐条 POST 给录制服务，失败时按指数退避重试，重试用完后放弃该条。
+pub(crate) async fn run_recorder(
+    context: Arc<AppContext>,
+    mut receiver: mpsc::Receiver<Recording>,
+) {
+    let Some(url) = context.config.recorder_url.clone() else {
+        return;
+    };
+
+    while let Some(recording) = receiver.recv().await {
+        let body = serde_json::json!({
+            "roomId": recording.room_id,
+            "at": recording.at,
+            "message": recording.message,
+        });
+        for attempt in 0..=context.config.recorder_retry_attempts {
+            if attempt > 0 {
+                let backoff_ms = RECORDER_RETRY_BASE_MS << (attempt - 1).min(6);
+                tokio::time::sleep(Duration::from_millis(backoff_ms)).await;
+            }
+            match context.http_client.post(&url).json(&body).send().await {
+                Ok(response) if response.status().is_success() => break,
+                Ok(response) => warn!(
+                    "recorder returned {} for room {}",
+                    response.status(),
+                    recording.room_id
+                ),
+                Err(err) => warn!("recorder request failed: {err}"),
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        app::test_context,
+        ws::{join_for_tests, route_for_tests},
+    };
+
+    fn signal(value: Value) -> SignalMessage {
+        serde_json::from_value(value).expect("signal message")
+    }
+
+    #[tokio::test]
+    async fn recorder_receives_taps_without_blocking_relay() {
+        let mut config = AppConfig::for_tests();
+        config.recorder_url = Some("http://recorder.invalid/ingest".to_string());
+        config.recorder_rooms = vec!["studio-*".to_string()];
+        config.recorder_queue_capacity = 2;
+        let mut context = test_context(config);
+        // 这里不启动 `run_recorder`，由测试充当一个从不读取的录制服务。
+        let (sender, mut recordings) =
+            recorder_queue(&context.config).expect("the recorder is configured");
+        Arc::get_mut(&mut context)
+            .expect("the context is not shared yet")
+            .recorder = Some(sender);
+        let (alice_id, _) = join_for_tests(&context, "alice", "studio-1").await;
+        let (_, bob_queue) = join_for_tests(&context, "bob", "studio-1").await;
+        while bob_queue.try_recv_json().is_some() {}
+
+        let messages = [
+            signal(serde_json::json!({ "type": "relay_data", "to": "bob", "payload": "opaque" })),
+            signal(serde_json::json!({ "type": "offer", "to": "bob", "id": "o1" })),
+            signal(serde_json::json!({ "type": "candidate", "to": "bob", "id": "c1" })),
+            signal(serde_json::json!({ "type": "candidate", "to": "bob", "id": "c2" })),
+        ];
+        for message in messages {
+            route_for_tests(&context, alice_id, message).await;
+        }
+
+        // 录制队列写满后照常转发，多出来的记录被丢弃。
+        let relayed: Vec<_> = std::iter::from_fn(|| bob_queue.try_recv_json())
+            .map(|message| message.kind)
+            .collect();
+        assert_eq!(relayed, ["relay_data", "offer", "candidate", "candidate"]);
+        let recorded: Vec<_> = std::iter::from_fn(|| recordings.try_recv().ok())
+            .map(|recording| (recording.room_id, recording.message.id))
+            .collect();
+        assert_eq!(
+            recorded,
+            [
+                ("studio-1".to_string(), Some("o1".to_string())),
+                ("studio-1".to_string(), Some("c1".to_string())),
+            ]
+        );
+    }
+}
@@ -0,0 +1,189 @@
+//! 按关联链排序：同一发送方、同一 `correlationId` 下带 `seq` 的消息按序号依次转发。
+
+use std::collections::{BTreeMap, HashMap};
+
+use crate::types::SignalMessage;
+
+/// 单个连接同时跟踪的关联链数，超出后新链的消息不再排序、直接放行。
+const MAX_CHAINS_PER_CONNECTION: usize = 256;
+/// 没有积压的链闲置超过该时长（毫秒）后丢弃，之后同名的链从 0 重新开始。
+const CHAIN_IDLE_MS: u64 = 60_000;
+
+/// 一条关联链的进度。
+struct Chain {
+    /// 下一条应当转发的序号，从 0 开始。
+    next_seq: u64,
+    /// 序号超前、暂不能转发的消息。
+    pending: BTreeMap<u64, SignalMessage>,
+    /// 最近一次有进展的时间；积压超过超时后整体放行。
+    progressed_at: u64,
+}
+
+/// 一个发送方连接的重排缓冲，只在该连接的读循环里使用。
+pub(crate) struct ReorderBuffer {
+    max_pending: usize,
+    timeout_ms: u64,
+    chains: HashMap<String, Chain>,
+}
+
+impl ReorderBuffer {
+    pub(crate) fn new(max_pending: usize, timeout_ms: u64) -> Self {
+        Self {
+            max_pending,
+            timeout_ms,
+            chains: HashMap::new(),
+        }
+    }
+
+    /// 收下一条消息，返回现在可以按序转发的消息；没有 `correlationId` 或 `seq` 的消息原样返回。
+    /// 积压超过上限时整条链立即放行，跳过的位置在恢复处的消息上用 `seqGap` 标出。
+    pub(crate) fn accept(&mut self, mut message: SignalMessage, now: u64) -> Vec<SignalMessage> {
+        // `seqGap` 只能由服务端标注。
+        message.seq_gap = None;
+        let (Some(correlation_id), Some(seq)) = (message.correlation_id.clone(), message.seq)
+        else {
+            return vec![message];
+        };
+        if !self.chains.contains_key(&correlation_id)
+            && self.chains.len() >= MAX_CHAINS_PER_CONNECTION
+        {
+            return vec![message];
+        }
+
+        let chain = self.chains.entry(correlation_id).or_insert_with(|| Chain {
+            next_seq: 0,
+            pending: BTreeMap::new(),
+            progressed_at: now,
+        });
+        // 已经放行过的序号（重发或跳过后才到达）不再等待，直接转发。
+        if seq < chain.next_seq {
+            return vec![message];
+        }
+        if seq > chain.next_seq {
+            chain.pending.insert(seq, message);
+            if chain.pending.len() > self.max_pending {
+                return release_all(chain, now);
+            }
+            return Vec::new();
+        }
+
+        chain.next_seq = seq + 1;
+        chain.progressed_at = now;
+        let mut ready = vec![message];
+        while let Some(next) = chain.pending.remove(&chain.next_seq) {
+            chain.next_seq += 1;
+            ready.push(next);
+        }
+        ready
+    }
+
+    /// 定时调用：放行积压超时的链，并清理闲置的空链。
+    pub(crate) fn flush_expired(&mut self, now: u64) -> Vec<SignalMessage> {
+        let timeout_ms = self.timeout_ms;
+        let mut ready = Vec::new();
+        for chain in self.chains.values_mut() {
+            if !chain.pending.is_empty() && now.saturating_sub(chain.progressed_at) >= timeout_ms {
+                ready.extend(release_all(chain, now));
+            }
+        }
+        self.chains.retain(|_, chain| {
+            !chain.pending.is_empty() || now.saturating_sub(chain.progressed_at) < CHAIN_IDLE_MS
+        });
+        ready
+    }
+}
+
+/// 按序号放行链上的全部积压；与上一条不连续的消息带上 `seqGap`，值为缺失的第一个序号。
+fn release_all(chain: &mut Chain, now: u64) -> Vec<SignalMessage> {
+    let pending = std::mem::take(&mut chain.pending);
+    let mut ready = Vec::with_capacity(pending.len());
+    for (seq, mut message) in pending {
+        if seq != chain.next_seq {
+            message.seq_gap = Some(chain.next_seq);
+        }
+        chain.next_seq = seq + 1;
+        ready.push(message);
+    }
+    chain.progressed_at = now;
+    ready
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chained(correlation_id: &str, seq: u64) -> SignalMessage {
+        SignalMessage {
+            kind: "candidate".to_string(),
+            correlation_id: Some(correlation_id.to_string()),
+            seq: Some(seq),
+            ..Default::default()
+        }
+    }
+
+    fn seqs(messages: &[SignalMessage]) -> Vec<u64> {
+        messages.iter().filter_map(|message| message.seq).collect()
+    }
+
+    #[test]
+    fn out_of_order_chain_is_delivered_in_order_while_unrelated_messages_pass() {
+        let mut buffer = ReorderBuffer::new(8, 1_000);
+
+        assert!(buffer.accept(chained("call", 2), 0).is_empty());
+        assert!(buffer.accept(chained("call", 1), 0).is_empty());
+        // 没有关联链的消息和另一条链上按序到达的消息都不用等。
+        let unrelated = buffer.accept(
+            SignalMessage {
+                kind: "chat".to_string(),
+                ..Default::default()
+            },
+            0,
+        );
+        assert_eq!(unrelated.len(), 1);
+        assert_eq!(unrelated[0].kind, "chat");
+        assert_eq!(seqs(&buffer.accept(chained("other", 0), 0)), [0]);
+
+        let ready = buffer.accept(chained("call", 0), 0);
+        assert_eq!(seqs(&ready), [0, 1, 2]);
+        assert!(ready.iter().all(|message| message.seq_gap.is_none()));
+    }
+
+    #[test]
+    fn overflowing_the_buffer_flushes_the_chain_with_a_gap_marker() {
+        let mut buffer = ReorderBuffer::new(2, 1_000);
+        assert_eq!(seqs(&buffer.accept(chained("call", 0), 0)), [0]);
+
+        // 序号 1 一直没到，积压到第三条时整条链放行。
+        assert!(buffer.accept(chained("call", 2), 0).is_empty());
+        assert!(buffer.accept(chained("call", 3), 0).is_empty());
+        let ready = buffer.accept(chained("call", 4), 0);
+        assert_eq!(seqs(&ready), [2, 3, 4]);
+        assert_eq!(ready[0].seq_gap, Some(1));
+        assert!(ready[1..].iter().all(|message| message.seq_gap.is_none()));
+
+        // 迟到的 1 已被跳过，直接放行，后续序号照常。
+        assert_eq!(seqs(&buffer.accept(chained("call", 1), 0)), [1]);
+        assert_eq!(seqs(&buffer.accept(chained("call", 5), 0)), [5]);
+    }
+
+    #[test]
+    fn stalled_chain_is_released_after_the_timeout() {
+        let mut buffer = ReorderBuffer::new(8, 1_000);
+        assert!(buffer.accept(chained("call", 1), 0).is_empty());
+
+        assert!(buffer.flush_expired(999).is_empty());
+        let ready = buffer.flush_expired(1_000);
+        assert_eq!(seqs(&ready), [1]);
+        assert_eq!(ready[0].seq_gap, Some(0));
+    }
+
+    #[test]
+    fn client_supplied_seq_gap_is_cleared() {
+        let mut buffer = ReorderBuffer::new(8, 1_000);
+        let forged = SignalMessage {
+            seq_gap: Some(7),
+            ..chained("call", 0)
+        };
+        assert_eq!(buffer.accept(forged, 0)[0].seq_gap, None);
+    }
+}
@@ -1,64 +1,382 @@
 //! HTTP 路由装配与轻量接口处理。
 
-use std::sync::Arc;
+use std::{
+    sync::{atomic::Ordering, Arc},
+    time::Duration,
+};
 
 use axum::{
-    extract::State,
+    extract::{Path, Query, State},
     http::{
         header::{self},
         HeaderMap, HeaderValue, StatusCode,
     },
+    middleware,
     response::{IntoResponse, Response},
-    routing::get,
+    routing::{any, get, post},
     Json, Router,
 };
-use serde_json::Value;
-use tracing::error;
+use futures_util::future::join_all;
+use tokio::sync::Notify;
+use tracing::{error, warn};
 
 use crate::{
-    app::AppContext,
+    access_log::log_access,
+    admin::{admin_routes, debug_routes},
+    api_error::{render_error_body, ApiError},
+    app::{AppContext, AppState, OutboundMessage},
+    config::AppConfig,
     ice::build_ice_config,
-    session::{build_session_cookie, existing_or_new_session},
+    session::{
+        build_session_cookie, existing_or_new_session, issue_room_pass, parse_session_cookie,
+        room_password_matches, room_pseudonym, verify_room_pass,
+    },
     static_files::static_handler,
-    types::{IceConfigResponse, RoomInfo, SessionResponse},
-    utils::request_is_secure,
-    ws::ws_handler,
+    types::{
+        HistoryParams, IceConfigResponse, RoomHistoryResponse, RoomInfo, RoomListResponse,
+        RoomPassResponse, RoomPasswordRequest, SessionResponse, TenantParams,
+    },
+    utils::{now_ms, request_is_secure, tenant_room_key},
+    ws::{ws_handler, ws_tenant_handler},
 };
 
-/// 统一创建 Axum 路由树。
+/// 同一房间在窗口期内允许的密码校验失败次数，超出后暂时拒绝继续尝试。
+const ROOM_PASSWORD_MAX_FAILURES: usize = 5;
+const ROOM_PASSWORD_FAILURE_WINDOW_MS: u64 = 60_000;
+
+/// 统一创建 Axum 路由树：信令、前端页面、API 与管理面共用一个端口。
 pub(crate) fn build_router(context: Arc<AppContext>) -> Router {
+    let router = public_routes()
+        .merge(client_api_routes())
+        .merge(management_routes(&context.config));
+    finish_router(router, context)
+}
+
+/// 分端口部署时的两棵路由树：公开端口保留 `/ws`、前端页面和页面依赖的 `/api/*`，
+/// `/admin/*`、`/debug/*` 只挂在内部端口上，便于用防火墙隔离。
+pub(crate) fn build_split_routers(context: Arc<AppContext>) -> (Router, Router) {
+    let public = finish_router(public_routes().merge(client_api_routes()), context.clone());
+    let internal = finish_router(
+        Router::new()
+            .route("/healthz", get(healthz))
+            .route("/readyz", get(readyz))
+            .merge(management_routes(&context.config)),
+        context,
+    );
+    (public, internal)
+}
+
+/// 信令与前端静态资源。
+fn public_routes() -> Router<Arc<AppContext>> {
     Router::new()
         .route("/healthz", get(healthz))
+        .route("/readyz", get(readyz))
+        .route("/ws", get(ws_handler))
+        .route("/ws/{tenant}", get(ws_tenant_handler))
+        .fallback(get(static_handler))
+}
+
+/// 前端页面直接调用的 HTTP API：建连所需的会话 Cookie 只能从 `/api/session` 拿到，必须和 `/ws` 同端口。
+/// 未登记的 `/api/*` 返回 JSON 404，不落到前端页面的兜底路由。
+fn client_api_routes() -> Router<Arc<AppContext>> {
+    Router::new()
         .route("/api/rooms", get(list_rooms))
+        .route("/api/rooms/{id}/history", get(get_room_history))
+        .route("/api/rooms/{id}/verify", post(verify_room_password))
         .route("/api/session", get(get_session))
         .route("/api/ice", get(get_ice_config))
-        .route("/ws", get(ws_handler))
-        .fallback(get(static_handler))
+        .route("/api/{*rest}", any(api_not_found))
+}
+
+/// 按配置挂载的管理与诊断接口。
+fn management_routes(config: &AppConfig) -> Router<Arc<AppContext>> {
+    let mut router = Router::new();
+    if config.admin_endpoints_enabled() {
+        router = router.merge(admin_routes());
+    }
+    if config.debug_endpoints_enabled() {
+        router = router.merge(debug_routes());
+    }
+    router
+}
+
+async fn api_not_found() -> ApiError {
+    ApiError::new(StatusCode::NOT_FOUND, "not_found")
+}
+
+fn finish_router(router: Router<Arc<AppContext>>, context: Arc<AppContext>) -> Router {
+    let access_log = context.config.access_log;
+    let error_body_format = context.config.error_body_format;
+    let router = router
         .with_state(context)
+        .layer(middleware::from_fn_with_state(
+            error_body_format,
+            render_error_body,
+        ));
+
+    if access_log {
+        router.layer(middleware::from_fn(log_access))
+    } else {
+        router
+    }
+}
+
+/// 维护模式下的统一 503 响应，提示客户端稍后重试。
+pub(crate) fn maintenance_response(config: &AppConfig) -> Response {
+    let mut response =
+        ApiError::new(StatusCode::SERVICE_UNAVAILABLE, "maintenance").into_response();
+    response.headers_mut().insert(
+        header::RETRY_AFTER,
+        HeaderValue::from(config.maintenance_retry_after_seconds),
+    );
+    response
+}
+
+/// 重连过于频繁的身份在冷却期内收到 429，`Retry-After` 向上取整到秒。
+pub(crate) fn reconnect_limited_response(retry_after_ms: u64) -> Response {
+    let mut response = ApiError::new(StatusCode::TOO_MANY_REQUESTS, "reconnect_limited")
+        .with_detail("retryAfterMs", retry_after_ms)
+        .into_response();
+    response.headers_mut().insert(
+        header::RETRY_AFTER,
+        HeaderValue::from(retry_after_ms.div_ceil(1000)),
+    );
+    response
 }
 
-/// 健康检查接口，便于反向代理或容器探针使用。
-async fn healthz() -> impl IntoResponse {
-    Json(serde_json::json!({ "status": "ok" }))
+/// 健康检查接口，便于反向代理或容器探针使用：附带房间数、在线连接数与运行时长。
+/// 探针可能每秒都来，这里只尝试一次读锁；状态锁正忙（例如大房间广播）时仍返回 200，只是不带计数。
+async fn healthz(State(context): State<Arc<AppContext>>) -> impl IntoResponse {
+    let mut body = serde_json::json!({
+        "status": "ok",
+        "uptimeMs": context.started_at.elapsed().as_millis() as u64,
+    });
+    if let Ok(state) = context.state.try_read() {
+        body["rooms"] = state.rooms.len().into();
+        body["clients"] = state.connections.len().into();
+    }
+    Json(body)
+}
+
+/// 就绪检查：共享状态锁要能及时拿到，抽查的房间里各有一个连接的 writer 要在超时内处理完哨兵。
+/// 哨兵排在已积压的消息之后，卡在写 socket 上或已意外退出的 writer 都会让结果变成 `degraded`。
+async fn readyz(State(context): State<Arc<AppContext>>) -> Response {
+    let timeout = Duration::from_millis(context.config.readiness_probe_timeout_ms);
+    let Ok(state) = tokio::time::timeout(timeout, context.state.read()).await else {
+        return ApiError::new(StatusCode::SERVICE_UNAVAILABLE, "degraded")
+            .with_detail("stateLock", "timeout")
+            .into_response();
+    };
+    let probes = state
+        .rooms
+        .values()
+        .filter_map(|room| {
+            let connection_id = room.clients.values().next()?;
+            let connection = state.connections.get(connection_id)?;
+            Some((room.id.clone(), connection.sender.clone()))
+        })
+        .take(context.config.readiness_probe_rooms)
+        .collect::<Vec<_>>();
+    drop(state);
+
+    let probed = probes.len();
+    let stalled = join_all(probes.into_iter().map(|(room_id, sender)| async move {
+        let ack = Arc::new(Notify::new());
+        // 入队失败说明连接恰好在关闭，不算卡住。
+        let acknowledged = sender.send(OutboundMessage::Probe(ack.clone())).is_err()
+            || tokio::time::timeout(timeout, ack.notified()).await.is_ok();
+        (!acknowledged).then_some(room_id)
+    }))
+    .await
+    .into_iter()
+    .flatten()
+    .collect::<Vec<_>>();
+
+    if !stalled.is_empty() {
+        warn!("readiness probe found stalled writers in rooms {stalled:?}");
+        return ApiError::new(StatusCode::SERVICE_UNAVAILABLE, "degraded")
+            .with_detail("probedRooms", probed)
+            .with_detail("stalledRooms", stalled)
+            .into_response();
+    }
+    Json(serde_json::json!({ "status": "ok", "probedRooms": probed })).into_response()
 }
 
-/// 返回当前所有公开房间的简要信息。
-async fn list_rooms(State(context): State<Arc<AppContext>>) -> impl IntoResponse {
+/// 返回当前所有公开房间的简要信息；多租户模式下只列出该租户的房间。
+async fn list_rooms(
+    State(context): State<Arc<AppContext>>,
+    Query(params): Query<TenantParams>,
+) -> Response {
+    if context.config.maintenance_blocks_room_list && context.maintenance.load(Ordering::Relaxed) {
+        return maintenance_response(&context.config);
+    }
+
+    let tenant = match context.config.resolve_tenant(params.tenant.as_deref()) {
+        Ok(tenant) => tenant,
+        Err(code) => return ApiError::new(StatusCode::BAD_REQUEST, code).into_response(),
+    };
     let state = context.state.read().await;
-    let mut rooms = state
+    Json(public_room_list(&context.config, &state, tenant.as_deref())).into_response()
+}
+
+/// 按租户筛选公开房间并按名称排序，超出列表上限的部分只计入总数。
+fn public_room_list(
+    config: &AppConfig,
+    state: &AppState,
+    tenant: Option<&str>,
+) -> RoomListResponse {
+    let tenant_prefix = tenant.map(|tenant| format!("{tenant}/"));
+    let mut public_rooms = state
         .rooms
         .values()
-        .filter(|room| !room.is_private)
-        .map(|room| RoomInfo {
-            id: room.id.clone(),
+        .filter(|room| !room.is_private && !room.awaiting_second_member)
+        .filter_map(|room| match &tenant_prefix {
+            // 列表里只返回租户内的房间名，客户端拿它直接建连即可。
+            Some(prefix) => room
+                .id
+                .strip_prefix(prefix.as_str())
+                .map(|name| (name, room)),
+            None => Some((room.id.as_str(), room)),
+        })
+        .collect::<Vec<_>>();
+    public_rooms.sort_by(|(left, _), (right, _)| left.cmp(right));
+
+    // 只为实际返回的房间构造成员列表，房间很多时避免一次请求放大内存和 CPU。
+    let list_max = match (&tenant_prefix, config.tenant_room_list_max) {
+        (Some(_), max) if max > 0 => max,
+        _ => config.room_list_max,
+    };
+    let total = public_rooms.len();
+    let limit = match list_max {
+        0 => total,
+        max => max.min(total),
+    };
+    let now = now_ms();
+    let rooms = public_rooms
+        .into_iter()
+        .take(limit)
+        .map(|(name, room)| RoomInfo {
+            id: name.to_string(),
             client_count: room.clients.len(),
             clients: room.clients.keys().cloned().collect(),
             created_at: room.created_at_ms,
             is_private: room.is_private,
+            activity: config
+                .room_activity_summary
+                .then(|| room.activity.summary(now)),
         })
         .collect::<Vec<_>>();
-    rooms.sort_by(|left, right| left.id.cmp(&right.id));
-    Json(rooms)
+
+    RoomListResponse {
+        rooms,
+        truncated: limit < total,
+        total,
+    }
+}
+
+/// 返回房间缓存的最近聊天记录；私密房间与设了密码的房间只对当前成员，或带着有效 `room_pass` 的会话开放。
+async fn get_room_history(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    Query(params): Query<HistoryParams>,
+    headers: HeaderMap,
+) -> Result<Json<RoomHistoryResponse>, ApiError> {
+    let tenant = context
+        .config
+        .resolve_tenant(params.tenant.as_deref())
+        .map_err(|code| ApiError::new(StatusCode::BAD_REQUEST, code))?;
+    let room_id = tenant_room_key(tenant.as_deref(), &room_id);
+
+    let state = context.state.read().await;
+    let room_id = state.room_aliases.get(&room_id).cloned().unwrap_or(room_id);
+    let Some(room) = state.rooms.get(&room_id) else {
+        return Err(ApiError::new(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+
+    if room.is_private || room.password_hash.is_some() {
+        let Some(session) = parse_session_cookie(&context.config, &headers) else {
+            return Err(ApiError::new(StatusCode::UNAUTHORIZED, "unauthorized"));
+        };
+        // 入场令牌绑定真实身份，先于化名换算校验。
+        let pass_valid = params.room_pass.as_deref().is_some_and(|token| {
+            verify_room_pass(&context.config, token, &room.id, &session.client_id)
+        });
+        // 化名模式下房间成员表里存的是化名，按同样的规则换算后再比对。
+        let member_id = if context.config.pseudonymous_ids {
+            room_pseudonym(&context.config, &room.id, &session.client_id)
+        } else {
+            session.client_id
+        };
+        if !pass_valid && !room.clients.contains_key(&member_id) {
+            return Err(ApiError::new(StatusCode::FORBIDDEN, "forbidden"));
+        }
+    }
+
+    Ok(Json(RoomHistoryResponse {
+        room_id: room.id.clone(),
+        messages: room
+            .recent_history(now_ms(), context.config.chat_history_max_age_ms)
+            .cloned()
+            .collect(),
+    }))
+}
+
+/// 校验房间密码，通过后签发绑定当前会话的短期入场令牌，建连时放在 `room_pass` 参数里。
+async fn verify_room_password(
+    State(context): State<Arc<AppContext>>,
+    Path(room_id): Path<String>,
+    Query(params): Query<TenantParams>,
+    headers: HeaderMap,
+    Json(request): Json<RoomPasswordRequest>,
+) -> Result<Json<RoomPassResponse>, ApiError> {
+    let tenant = context
+        .config
+        .resolve_tenant(params.tenant.as_deref())
+        .map_err(|code| ApiError::new(StatusCode::BAD_REQUEST, code))?;
+    let Some(session) = parse_session_cookie(&context.config, &headers) else {
+        return Err(ApiError::new(StatusCode::UNAUTHORIZED, "unauthorized"));
+    };
+    let room_id = tenant_room_key(tenant.as_deref(), &room_id);
+
+    let mut state = context.state.write().await;
+    let room_id = state.room_aliases.get(&room_id).cloned().unwrap_or(room_id);
+    let Some(room) = state.rooms.get_mut(&room_id) else {
+        return Err(ApiError::new(StatusCode::NOT_FOUND, "room_not_found"));
+    };
+    let Some(password_hash) = room.password_hash.as_deref() else {
+        return Err(ApiError::new(
+            StatusCode::BAD_REQUEST,
+            "password_not_required",
+        ));
+    };
+
+    let now = now_ms();
+    while room
+        .password_failures
+        .front()
+        .is_some_and(|at| now.saturating_sub(*at) >= ROOM_PASSWORD_FAILURE_WINDOW_MS)
+    {
+        room.password_failures.pop_front();
+    }
+    if room.password_failures.len() >= ROOM_PASSWORD_MAX_FAILURES {
+        let retry_after_ms = room.password_failures.front().map_or(0, |at| {
+            (at + ROOM_PASSWORD_FAILURE_WINDOW_MS).saturating_sub(now)
+        });
+        return Err(
+            ApiError::new(StatusCode::TOO_MANY_REQUESTS, "too_many_attempts")
+                .with_detail("retryAfterMs", retry_after_ms),
+        );
+    }
+    if !room_password_matches(&context.config, &request.password, password_hash) {
+        room.password_failures.push_back(now);
+        return Err(ApiError::new(StatusCode::FORBIDDEN, "invalid_password"));
+    }
+
+    let expires_at = now.saturating_add(context.config.room_pass_ttl_ms);
+    Ok(Json(RoomPassResponse {
+        room_pass: issue_room_pass(&context.config, &room_id, &session.client_id, expires_at),
+        expires_at,
+    }))
 }
 
 /// 获取或续签匿名会话，并把签名后的 Cookie 写回浏览器。
@@ -99,17 +417,625 @@ async fn get_session(State(context): State<Arc<AppContext>>, headers: HeaderMap)
 /// 生成当前前端应使用的 ICE 配置。
 async fn get_ice_config(
     State(context): State<Arc<AppContext>>,
-) -> Result<Json<IceConfigResponse>, (StatusCode, Json<Value>)> {
+) -> Result<Json<IceConfigResponse>, ApiError> {
     let config = build_ice_config(&context).await.map_err(|err| {
         error!("failed to build ICE config: {err}");
-        (
-            StatusCode::BAD_GATEWAY,
-            Json(serde_json::json!({
-                "error": "failed_to_build_ice_config",
-                "message": err,
-            })),
-        )
+        ApiError::new(StatusCode::BAD_GATEWAY, "failed_to_build_ice_config").with_message(err)
     })?;
 
     Ok(Json(config))
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        api_error::ErrorBodyFormat,
+        app::{test_context, RoomOptions, RoomState},
+        config::OwnerLeavePolicy,
+        session::room_password_hash,
+        types::SignalMessage,
+        ws::{join_for_tests, route_for_tests, try_join_for_tests},
+    };
+    use uuid::Uuid;
+
+    /// 建一个带一条聊天记录的房间。
+    async fn room_with_history(context: &AppContext, room_id: &str, is_private: bool) {
+        let mut room = RoomState::new(
+            room_id.to_string(),
+            None,
+            RoomOptions {
+                is_private,
+                owner_leave_policy: OwnerLeavePolicy::Transfer,
+                allowed_origins: Vec::new(),
+                persistent: false,
+                approval_required: false,
+                message_log: false,
+                max_lifetime_ms: None,
+                retention: None,
+            },
+        );
+        room.history.push_back((
+            now_ms(),
+            SignalMessage {
+                kind: "chat".to_string(),
+                from: "alice".to_string(),
+                payload: serde_json::json!("hello"),
+                ..Default::default()
+            },
+        ));
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .insert(room_id.to_string(), room);
+    }
+
+    /// 签发一个新会话，返回它的 `client_id` 与带 Cookie 的请求头。
+    fn session_headers(config: &AppConfig) -> (String, HeaderMap) {
+        let session = existing_or_new_session(config, &HeaderMap::new());
+        let cookie = build_session_cookie(config, &session, false).unwrap();
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            header::COOKIE,
+            HeaderValue::from_str(cookie.split(';').next().unwrap()).unwrap(),
+        );
+        (session.client_id, headers)
+    }
+
+    async fn read_history(
+        context: &Arc<AppContext>,
+        room_id: &str,
+        room_pass: Option<String>,
+        headers: HeaderMap,
+    ) -> Result<RoomHistoryResponse, ApiError> {
+        get_room_history(
+            State(context.clone()),
+            Path(room_id.to_string()),
+            Query(HistoryParams {
+                tenant: None,
+                room_pass,
+            }),
+            headers,
+        )
+        .await
+        .map(|Json(history)| history)
+    }
+
+    #[tokio::test]
+    async fn public_room_history_is_returned_without_a_session() {
+        let context = test_context(AppConfig::for_tests());
+        room_with_history(&context, "lobby", false).await;
+
+        let history = read_history(&context, "lobby", None, HeaderMap::new())
+            .await
+            .unwrap_or_else(|_| panic!("public history must be readable"));
+        assert_eq!(history.room_id, "lobby");
+        assert_eq!(history.messages.len(), 1);
+        assert_eq!(history.messages[0].payload, serde_json::json!("hello"));
+
+        let missing = read_history(&context, "nowhere", None, HeaderMap::new()).await;
+        assert_eq!(
+            missing.err().map(|err| err.status()),
+            Some(StatusCode::NOT_FOUND)
+        );
+    }
+
+    #[tokio::test]
+    async fn private_room_history_is_only_returned_to_members() {
+        let context = test_context(AppConfig::for_tests());
+        room_with_history(&context, "secret", true).await;
+
+        let anonymous = read_history(&context, "secret", None, HeaderMap::new()).await;
+        assert_eq!(
+            anonymous.err().map(|err| err.status()),
+            Some(StatusCode::UNAUTHORIZED)
+        );
+
+        let (client_id, headers) = session_headers(&context.config);
+        let outsider = read_history(&context, "secret", None, headers.clone()).await;
+        assert_eq!(
+            outsider.err().map(|err| err.status()),
+            Some(StatusCode::FORBIDDEN)
+        );
+
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .get_mut("secret")
+            .unwrap()
+            .clients
+            .insert(client_id, Uuid::new_v4());
+        let member = read_history(&context, "secret", None, headers).await;
+        assert_eq!(member.map(|history| history.messages.len()).ok(), Some(1));
+    }
+
+    #[tokio::test]
+    async fn password_room_history_accepts_a_room_pass_for_the_session() {
+        let context = test_context(AppConfig::for_tests());
+        room_with_history(&context, "locked", false).await;
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .get_mut("locked")
+            .unwrap()
+            .password_hash = Some(room_password_hash(&context.config, "hunter2"));
+        let (client_id, headers) = session_headers(&context.config);
+        let expires_at_ms = now_ms() + 60_000;
+
+        let without_pass = read_history(&context, "locked", None, headers.clone()).await;
+        assert_eq!(
+            without_pass.err().map(|err| err.status()),
+            Some(StatusCode::FORBIDDEN)
+        );
+
+        let other_room = issue_room_pass(&context.config, "elsewhere", &client_id, expires_at_ms);
+        let wrong_pass = read_history(&context, "locked", Some(other_room), headers.clone()).await;
+        assert_eq!(
+            wrong_pass.err().map(|err| err.status()),
+            Some(StatusCode::FORBIDDEN)
+        );
+
+        let pass = issue_room_pass(&context.config, "locked", &client_id, expires_at_ms);
+        let admitted = read_history(&context, "locked", Some(pass), headers).await;
+        assert_eq!(admitted.map(|history| history.messages.len()).ok(), Some(1));
+    }
+
+    #[test]
+    fn reconnect_refusal_rounds_retry_after_up_to_whole_seconds() {
+        let response = reconnect_limited_response(1_500);
+        assert_eq!(response.headers()[header::RETRY_AFTER], "2");
+    }
+
+    #[tokio::test]
+    async fn public_room_list_does_not_expose_user_agents() {
+        let context = test_context(AppConfig::for_tests());
+        let (alice_id, _) = join_for_tests(&context, "alice", "lobby").await;
+        context
+            .state
+            .write()
+            .await
+            .connections
+            .get_mut(&alice_id)
+            .expect("alice is connected")
+            .user_agent = Some("Firefox/128.0".to_string());
+
+        let list = public_room_list(&context.config, &*context.state.read().await, None);
+        let body = serde_json::to_string(&list).expect("room list serializes");
+        assert!(body.contains("alice"));
+        assert!(!body.contains("Firefox"));
+        assert!(!body.contains("userAgent"));
+    }
+
+    #[tokio::test]
+    async fn room_list_beyond_the_cap_is_truncated_with_the_full_total() {
+        let mut config = AppConfig::for_tests();
+        config.room_list_max = 2;
+        let context = test_context(config);
+        for room_id in ["c", "a", "d", "b"] {
+            room_with_history(&context, room_id, false).await;
+        }
+        room_with_history(&context, "hidden", true).await;
+
+        let list = public_room_list(&context.config, &*context.state.read().await, None);
+        let ids = list
+            .rooms
+            .iter()
+            .map(|room| room.id.as_str())
+            .collect::<Vec<_>>();
+        assert_eq!(ids, ["a", "b"]);
+        assert!(list.truncated);
+        assert_eq!(list.total, 4);
+
+        let mut config = AppConfig::for_tests();
+        config.room_list_max = 4;
+        let list = public_room_list(&config, &*context.state.read().await, None);
+        assert_eq!(list.rooms.len(), 4);
+        assert!(!list.truncated);
+        assert_eq!(list.total, 4);
+    }
+
+    async fn room_list_response(
+        context: &Arc<AppContext>,
+    ) -> (StatusCode, HeaderMap, serde_json::Value) {
+        let response =
+            list_rooms(State(context.clone()), Query(TenantParams { tenant: None })).await;
+        let (parts, body) = response.into_parts();
+        let body = axum::body::to_bytes(body, usize::MAX)
+            .await
+            .expect("response body");
+        (
+            parts.status,
+            parts.headers,
+            serde_json::from_slice(&body).expect("json body"),
+        )
+    }
+
+    #[tokio::test]
+    async fn maintenance_answers_503_with_retry_after_until_it_is_turned_off() {
+        let mut config = AppConfig::for_tests();
+        config.maintenance_blocks_room_list = true;
+        config.maintenance_retry_after_seconds = 30;
+        let context = test_context(config);
+        room_with_history(&context, "lobby", false).await;
+
+        context.maintenance.store(true, Ordering::Relaxed);
+        let (status, headers, body) = room_list_response(&context).await;
+        assert_eq!(status, StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(headers[header::RETRY_AFTER], "30");
+        assert_eq!(body, serde_json::json!({ "error": "maintenance" }));
+
+        context.maintenance.store(false, Ordering::Relaxed);
+        let (status, headers, body) = room_list_response(&context).await;
+        assert_eq!(status, StatusCode::OK);
+        assert!(headers.get(header::RETRY_AFTER).is_none());
+        assert_eq!(body["total"], 1);
+        assert_eq!(body["rooms"][0]["id"], "lobby");
+    }
+
+    #[tokio::test]
+    async fn same_room_name_under_two_tenants_stays_isolated() {
+        let mut config = AppConfig::for_tests();
+        config.tenancy = true;
+        let context = test_context(config);
+        let (alice_id, _) = join_for_tests(&context, "alice", "acme/standup").await;
+        let (_, bob_queue) = join_for_tests(&context, "bob", "acme/standup").await;
+        let (_, carol_queue) = join_for_tests(&context, "carol", "globex/standup").await;
+        while bob_queue.try_recv_json().is_some() {}
+        while carol_queue.try_recv_json().is_some() {}
+
+        let chat = serde_json::from_value(serde_json::json!({ "type": "chat", "payload": "hi" }))
+            .expect("chat message");
+        route_for_tests(&context, alice_id, chat).await;
+        assert_eq!(
+            bob_queue.try_recv_json().map(|message| message.kind),
+            Some("chat".to_string())
+        );
+        assert!(carol_queue.try_recv_json().is_none());
+
+        let state = context.state.read().await;
+        for (tenant, members) in [("acme", vec!["alice", "bob"]), ("globex", vec!["carol"])] {
+            let list = public_room_list(&context.config, &state, Some(tenant));
+            assert_eq!(list.total, 1);
+            assert_eq!(list.rooms[0].id, "standup");
+            let mut clients = list.rooms[0].clients.clone();
+            clients.sort();
+            assert_eq!(clients, members, "{tenant}");
+        }
+    }
+
+    #[test]
+    fn debug_endpoints_are_only_mounted_with_the_flag_and_an_admin_token() {
+        let mut config = AppConfig::for_tests();
+        assert!(!config.debug_endpoints_enabled());
+
+        config.debug_endpoints = true;
+        assert!(
+            !config.debug_endpoints_enabled(),
+            "DEBUG_ENDPOINTS alone does not expose /debug/* without ADMIN_TOKEN"
+        );
+
+        config.admin_token = Some("secret".to_string());
+        assert!(config.debug_endpoints_enabled());
+
+        config.debug_endpoints = false;
+        assert!(config.admin_endpoints_enabled());
+        assert!(!config.debug_endpoints_enabled());
+    }
+
+    /// 在随机端口上按 `main` 的方式起一个服务，返回它的地址。
+    async fn serve_for_tests(router: Router) -> std::net::SocketAddr {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0")
+            .await
+            .expect("bind a test listener");
+        let addr = listener.local_addr().expect("listener address");
+        tokio::spawn(async move {
+            axum::serve(
+                listener,
+                router.into_make_service_with_connect_info::<std::net::SocketAddr>(),
+            )
+            .await
+        });
+        addr
+    }
+
+    /// 发一个带管理员令牌的 GET，返回状态码与 `Content-Type`。
+    async fn http_get(addr: std::net::SocketAddr, path: &str) -> (u16, String) {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        let mut stream = tokio::net::TcpStream::connect(addr)
+            .await
+            .expect("connect to the test server");
+        let request = format!(
+            "GET {path} HTTP/1.1\r\nHost: localhost\r\nAuthorization: Bearer secret\r\nConnection: close\r\n\r\n"
+        );
+        stream
+            .write_all(request.as_bytes())
+            .await
+            .expect("send the request");
+        let mut response = Vec::new();
+        stream
+            .read_to_end(&mut response)
+            .await
+            .expect("read the response");
+        let response = String::from_utf8_lossy(&response);
+        let (head, _) = response.split_once("\r\n\r\n").expect("response head");
+        let status = head
+            .split(' ')
+            .nth(1)
+            .and_then(|code| code.parse().ok())
+            .expect("status code");
+        let content_type = head
+            .lines()
+            .find_map(|line| {
+                let (name, value) = line.split_once(':')?;
+                name.eq_ignore_ascii_case("content-type")
+                    .then(|| value.trim().to_string())
+            })
+            .unwrap_or_default();
+        (status, content_type)
+    }
+
+    #[tokio::test]
+    async fn split_routers_only_expose_their_intended_routes() {
+        let mut config = AppConfig::for_tests();
+        config.admin_token = Some("secret".to_string());
+        let (public, internal) = build_split_routers(test_context(config));
+        let public = serve_for_tests(public).await;
+        let internal = serve_for_tests(internal).await;
+
+        assert_eq!(http_get(public, "/api/rooms").await.0, 200);
+        assert_eq!(http_get(internal, "/api/rooms").await.0, 404);
+        assert_eq!(http_get(internal, "/ws").await.0, 404);
+        assert_eq!(http_get(internal, "/healthz").await.0, 200);
+
+        let (status, content_type) = http_get(internal, "/admin/runtime").await;
+        assert_eq!((status, content_type.as_str()), (200, "application/json"));
+        // 公开端口上的 `/admin/*` 只会落到前端页面的兜底路由。
+        let (status, content_type) = http_get(public, "/admin/runtime").await;
+        assert!(
+            status == 404 || content_type.starts_with("text/html"),
+            "{status} {content_type}"
+        );
+    }
+
+    #[tokio::test]
+    async fn active_room_reports_more_activity_than_an_idle_one() {
+        let mut config = AppConfig::for_tests();
+        config.room_activity_summary = true;
+        let context = test_context(config);
+        let (alice_id, _) = join_for_tests(&context, "alice", "busy").await;
+        join_for_tests(&context, "bob", "busy").await;
+        join_for_tests(&context, "carol", "busy").await;
+        join_for_tests(&context, "dave", "quiet").await;
+
+        for text in ["one", "two", "three"] {
+            let chat =
+                serde_json::from_value(serde_json::json!({ "type": "chat", "payload": text }))
+                    .expect("chat message");
+            route_for_tests(&context, alice_id, chat).await;
+        }
+
+        let list = public_room_list(&context.config, &*context.state.read().await, None);
+        let [busy, quiet] = list.rooms.as_slice() else {
+            panic!("expected two rooms, got {:?}", list.rooms);
+        };
+        let (busy, quiet) = (
+            busy.activity.expect("busy room has a summary"),
+            quiet.activity.expect("quiet room has a summary"),
+        );
+        assert_eq!(busy.messages_last_minute, 3);
+        assert_eq!(quiet.messages_last_minute, 0);
+        assert!(busy.peak_members > quiet.peak_members);
+
+        // 未开启时不输出摘要。
+        let list = public_room_list(&AppConfig::for_tests(), &*context.state.read().await, None);
+        assert!(list.rooms.iter().all(|room| room.activity.is_none()));
+    }
+
+    #[tokio::test]
+    async fn error_endpoints_share_one_body_structure_with_their_status() {
+        let context = test_context(AppConfig::for_tests());
+        room_with_history(&context, "secret", true).await;
+        let unauthorized = read_history(&context, "secret", None, HeaderMap::new())
+            .await
+            .err()
+            .expect("private history needs a session");
+
+        for (response, status, code) in [
+            (
+                api_not_found().await.into_response(),
+                StatusCode::NOT_FOUND,
+                "not_found",
+            ),
+            (
+                unauthorized.into_response(),
+                StatusCode::UNAUTHORIZED,
+                "unauthorized",
+            ),
+            (
+                reconnect_limited_response(1_500),
+                StatusCode::TOO_MANY_REQUESTS,
+                "reconnect_limited",
+            ),
+            (
+                maintenance_response(&context.config),
+                StatusCode::SERVICE_UNAVAILABLE,
+                "maintenance",
+            ),
+        ] {
+            let (mut parts, body) = response.into_parts();
+            assert_eq!(parts.status, status, "{code}");
+            let flat: serde_json::Value = serde_json::from_slice(
+                &axum::body::to_bytes(body, usize::MAX)
+                    .await
+                    .expect("response body"),
+            )
+            .expect("json body");
+            assert_eq!(flat["error"], code);
+
+            // `ERROR_BODY_FORMAT=nested` 时中间件用同一个错误重写响应体。
+            let error = parts
+                .extensions
+                .remove::<ApiError>()
+                .expect("error responses carry their ApiError");
+            let nested = error.body(ErrorBodyFormat::Nested);
+            assert_eq!(nested["error"]["code"], code);
+            assert!(nested["error"]["message"].is_string(), "{code}");
+        }
+    }
+
+    #[tokio::test]
+    async fn tenant_at_its_room_cap_cannot_create_more_and_lists_a_bounded_page() {
+        let mut config = AppConfig::for_tests();
+        config.tenancy = true;
+        config.tenant_max_rooms = 2;
+        config.tenant_room_list_max = 1;
+        let context = test_context(config);
+        for (client_id, room_id) in [
+            ("alice", "acme/a"),
+            ("bob", "acme/b"),
+            ("carol", "globex/a"),
+        ] {
+            join_for_tests(&context, client_id, room_id).await;
+        }
+
+        let refusal = try_join_for_tests(&context, "dave", "acme/c")
+            .await
+            .err()
+            .expect("acme is at its room cap");
+        assert_eq!(refusal.payload["code"], "tenant_room_limit");
+        // 加入租户内已有的房间不受上限影响，另一个租户照常建房。
+        assert!(try_join_for_tests(&context, "dave", "acme/a").await.is_ok());
+        assert!(try_join_for_tests(&context, "erin", "globex/b")
+            .await
+            .is_ok());
+
+        let state = context.state.read().await;
+        let acme = public_room_list(&context.config, &state, Some("acme"));
+        assert_eq!((acme.rooms.len(), acme.total, acme.truncated), (1, 2, true));
+        let globex = public_room_list(&context.config, &state, Some("globex"));
+        assert_eq!(
+            (globex.rooms.len(), globex.total, globex.truncated),
+            (1, 2, true)
+        );
+        assert!(!state.rooms.contains_key("acme/c"));
+    }
+
+    async fn readyz_response(context: &Arc<AppContext>) -> (StatusCode, serde_json::Value) {
+        let (parts, body) = readyz(State(context.clone())).await.into_parts();
+        let body = axum::body::to_bytes(body, usize::MAX)
+            .await
+            .expect("response body");
+        (
+            parts.status,
+            serde_json::from_slice(&body).expect("json body"),
+        )
+    }
+
+    #[tokio::test]
+    async fn stalled_writer_turns_readiness_degraded() {
+        let mut config = AppConfig::for_tests();
+        config.readiness_probe_timeout_ms = 50;
+        config.readiness_probe_rooms = 8;
+        let context = test_context(config);
+        let (_, live_queue) = join_for_tests(&context, "alice", "live").await;
+        let (_, _stuck_queue) = join_for_tests(&context, "bob", "stuck").await;
+        // 只有 live 房间的连接在消费队列，相当于 stuck 房间的 writer 卡住了。
+        tokio::spawn(async move {
+            while let Some(message) = live_queue.recv().await {
+                if let OutboundMessage::Probe(ack) = message {
+                    ack.notify_one();
+                }
+            }
+        });
+
+        let (status, body) = readyz_response(&context).await;
+        assert_eq!(status, StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(body["error"], "degraded");
+        assert_eq!(body["probedRooms"], 2);
+        assert_eq!(body["stalledRooms"], serde_json::json!(["stuck"]));
+
+        // stuck 房间关闭后，抽查到的 writer 都能及时响应。
+        context.state.write().await.rooms.remove("stuck");
+        let (status, body) = readyz_response(&context).await;
+        assert_eq!(status, StatusCode::OK);
+        assert_eq!(
+            body,
+            serde_json::json!({ "status": "ok", "probedRooms": 1 })
+        );
+    }
+
+    async fn verify(
+        context: &Arc<AppContext>,
+        headers: &HeaderMap,
+        password: &str,
+    ) -> Result<RoomPassResponse, ApiError> {
+        verify_room_password(
+            State(context.clone()),
+            Path("locked".to_string()),
+            Query(TenantParams { tenant: None }),
+            headers.clone(),
+            Json(RoomPasswordRequest {
+                password: password.to_string(),
+            }),
+        )
+        .await
+        .map(|Json(pass)| pass)
+    }
+
+    #[tokio::test]
+    async fn verified_password_yields_an_admitting_pass_and_wrong_ones_are_throttled() {
+        let context = test_context(AppConfig::for_tests());
+        room_with_history(&context, "locked", false).await;
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .get_mut("locked")
+            .unwrap()
+            .password_hash = Some(room_password_hash(&context.config, "hunter2"));
+        let (client_id, headers) = session_headers(&context.config);
+
+        let pass = verify(&context, &headers, "hunter2")
+            .await
+            .unwrap_or_else(|_| panic!("the right password is accepted"));
+        assert!(pass.expires_at > now_ms());
+        // 建连时校验的就是这张令牌：只对本会话、本房间有效。
+        assert!(verify_room_pass(
+            &context.config,
+            &pass.room_pass,
+            "locked",
+            &client_id
+        ));
+        assert!(!verify_room_pass(
+            &context.config,
+            &pass.room_pass,
+            "locked",
+            "someone-else"
+        ));
+        let admitted =
+            read_history(&context, "locked", Some(pass.room_pass), headers.clone()).await;
+        assert!(admitted.is_ok());
+
+        for _ in 0..ROOM_PASSWORD_MAX_FAILURES {
+            let refused = verify(&context, &headers, "guess").await.err();
+            assert_eq!(
+                refused.map(|err| (err.status(), err.code())),
+                Some((StatusCode::FORBIDDEN, "invalid_password"))
+            );
+        }
+        // 失败次数用完后连正确的密码也要等窗口过去。
+        let throttled = verify(&context, &headers, "hunter2").await.err();
+        assert_eq!(
+            throttled.map(|err| (err.status(), err.code())),
+            Some((StatusCode::TOO_MANY_REQUESTS, "too_many_attempts"))
+        );
+    }
+}
@@ -1,5 +1,7 @@
 //! 匿名会话的签发、校验与 Cookie 编解码。
 
+use std::collections::HashSet;
+
 use axum::http::{header, HeaderMap};
 use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine as _};
 use cookie::{time::Duration as CookieDuration, Cookie, SameSite};
@@ -118,6 +120,112 @@ fn verify_session_token(config: &AppConfig, token: &str) -> Option<SessionClaims
     })
 }
 
+/// 校验消息类型授权令牌：`client_id.类型列表.过期时间.签名`，类型之间用逗号分隔，
+/// 签名是对前三段用 `MESSAGE_TYPE_GRANT_SECRET` 做的 HMAC-SHA256（URL-safe base64，无填充）。
+/// 令牌必须签给当前会话的 client_id，校验通过时返回允许发送的消息类型。
+pub(crate) fn verify_type_grant(
+    config: &AppConfig,
+    token: &str,
+    client_id: &str,
+) -> Option<HashSet<String>> {
+    let secret = config.message_type_grant_secret.as_deref()?;
+    let mut parts = token.split('.');
+    let granted_client_id = parts.next()?;
+    let types = parts.next()?;
+    let expires_at_ms = parts.next()?.parse::<u64>().ok()?;
+    let signature = parts.next()?;
+
+    if parts.next().is_some() || granted_client_id != client_id || expires_at_ms <= now_ms() {
+        return None;
+    }
+
+    let mut mac = HmacSha256::new_from_slice(secret.as_bytes()).ok()?;
+    mac.update(format!("{granted_client_id}.{types}.{expires_at_ms}").as_bytes());
+    let provided = URL_SAFE_NO_PAD.decode(signature).ok()?;
+    mac.verify_slice(&provided).ok()?;
+
+    Some(
+        types
+            .split(',')
+            .map(str::trim)
+            .filter(|kind| !kind.is_empty())
+            .map(str::to_string)
+            .collect(),
+    )
+}
+
+/// 某个身份在指定房间里的化名：同一房间内始终相同，不同房间之间无法关联，也无法反推真实 ID。
+pub(crate) fn room_pseudonym(config: &AppConfig, room_id: &str, client_id: &str) -> String {
+    let mut mac = HmacSha256::new_from_slice(config.session_secret.as_slice())
+        .expect("HMAC accepts keys of any length");
+    mac.update(format!("pseudonym.{room_id}.{client_id}").as_bytes());
+    let digest = mac.finalize().into_bytes();
+    format!("p-{}", URL_SAFE_NO_PAD.encode(&digest[..12]))
+}
+
+/// 房间密码的存储形式：用服务端密钥做的 HMAC-SHA256，内存里不保留明文。
+/// 没有引入专门的慢哈希，房间密码应当视为短期的入场口令，而不是长期账户密码。
+pub(crate) fn room_password_hash(config: &AppConfig, password: &str) -> Vec<u8> {
+    let mut mac = HmacSha256::new_from_slice(config.session_secret.as_slice())
+        .expect("HMAC accepts keys of any length");
+    mac.update(format!("room_password.{password}").as_bytes());
+    mac.finalize().into_bytes().to_vec()
+}
+
+/// 按定长比较校验提交的房间密码。
+pub(crate) fn room_password_matches(config: &AppConfig, password: &str, stored: &[u8]) -> bool {
+    let mut mac = HmacSha256::new_from_slice(config.session_secret.as_slice())
+        .expect("HMAC accepts keys of any length");
+    mac.update(format!("room_password.{password}").as_bytes());
+    mac.verify_slice(stored).is_ok()
+}
+
+/// 签发房间入场令牌：`过期时间.签名`，签名覆盖房间号与会话身份，换个房间或身份都无法使用。
+pub(crate) fn issue_room_pass(
+    config: &AppConfig,
+    room_id: &str,
+    client_id: &str,
+    expires_at_ms: u64,
+) -> String {
+    let mac = room_pass_mac(config, room_id, client_id, expires_at_ms);
+    let signature = URL_SAFE_NO_PAD.encode(mac.finalize().into_bytes());
+    format!("{expires_at_ms}.{signature}")
+}
+
+/// 校验建连时带上的房间入场令牌。
+pub(crate) fn verify_room_pass(
+    config: &AppConfig,
+    token: &str,
+    room_id: &str,
+    client_id: &str,
+) -> bool {
+    let Some((expires_at_ms, signature)) = token.split_once('.') else {
+        return false;
+    };
+    let Ok(expires_at_ms) = expires_at_ms.parse::<u64>() else {
+        return false;
+    };
+    let Ok(provided) = URL_SAFE_NO_PAD.decode(signature) else {
+        return false;
+    };
+    expires_at_ms > now_ms()
+        && room_pass_mac(config, room_id, client_id, expires_at_ms)
+            .verify_slice(&provided)
+            .is_ok()
+}
+
+fn room_pass_mac(
+    config: &AppConfig,
+    room_id: &str,
+    client_id: &str,
+    expires_at_ms: u64,
+) -> HmacSha256 {
+    let mut mac = HmacSha256::new_from_slice(config.session_secret.as_slice())
+        .expect("HMAC accepts keys of any length");
+    mac.update(format!("room_pass.{room_id}.{client_id}.{expires_at_ms}").as_bytes());
+    mac
+}
+
 /// 使用服务端密钥对会话载荷做 HMAC-SHA256 签名。
 fn sign_session_payload(config: &AppConfig, payload: &str) -> Result<HmacSha256, String> {
     let mut mac = HmacSha256::new_from_slice(config.session_secret.as_slice())
@@ -1,42 +1,158 @@
 //! 前端静态资源内嵌与回退路由处理。
 
-use std::borrow::Cow;
+use std::{borrow::Cow, sync::Arc};
 
 use axum::{
     body::Body,
+    extract::State,
     http::{
         header::{self},
-        HeaderValue, Response, StatusCode, Uri,
+        HeaderMap, HeaderValue, Response, StatusCode, Uri,
     },
     response::IntoResponse,
-    Json,
 };
 use mime_guess::from_path;
 use rust_embed::RustEmbed;
+use tracing::{info, warn};
+
+use crate::{api_error::ApiError, app::AppContext};
 
 /// 将 `frontend/dist` 打进 Rust 二进制，便于单文件部署。
 #[derive(RustEmbed)]
 #[folder = "frontend/dist"]
 struct FrontendAssets;
 
+/// 按优先级排列的预压缩格式：`(Content-Encoding, 文件后缀)`。
+const PRECOMPRESSED_ENCODINGS: &[(&str, &str)] = &[("br", ".br"), ("gzip", ".gz")];
+/// 值得预压缩的文本类资源后缀；图片、字体等已压缩格式不在检查范围内。
+const COMPRESSIBLE_SUFFIXES: &[&str] = &[
+    ".html", ".js", ".mjs", ".css", ".json", ".svg", ".wasm", ".txt", ".map",
+];
+
+/// 启动时检查构建产物：列出缺少 `.br` 或 `.gz` 版本的文本资源。
+/// 缺少时请求仍会回退到原文件，这里只是提醒运维构建流程漏了压缩步骤。
+pub(crate) fn warn_missing_precompressed_assets() {
+    let mut missing = Vec::new();
+    for path in FrontendAssets::iter() {
+        let is_variant = PRECOMPRESSED_ENCODINGS
+            .iter()
+            .any(|(_, suffix)| path.ends_with(suffix));
+        if is_variant
+            || !COMPRESSIBLE_SUFFIXES
+                .iter()
+                .any(|suffix| path.ends_with(suffix))
+        {
+            continue;
+        }
+        let absent = PRECOMPRESSED_ENCODINGS
+            .iter()
+            .filter(|(_, suffix)| FrontendAssets::get(&format!("{path}{suffix}")).is_none())
+            .map(|(_, suffix)| *suffix)
+            .collect::<Vec<_>>();
+        if !absent.is_empty() {
+            missing.push(format!("{path} ({})", absent.join(", ")));
+        }
+    }
+
+    if missing.is_empty() {
+        info!("all compressible frontend assets have precompressed variants");
+    } else {
+        warn!(
+            "{} frontend assets lack precompressed variants and will be served uncompressed: {}",
+            missing.len(),
+            missing.join("; ")
+        );
+    }
+}
+
 /// SPA 静态资源处理：找不到文件时回退到 `index.html`，交给前端路由接管。
-pub(crate) async fn static_handler(uri: Uri) -> impl IntoResponse {
+pub(crate) async fn static_handler(
+    State(context): State<Arc<AppContext>>,
+    uri: Uri,
+    headers: HeaderMap,
+) -> impl IntoResponse {
     let path = uri.path().trim_start_matches('/');
-    let asset_path = if path.is_empty() { "index.html" } else { path };
-    let asset = FrontendAssets::get(asset_path).or_else(|| FrontendAssets::get("index.html"));
-
-    match asset {
-        Some(asset) => build_static_response(asset_path, asset),
-        None => (
-            StatusCode::NOT_FOUND,
-            Json(serde_json::json!({ "error": "not_found" })),
-        )
-            .into_response(),
+    let requested_path = if path.is_empty() { "index.html" } else { path };
+    let asset_path = if FrontendAssets::get(requested_path).is_some() {
+        requested_path
+    } else {
+        "index.html"
+    };
+    let Some(asset) = FrontendAssets::get(asset_path) else {
+        return ApiError::new(StatusCode::NOT_FOUND, "not_found").into_response();
+    };
+
+    if context.config.precompressed_assets {
+        let accepted = accepted_encodings(&headers);
+        let variant = precompressed_variant(asset_path, &accepted, |path| {
+            FrontendAssets::get(path).is_some()
+        });
+        if let Some((variant_path, encoding)) = variant {
+            if let Some(compressed) = FrontendAssets::get(&variant_path) {
+                return build_static_response(asset_path, compressed.data, Some(encoding), true);
+            }
+        }
     }
+
+    build_static_response(
+        asset_path,
+        asset.data,
+        None,
+        context.config.precompressed_assets,
+    )
+}
+
+/// 客户端接受且存在对应的预压缩文件时直接返回它，不在运行时压缩；
+/// 某个格式的文件缺失时依次尝试下一个，都没有就返回 `None`，回退到原文件而不是 404。
+fn precompressed_variant(
+    asset_path: &str,
+    accepted: &[&'static str],
+    exists: impl Fn(&str) -> bool,
+) -> Option<(String, &'static str)> {
+    PRECOMPRESSED_ENCODINGS
+        .iter()
+        .filter(|(encoding, _)| accepted.contains(encoding))
+        .map(|(encoding, suffix)| (format!("{asset_path}{suffix}"), *encoding))
+        .find(|(variant_path, _)| exists(variant_path))
+}
+
+/// 解析 `Accept-Encoding`，忽略 `q=0` 的项。
+fn accepted_encodings(headers: &HeaderMap) -> Vec<&'static str> {
+    let Some(value) = headers
+        .get(header::ACCEPT_ENCODING)
+        .and_then(|value| value.to_str().ok())
+    else {
+        return Vec::new();
+    };
+
+    PRECOMPRESSED_ENCODINGS
+        .iter()
+        .map(|(encoding, _)| *encoding)
+        .filter(|encoding| {
+            value.split(',').any(|item| {
+                let mut parts = item.split(';');
+                let name = parts.next().unwrap_or_default().trim();
+                let rejected = parts.any(|param| {
+                    param
+                        .trim()
+                        .strip_prefix("q=")
+                        .and_then(|q| q.trim().parse::<f32>().ok())
+                        .map(|q| q <= 0.0)
+                        .unwrap_or(false)
+                });
+                name.eq_ignore_ascii_case(encoding) && !rejected
+            })
+        })
+        .collect()
 }
 
 /// 为嵌入资源补齐 MIME 与缓存头。
-fn build_static_response(path: &str, asset: rust_embed::EmbeddedFile) -> Response<Body> {
+fn build_static_response(
+    path: &str,
+    data: Cow<'static, [u8]>,
+    content_encoding: Option<&'static str>,
+    vary_on_encoding: bool,
+) -> Response<Body> {
     let mime = from_path(path).first_or_octet_stream();
     let cache_control = if path.starts_with("assets/") {
         // 带 hash 的静态资源可以长期缓存。
@@ -46,7 +162,7 @@ fn build_static_response(path: &str, asset: rust_embed::EmbeddedFile) -> Respons
         "no-cache"
     };
 
-    Response::builder()
+    let mut builder = Response::builder()
         .status(StatusCode::OK)
         .header(
             header::CONTENT_TYPE,
@@ -56,10 +172,80 @@ fn build_static_response(path: &str, asset: rust_embed::EmbeddedFile) -> Respons
         .header(
             header::CACHE_CONTROL,
             HeaderValue::from_str(cache_control).unwrap_or(HeaderValue::from_static("no-cache")),
-        )
-        .body(Body::from(match asset.data {
+        );
+    if let Some(encoding) = content_encoding {
+        builder = builder.header(header::CONTENT_ENCODING, HeaderValue::from_static(encoding));
+    }
+    if vary_on_encoding {
+        builder = builder.header(header::VARY, HeaderValue::from_static("Accept-Encoding"));
+    }
+
+    builder
+        .body(Body::from(match data {
             Cow::Borrowed(bytes) => bytes.to_vec(),
             Cow::Owned(bytes) => bytes,
         }))
         .unwrap_or_else(|_| Response::new(Body::empty()))
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn accept_encoding(value: &'static str) -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        headers.insert(header::ACCEPT_ENCODING, HeaderValue::from_static(value));
+        headers
+    }
+
+    #[test]
+    fn brotli_client_gets_the_br_variant_with_encoding_headers() {
+        let accepted = accepted_encodings(&accept_encoding("gzip, deflate, br"));
+        let variant = precompressed_variant("assets/app.js", &accepted, |path| {
+            matches!(path, "assets/app.js.br" | "assets/app.js.gz")
+        });
+        assert_eq!(variant, Some(("assets/app.js.br".to_string(), "br")));
+
+        let response = build_static_response(
+            "assets/app.js",
+            Cow::Borrowed(b"compressed"),
+            Some("br"),
+            true,
+        );
+        let headers = response.headers();
+        assert_eq!(headers[header::CONTENT_ENCODING], "br");
+        assert_eq!(headers[header::VARY], "Accept-Encoding");
+        // 类型仍按原文件名推断，而不是 `.br`。
+        assert!(headers[header::CONTENT_TYPE]
+            .to_str()
+            .unwrap()
+            .contains("javascript"));
+    }
+
+    #[test]
+    fn br_with_zero_quality_is_not_accepted() {
+        assert_eq!(
+            accepted_encodings(&accept_encoding("br;q=0, gzip")),
+            vec!["gzip"]
+        );
+    }
+
+    #[test]
+    fn missing_br_variant_falls_back_to_gzip_then_to_the_plain_file() {
+        let accepted = accepted_encodings(&accept_encoding("br, gzip"));
+        assert_eq!(
+            precompressed_variant("index.html", &accepted, |path| path == "index.html.gz"),
+            Some(("index.html.gz".to_string(), "gzip"))
+        );
+        assert_eq!(
+            precompressed_variant("index.html", &accepted, |path| path == "index.html"),
+            None
+        );
+
+        let response = build_static_response("index.html", Cow::Borrowed(b"<html>"), None, true);
+        let headers = response.headers();
+        assert_eq!(response.status(), StatusCode::OK);
+        assert!(headers.get(header::CONTENT_ENCODING).is_none());
+        assert_eq!(headers[header::VARY], "Accept-Encoding");
+    }
+}
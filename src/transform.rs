@@ -0,0 +1,82 @@
+//! 按房间配置的服务端消息处理链。
+
+use std::sync::Arc;
+
+use serde_json::Value;
+
+use crate::{types::SignalMessage, utils::next_server_timestamp_ms};
+
+/// 聊天内容被替换后的占位文本。
+const REDACTED_TEXT: &str = "[redacted]";
+
+/// 转发前对房间消息做的一步处理；多个处理按登记顺序依次执行。
+pub(crate) trait MessageTransform: Send + Sync {
+    /// 管理接口与房间导出中使用的名称。
+    fn name(&self) -> &'static str;
+
+    /// 就地修改消息；返回 `false` 时整条消息不再转发。
+    fn apply(&self, message: &mut SignalMessage) -> bool;
+}
+
+/// 把聊天正文替换成占位文本，其余消息原样放行。
+struct RedactChat;
+
+impl MessageTransform for RedactChat {
+    fn name(&self) -> &'static str {
+        "redact_chat"
+    }
+
+    fn apply(&self, message: &mut SignalMessage) -> bool {
+        if message.kind != "chat" {
+            return true;
+        }
+        match &mut message.payload {
+            Value::Object(fields) if fields.contains_key("text") => {
+                fields.insert("text".to_string(), Value::from(REDACTED_TEXT));
+            }
+            payload => *payload = Value::from(REDACTED_TEXT),
+        }
+        true
+    }
+}
+
+/// 为本房间的消息打上 `serverTs`，不必为此开启全局的 `SERVER_TIMESTAMPS`。
+struct StampServerTs;
+
+impl MessageTransform for StampServerTs {
+    fn name(&self) -> &'static str {
+        "server_ts"
+    }
+
+    fn apply(&self, message: &mut SignalMessage) -> bool {
+        if message.server_ts.is_none() {
+            message.server_ts = Some(next_server_timestamp_ms());
+        }
+        true
+    }
+}
+
+/// 按名称查找内置处理；未知名称返回 `None`。
+pub(crate) fn builtin_transform(name: &str) -> Option<Arc<dyn MessageTransform>> {
+    match name.trim() {
+        "redact_chat" => Some(Arc::new(RedactChat)),
+        "server_ts" => Some(Arc::new(StampServerTs)),
+        _ => None,
+    }
+}
+
+/// 把名称列表解析成处理链，遇到未知名称时返回该名称。
+pub(crate) fn parse_transforms(names: &[String]) -> Result<Vec<Arc<dyn MessageTransform>>, String> {
+    names
+        .iter()
+        .map(|name| builtin_transform(name).ok_or_else(|| name.clone()))
+        .collect()
+}
+
+/// 依次执行处理链，任一步要求丢弃时立即停止。
+pub(crate) fn apply_transforms(
+    transforms: &[Arc<dyn MessageTransform>],
+    message: &mut SignalMessage,
+) -> bool {
+    transforms.iter().all(|transform| transform.apply(message))
+}
@@ -1,10 +1,23 @@
 //! 路由层与 WebSocket 层共享的数据结构定义。
 
+use std::sync::Arc;
+
 use serde::{Deserialize, Serialize};
 use serde_json::Value;
 
+use crate::{config::AppConfig, outbound::InFlightToken};
+
+/// 压缩转发时 `encoding` 字段的取值：payload 是 base64 编码的 raw DEFLATE 数据。
+pub(crate) const PAYLOAD_ENCODING_DEFLATE_RAW: &str = "deflate-raw";
+
+/// 从该协议版本起，成员列表以对象数组下发（`{id, name, role, ...}`）；更早的客户端只认 ID 字符串数组。
+pub(crate) const ROSTER_OBJECTS_MIN_VERSION: u32 = 2;
+
+/// 未配置 `SERVER_SENDER_ID` 时系统消息使用的发送方标识。
+pub(crate) const DEFAULT_SERVER_SENDER_ID: &str = "server";
+
 /// WebSocket 信令消息。
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub(crate) struct SignalMessage {
     #[serde(rename = "type")]
     pub(crate) kind: String,
@@ -14,6 +27,69 @@ pub(crate) struct SignalMessage {
     pub(crate) from: String,
     #[serde(default, skip_serializing_if = "Option::is_none")]
     pub(crate) to: Option<String>,
+    /// 只广播给房间内同一分组的成员。
+    #[serde(default, rename = "toGroup", skip_serializing_if = "Option::is_none")]
+    pub(crate) to_group: Option<String>,
+    /// 同时发给房间里的多个指定成员；未设置 `to` 时生效，人数上限见 `MAX_RECIPIENTS_PER_MESSAGE`。
+    #[serde(default, rename = "toMany", skip_serializing_if = "Option::is_none")]
+    pub(crate) to_many: Option<Vec<String>>,
+    /// 发给房间内当前持有该角色的成员，发送时才解析成具体 ID。
+    #[serde(default, rename = "toRole", skip_serializing_if = "Option::is_none")]
+    pub(crate) to_role: Option<String>,
+    /// 客户端自定的消息 ID；开启至少一次投递时，目标用 `ack` 回带同一 ID 确认。
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) id: Option<String>,
+    /// 客户端声明的过期时间（毫秒时间戳）；出站时已过期的消息直接跳过，不再发送。
+    #[serde(default, rename = "expiresAt", skip_serializing_if = "Option::is_none")]
+    pub(crate) expires_at: Option<u64>,
+    /// 请求/响应的关联 ID，服务端原样转发，从不改写或丢弃。
+    #[serde(
+        default,
+        rename = "correlationId",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub(crate) correlation_id: Option<String>,
+    /// 请求方希望在该时长（毫秒）内收到带同一 `correlationId` 的回复，超时由服务端回 `response_timeout`。
+    #[serde(
+        default,
+        rename = "responseTimeoutMs",
+        skip_serializing_if = "Option::is_none"
+    )]
+    pub(crate) response_timeout_ms: Option<u64>,
+    /// 在 `correlationId` 关联链里的序号，从 0 开始；开启链内排序后服务端按序号依次转发。
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) seq: Option<u64>,
+    /// 链内排序因积压或超时放弃等待时，由服务端标在恢复处的消息上：值为缺失的第一个序号。
+    #[serde(default, rename = "seqGap", skip_serializing_if = "Option::is_none")]
+    pub(crate) seq_gap: Option<u64>,
+    /// 服务端转发时打上的单调递增时间戳（毫秒），客户端可据此对所有发送方的消息统一排序。
+    #[serde(default, rename = "serverTs", skip_serializing_if = "Option::is_none")]
+    pub(crate) server_ts: Option<u64>,
+    /// payload 的编码方式；为 `deflate-raw` 时 payload 是压缩后再 base64 的字符串。
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) encoding: Option<String>,
+    /// 发送方支持压缩时预先算好的压缩 payload，由支持压缩的接收方在出站时换上；
+    /// 只在服务端内部传递，不参与序列化。
+    #[serde(skip)]
+    pub(crate) compressed_payload: Option<Arc<String>>,
+    /// 转发副本占用的发送方在途计数，写出或丢弃时释放；同样不参与序列化。
+    #[serde(skip)]
+    pub(crate) in_flight: Option<InFlightToken>,
+    /// 广播时要求服务端回一条汇总的 `broadcast_receipt`。
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub(crate) receipt: bool,
+}
+
+impl SignalMessage {
+    /// 构造一条由服务端发出的系统消息，发送方标识取自 `SERVER_SENDER_ID`。
+    pub(crate) fn server(config: &AppConfig, kind: &str, payload: Value) -> Self {
+        Self {
+            kind: kind.to_string(),
+            payload,
+            from: config.server_sender_id.clone(),
+            ..Default::default()
+        }
+    }
 }
 
 /// 前端房间列表接口返回的数据。
@@ -25,6 +101,145 @@ pub(crate) struct RoomInfo {
     pub(crate) clients: Vec<String>,
     pub(crate) created_at: u64,
     pub(crate) is_private: bool,
+    /// 开启 `ROOM_ACTIVITY_SUMMARY` 时附带的活跃度摘要。
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) activity: Option<RoomActivitySummary>,
+}
+
+/// 房间列表中的活跃度摘要，供大厅界面挑出热闹的房间。
+#[derive(Debug, Clone, Copy, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomActivitySummary {
+    /// 最近一分钟转发的消息数，不含心跳。
+    pub(crate) messages_last_minute: u64,
+    /// 房间存在以来同时在线的成员数峰值。
+    pub(crate) peak_members: usize,
+}
+
+/// 管理接口中单个连接的详情，包含不对公开接口暴露的客户端信息。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct AdminClientInfo {
+    pub(crate) client_id: String,
+    /// 开启化名时的真实身份，`clientId` 此时是房间内的化名。
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) real_client_id: Option<String>,
+    pub(crate) group: Option<String>,
+    pub(crate) role: Option<String>,
+    pub(crate) display_name: Option<String>,
+    pub(crate) spectator: bool,
+    pub(crate) joined_at: u64,
+    pub(crate) last_seen_at: u64,
+    pub(crate) user_agent: Option<String>,
+    pub(crate) client_version: Option<String>,
+    /// 出站队列当前容量；开启自适应后随客户端的消费速度变化，不限容量时为 `null`。
+    pub(crate) queue_capacity: Option<usize>,
+}
+
+/// 迁移房间时导出的元数据；字段与 `POST /admin/rooms` 的请求体兼容，可直接在目标实例上预建。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomExport {
+    pub(crate) id: String,
+    #[serde(rename = "private")]
+    pub(crate) is_private: bool,
+    pub(crate) owner_leave: &'static str,
+    pub(crate) allowed_origins: Vec<String>,
+    pub(crate) require_approval: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) retention: Option<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub(crate) transforms: Vec<&'static str>,
+    pub(crate) created_at: u64,
+    pub(crate) owner: Option<String>,
+    pub(crate) read_only: bool,
+    pub(crate) members: Vec<String>,
+    /// 成员被引导去重连的目标实例。
+    pub(crate) target: String,
+}
+
+/// `GET /admin/rooms/{id}/config` 的返回结构：建房时与管理接口设置的属性，加上当前的派生状态。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomConfigResponse {
+    pub(crate) id: String,
+    #[serde(rename = "private")]
+    pub(crate) is_private: bool,
+    pub(crate) owner_leave: &'static str,
+    pub(crate) allowed_origins: Vec<String>,
+    pub(crate) require_approval: bool,
+    pub(crate) persistent: bool,
+    pub(crate) retention: Option<String>,
+    pub(crate) transforms: Vec<&'static str>,
+    pub(crate) message_log: bool,
+    pub(crate) floor_control: bool,
+    pub(crate) owner: Option<String>,
+    pub(crate) read_only: bool,
+    pub(crate) awaiting_second_member: bool,
+    pub(crate) created_at: u64,
+    pub(crate) expires_at: Option<u64>,
+    pub(crate) draining_until: Option<u64>,
+    pub(crate) password_protected: bool,
+    pub(crate) last_activity_at: u64,
+    pub(crate) age_ms: u64,
+    pub(crate) idle_ms: u64,
+    pub(crate) client_count: usize,
+    pub(crate) pending_joins: usize,
+    pub(crate) history_length: usize,
+    pub(crate) calls_in_progress: usize,
+    /// 只在开启 `ROOM_ACTIVITY_SUMMARY` 时统计。
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) activity: Option<RoomActivitySummary>,
+}
+
+/// `/api/rooms` 的返回结构；未配置 `ROOM_LIST_MAX` 时 `truncated` 恒为 false。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomListResponse {
+    pub(crate) rooms: Vec<RoomInfo>,
+    pub(crate) truncated: bool,
+    pub(crate) total: usize,
+}
+
+/// 房间调试日志中的一条转发记录。
+#[derive(Debug, Clone, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct MessageLogEntry {
+    pub(crate) at: u64,
+    #[serde(rename = "type")]
+    pub(crate) kind: String,
+    pub(crate) from: String,
+    pub(crate) to: Option<String>,
+    pub(crate) to_group: Option<String>,
+    pub(crate) payload_bytes: usize,
+    /// 未开启 `ROOM_MESSAGE_LOG_PAYLOADS` 时不记录 payload 内容。
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub(crate) payload: Option<Value>,
+}
+
+/// `GET /admin/rooms/{id}/log` 返回的房间调试日志。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomLogResponse {
+    pub(crate) room_id: String,
+    pub(crate) enabled: bool,
+    pub(crate) messages: Vec<MessageLogEntry>,
+}
+
+/// `/api/rooms/{id}/history` 返回的房间聊天记录。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomHistoryResponse {
+    pub(crate) room_id: String,
+    pub(crate) messages: Vec<SignalMessage>,
+}
+
+/// 从 `/proc/self/status` 读到的进程内存占用。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct ProcessMemory {
+    pub(crate) rss_bytes: u64,
+    pub(crate) peak_rss_bytes: u64,
 }
 
 /// WebRTC `iceServers` 中的单项配置。
@@ -56,10 +271,77 @@ pub(crate) struct SessionResponse {
     pub(crate) expires_in_seconds: u64,
 }
 
+/// 房间类 HTTP 接口的 query 参数。
+#[derive(Debug, Deserialize)]
+pub(crate) struct TenantParams {
+    pub(crate) tenant: Option<String>,
+}
+
+/// `GET /api/rooms/{id}/history` 的 query 参数。
+#[derive(Debug, Deserialize)]
+pub(crate) struct HistoryParams {
+    pub(crate) tenant: Option<String>,
+    /// `POST /api/rooms/{id}/verify` 签发的入场令牌，尚未加入房间时用它读取记录。
+    pub(crate) room_pass: Option<String>,
+}
+
+/// `POST /api/rooms/{id}/verify` 的请求体。
+#[derive(Debug, Deserialize)]
+pub(crate) struct RoomPasswordRequest {
+    pub(crate) password: String,
+}
+
+/// 房间密码校验通过后签发的入场令牌。
+#[derive(Debug, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub(crate) struct RoomPassResponse {
+    pub(crate) room_pass: String,
+    pub(crate) expires_at: u64,
+}
+
 /// WebSocket 建连时从 query 中提取的参数。
 #[derive(Debug, Deserialize)]
 pub(crate) struct ConnectParams {
     pub(crate) room: Option<String>,
     #[serde(default, rename = "private")]
     pub(crate) is_private: bool,
+    /// 建房时指定的房主离开策略：`transfer` / `close` / `ownerless`。
+    pub(crate) owner_leave: Option<String>,
+    /// 建房时指定：非房主成员需经房主审批才能入房。
+    #[serde(default)]
+    pub(crate) approval: bool,
+    /// 建房时指定的最长存活时间（毫秒），到期后不论是否有人都会关闭房间。
+    pub(crate) max_lifetime_ms: Option<u64>,
+    /// 建房时指定的消息数据保留策略：`none` / `session` / 保留毫秒数。
+    pub(crate) retention: Option<String>,
+    /// 成员在房间内的分组标签，用于分组广播。
+    pub(crate) group: Option<String>,
+    /// 成员在房间内的角色，如 `presenter`，其他成员可用 `toRole` 按角色寻址。
+    pub(crate) role: Option<String>,
+    /// 显示名，之后可用 `set_name` 修改；重名处理见 `DISPLAY_NAME_POLICY`。
+    pub(crate) name: Option<String>,
+    /// 以旁观身份加入：不能向房间广播，也不会成为房主。
+    #[serde(default)]
+    pub(crate) spectator: bool,
+    /// 客户端自报的应用版本，仅在管理接口中展示。
+    pub(crate) client_version: Option<String>,
+    /// 客户端能解码的 payload 压缩格式，目前只支持 `deflate-raw`；也可以放在 `hello` 的 payload 里。
+    pub(crate) compression: Option<String>,
+    /// 压缩本连接所发 payload 时希望使用的级别（1..=9），超出范围按边界处理；也可以放在 `hello` 的 payload 里。
+    pub(crate) compression_level: Option<u32>,
+    /// 客户端类别（如 `mobile` / `desktop`），按 `PING_PROFILES` 选用心跳参数；也可以放在 `hello` 的 payload 里。
+    pub(crate) client_class: Option<String>,
+    /// 密码房间的入场令牌，由 `POST /api/rooms/{id}/verify` 签发。
+    pub(crate) room_pass: Option<String>,
+    /// 客户端能解开服务端合并下发的 `batch` 帧；也可以放在 `hello` 的 payload 里。
+    #[serde(default)]
+    pub(crate) batch: bool,
+    /// 客户端实现的信令协议版本，未声明时视为当前版本；也可以放在 `hello` 的 payload 里。
+    pub(crate) protocol_version: Option<u32>,
+    /// 多租户模式下的租户标识，也可以写在路径里：`/ws/{tenant}`。
+    pub(crate) tenant: Option<String>,
+    /// 签名的消息类型授权令牌，限定该身份可以发送的消息类型。
+    pub(crate) grant: Option<String>,
+    /// 管理员监控模式：订阅房间号匹配该模式的广播，如 `room-prefix-*`。
+    pub(crate) subscribe: Option<String>,
 }
@@ -7,6 +7,53 @@ use std::{
 };
 
 use axum::http::HeaderMap;
+use uuid::Uuid;
+
+use crate::types::ProcessMemory;
+
+/// 租户内的房间在共享房间表中的键；未开启多租户时房间号保持原样。
+pub(crate) fn tenant_room_key(tenant: Option<&str>, room_id: &str) -> String {
+    match tenant {
+        Some(tenant) => format!("{tenant}/{room_id}"),
+        None => room_id.to_string(),
+    }
+}
+
+static LAST_SERVER_TIMESTAMP_MS: AtomicU64 = AtomicU64::new(0);
+
+/// 全实例单调递增的服务端时间戳：取墙上时钟，但总比上一次发出的值至少大 1。
+/// 同一毫秒内的多条消息会依次顺延，时钟回拨时也不会倒退。
+pub(crate) fn next_server_timestamp_ms() -> u64 {
+    let now = now_ms();
+    let previous = LAST_SERVER_TIMESTAMP_MS
+        .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |last| {
+            Some(now.max(last + 1))
+        })
+        .unwrap_or(now);
+    now.max(previous + 1)
+}
+
+/// 读取当前进程的常驻内存与峰值；非 Linux 平台或读取失败时返回 `None`。
+pub(crate) fn process_memory() -> Option<ProcessMemory> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let field_bytes = |name: &str| {
+        status
+            .lines()
+            .find_map(|line| line.strip_prefix(name))
+            .and_then(|rest| {
+                rest.trim()
+                    .trim_end_matches("kB")
+                    .trim()
+                    .parse::<u64>()
+                    .ok()
+            })
+            .map(|kib| kib * 1024)
+    };
+    Some(ProcessMemory {
+        rss_bytes: field_bytes("VmRSS:")?,
+        peak_rss_bytes: field_bytes("VmHWM:")?,
+    })
+}
 
 /// 判断当前请求在反向代理之后是否应视为 HTTPS。
 pub(crate) fn request_is_secure(headers: &HeaderMap) -> bool {
@@ -25,9 +72,43 @@ pub(crate) fn now_ms() -> u64 {
         .unwrap_or_default()
 }
 
+/// 在 `[min, max]` 中取一个随机值；随机源直接复用 UUID v4，避免额外依赖。
+pub(crate) fn random_between(min: u64, max: u64) -> u64 {
+    if max <= min {
+        return min;
+    }
+
+    let span = (max - min) as u128 + 1;
+    min + (Uuid::new_v4().as_u128() % span) as u64
+}
+
+#[cfg(test)]
+thread_local! {
+    static IGNORE_PROCESS_ENV: std::cell::Cell<bool> = const { std::cell::Cell::new(false) };
+}
+
+/// 读取单个环境变量；配置解析统一经过这里。
+/// 测试构造默认配置时会屏蔽进程环境，结果不随开发者 shell 里的变量变化。
+pub(crate) fn env_var(key: &str) -> Result<String, env::VarError> {
+    #[cfg(test)]
+    if IGNORE_PROCESS_ENV.with(std::cell::Cell::get) {
+        return Err(env::VarError::NotPresent);
+    }
+    env::var(key)
+}
+
+/// 在屏蔽进程环境变量的前提下执行 `f`，只供测试构造确定的配置。
+#[cfg(test)]
+pub(crate) fn without_process_env<T>(f: impl FnOnce() -> T) -> T {
+    IGNORE_PROCESS_ENV.with(|ignore| ignore.set(true));
+    let result = f();
+    IGNORE_PROCESS_ENV.with(|ignore| ignore.set(false));
+    result
+}
+
 /// 读取逗号分隔环境变量并去掉空白与空项。
 pub(crate) fn split_csv(key: &str) -> Vec<String> {
-    env::var(key)
+    env_var(key)
         .unwrap_or_default()
         .split(',')
         .filter_map(|value| {
@@ -62,7 +143,7 @@ pub(crate) fn filter_browser_unsafe_urls(urls: Vec<String>, enabled: bool) -> Ve
 
 /// 解析布尔型环境变量，兼容常见写法。
 pub(crate) fn env_bool(key: &str) -> Option<bool> {
-    env::var(key)
+    env_var(key)
         .ok()
         .and_then(|value| match value.trim().to_lowercase().as_str() {
             "1" | "true" | "yes" | "on" => Some(true),
@@ -71,6 +152,54 @@ pub(crate) fn env_bool(key: &str) -> Option<bool> {
         })
 }
 
+/// 解析数值型环境变量；缺失或格式不合法时返回 `None`，由调用方决定默认值。
+pub(crate) fn env_parse<T: std::str::FromStr>(key: &str) -> Option<T> {
+    env_var(key)
+        .ok()
+        .and_then(|value| value.trim().parse::<T>().ok())
+}
+
+/// 简单令牌桶：按固定速率回填，最多积攒 `burst` 个令牌。
+#[derive(Debug, Clone)]
+pub(crate) struct TokenBucket {
+    capacity: f64,
+    refill_per_ms: f64,
+    tokens: f64,
+    updated_at_ms: u64,
+}
+
+impl TokenBucket {
+    pub(crate) fn new(rate_per_second: f64, burst: f64) -> Self {
+        let capacity = burst.max(1.0);
+        Self {
+            capacity,
+            refill_per_ms: rate_per_second.max(0.0) / 1000.0,
+            tokens: capacity,
+            updated_at_ms: now_ms(),
+        }
+    }
+
+    /// 尝试取走一个令牌；桶空时返回 `false`。
+    pub(crate) fn try_take(&mut self) -> bool {
+        self.try_take_n(1.0)
+    }
+
+    /// 尝试一次取走 `amount` 个令牌，用于按字节计量的场景；余量不足时不扣减。
+    pub(crate) fn try_take_n(&mut self, amount: f64) -> bool {
+        let now = now_ms();
+        let elapsed_ms = now.saturating_sub(self.updated_at_ms) as f64;
+        self.tokens = (self.tokens + elapsed_ms * self.refill_per_ms).min(self.capacity);
+        self.updated_at_ms = now;
+
+        if self.tokens >= amount {
+            self.tokens -= amount;
+            true
+        } else {
+            false
+        }
+    }
+}
+
 /// 简单的限流告警状态，避免高频重复日志把真正的问题淹没。
 pub(crate) struct RateLimitedLogState {
     last_logged_at_ms: AtomicU64,
@@ -84,6 +213,12 @@ impl RateLimitedLogState {
             suppressed_count: AtomicU64::new(0),
         }
     }
+
+    /// 是否已经输出过至少一次告警。
+    #[cfg(test)]
+    pub(crate) fn has_logged(&self) -> bool {
+        self.last_logged_at_ms.load(Ordering::Relaxed) != 0
+    }
 }
 
 /// 判断当前是否应该输出一次限流告警；返回值为本次一并带出的 suppressed 数量。
@@ -1,9 +1,10 @@
 //! WebSocket 信令、房间管理与连接回收逻辑。
 
 use std::{
-    collections::HashMap,
+    collections::{hash_map::DefaultHasher, HashMap, HashSet, VecDeque},
+    hash::{Hash, Hasher},
     sync::{
-        atomic::{AtomicU64, Ordering},
+        atomic::{AtomicU64, AtomicUsize, Ordering},
         Arc,
     },
     time::Duration,
@@ -12,80 +13,351 @@ use std::{
 use axum::{
     extract::{
         ws::{Message as WsMessage, WebSocket, WebSocketUpgrade},
-        Query, State,
+        Path, Query, State,
     },
     http::{
         header::{self},
         HeaderMap, StatusCode,
     },
-    response::IntoResponse,
+    response::Response,
+};
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use futures_util::{
+    future::join_all,
+    sink::{Sink, SinkExt},
+    stream::{Stream, StreamExt},
 };
-use futures_util::{sink::SinkExt, stream::StreamExt};
 use serde_json::Value;
-use tokio::sync::{mpsc, watch};
-use tracing::{error, info, warn};
+use tokio::sync::{oneshot, watch};
+use tracing::{debug, error, info, warn};
 use uuid::Uuid;
 
 use crate::{
-    app::{AppContext, ConnectionHandle, OutboundMessage, RoomState},
-    session::parse_session_cookie,
-    types::{ConnectParams, SignalMessage},
-    utils::{now_ms, take_rate_limited_log_count, RateLimitedLogState},
+    admin::authorize_admin,
+    api_error::ApiError,
+    app::{
+        room_tenant, AppContext, AppState, ConnectionHandle, ConnectionTable, FloorState,
+        HeldMessages, LobbyEvent, OutboundMessage, RoomOptions, RoomState,
+    },
+    auth::AuthorizedConnection,
+    bots::{answer_as_bot, virtual_bot_for},
+    compress::{clamp_compression_level, deflate_raw},
+    config::{
+        AppConfig, BackpressurePolicy, ChatContentPolicy, DisplayNamePolicy, MessageRateLimits,
+        OwnerLeavePolicy, PingProfile, RetentionPolicy,
+    },
+    dead_letter::{report_dead_letter, DeadLetterReason, DeadLetterSink},
+    monitor::{handle_subscriber, room_matches},
+    outbound::{InFlightToken, OutboundQueue, OutboundSender, SendError},
+    recorder::tap_message,
+    reorder::ReorderBuffer,
+    routes::{maintenance_response, reconnect_limited_response},
+    session::{room_pseudonym, verify_room_pass},
+    transform::apply_transforms,
+    types::{
+        ConnectParams, SignalMessage, PAYLOAD_ENCODING_DEFLATE_RAW, ROSTER_OBJECTS_MIN_VERSION,
+    },
+    utils::{
+        next_server_timestamp_ms, now_ms, random_between, take_rate_limited_log_count,
+        tenant_room_key, RateLimitedLogState, TokenBucket,
+    },
 };
 
+/// 信令协议版本，随 `welcome` 下发给客户端。
+const PROTOCOL_VERSION: u32 = 2;
+/// 未声明协议版本的客户端按此版本对待，早于对象形式成员列表的客户端无需改动。
+const DEFAULT_CLIENT_PROTOCOL_VERSION: u32 = 1;
 const WS_HEARTBEAT_TIMEOUT_MS: u64 = 20_000;
 const WS_STALE_SWEEP_INTERVAL_MS: u64 = 5_000;
-const WS_SERVER_PING_INTERVAL_MS: u64 = 8_000;
-const INVALID_SESSION_WARN_INTERVAL_MS: u64 = 30_000;
-static INVALID_SESSION_WARN_STATE: RateLimitedLogState = RateLimitedLogState::new();
+pub(crate) const WS_SERVER_PING_INTERVAL_MS: u64 = 8_000;
+const WS_SHUTDOWN_FLUSH_MS: u64 = 1_000;
+const CLIENT_METADATA_MAX_CHARS: usize = 256;
+const BROADCAST_DEDUP_MAX_ENTRIES: usize = 64;
+const FANOUT_WARN_INTERVAL_MS: u64 = 10_000;
+static FANOUT_WARN_STATE: RateLimitedLogState = RateLimitedLogState::new();
+/// 正在运行的读写循环数，每个已注册连接各占一个 reader 和一个 writer。
+static ACTIVE_PUMPS: AtomicUsize = AtomicUsize::new(0);
+/// `call_state` 消息允许的状态取值。
+const CALL_STATES: &[&str] = &["ringing", "connected", "on_hold", "ended"];
 
-/// WebSocket 升级入口：校验来源、校验匿名会话、提取房间参数。
+/// WebSocket 升级入口：校验来源，再交给 `Authorizer` 确定身份与房间。
 pub(crate) async fn ws_handler(
     State(context): State<Arc<AppContext>>,
     Query(params): Query<ConnectParams>,
     headers: HeaderMap,
     ws: WebSocketUpgrade,
-) -> Result<impl IntoResponse, StatusCode> {
+) -> Result<Response, ApiError> {
+    upgrade_websocket(context, params, headers, ws).await
+}
+
+/// 多租户部署的路径形式入口：`/ws/{tenant}`，路径中的租户优先于 query。
+pub(crate) async fn ws_tenant_handler(
+    State(context): State<Arc<AppContext>>,
+    Path(tenant): Path<String>,
+    Query(mut params): Query<ConnectParams>,
+    headers: HeaderMap,
+    ws: WebSocketUpgrade,
+) -> Result<Response, ApiError> {
+    params.tenant = Some(tenant);
+    upgrade_websocket(context, params, headers, ws).await
+}
+
+/// 按配置调整升级后连接的读写缓冲；未配置的项保持底层库默认值。
+fn configure_upgrade(config: &AppConfig, mut ws: WebSocketUpgrade) -> WebSocketUpgrade {
+    if let Some(size) = config.ws_read_buffer_size {
+        ws = ws.read_buffer_size(size);
+    }
+    if let Some(size) = config.ws_write_buffer_size {
+        ws = ws.write_buffer_size(size);
+    }
+    ws
+}
+
+/// 交给部署配置的 `Authorizer` 确定连接身份，授权器放行的保留身份同样拒绝。
+fn authorize_upgrade(
+    context: &AppContext,
+    headers: &HeaderMap,
+    params: &ConnectParams,
+) -> Result<AuthorizedConnection, ApiError> {
+    let authorized = context
+        .authorizer
+        .authorize(&context.config, headers, params)
+        .map_err(|err| {
+            debug!("rejecting websocket upgrade: {}", err.reason);
+            ApiError::from_status(err.status)
+        })?;
+    // 系统消息的发送方标识是保留身份，客户端冒用它就能伪造服务端通知。
+    if authorized
+        .client_id
+        .eq_ignore_ascii_case(&context.config.server_sender_id)
+    {
+        warn!("rejecting websocket upgrade using the reserved sender identity");
+        return Err(ApiError::new(StatusCode::FORBIDDEN, "reserved_identity"));
+    }
+    Ok(authorized)
+}
+
+/// 连接在房间内使用的身份与真实身份。
+/// 开启化名后，从审批到转发的所有房间内流程都只看到化名，化名本身即可用于单播寻址。
+fn room_identity(config: &AppConfig, room_id: &str, client_id: String) -> (String, Option<String>) {
+    if config.pseudonymous_ids {
+        let pseudonym = room_pseudonym(config, room_id, &client_id);
+        (pseudonym, Some(client_id))
+    } else {
+        (client_id, None)
+    }
+}
+
+async fn upgrade_websocket(
+    context: Arc<AppContext>,
+    params: ConnectParams,
+    headers: HeaderMap,
+    ws: WebSocketUpgrade,
+) -> Result<Response, ApiError> {
+    // 维护模式只挡新连接，已建立的连接不受影响。
+    if context.maintenance.load(Ordering::Relaxed) {
+        return Ok(maintenance_response(&context.config));
+    }
+
     let origin = headers
         .get(header::ORIGIN)
         .and_then(|value| value.to_str().ok());
 
     if !context.config.request_origin_allowed(&headers) {
         warn!("rejecting websocket upgrade from origin {:?}", origin);
-        return Err(StatusCode::FORBIDDEN);
+        return Err(ApiError::new(StatusCode::FORBIDDEN, "origin_not_allowed"));
     }
 
-    let Some(session) = parse_session_cookie(&context.config, &headers) else {
-        if let Some(suppressed_count) = take_rate_limited_log_count(
-            &INVALID_SESSION_WARN_STATE,
-            INVALID_SESSION_WARN_INTERVAL_MS,
-        ) {
-            if suppressed_count > 0 {
-                warn!(
-                    "rejecting websocket upgrade without a valid anonymous session (suppressed {} similar events in the last {}s)",
-                    suppressed_count,
-                    INVALID_SESSION_WARN_INTERVAL_MS / 1000
-                );
-            } else {
-                warn!("rejecting websocket upgrade without a valid anonymous session");
-            }
+    // 监控连接走管理员鉴权，不占用房间身份。
+    if let Some(pattern) = params
+        .subscribe
+        .as_deref()
+        .map(str::trim)
+        .filter(|value| !value.is_empty())
+    {
+        authorize_admin(&context.config, &headers)?;
+        let pattern = pattern.to_string();
+        return Ok(configure_upgrade(&context.config, ws)
+            .on_upgrade(move |socket| handle_subscriber(context, socket, pattern)));
+    }
+
+    let tenant = context
+        .config
+        .resolve_tenant(params.tenant.as_deref())
+        .map_err(|code| {
+            debug!("rejecting websocket upgrade: {code}");
+            ApiError::new(StatusCode::BAD_REQUEST, code)
+        })?;
+
+    let AuthorizedConnection {
+        client_id,
+        room_id,
+        allowed_types,
+        anonymous,
+    } = authorize_upgrade(&context, &headers, &params)?;
+    // 卡在重连循环里的客户端会反复触发进出房间广播，超过次数后先让它冷却。
+    if context.config.reconnect_limit > 0 || context.config.read_timeout_limit > 0 {
+        let admitted = context.state.write().await.admit_connection_attempt(
+            &context.config,
+            &client_id,
+            now_ms(),
+        );
+        if let Err(retry_after_ms) = admitted {
+            debug!("refusing reconnect from {client_id} for {retry_after_ms}ms");
+            return Ok(reconnect_limited_response(retry_after_ms));
+        }
+    }
+    // 匿名连接单独设上限，刷满匿名名额后带凭证的用户仍可以建连。
+    if context.config.max_connections > 0 || context.config.max_anonymous_connections > 0 {
+        let limited = context.state.read().await.connection_limit_reached(
+            &context.config,
+            &client_id,
+            anonymous,
+        );
+        if let Some(code) = limited {
+            debug!("refusing websocket upgrade from {client_id}: {code}");
+            return Err(ApiError::new(StatusCode::SERVICE_UNAVAILABLE, code));
         }
-        return Err(StatusCode::UNAUTHORIZED);
+    }
+    // 不同租户的同名房间在房间表里使用不同的键，互不可见。
+    let room_id = tenant_room_key(tenant.as_deref(), &room_id);
+
+    // 别名解析成规范房间号，未登记的名字照常当作房间号；
+    // 房间可以在预建时收紧 Origin，这里要等拿到房间号后才能判断。
+    let (room_id, room_origin_allowed, room_password_required) = {
+        let state = context.state.read().await;
+        let room_id = state.canonical_room_id(room_id);
+        let room = state.rooms.get(&room_id);
+        let room_origin_allowed = room.map(|room| room.origin_allowed(origin)).unwrap_or(true);
+        let room_password_required = room.is_some_and(|room| room.password_hash.is_some());
+        (room_id, room_origin_allowed, room_password_required)
+    };
+    if !room_origin_allowed {
+        warn!(
+            "rejecting websocket upgrade to room {room_id} from origin {:?}",
+            origin
+        );
+        return Err(ApiError::new(StatusCode::FORBIDDEN, "origin_not_allowed"));
+    }
+    // 密码在 HTTP 预检时校验过，升级请求只认绑定本会话与房间的入场令牌。
+    if room_password_required
+        && !params
+            .room_pass
+            .as_deref()
+            .is_some_and(|token| verify_room_pass(&context.config, token, &room_id, &client_id))
+    {
+        debug!("rejecting websocket upgrade to password-protected room {room_id}");
+        return Err(ApiError::new(
+            StatusCode::FORBIDDEN,
+            "room_password_required",
+        ));
+    }
+    let (client_id, real_client_id) = room_identity(&context.config, &room_id, client_id);
+    let room_options = RoomOptions {
+        is_private: params.is_private,
+        owner_leave_policy: params
+            .owner_leave
+            .as_deref()
+            .and_then(OwnerLeavePolicy::parse)
+            .unwrap_or(context.config.owner_leave_policy),
+        allowed_origins: Vec::new(),
+        persistent: false,
+        message_log: context.config.room_message_log,
+        approval_required: params.approval,
+        max_lifetime_ms: context.config.room_lifetime_ms(params.max_lifetime_ms),
+        retention: params
+            .retention
+            .as_deref()
+            .and_then(RetentionPolicy::parse)
+            .or(context.config.room_retention),
     };
-    let room_id = params
-        .room
-        .filter(|value| !value.trim().is_empty())
-        .unwrap_or_else(|| "default".to_string());
 
-    Ok(ws.on_upgrade(move |socket| {
-        handle_socket(
-            context,
-            socket,
-            session.client_id,
-            room_id,
-            params.is_private,
-        )
-    }))
+    let client_options = ClientOptions {
+        allowed_types,
+        group: params
+            .group
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty()),
+        role: params
+            .role
+            .map(|value| value.trim().to_string())
+            .filter(|value| !value.is_empty()),
+        display_name: params.name.as_deref().and_then(client_metadata),
+        spectator: params.spectator,
+        user_agent: headers
+            .get(header::USER_AGENT)
+            .and_then(|value| value.to_str().ok())
+            .and_then(client_metadata),
+        client_version: params.client_version.as_deref().and_then(client_metadata),
+        protocol_version: params
+            .protocol_version
+            .unwrap_or(DEFAULT_CLIENT_PROTOCOL_VERSION),
+        accepts_compression: params.compression.as_deref() == Some(PAYLOAD_ENCODING_DEFLATE_RAW),
+        accepts_batch: params.batch,
+        compression_level: params
+            .compression_level
+            .map(clamp_compression_level)
+            .unwrap_or(context.config.payload_compression_level),
+        ping_profile: ping_profile_for(&context.config, params.client_class.as_deref()),
+        anonymous,
+        real_client_id,
+    };
+
+    Ok(
+        configure_upgrade(&context.config, ws).on_upgrade(move |socket| {
+            handle_socket(
+                context,
+                socket,
+                client_id,
+                room_id,
+                room_options,
+                client_options,
+            )
+        }),
+    )
+}
+
+/// 建连时由客户端声明、随连接保存的成员属性。
+struct ClientOptions {
+    group: Option<String>,
+    role: Option<String>,
+    display_name: Option<String>,
+    spectator: bool,
+    user_agent: Option<String>,
+    client_version: Option<String>,
+    /// 决定出站时按哪一版协议改写消息类型。
+    protocol_version: u32,
+    accepts_compression: bool,
+    /// 能解开服务端合并下发的 `batch` 帧。
+    accepts_batch: bool,
+    compression_level: u8,
+    /// 按客户端类别选定的 Ping 间隔与心跳超时。
+    ping_profile: PingProfile,
+    allowed_types: Option<HashSet<String>>,
+    anonymous: bool,
+    /// 开启化名时的真实身份，房间内只使用化名。
+    real_client_id: Option<String>,
+}
+
+/// 按客户端自报的类别选用心跳参数；未声明或未配置的类别使用默认的间隔与超时。
+fn ping_profile_for(config: &AppConfig, class: Option<&str>) -> PingProfile {
+    class
+        .map(|class| class.trim().to_ascii_lowercase())
+        .and_then(|class| config.ping_profiles.get(&class).copied())
+        .unwrap_or(PingProfile {
+            interval_ms: WS_SERVER_PING_INTERVAL_MS,
+            timeout_ms: WS_HEARTBEAT_TIMEOUT_MS,
+        })
+}
+
+/// 客户端自报的元数据只做展示用途，截断到固定长度避免撑大内存。
+fn client_metadata(value: &str) -> Option<String> {
+    let value = value.trim();
+    if value.is_empty() {
+        return None;
+    }
+
+    Some(value.chars().take(CLIENT_METADATA_MAX_CHARS).collect())
 }
 
 /// 周期性扫描长时间未活跃的连接，避免浏览器异常退出后状态残留。
@@ -96,6 +368,18 @@ pub(crate) async fn run_stale_connection_reaper(context: Arc<AppContext>) {
     loop {
         interval.tick().await;
         reap_stale_connections(&context).await;
+        reap_spectator_only_rooms(&context).await;
+        reap_unpaired_rooms(&context).await;
+        reap_expired_rooms(&context).await;
+        purge_expired_retention(&context).await;
+        enforce_retained_memory_budget(&context).await;
+        if context.config.reconnect_limit > 0 || context.config.read_timeout_limit > 0 {
+            context
+                .state
+                .write()
+                .await
+                .prune_reconnect_history(&context.config, now_ms());
+        }
     }
 }
 
@@ -105,84 +389,196 @@ async fn handle_socket(
     socket: WebSocket,
     client_id: String,
     room_id: String,
-    is_private: bool,
+    room_options: RoomOptions,
+    mut client_options: ClientOptions,
 ) {
     let connection_id = Uuid::new_v4();
     let (mut sink, mut stream) = socket.split();
-    let (sender, mut receiver) = mpsc::unbounded_channel::<OutboundMessage>();
+
+    // 握手阶段尚未占用房间名额；超时未完成就直接断开，避免空连接长期挂起。
+    if context.config.require_hello {
+        let Some(hello) = await_hello(&mut stream, context.config.hello_timeout_ms).await else {
+            warn!("closing websocket for {client_id}: no hello within the pre-auth timeout");
+            let _ = sink.send(WsMessage::Close(None)).await;
+            return;
+        };
+        if let Some(version) = hello
+            .payload
+            .get("protocolVersion")
+            .and_then(Value::as_u64)
+            .and_then(|version| u32::try_from(version).ok())
+        {
+            client_options.protocol_version = version;
+        }
+        if hello.payload.get("compression").and_then(Value::as_str)
+            == Some(PAYLOAD_ENCODING_DEFLATE_RAW)
+        {
+            client_options.accepts_compression = true;
+        }
+        if let Some(level) = hello
+            .payload
+            .get("compressionLevel")
+            .and_then(Value::as_u64)
+        {
+            client_options.compression_level =
+                clamp_compression_level(u32::try_from(level).unwrap_or(u32::MAX));
+        }
+        if hello.payload.get("batch").and_then(Value::as_bool) == Some(true) {
+            client_options.accepts_batch = true;
+        }
+        if let Some(class) = hello.payload.get("clientClass").and_then(Value::as_str) {
+            client_options.ping_profile = ping_profile_for(&context.config, Some(class));
+        }
+    }
+
+    match await_join_approval(&context, &mut stream, &client_id, &room_id).await {
+        JoinApproval::NotRequired | JoinApproval::Approved => {}
+        JoinApproval::Disconnected => return,
+        rejected => {
+            let reason = if matches!(rejected, JoinApproval::TimedOut) {
+                "timeout"
+            } else {
+                "denied"
+            };
+            info!("join request from {client_id} to room {room_id} was not approved ({reason})");
+            let notice = SignalMessage::server(
+                &context.config,
+                "join_denied",
+                Value::String(reason.to_string()),
+            );
+            if let Ok(text) = serde_json::to_string(&notice) {
+                let _ = sink.send(WsMessage::Text(text.into())).await;
+            }
+            let _ = sink.send(WsMessage::Close(None)).await;
+            return;
+        }
+    }
+    let sender = OutboundQueue::new(
+        context.config.outbound_queue_capacity,
+        context.config.backpressure.clone(),
+    );
+    let receiver = sender.clone();
     let (shutdown_sender, mut shutdown_receiver) = watch::channel(false);
+    let type_aliases = type_aliases_for(&context.config, client_options.protocol_version);
+    let accepts_compression = client_options.accepts_compression;
+    let mut inbound = InboundState::new(&context.config, &client_options);
+    let ping_interval_ms = client_options.ping_profile.interval_ms;
+    let batch_max_messages = if client_options.accepts_batch {
+        context.config.outbound_batch_max_messages
+    } else {
+        0
+    };
+    let batch_max_bytes = context.config.outbound_batch_max_bytes;
 
-    let registration = register_connection(
+    let registration = match register_connection(
         &context,
         connection_id,
         client_id.clone(),
         room_id.clone(),
-        is_private,
+        room_options,
+        client_options,
         sender.clone(),
         shutdown_sender.clone(),
     )
-    .await;
-
-    // 新用户加入时，先把已在房间中的成员列表发给它，方便前端发起点对点协商。
-    if let Some(existing_users) = registration.existing_users {
-        let _ = sender.send(OutboundMessage::Json(SignalMessage {
-            kind: "existing_users".to_string(),
-            payload: Value::Array(existing_users.into_iter().map(Value::String).collect()),
-            from: "server".to_string(),
-            to: None,
-        }));
-    }
+    .await
+    {
+        Ok(registration) => registration,
+        Err(err) => {
+            let notice = registration_refusal(&context.config, &err);
+            info!(
+                "refusing to register {client_id} in room {room_id}: {}",
+                notice.payload["code"]
+            );
+            if let Ok(text) = serde_json::to_string(&notice) {
+                let _ = sink.send(WsMessage::Text(text.into())).await;
+            }
+            let _ = sink.send(WsMessage::Close(None)).await;
+            return;
+        }
+    };
 
     // 同一个匿名用户重新连入时，主动挤掉旧连接，避免一个 client_id 挂两条 socket。
     if let Some(replaced) = registration.replaced_connection {
-        let _ = replaced.shutdown.send(true);
-        let _ = replaced.sender.send(OutboundMessage::Close);
+        replaced.close();
     }
 
-    broadcast_outbound(
-        &registration.join_recipients,
-        SignalMessage {
-            kind: "user_joined".to_string(),
-            payload: Value::Null,
-            from: client_id.clone(),
-            to: None,
-        },
-    );
+    let mut payload = registration
+        .display_name
+        .as_ref()
+        .map(|name| serde_json::json!({ "name": name }))
+        .unwrap_or(Value::Null);
+    // 宽限期内重连的成员对其他人来说一直在房间里，客户端据此跳过进出动画，只需重新协商连接。
+    if registration.resumed {
+        if payload.is_null() {
+            payload = serde_json::json!({});
+        }
+        payload["resumed"] = Value::Bool(true);
+    }
+    let user_joined = SignalMessage {
+        kind: "user_joined".to_string(),
+        payload,
+        from: client_id.clone(),
+        ..Default::default()
+    };
+    for (member_id, recipient) in &registration.join_recipients {
+        let _ = recipient.send(OutboundMessage::Json(user_joined.clone()));
+        // 已有成员各自收到自己相对新成员的角色，与新成员在 `joined` 里拿到的正好相反。
+        if context.config.peer_role_hints {
+            let _ = recipient.send(OutboundMessage::Json(SignalMessage::server(
+                &context.config,
+                "role",
+                serde_json::json!({
+                    "peerId": client_id,
+                    "role": peer_role(member_id, &client_id),
+                }),
+            )));
+        }
+    }
 
     info!("client {client_id} joined room {room_id}");
 
-    // writer 独占 socket 写端，避免多处并发写入导致协议混乱。
-    let writer = tokio::spawn(async move {
-        while let Some(message) = receiver.recv().await {
-            let result = match message {
-                OutboundMessage::Json(payload) => {
-                    let text = match serde_json::to_string(&payload) {
-                        Ok(text) => text,
-                        Err(err) => {
-                            error!("failed to serialize outbound websocket payload: {err}");
-                            continue;
-                        }
-                    };
-                    sink.send(WsMessage::Text(text.into())).await
-                }
-                // 由服务端定时发 Ping，浏览器会自动回 Pong；reader 收到 Pong 后会刷新活跃时间。
-                OutboundMessage::Ping => sink.send(WsMessage::Ping(Vec::new().into())).await,
-                OutboundMessage::Close => {
-                    let _ = sink.send(WsMessage::Close(None)).await;
-                    break;
-                }
-            };
-
-            if result.is_err() {
-                break;
-            }
-        }
+    // 按字节计量下行流量；超出预算时只丢低优先级消息，信令等 `block` 类消息照常发送。
+    let egress_bucket = (context.config.client_egress_bytes_per_second > 0.0).then(|| {
+        TokenBucket::new(
+            context.config.client_egress_bytes_per_second,
+            context.config.client_egress_burst_bytes,
+        )
     });
 
+    // writer 独占 socket 写端，避免多处并发写入导致协议混乱。
+    let mut writer = tokio::spawn(run_writer(
+        sink,
+        receiver,
+        WriterOptions {
+            room_id: room_id.clone(),
+            type_aliases,
+            accepts_compression,
+            batch_max_messages,
+            batch_max_bytes,
+            server_sender_id: context.config.server_sender_id.clone(),
+            dead_letters: context.dead_letters.clone(),
+            egress_bucket,
+            backpressure: context.config.backpressure.clone(),
+        },
+    ));
+
     // reader 负责收消息、更新时间戳，并在必要时退出整个连接生命周期。
-    let mut ping_interval =
-        tokio::time::interval(Duration::from_millis(WS_SERVER_PING_INTERVAL_MS));
+    let mut ping_interval = tokio::time::interval(Duration::from_millis(ping_interval_ms));
+    // 关联链排序只看本连接自己发出的消息，缓冲随读循环一起结束。
+    let mut reorder = (context.config.correlation_reorder_max > 0).then(|| {
+        ReorderBuffer::new(
+            context.config.correlation_reorder_max,
+            context.config.correlation_reorder_timeout_ms,
+        )
+    });
+    let mut reorder_interval = tokio::time::interval(Duration::from_millis(
+        (context.config.correlation_reorder_timeout_ms / 4).max(10),
+    ));
+    reorder_interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Skip);
+    let mut shutdown_requested = false;
+    let mut warned_message_types = false;
     ping_interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Skip);
+    let _pump = PumpGuard::enter();
 
     loop {
         tokio::select! {
@@ -195,7 +591,46 @@ async fn handle_socket(
                     Ok(WsMessage::Text(text)) => {
                         touch_connection(&context, connection_id).await;
                         match serde_json::from_str::<SignalMessage>(&text) {
-                            Ok(message) => route_message(&context, connection_id, message).await,
+                            Ok(message) => {
+                                let messages = match unpack_batch(&context.config, message) {
+                                    Ok(messages) => messages,
+                                    Err(code) => {
+                                        send_error(&context.config, &sender, code, "batch rejected");
+                                        continue;
+                                    }
+                                };
+
+                                let max_types = context.config.max_distinct_message_types;
+                                let mut over_type_limit = false;
+                                for message in messages {
+                                    if inbound.exceeds_type_limit(max_types, &message.kind) {
+                                        if context.config.distinct_message_types_disconnect {
+                                            warn!("closing websocket for {client_id}: used more than {max_types} distinct message types");
+                                            over_type_limit = true;
+                                            break;
+                                        }
+                                        if !warned_message_types {
+                                            warn!("client {client_id} used more than {max_types} distinct message types");
+                                            warned_message_types = true;
+                                        }
+                                    }
+                                    let ready = match reorder.as_mut() {
+                                        Some(buffer) => buffer.accept(message, now_ms()),
+                                        // 未开启排序时 `seqGap` 同样只能由服务端标注。
+                                        None => vec![SignalMessage {
+                                            seq_gap: None,
+                                            ..message
+                                        }],
+                                    };
+                                    for message in ready {
+                                        notify_sequence_gap(&context.config, &sender, &message);
+                                        route_message(&context, connection_id, &mut inbound, message).await;
+                                    }
+                                }
+                                if over_type_limit {
+                                    break;
+                                }
+                            }
                             Err(err) => warn!("ignoring invalid websocket payload from {client_id}: {err}"),
                         }
                     }
@@ -214,282 +649,6208 @@ async fn handle_socket(
                     break;
                 }
             }
+            _ = reorder_interval.tick(), if reorder.is_some() => {
+                let ready = reorder
+                    .as_mut()
+                    .map(|buffer| buffer.flush_expired(now_ms()))
+                    .unwrap_or_default();
+                for message in ready {
+                    notify_sequence_gap(&context.config, &sender, &message);
+                    route_message(&context, connection_id, &mut inbound, message).await;
+                }
+            }
             changed = shutdown_receiver.changed() => {
                 if changed.is_err() || *shutdown_receiver.borrow() {
+                    shutdown_requested = true;
                     break;
                 }
             }
         }
     }
 
+    // 服务端主动关闭时，先让 writer 把已排队的通知和 Close 帧发完。
+    if shutdown_requested {
+        let _ =
+            tokio::time::timeout(Duration::from_millis(WS_SHUTDOWN_FLUSH_MS), &mut writer).await;
+    }
     writer.abort();
+    sender.close();
     unregister_connection(&context, connection_id, false).await;
 }
 
-/// 被新连接顶掉的旧连接句柄。
-struct ReplacedConnection {
-    sender: mpsc::UnboundedSender<OutboundMessage>,
-    shutdown: watch::Sender<bool>,
-}
-
-/// 新连接注册完成后，需要返回给调用方的附带信息。
-struct RegistrationResult {
-    existing_users: Option<Vec<String>>,
-    join_recipients: Vec<mpsc::UnboundedSender<OutboundMessage>>,
-    replaced_connection: Option<ReplacedConnection>,
-}
-
-/// 把新连接加入房间，并返回需要广播和补发的数据。
-async fn register_connection(
-    context: &Arc<AppContext>,
-    connection_id: Uuid,
-    client_id: String,
+/// writer 在建连时就确定下来的出站参数。
+struct WriterOptions {
     room_id: String,
-    is_private: bool,
-    sender: mpsc::UnboundedSender<OutboundMessage>,
-    shutdown: watch::Sender<bool>,
-) -> RegistrationResult {
-    let mut state = context.state.write().await;
-    // 房间不存在时按当前连接携带的属性创建。
-    let room = state
-        .rooms
-        .entry(room_id.clone())
-        .or_insert_with(|| RoomState {
-            id: room_id.clone(),
-            created_at_ms: now_ms(),
-            is_private,
-            clients: HashMap::new(),
-        });
+    /// 按接收方协议版本改写的消息类型。
+    type_aliases: HashMap<String, String>,
+    accepts_compression: bool,
+    batch_max_messages: usize,
+    batch_max_bytes: usize,
+    /// 合并后的 `batch` 帧以服务端身份发出。
+    server_sender_id: String,
+    /// 排队中过期的单播作为死信转交。
+    dead_letters: Option<DeadLetterSink>,
+    egress_bucket: Option<TokenBucket>,
+    backpressure: Arc<BackpressurePolicy>,
+}
 
-    // 记录加入前已有的成员列表，用于前端建立已有 peer 的连接。
-    let existing_users = room
-        .clients
-        .keys()
-        .filter(|id| *id != &client_id)
+/// 接收方协议版本对应的类型改名表；没有配置时原样下发。
+fn type_aliases_for(config: &AppConfig, protocol_version: u32) -> HashMap<String, String> {
+    config
+        .message_type_aliases
+        .get(&protocol_version)
         .cloned()
-        .collect::<Vec<_>>();
+        .unwrap_or_default()
+}
 
-    // 如果同一 client_id 已存在，则旧连接会被挤掉。
-    let replaced_connection_id = room.clients.insert(client_id.clone(), connection_id);
-    let recipient_connection_ids = room
-        .clients
-        .iter()
-        .filter_map(|(id, member_connection_id)| {
-            if id == &client_id {
-                None
-            } else {
-                Some(*member_connection_id)
+/// 把出站队列里的消息依次写到 socket，写出 Close 帧、队列关闭或写失败后退出，并交还写端。
+async fn run_writer<S>(mut sink: S, receiver: OutboundSender, options: WriterOptions) -> S
+where
+    S: Sink<WsMessage> + Unpin,
+{
+    let _pump = PumpGuard::enter();
+    let WriterOptions {
+        room_id: writer_room_id,
+        type_aliases,
+        accepts_compression,
+        batch_max_messages,
+        batch_max_bytes,
+        server_sender_id,
+        dead_letters,
+        mut egress_bucket,
+        backpressure,
+    } = options;
+    // 把一条出站消息处理成最终发送的文本；过期或超出下行预算被丢弃时返回 `None`。
+    let mut encode = |mut payload: SignalMessage| -> Option<String> {
+        // 处理结束时副本已写出或被跳过，发送方的在途计数随之释放。
+        let _in_flight = payload.in_flight.take();
+        // 在慢客户端的队列里排到时已经过期的消息，对接收方没有意义了。
+        if payload
+            .expires_at
+            .is_some_and(|expires_at| now_ms() > expires_at)
+        {
+            debug!(
+                "skipping expired {} message from {}",
+                payload.kind, payload.from
+            );
+            if let Some(target) = payload.to.as_deref() {
+                report_dead_letter(
+                    dead_letters.as_ref(),
+                    &writer_room_id,
+                    target,
+                    DeadLetterReason::Expired,
+                    &payload,
+                );
             }
-        })
-        .collect::<Vec<_>>();
-
-    let replaced_connection = replaced_connection_id.and_then(|old_connection_id| {
-        state
-            .connections
-            .remove(&old_connection_id)
-            .map(|connection| ReplacedConnection {
-                sender: connection.sender,
-                shutdown: connection.shutdown,
-            })
-    });
-
-    state.connections.insert(
-        connection_id,
-        ConnectionHandle {
-            client_id,
-            room_id,
-            sender,
-            last_seen_ms: Arc::new(AtomicU64::new(now_ms())),
-            shutdown,
-        },
-    );
-
-    let join_recipients = recipient_connection_ids
-        .iter()
-        .filter_map(|connection_id| {
-            state
-                .connections
-                .get(connection_id)
-                .map(|connection| connection.sender.clone())
-        })
-        .collect::<Vec<_>>();
+            return None;
+        }
+        // 混合版本的房间里，按接收方的协议版本换成它认识的类型名。
+        if let Some(kind) = type_aliases.get(&payload.kind) {
+            payload.kind = kind.clone();
+        }
+        // 只有收发双方都声明支持时才换成压缩版本，其余接收方拿到原文。
+        if let Some(compressed) = payload.compressed_payload.take() {
+            if accepts_compression {
+                payload.payload = Value::String(compressed.as_ref().clone());
+                payload.encoding = Some(PAYLOAD_ENCODING_DEFLATE_RAW.to_string());
+            }
+        }
+        let text = match serde_json::to_string(&payload) {
+            Ok(text) => text,
+            Err(err) => {
+                error!("failed to serialize outbound websocket payload: {err}");
+                return None;
+            }
+        };
+        if let Some(bucket) = egress_bucket.as_mut() {
+            let within_budget = bucket.try_take_n(text.len() as f64);
+            if !within_budget && backpressure.is_low_priority(&payload.kind) {
+                debug!(
+                    "shedding {} message ({} bytes) over the egress budget",
+                    payload.kind,
+                    text.len()
+                );
+                return None;
+            }
+        }
+        Some(text)
+    };
+    while let Some(message) = receiver.recv().await {
+        let result = match message {
+            OutboundMessage::Json(payload) => {
+                let Some(mut text) = encode(payload) else {
+                    continue;
+                };
+                // 队列里还有积压时一次取走多条，合并成一个 `batch` 帧写出；只有一条时照常单独发送。
+                if batch_max_messages > 1 {
+                    let mut frames = vec![text];
+                    let mut bytes = frames[0].len();
+                    while frames.len() < batch_max_messages && bytes < batch_max_bytes {
+                        let Some(payload) = receiver.try_recv_json() else {
+                            break;
+                        };
+                        if let Some(frame) = encode(payload) {
+                            bytes += frame.len();
+                            frames.push(frame);
+                        }
+                    }
+                    text = match frames.len() {
+                        1 => frames.remove(0),
+                        _ => format!(
+                            "{{\"type\":\"batch\",\"from\":{},\"payload\":[{}]}}",
+                            Value::from(server_sender_id.as_str()),
+                            frames.join(",")
+                        ),
+                    };
+                }
+                sink.send(WsMessage::Text(text.into())).await
+            }
+            // 由服务端定时发 Ping，浏览器会自动回 Pong；reader 收到 Pong 后会刷新活跃时间。
+            OutboundMessage::Ping => sink.send(WsMessage::Ping(Vec::new().into())).await,
+            OutboundMessage::Probe(ack) => {
+                ack.notify_one();
+                continue;
+            }
+            OutboundMessage::Close => {
+                let _ = sink.send(WsMessage::Close(None)).await;
+                break;
+            }
+        };
 
-    RegistrationResult {
-        existing_users: if existing_users.is_empty() {
-            None
-        } else {
-            Some(existing_users)
-        },
-        join_recipients,
-        replaced_connection,
+        if result.is_err() {
+            break;
+        }
     }
+    sink
 }
 
-/// 从房间和全局连接表中移除连接，并按需广播离开事件。
-async fn unregister_connection(context: &Arc<AppContext>, connection_id: Uuid, close_socket: bool) {
-    let (room_id, client_id, recipients, removed_from_room, sender, shutdown) = {
-        let mut state = context.state.write().await;
-        let Some(connection) = state.connections.remove(&connection_id) else {
-            return;
-        };
+/// 关联链放弃等待缺号时告诉发送方从哪里断开，便于它重发缺失的消息。
+fn notify_sequence_gap(config: &AppConfig, sender: &OutboundSender, message: &SignalMessage) {
+    let Some(expected) = message.seq_gap else {
+        return;
+    };
+    let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+        config,
+        "sequence_gap",
+        serde_json::json!({
+            "correlationId": message.correlation_id,
+            "expected": expected,
+            "resumedAt": message.seq,
+        }),
+    )));
+}
 
-        let room_id = connection.room_id.clone();
-        let client_id = connection.client_id.clone();
-        let sender = connection.sender.clone();
-        let shutdown = connection.shutdown.clone();
+/// 把 `batch` 拆成内层消息，每条都按单独发送处理；未开启拆包时原样返回。
+/// 内层消息没写目标时继承外层的 `to` / `toGroup`，且不允许再嵌套 `batch`。
+fn unpack_batch(
+    config: &AppConfig,
+    message: SignalMessage,
+) -> Result<Vec<SignalMessage>, &'static str> {
+    if message.kind != "batch" || config.batch_max_messages == 0 {
+        return Ok(vec![message]);
+    }
 
-        let mut removed_from_room = false;
-        let mut recipient_connection_ids = Vec::new();
-        let mut should_remove_room = false;
+    let Value::Array(items) = message.payload else {
+        return Err("invalid_batch");
+    };
+    if items.len() > config.batch_max_messages {
+        return Err("batch_too_large");
+    }
 
-        if let Some(room) = state.rooms.get_mut(&room_id) {
-            if room.clients.get(&client_id) == Some(&connection_id) {
-                room.clients.remove(&client_id);
-                removed_from_room = true;
+    items
+        .into_iter()
+        .map(|item| {
+            let mut inner =
+                serde_json::from_value::<SignalMessage>(item).map_err(|_| "invalid_batch")?;
+            if inner.kind == "batch" {
+                return Err("invalid_batch");
+            }
+            if inner.to.is_none()
+                && inner.to_group.is_none()
+                && inner.to_many.is_none()
+                && inner.to_role.is_none()
+            {
+                inner.to = message.to.clone();
+                inner.to_group = message.to_group.clone();
+                inner.to_many = message.to_many.clone();
+                inner.to_role = message.to_role.clone();
             }
+            Ok(inner)
+        })
+        .collect()
+}
 
-            if room.clients.is_empty() {
-                should_remove_room = true;
-            } else {
-                recipient_connection_ids.extend(room.clients.values().copied());
+/// 等待客户端发来 `hello`；其他消息在握手完成前一律忽略。
+/// 超时、断开或读取出错时返回 `None`。
+async fn await_hello<S, E>(stream: &mut S, timeout_ms: u64) -> Option<SignalMessage>
+where
+    S: Stream<Item = Result<WsMessage, E>> + Unpin,
+{
+    let wait = async {
+        while let Some(result) = stream.next().await {
+            match result {
+                Ok(WsMessage::Text(text)) => {
+                    if let Ok(message) = serde_json::from_str::<SignalMessage>(&text) {
+                        if message.kind == "hello" {
+                            return Some(message);
+                        }
+                    }
+                }
+                Ok(WsMessage::Close(_)) | Err(_) => return None,
+                Ok(_) => {}
             }
         }
+        None
+    };
 
-        if should_remove_room {
-            state.rooms.remove(&room_id);
-        }
+    tokio::time::timeout(Duration::from_millis(timeout_ms), wait)
+        .await
+        .ok()
+        .flatten()
+}
 
-        let recipients = recipient_connection_ids
-            .iter()
-            .filter_map(|member_connection_id| {
-                state
-                    .connections
-                    .get(member_connection_id)
-                    .map(|member| member.sender.clone())
-            })
-            .collect::<Vec<_>>();
+/// 入房审批的结果。
+enum JoinApproval {
+    NotRequired,
+    Approved,
+    Denied,
+    TimedOut,
+    Disconnected,
+}
 
-        (
-            room_id,
-            client_id,
-            recipients,
-            removed_from_room,
-            sender,
-            shutdown,
-        )
+/// 需要房主审批的房间：先登记为待审批并通知房主，再等待审批结果。
+/// 待审批期间连接不在 `clients` 中，既收不到广播，也不会出现在成员列表里。
+async fn await_join_approval<S, E>(
+    context: &Arc<AppContext>,
+    stream: &mut S,
+    client_id: &str,
+    room_id: &str,
+) -> JoinApproval
+where
+    S: Stream<Item = Result<WsMessage, E>> + Unpin,
+{
+    let decision = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let Some(room) = state.rooms.get_mut(room_id) else {
+            return JoinApproval::NotRequired;
+        };
+        if !room.approval_required {
+            return JoinApproval::NotRequired;
+        }
+        // 房主本人重连、或当前没有在线房主时不走审批。
+        let owner_sender = room
+            .owner
+            .as_ref()
+            .filter(|owner| owner.as_str() != client_id)
+            .and_then(|owner| room.clients.get(owner))
+            .and_then(|owner_connection_id| state.connections.get(owner_connection_id))
+            .map(|owner| owner.sender.clone());
+        let Some(owner_sender) = owner_sender else {
+            return JoinApproval::NotRequired;
+        };
+
+        let (decision_sender, decision) = oneshot::channel();
+        room.pending_joins
+            .insert(client_id.to_string(), decision_sender);
+        let _ = owner_sender.send(OutboundMessage::Json(SignalMessage::server(
+            &context.config,
+            "join_request",
+            serde_json::json!({ "clientId": client_id }),
+        )));
+        decision
     };
 
-    if close_socket {
-        let _ = shutdown.send(true);
-        let _ = sender.send(OutboundMessage::Close);
+    let wait = async {
+        tokio::select! {
+            decision = decision => match decision {
+                Ok(true) => JoinApproval::Approved,
+                _ => JoinApproval::Denied,
+            },
+            _ = wait_for_disconnect(stream) => JoinApproval::Disconnected,
+        }
+    };
+    let outcome = tokio::time::timeout(
+        Duration::from_millis(context.config.join_approval_timeout_ms),
+        wait,
+    )
+    .await
+    .unwrap_or(JoinApproval::TimedOut);
+
+    // 等待方已经退出，清掉已无人接收的审批通道。
+    if !matches!(outcome, JoinApproval::Approved) {
+        if let Some(room) = context.state.write().await.rooms.get_mut(room_id) {
+            room.pending_joins
+                .retain(|_, decision_sender| !decision_sender.is_closed());
+        }
     }
 
-    if removed_from_room {
-        info!("client {client_id} left room {room_id}");
-        broadcast_outbound(
-            &recipients,
-            SignalMessage {
-                kind: "user_left".to_string(),
-                payload: Value::Null,
-                from: client_id,
-                to: None,
-            },
-        );
+    outcome
+}
+
+/// 读到 Close、出错或流结束时返回；其余消息在此阶段一律忽略。
+async fn wait_for_disconnect<S, E>(stream: &mut S)
+where
+    S: Stream<Item = Result<WsMessage, E>> + Unpin,
+{
+    while let Some(result) = stream.next().await {
+        if matches!(result, Ok(WsMessage::Close(_)) | Err(_)) {
+            return;
+        }
     }
 }
 
-/// 根据 `to` 字段路由单播或房间广播消息。
-async fn route_message(context: &Arc<AppContext>, connection_id: Uuid, mut message: SignalMessage) {
-    let recipients = {
+/// 当前实例开启的可选协议能力，供客户端按需适配。
+fn server_capabilities(config: &AppConfig) -> Vec<&'static str> {
+    let mut capabilities = vec![
+        "relay_data",
+        "group_broadcast",
+        "join_ack",
+        "role_routing",
+        "time",
+    ];
+    if config.chat_history_limit > 0 {
+        capabilities.push("chat_history");
+    }
+    if config.require_hello {
+        capabilities.push("hello");
+    }
+    if config.peer_role_hints {
+        capabilities.push("peer_roles");
+    }
+    if config.payload_compression_min_bytes > 0 {
+        capabilities.push(PAYLOAD_ENCODING_DEFLATE_RAW);
+    }
+    if config.outbound_batch_max_messages > 1 {
+        capabilities.push("outbound_batch");
+    }
+    if config.correlation_reorder_max > 0 {
+        capabilities.push("ordered_chains");
+    }
+    capabilities
+}
+
+/// 对象形式成员列表里的一项；只带有值的属性，未声明的字段不出现。
+fn roster_entry(member_id: &str, member: Option<&ConnectionHandle>) -> Value {
+    let mut entry = serde_json::json!({ "id": member_id });
+    let Some(member) = member else {
+        return entry;
+    };
+    if let Some(name) = &member.display_name {
+        entry["name"] = Value::from(name.clone());
+    }
+    if let Some(role) = &member.role {
+        entry["role"] = Value::from(role.clone());
+    }
+    if let Some(group) = &member.group {
+        entry["group"] = Value::from(group.clone());
+    }
+    if let Some(call_state) = &member.call_state {
+        entry["callState"] = Value::from(call_state.clone());
+    }
+    if member.spectator {
+        entry["spectator"] = Value::Bool(true);
+    }
+    entry
+}
+
+/// 为一对成员确定性地分配 perfect negotiation 中的角色：client_id 字典序较小的一方为 polite。
+/// 双方各自计算总是得到相反的结果，服务端本身不介入 offer 冲突。
+fn peer_role(client_id: &str, peer_id: &str) -> &'static str {
+    if client_id < peer_id {
+        "polite"
+    } else {
+        "impolite"
+    }
+}
+
+/// 当前存活的读写循环数；持续高于连接数的两倍说明有循环在断开后没有退出。
+pub(crate) fn active_pump_count() -> usize {
+    ACTIVE_PUMPS.load(Ordering::Relaxed)
+}
+
+/// 随读写循环一起存活的计数守卫，循环以任何方式退出时都会归还计数。
+struct PumpGuard;
+
+impl PumpGuard {
+    fn enter() -> Self {
+        ACTIVE_PUMPS.fetch_add(1, Ordering::Relaxed);
+        Self
+    }
+}
+
+impl Drop for PumpGuard {
+    fn drop(&mut self) {
+        ACTIVE_PUMPS.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// 已从注册表摘除、需要主动关闭的连接句柄。
+pub(crate) struct DetachedConnection {
+    pub(crate) sender: OutboundSender,
+    pub(crate) shutdown: watch::Sender<bool>,
+}
+
+impl DetachedConnection {
+    /// 通知读取循环退出，并让 writer 发出 Close 帧。
+    pub(crate) fn close(&self) {
+        let _ = self.shutdown.send(true);
+        let _ = self.sender.send(OutboundMessage::Close);
+    }
+}
+
+/// 新连接注册完成后，需要返回给调用方的附带信息。
+struct RegistrationResult {
+    /// 房间内其他成员的 `(client_id, 发送队列)`，用于广播加入事件。
+    join_recipients: Vec<(String, OutboundSender)>,
+    replaced_connection: Option<DetachedConnection>,
+    /// 按重名策略处理后的显示名。
+    display_name: Option<String>,
+    /// 在 `user_left` 宽限期内重连，其他成员从未收到过它离开。
+    resumed: bool,
+}
+
+/// 新成员注册后依次收到的引导消息。
+struct Bootstrap {
+    joined: Value,
+    welcome: Option<Value>,
+    existing_users: Vec<String>,
+    call_states: serde_json::Map<String, Value>,
+    history: Vec<SignalMessage>,
+    /// 掉线期间暂存的单播与需要重新应用的画质请求，原样补发。
+    replayed: Vec<SignalMessage>,
+}
+
+/// 按固定顺序把引导消息放进新连接的队列：`joined` 永远是第一条，
+/// 客户端应以它作为已注册完成的信号，再开始发送协商消息。
+fn enqueue_bootstrap(config: &AppConfig, sender: &OutboundSender, bootstrap: Bootstrap) {
+    let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+        config,
+        "joined",
+        bootstrap.joined,
+    )));
+
+    if let Some(welcome) = bootstrap.welcome {
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            config, "welcome", welcome,
+        )));
+    }
+
+    // 新用户加入时，先把已在房间中的成员列表发给它，方便前端发起点对点协商。
+    if !bootstrap.existing_users.is_empty() {
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            config,
+            "existing_users",
+            Value::Array(
+                bootstrap
+                    .existing_users
+                    .into_iter()
+                    .map(Value::String)
+                    .collect(),
+            ),
+        )));
+    }
+
+    if !bootstrap.call_states.is_empty() {
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            config,
+            "call_states",
+            Value::Object(bootstrap.call_states),
+        )));
+    }
+
+    // 房间开启了聊天缓存时，把最近的消息补发给新成员。
+    if !bootstrap.history.is_empty() {
+        let history = bootstrap
+            .history
+            .into_iter()
+            .filter_map(|message| serde_json::to_value(message).ok())
+            .collect::<Vec<_>>();
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            config,
+            "chat_history",
+            Value::Array(history),
+        )));
+    }
+
+    for message in bootstrap.replayed {
+        let _ = sender.send(OutboundMessage::Json(message));
+    }
+}
+
+/// 进程退出前调用：挡住新连接，通知所有在线成员 `server_shutdown` 后主动关闭，
+/// 再在超时内等各连接的读写循环退出，让通知和 Close 帧都写到客户端。
+/// 通知与 Close 排在队列末尾后队列即关闭，此后成员离开等广播不会再挤进来；
+/// 读循环收到关闭信号后会等 writer 把队列写完再退出。
+pub(crate) async fn shutdown_connections(context: &Arc<AppContext>, timeout: Duration) {
+    context.maintenance.store(true, Ordering::Relaxed);
+    let connection_count = {
         let state = context.state.read().await;
-        let Some(connection) = state.connections.get(&connection_id) else {
-            return;
-        };
-        let Some(room) = state.rooms.get(&connection.room_id) else {
-            return;
-        };
+        for connection in state.connections.values() {
+            let _ = connection
+                .sender
+                .send(OutboundMessage::Json(SignalMessage::server(
+                    &context.config,
+                    "server_shutdown",
+                    Value::Null,
+                )));
+            connection.sender.close_after_pending();
+            let _ = connection.shutdown.send(true);
+        }
+        for subscriber in state.subscribers.values() {
+            subscriber.sender.close_after_pending();
+        }
+        state.connections.len()
+    };
+    info!("notified {connection_count} connections of server shutdown");
 
-        message.from = connection.client_id.clone();
+    let deadline = tokio::time::Instant::now() + timeout;
+    while active_pump_count() > 0 && tokio::time::Instant::now() < deadline {
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+    let remaining = active_pump_count();
+    if remaining > 0 {
+        warn!("{remaining} websocket pumps still running after the shutdown timeout");
+    }
+}
 
-        // 心跳只用于保活，不需要继续向外转发。
-        if matches!(message.kind.as_str(), "heartbeat" | "ping") {
-            return;
+/// 注册连接失败的原因。
+enum RegistrationError {
+    /// 需要新建房间，但该用户担任房主的房间数已达上限。
+    OwnedRoomLimit,
+    /// 全局建房速率已用完，加入已有房间不受影响。
+    ServerBusy,
+    /// 房间总数已达 `MAX_ROOMS`，且没有可回收的空房间。
+    RoomLimit,
+    /// 所属租户的房间数已达 `TENANT_MAX_ROOMS`。
+    TenantRoomLimit,
+    /// 开启全局唯一身份后，该 client_id 已在其他房间在线。
+    DuplicateId,
+    /// `DISPLAY_NAME_POLICY=reject` 时显示名已被房间内其他成员占用。
+    NameTaken,
+    /// 房间正在排空，不再接受新成员。
+    RoomDraining,
+    /// 房间在线成员数已达 `MAX_CLIENTS_PER_ROOM`。
+    RoomFull,
+}
+
+/// 注册失败时发给客户端的通知；房间已满单独使用 `room_full` 类型，其余都是带错误码的 `error`。
+fn registration_refusal(config: &AppConfig, err: &RegistrationError) -> SignalMessage {
+    let (code, message) = match err {
+        RegistrationError::OwnedRoomLimit => {
+            ("owned_room_limit", "too many rooms owned by this client")
         }
+        RegistrationError::ServerBusy => (
+            "server_busy",
+            "too many rooms are being created, retry later",
+        ),
+        RegistrationError::RoomLimit => ("room_limit", "the server has too many rooms"),
+        RegistrationError::TenantRoomLimit => {
+            ("tenant_room_limit", "this tenant has too many rooms")
+        }
+        RegistrationError::DuplicateId => (
+            "duplicate_id",
+            "this client id is already active in another room",
+        ),
+        RegistrationError::RoomDraining => (
+            "room_draining",
+            "the room is closing and not accepting members",
+        ),
+        RegistrationError::RoomFull => ("room_full", "the room has too many members"),
+        RegistrationError::NameTaken => (
+            "name_taken",
+            "this display name is already in use in the room",
+        ),
+    };
+    let kind = match err {
+        RegistrationError::RoomFull => "room_full",
+        _ => "error",
+    };
+    SignalMessage::server(
+        config,
+        kind,
+        serde_json::json!({ "code": code, "message": message }),
+    )
+}
 
-        if let Some(target) = &message.to {
-            room.clients
-                .get(target)
-                .and_then(|recipient_connection_id| state.connections.get(recipient_connection_id))
-                .map(|recipient| vec![recipient.sender.clone()])
-                .unwrap_or_default()
-        } else {
-            room.clients
-                .iter()
-                .filter_map(|(client_id, recipient_connection_id)| {
-                    if client_id == &connection.client_id {
-                        None
-                    } else {
-                        state
-                            .connections
-                            .get(recipient_connection_id)
-                            .map(|recipient| recipient.sender.clone())
-                    }
-                })
-                .collect::<Vec<_>>()
+/// 把新连接加入房间，并返回需要广播和补发的数据。
+async fn register_connection(
+    context: &Arc<AppContext>,
+    connection_id: Uuid,
+    client_id: String,
+    room_id: String,
+    room_options: RoomOptions,
+    mut client_options: ClientOptions,
+    sender: OutboundSender,
+    shutdown: watch::Sender<bool>,
+) -> Result<RegistrationResult, RegistrationError> {
+    let mut state = context.state.write().await;
+    let state = &mut *state;
+    // 跨房间的检查按真实身份进行，化名在不同房间里互不相同。
+    let identity = client_options
+        .real_client_id
+        .clone()
+        .unwrap_or_else(|| client_id.clone());
+    // 同一房间内的重复身份仍按挤掉旧连接处理，这里只拦截跨房间的重复登录。
+    if context.config.unique_client_ids && state.client_active_elsewhere(&identity, &room_id) {
+        return Err(RegistrationError::DuplicateId);
+    }
+
+    let max_owned_rooms = context.config.max_owned_rooms;
+    let at_owned_limit =
+        max_owned_rooms > 0 && state.owned_room_count(&identity) >= max_owned_rooms;
+    if at_owned_limit && !state.rooms.contains_key(&room_id) {
+        return Err(RegistrationError::OwnedRoomLimit);
+    }
+    // 租户名额在扣减全局建房令牌之前检查，一个租户建满不会消耗其他租户的建房速率。
+    if !state.rooms.contains_key(&room_id) && !state.tenant_has_room_slot(&context.config, &room_id)
+    {
+        return Err(RegistrationError::TenantRoomLimit);
+    }
+
+    if state
+        .rooms
+        .get(&room_id)
+        .is_some_and(|room| room.draining_until_ms.is_some())
+    {
+        return Err(RegistrationError::RoomDraining);
+    }
+    // 同一身份重连会挤掉自己的旧连接，成员数不变，不受上限约束。
+    let max_clients = context.config.max_clients_per_room;
+    if max_clients > 0
+        && state.rooms.get(&room_id).is_some_and(|room| {
+            room.clients.len() >= max_clients && !room.clients.contains_key(&client_id)
+        })
+    {
+        return Err(RegistrationError::RoomFull);
+    }
+
+    // 全局建房令牌桶用来削平活动开场时的集中建房，只在真正新建房间时扣减。
+    let rate = context.config.room_creation_rate_per_second;
+    if rate > 0.0 && !state.rooms.contains_key(&room_id) {
+        let burst = context.config.room_creation_burst;
+        let allowed = state
+            .room_creation_bucket
+            .get_or_insert_with(|| TokenBucket::new(rate, burst))
+            .try_take();
+        if !allowed {
+            return Err(RegistrationError::ServerBusy);
         }
+    }
+
+    if !state.rooms.contains_key(&room_id) && !state.reserve_room_slot(&context.config) {
+        return Err(RegistrationError::RoomLimit);
+    }
+
+    // 重名只可能发生在已有成员的房间里，确定显示名要赶在建房之前。
+    let display_name = match (
+        client_options.display_name.take(),
+        state.rooms.get(&room_id),
+    ) {
+        (Some(requested), Some(room)) => Some(
+            resolve_display_name(
+                context.config.display_name_policy,
+                &room.clients,
+                &state.connections,
+                &client_id,
+                requested,
+            )
+            .map_err(|_| RegistrationError::NameTaken)?,
+        ),
+        (requested, _) => requested,
     };
 
-    broadcast_outbound(&recipients, message);
-}
+    // 房间不存在时按当前连接携带的属性创建。
+    let room_created = !state.rooms.contains_key(&room_id);
+    let spectator = client_options.spectator;
+    let room = state.rooms.entry(room_id.clone()).or_insert_with(|| {
+        let owner = (!spectator).then(|| client_id.clone());
+        RoomState::new(room_id.clone(), owner, room_options)
+    });
 
-/// 刷新连接的最近活跃时间，供超时回收逻辑判断。
-async fn touch_connection(context: &Arc<AppContext>, connection_id: Uuid) {
-    let state = context.state.read().await;
-    if let Some(connection) = state.connections.get(&connection_id) {
-        connection.last_seen_ms.store(now_ms(), Ordering::Relaxed);
+    room.last_activity_ms.store(now_ms(), Ordering::Relaxed);
+    if room_created && context.config.room_pairing_timeout_ms > 0 {
+        room.awaiting_second_member = true;
     }
-}
 
-/// 找出超时连接并主动关闭。
-async fn reap_stale_connections(context: &Arc<AppContext>) {
+    // 预建房间在第一位成员进入时才确定房主；已达上限的用户只作为普通成员加入。
+    if room.owner.is_none()
+        && !room.read_only
+        && room.clients.is_empty()
+        && !at_owned_limit
+        && !spectator
+    {
+        room.owner = Some(client_id.clone());
+    }
+
+    // 记录加入前已有的成员列表，用于前端建立已有 peer 的连接。
+    let existing_users = room
+        .clients
+        .keys()
+        .filter(|id| *id != &client_id)
+        .cloned()
+        .collect::<Vec<_>>();
+
     let now = now_ms();
-    let stale_connections = {
-        let state = context.state.read().await;
-        state
-            .connections
-            .iter()
-            .filter_map(|(connection_id, connection)| {
-                let last_seen_ms = connection.last_seen_ms.load(Ordering::Relaxed);
-                let idle_for_ms = now.saturating_sub(last_seen_ms);
+    let history = room
+        .recent_history(now, context.config.chat_history_max_age_ms)
+        .cloned()
+        .collect::<Vec<_>>();
+    let resumed = room.pending_leaves.remove(&client_id).is_some();
+    // 宽限期内重连时，补发掉线期间暂存的、尚未过期的单播消息。
+    let held_messages = room
+        .held_messages
+        .remove(&client_id)
+        .map(|held| {
+            held.messages
+                .into_iter()
+                .filter(|(expires_at_ms, _)| *expires_at_ms > now)
+                .map(|(_, message)| message)
+                .collect::<Vec<_>>()
+        })
+        .unwrap_or_default();
+    // 其他成员此前要求本成员调整画质时，重连后再发一次以便重新应用。
+    let quality_requests = room
+        .quality_requests
+        .iter()
+        .filter(|((requester, target), _)| target == &client_id && requester != &client_id)
+        .map(|(_, message)| message.clone())
+        .collect::<Vec<_>>();
+    let welcome = context.config.welcome_message.then(|| {
+        serde_json::json!({
+            "clientId": client_id,
+            "roomId": room.id,
+            "isPrivate": room.is_private,
+            "readOnly": room.read_only,
+            "owner": room.owner,
+            "expiresAt": room.expires_at_ms,
+            "protocolVersion": PROTOCOL_VERSION,
+            "capabilities": server_capabilities(&context.config),
+        })
+    });
 
-                if idle_for_ms >= WS_HEARTBEAT_TIMEOUT_MS {
-                    Some((
-                        *connection_id,
-                        connection.client_id.clone(),
-                        connection.room_id.clone(),
-                        idle_for_ms,
-                    ))
-                } else {
-                    None
+    let mut joined = serde_json::json!({
+        "roomId": room.id,
+        "clientId": client_id,
+    });
+    if let Some(name) = &display_name {
+        joined["name"] = Value::from(name.clone());
+    }
+    if let Some(floor) = &room.floor {
+        joined["floor"] = floor.snapshot();
+    }
+    if client_options.protocol_version >= ROSTER_OBJECTS_MIN_VERSION {
+        // 新协议把成员的各项属性收进同一个对象，不再拆成 `names` / `roles` 两张表。
+        joined["members"] = existing_users
+            .iter()
+            .map(|member_id| {
+                let member = room
+                    .clients
+                    .get(member_id)
+                    .and_then(|member_connection_id| state.connections.get(member_connection_id));
+                let mut entry = roster_entry(member_id, member);
+                if context.config.peer_role_hints {
+                    entry["peerRole"] = Value::from(peer_role(&client_id, member_id));
                 }
+                entry
             })
             .collect::<Vec<_>>()
+            .into();
+    } else {
+        joined["members"] = existing_users.clone().into();
+        // 已有成员的显示名，新成员据此渲染成员列表。
+        let member_names = existing_users
+            .iter()
+            .filter_map(|member_id| {
+                room.clients
+                    .get(member_id)
+                    .and_then(|member_connection_id| state.connections.get(member_connection_id))
+                    .and_then(|member| member.display_name.clone())
+                    .map(|name| (member_id.clone(), Value::from(name)))
+            })
+            .collect::<serde_json::Map<_, _>>();
+        if !member_names.is_empty() {
+            joined["names"] = member_names.into();
+        }
+        if context.config.peer_role_hints {
+            joined["roles"] = existing_users
+                .iter()
+                .map(|member_id| {
+                    (
+                        member_id.clone(),
+                        Value::from(peer_role(&client_id, member_id)),
+                    )
+                })
+                .collect::<serde_json::Map<_, _>>()
+                .into();
+        }
+    }
+
+    // 如果同一 client_id 已存在，则旧连接会被挤掉。
+    let replaced_connection_id = room.clients.insert(client_id.clone(), connection_id);
+    if let Some(real_client_id) = &client_options.real_client_id {
+        room.pseudonyms
+            .insert(client_id.clone(), real_client_id.clone());
+    }
+    if context.config.room_activity_summary {
+        room.activity.record_members(room.clients.len());
+    }
+    // 待配对的房间对大厅不可见，第二位成员到达时才作为新房间公布。
+    let lobby_event = if room.awaiting_second_member {
+        (room.clients.len() >= 2).then(|| {
+            room.awaiting_second_member = false;
+            LobbyEvent::Created
+        })
+    } else if room_created {
+        Some(LobbyEvent::Created)
+    } else {
+        Some(LobbyEvent::Updated)
     };
+    let recipient_connection_ids = room
+        .clients
+        .iter()
+        .filter_map(|(id, member_connection_id)| {
+            if id == &client_id {
+                None
+            } else {
+                Some(*member_connection_id)
+            }
+        })
+        .collect::<Vec<_>>();
 
-    for (connection_id, client_id, room_id, idle_for_ms) in stale_connections {
-        warn!(
-            "closing stale websocket connection for client {client_id} in room {room_id} after {idle_for_ms}ms of inactivity"
-        );
-        unregister_connection(context, connection_id, true).await;
+    let replaced_connection = replaced_connection_id.and_then(|old_connection_id| {
+        state
+            .connections
+            .remove(&old_connection_id)
+            .map(|connection| DetachedConnection {
+                sender: connection.sender,
+                shutdown: connection.shutdown,
+            })
+    });
+
+    if let (Some(event), Some(room)) = (lobby_event, state.rooms.get(&room_id)) {
+        state.notify_lobby(&context.config, event, room);
     }
+
+    let bootstrap_sender = sender.clone();
+    let tenant = room_tenant(&context.config, &room_id).map(str::to_string);
+    state.connections.insert(
+        connection_id,
+        ConnectionHandle {
+            client_id,
+            room_id,
+            tenant,
+            group: client_options.group,
+            role: client_options.role,
+            display_name: display_name.clone(),
+            spectator,
+            protocol_version: client_options.protocol_version,
+            heartbeat_timeout_ms: client_options.ping_profile.timeout_ms,
+            real_client_id: client_options.real_client_id,
+            allowed_types: client_options.allowed_types,
+            anonymous: client_options.anonymous,
+            user_agent: client_options.user_agent,
+            client_version: client_options.client_version,
+            joined_at_ms: now_ms(),
+            sender,
+            last_seen_ms: Arc::new(AtomicU64::new(now_ms())),
+            shutdown,
+            call_state: None,
+            in_flight: Arc::new(AtomicUsize::new(0)),
+        },
+    );
+
+    // 其他成员当前的通话状态，重连的一方据此恢复通话界面。
+    let call_states = recipient_connection_ids
+        .iter()
+        .filter_map(|connection_id| state.connections.get(connection_id))
+        .filter_map(|connection| {
+            connection
+                .call_state
+                .clone()
+                .map(|call_state| (connection.client_id.clone(), Value::String(call_state)))
+        })
+        .collect::<serde_json::Map<_, _>>();
+
+    let join_recipients = recipient_connection_ids
+        .iter()
+        .filter_map(|connection_id| {
+            state
+                .connections
+                .get(connection_id)
+                .map(|connection| (connection.client_id.clone(), connection.sender.clone()))
+        })
+        .collect::<Vec<_>>();
+
+    // 仍持有写锁时入队，保证引导消息排在任何房间内转发之前。
+    enqueue_bootstrap(
+        &context.config,
+        &bootstrap_sender,
+        Bootstrap {
+            joined,
+            welcome,
+            existing_users,
+            call_states,
+            history,
+            replayed: held_messages.into_iter().chain(quality_requests).collect(),
+        },
+    );
+
+    Ok(RegistrationResult {
+        join_recipients,
+        replaced_connection,
+        display_name,
+        resumed,
+    })
 }
 
-/// 将一条业务消息复制发送给多个接收方。
-fn broadcast_outbound(
-    recipients: &[mpsc::UnboundedSender<OutboundMessage>],
-    message: SignalMessage,
-) {
-    for recipient in recipients {
+/// 房主离开后，按房间策略得到的处理结果。
+enum OwnerLeaveOutcome {
+    Unchanged,
+    Transferred(String),
+    Closed(Vec<DetachedConnection>),
+    Ownerless,
+}
+
+/// 从房间和全局连接表中移除连接，并按需广播离开事件。
+///
+/// 房间槽位按连接 ID 而不是客户端 ID 比对：同名客户端顶替旧连接后，
+/// 旧连接迟到的注销只会清理它自己，不会把新连接踢出房间。
+async fn unregister_connection(context: &Arc<AppContext>, connection_id: Uuid, close_socket: bool) {
+    let (
+        room_id,
+        client_id,
+        recipients,
+        removed_from_room,
+        owner_outcome,
+        floor_notice,
+        leave_deferred,
+        sender,
+        shutdown,
+    ) = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let Some(connection) = state.connections.remove(&connection_id) else {
+            // 被顶替或已被房间关闭摘除的连接，注册表里早已没有它。
+            debug!("ignoring unregister for detached connection {connection_id}");
+            return;
+        };
+
+        let room_id = connection.room_id.clone();
+        let client_id = connection.client_id.clone();
+        let sender = connection.sender.clone();
+        let shutdown = connection.shutdown.clone();
+
+        let mut removed_from_room = false;
+        let mut recipient_connection_ids = Vec::new();
+        let mut should_remove_room = false;
+        let mut owner_outcome = OwnerLeaveOutcome::Unchanged;
+        let mut floor_notice = None;
+        let mut leave_deferred = false;
+
+        if let Some(room) = state.rooms.get_mut(&room_id) {
+            if room.clients.get(&client_id) == Some(&connection_id) {
+                room.clients.remove(&client_id);
+                room.last_activity_ms.store(now_ms(), Ordering::Relaxed);
+                if !connection.spectator {
+                    room.participant_left_at_ms = now_ms();
+                }
+                removed_from_room = true;
+                // 离开的成员让出发言权并撤回排队中的申请。
+                if let Some(floor) = room.floor.as_mut() {
+                    let was_queued = floor.queue.contains(&client_id);
+                    floor.queue.retain(|requester| requester != &client_id);
+                    if floor.speaker.as_deref() == Some(client_id.as_str()) {
+                        floor.speaker = None;
+                        floor_notice = Some(floor_payload(Some(floor), &client_id));
+                    } else if was_queued {
+                        floor_notice = Some(floor_payload(Some(floor), &client_id));
+                    }
+                }
+                room.in_call.remove(&client_id);
+                // 请求方离开后它发出的画质请求不再有意义；发给它的请求保留到它重连。
+                room.quality_requests
+                    .retain(|(requester, _), _| requester != &client_id);
+
+                // 开启暂存后登记掉线时间，宽限期内发给它的单播消息先留在房间里。
+                if context.config.offline_hold_ttl_ms > 0 {
+                    room.prune_held_messages(context.config.offline_hold_ttl_ms);
+                    room.held_messages.insert(
+                        client_id.clone(),
+                        HeldMessages {
+                            departed_at_ms: now_ms(),
+                            messages: VecDeque::new(),
+                        },
+                    );
+                }
+            } else {
+                debug!("client {client_id} in room {room_id} is held by a newer connection; keeping it");
+            }
+
+            if room.clients.is_empty() {
+                // `session` 策略下最后一位成员离开即清空；非预建房间随后整体移除。
+                if room.retention == Some(RetentionPolicy::Session) {
+                    room.purge_retained();
+                }
+                if room.persistent {
+                    room.owner = None;
+                } else {
+                    should_remove_room = true;
+                }
+            } else if removed_from_room && room.owner.as_deref() == Some(client_id.as_str()) {
+                owner_outcome = match room.owner_leave_policy {
+                    OwnerLeavePolicy::Transfer => {
+                        // 按加入时间挑选最早的剩余成员作为新房主，旁观成员不参与。
+                        let next_owner = room
+                            .clients
+                            .iter()
+                            .filter(|(_, member_connection_id)| {
+                                state
+                                    .connections
+                                    .get(member_connection_id)
+                                    .is_some_and(|member| !member.spectator)
+                            })
+                            .min_by_key(|(_, member_connection_id)| {
+                                state
+                                    .connections
+                                    .get(member_connection_id)
+                                    .map(|member| member.joined_at_ms)
+                                    .unwrap_or(u64::MAX)
+                            })
+                            .map(|(member_id, _)| member_id.clone());
+                        room.owner = next_owner.clone();
+                        next_owner
+                            .map(OwnerLeaveOutcome::Transferred)
+                            .unwrap_or(OwnerLeaveOutcome::Unchanged)
+                    }
+                    OwnerLeavePolicy::Close => {
+                        should_remove_room = true;
+                        OwnerLeaveOutcome::Closed(Vec::new())
+                    }
+                    OwnerLeavePolicy::Ownerless => {
+                        room.owner = None;
+                        room.read_only = true;
+                        OwnerLeaveOutcome::Ownerless
+                    }
+                };
+            }
+
+            if !should_remove_room || matches!(owner_outcome, OwnerLeaveOutcome::Closed(_)) {
+                recipient_connection_ids.extend(room.clients.values().copied());
+            }
+
+            // 网络抖动的成员往往几秒内就会重连，先登记离开，宽限期过后仍未回来再广播。
+            if removed_from_room && !should_remove_room && context.config.leave_grace_ms > 0 {
+                room.pending_leaves.insert(client_id.clone(), connection_id);
+                leave_deferred = true;
+            }
+        }
+
+        if should_remove_room {
+            if let Some(room) = state.rooms.remove(&room_id) {
+                state.notify_lobby(&context.config, LobbyEvent::Destroyed, &room);
+            }
+        } else if removed_from_room {
+            if let Some(room) = state.rooms.get(&room_id) {
+                state.notify_lobby(&context.config, LobbyEvent::Updated, room);
+            }
+        }
+
+        // 关闭房间时，把剩余成员一并从连接表摘除，它们的读取循环退出后不会再重复广播。
+        if let OwnerLeaveOutcome::Closed(detached) = &mut owner_outcome {
+            detached.extend(recipient_connection_ids.drain(..).filter_map(
+                |member_connection_id| {
+                    state
+                        .connections
+                        .remove(&member_connection_id)
+                        .map(|member| DetachedConnection {
+                            sender: member.sender,
+                            shutdown: member.shutdown,
+                        })
+                },
+            ));
+        }
+
+        let recipients = recipient_connection_ids
+            .iter()
+            .filter_map(|member_connection_id| {
+                state
+                    .connections
+                    .get(member_connection_id)
+                    .map(|member| member.sender.clone())
+            })
+            .collect::<Vec<_>>();
+
+        (
+            room_id,
+            client_id,
+            recipients,
+            removed_from_room,
+            owner_outcome,
+            floor_notice,
+            leave_deferred,
+            sender,
+            shutdown,
+        )
+    };
+
+    if close_socket {
+        let _ = shutdown.send(true);
+        let _ = sender.send(OutboundMessage::Close);
+    }
+
+    if let OwnerLeaveOutcome::Closed(detached) = owner_outcome {
+        info!("owner {client_id} left room {room_id}; closing room");
+        for member in detached {
+            let _ = member
+                .sender
+                .send(OutboundMessage::Json(SignalMessage::server(
+                    &context.config,
+                    "owner_left",
+                    Value::String(client_id.clone()),
+                )));
+            member.close();
+        }
+        return;
+    }
+
+    if leave_deferred {
+        info!("client {client_id} left room {room_id}; deferring user_left");
+        tokio::spawn(broadcast_leave_after_grace(
+            context.clone(),
+            room_id.clone(),
+            client_id.clone(),
+            connection_id,
+        ));
+    } else if removed_from_room {
+        info!("client {client_id} left room {room_id}");
+        broadcast_outbound(&recipients, user_left_message(&client_id));
+    }
+    if let Some(payload) = floor_notice {
+        broadcast_outbound(
+            &recipients,
+            SignalMessage::server(&context.config, "floor_changed", payload),
+        );
+    }
+
+    match owner_outcome {
+        OwnerLeaveOutcome::Transferred(new_owner) => {
+            info!("room {room_id} ownership transferred to {new_owner}");
+            broadcast_outbound(
+                &recipients,
+                SignalMessage::server(&context.config, "owner_changed", Value::String(new_owner)),
+            );
+        }
+        OwnerLeaveOutcome::Ownerless => {
+            info!("room {room_id} is now ownerless and read-only");
+            broadcast_outbound(
+                &recipients,
+                SignalMessage::server(&context.config, "owner_changed", Value::Null),
+            );
+        }
+        OwnerLeaveOutcome::Unchanged | OwnerLeaveOutcome::Closed(_) => {}
+    }
+}
+
+fn user_left_message(client_id: &str) -> SignalMessage {
+    SignalMessage {
+        kind: "user_left".to_string(),
+        payload: Value::Null,
+        from: client_id.to_string(),
+        ..Default::default()
+    }
+}
+
+/// 宽限期结束仍未重连时补发 `user_left`；期间重连会撤销登记，这里就什么也不做。
+async fn broadcast_leave_after_grace(
+    context: Arc<AppContext>,
+    room_id: String,
+    client_id: String,
+    connection_id: Uuid,
+) {
+    tokio::time::sleep(Duration::from_millis(context.config.leave_grace_ms)).await;
+    let recipients = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let Some(room) = state.rooms.get_mut(&room_id) else {
+            return;
+        };
+        // 重连后又掉线时登记的是新连接，留给那一次的计时处理。
+        if room.pending_leaves.get(&client_id) != Some(&connection_id) {
+            return;
+        }
+        room.pending_leaves.remove(&client_id);
+        room.clients
+            .values()
+            .filter_map(|member_connection_id| state.connections.get(member_connection_id))
+            .map(|member| member.sender.clone())
+            .collect::<Vec<_>>()
+    };
+    debug!("client {client_id} did not return to room {room_id} within the leave grace");
+    broadcast_outbound(&recipients, user_left_message(&client_id));
+}
+
+/// 入站消息的逐连接状态：只有本连接的读循环会用到，随读循环一起存在，不放进共享状态加锁。
+struct InboundState {
+    /// 建连时声明能解码 `deflate-raw` payload。
+    accepts_compression: bool,
+    /// 压缩本连接所发 payload 时使用的级别，已收敛到有效范围。
+    compression_level: u8,
+    /// `relay_data` 兜底中转的限流状态。
+    relay_data_bucket: TokenBucket,
+    /// 按消息类型的入站限流桶；键为 `None` 的是未单独配置类型共用的默认桶。
+    message_buckets: HashMap<Option<String>, TokenBucket>,
+    /// 最近广播的 `(发送时间, 内容哈希)`，用于窗口内的重复广播去重。
+    recent_broadcasts: VecDeque<(u64, u64)>,
+    /// 本连接用过的消息类型；正常客户端只用固定的几种，持续出现新类型多半是探测或异常客户端。
+    seen_message_types: HashSet<String>,
+}
+
+impl InboundState {
+    fn new(config: &AppConfig, client_options: &ClientOptions) -> Self {
+        Self {
+            accepts_compression: client_options.accepts_compression,
+            compression_level: client_options.compression_level,
+            relay_data_bucket: TokenBucket::new(
+                config.relay_data_rate_per_second,
+                config.relay_data_burst,
+            ),
+            message_buckets: HashMap::new(),
+            recent_broadcasts: VecDeque::new(),
+            seen_message_types: HashSet::new(),
+        }
+    }
+
+    /// 记下消息类型，返回本连接用过的类型是否已超过 `max` 种；`max` 为 0 时不统计。
+    fn exceeds_type_limit(&mut self, max: usize, kind: &str) -> bool {
+        if max == 0 {
+            return false;
+        }
+        // 超出后不再记录新类型，集合大小停在 `max + 1`。
+        if self.seen_message_types.len() <= max {
+            self.seen_message_types.insert(kind.to_string());
+        }
+        self.seen_message_types.len() > max
+    }
+}
+
+/// 读锁下完成校验与寻址后的转发计划。
+struct RoutePlan {
+    recipients: Vec<(String, OutboundSender)>,
+    subscriber_recipients: Vec<OutboundSender>,
+    room_id: String,
+    receipt_to: Option<OutboundSender>,
+    in_flight: Arc<AtomicUsize>,
+    error_sender: OutboundSender,
+    is_broadcast: bool,
+    /// 单播目标不在房间里，写锁里再决定暂存还是作为死信上报。
+    offline_target: bool,
+    /// 处理链改写过 payload，预先压缩的结果要在锁外重算。
+    transformed: bool,
+    /// 需要补记历史、日志或待确认表等共享状态，转发前再拿一次短暂的写锁。
+    needs_bookkeeping: bool,
+}
+
+/// 写锁里登记的、需要后台任务等待的确认与回复。
+#[derive(Default)]
+struct PendingWaits {
+    delivery: Option<oneshot::Receiver<()>>,
+    response: Option<(oneshot::Receiver<()>, u64)>,
+}
+
+/// 读锁下的路由结果。
+enum Routing {
+    /// 已处理完或已回错误给发送方，不再转发。
+    Done,
+    /// 改名、发言权与审批指令要改动房间状态，在写锁里单独处理。
+    Control,
+    Relay(RoutePlan),
+}
+
+/// 根据 `to` 字段路由单播或房间广播消息。
+/// 校验与寻址只持读锁；历史、日志与待确认表等补记放在随后的短暂写锁里，压缩不占用任何锁。
+async fn route_message(
+    context: &Arc<AppContext>,
+    connection_id: Uuid,
+    inbound: &mut InboundState,
+    mut message: SignalMessage,
+) {
+    // 发送方支持压缩时只压缩一次，广播给多个支持压缩的接收方时共用同一份结果。
+    let compression_min_bytes = context.config.payload_compression_min_bytes;
+    let compression_level = inbound.compression_level;
+    if compression_min_bytes > 0 && inbound.accepts_compression {
+        message.compressed_payload =
+            compress_payload(&message, compression_min_bytes, compression_level);
+    }
+    // `serverTs` 只能由服务端填写，客户端自带的值一律丢弃。
+    message.server_ts = context
+        .config
+        .server_timestamps
+        .then(next_server_timestamp_ms);
+
+    let routing = {
+        let state = context.state.read().await;
+        plan_route(context, &state, connection_id, inbound, &mut message)
+    };
+    let plan = match routing {
+        Routing::Done => return,
+        Routing::Control => {
+            apply_control_message(context, connection_id, &message).await;
+            return;
+        }
+        Routing::Relay(plan) => plan,
+    };
+    // 处理链可能改写了 payload，预先压缩的结果需要重算。
+    if plan.transformed && message.compressed_payload.is_some() {
+        message.compressed_payload =
+            compress_payload(&message, compression_min_bytes, compression_level);
+    }
+
+    let waits = if plan.needs_bookkeeping {
+        let mut state = context.state.write().await;
+        match record_routed_message(context, &mut state, connection_id, &plan, &message) {
+            Some(waits) => waits,
+            None => return,
+        }
+    } else {
+        PendingWaits::default()
+    };
+
+    let RoutePlan {
+        recipients,
+        subscriber_recipients,
+        room_id,
+        receipt_to,
+        in_flight,
+        ..
+    } = plan;
+    if !subscriber_recipients.is_empty() {
+        broadcast_outbound(
+            &subscriber_recipients,
+            SignalMessage::server(
+                &context.config,
+                "room_message",
+                serde_json::json!({ "roomId": room_id, "message": message }),
+            ),
+        );
+    }
+    if let Some(ack_receiver) = waits.delivery {
+        tokio::spawn(retry_until_acked(
+            context.clone(),
+            connection_id,
+            message.clone(),
+            ack_receiver,
+        ));
+    }
+    if let Some((answer_receiver, timeout_ms)) = waits.response {
+        tokio::spawn(await_response(
+            context.clone(),
+            connection_id,
+            message.clone(),
+            answer_receiver,
+            timeout_ms,
+        ));
+    }
+    let fanout_threshold = context.config.broadcast_fanout_warn_threshold;
+    if fanout_threshold > 0 && message.to.is_none() && recipients.len() > fanout_threshold {
+        warn_broadcast_fanout(&room_id, &message.kind, recipients.len());
+    }
+    tap_message(context, &room_id, &message);
+    relay_outbound(context, room_id, recipients, message, receipt_to, in_flight).await;
+}
+
+/// 持读锁完成权限、限流与内容校验并算出接收方；这里不改动共享状态。
+fn plan_route(
+    context: &AppContext,
+    state: &AppState,
+    connection_id: Uuid,
+    inbound: &mut InboundState,
+    message: &mut SignalMessage,
+) -> Routing {
+    let Some(connection) = state.connections.get(&connection_id) else {
+        return Routing::Done;
+    };
+    let Some(room) = state.rooms.get(&connection.room_id) else {
+        return Routing::Done;
+    };
+
+    message.from = connection.client_id.clone();
+    room.last_activity_ms.store(now_ms(), Ordering::Relaxed);
+
+    // 发给虚拟机器人的查询由服务端以机器人的名义回答，对时与 ping 也不再由服务端自己回复。
+    let virtual_bot = message
+        .to
+        .as_deref()
+        .and_then(|target| virtual_bot_for(&context.config, room, target));
+    if let Some(bot) = virtual_bot {
+        if let Some(reply) = answer_as_bot(
+            &context.config,
+            bot,
+            room,
+            message,
+            connection.protocol_version,
+        ) {
+            // 名单查询要遍历整个房间，和普通消息一样受按类型限流约束。
+            if take_message_token(&context.config.message_rate_limits, inbound, &message.kind) {
+                let _ = connection.sender.send(OutboundMessage::Json(reply));
+            } else {
+                send_error(
+                    &context.config,
+                    &connection.sender,
+                    "rate_limited",
+                    "message rate limit exceeded",
+                );
+            }
+            return Routing::Done;
+        }
+    }
+    // 对时请求由服务端直接回复，不转发给房间。
+    if matches!(message.kind.as_str(), "time" | "ping") && virtual_bot.is_none() {
+        handle_time_request(&context.config, &connection.sender, message);
+    }
+    // 心跳只用于保活，不需要继续向外转发；只读房间也不再转发业务消息。
+    if matches!(message.kind.as_str(), "heartbeat" | "ping" | "time") || room.read_only {
+        return Routing::Done;
+    }
+    // 排空中的房间马上就要关闭，开启后成员的消息不再转发，只告诉发送方。
+    if room.draining_until_ms.is_some() && context.config.draining_room_drop_messages {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "room_draining",
+            "the room is closing; messages are no longer relayed",
+        );
+        return Routing::Done;
+    }
+
+    // 令牌限定了可发送的类型时，其余类型一律丢弃。
+    if connection
+        .allowed_types
+        .as_ref()
+        .is_some_and(|allowed| !allowed.contains(&message.kind))
+    {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "type_not_permitted",
+            "this identity may not send this message type",
+        );
+        return Routing::Done;
+    }
+
+    // 寻址优先级为 `to` > `toMany` > `toRole`；都没有时才是房间广播。
+    if message.to.is_some() {
+        message.to_many = None;
+    }
+    if message.to.is_some() || message.to_many.is_some() {
+        message.to_role = None;
+    }
+    let is_broadcast =
+        message.to.is_none() && message.to_many.is_none() && message.to_role.is_none();
+
+    if let Some(targets) = &message.to_many {
+        let max_recipients = context.config.max_recipients_per_message;
+        if max_recipients > 0 && targets.len() > max_recipients {
+            send_error(
+                &context.config,
+                &connection.sender,
+                "too_many_recipients",
+                "toMany lists more recipients than allowed",
+            );
+            return Routing::Done;
+        }
+    }
+
+    // 旁观成员只能定向发信令（例如建立只收不发的 peer 连接），不能向房间广播。
+    if connection.spectator && is_broadcast {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "spectator_read_only",
+            "spectators cannot broadcast to the room",
+        );
+        return Routing::Done;
+    }
+
+    if !take_message_token(&context.config.message_rate_limits, inbound, &message.kind) {
+        debug!(
+            "dropping rate-limited {} message from {}",
+            message.kind, message.from
+        );
+        send_error(
+            &context.config,
+            &connection.sender,
+            "rate_limited",
+            "message rate limit exceeded",
+        );
+        return Routing::Done;
+    }
+
+    // 接收方消化不过来时，发送方积压的转发副本达到上限就先拒收，等队列写出后再放行。
+    let max_in_flight = context.config.max_in_flight_per_sender;
+    if max_in_flight > 0 && connection.in_flight.load(Ordering::Relaxed) >= max_in_flight {
+        debug!(
+            "throttling {} message from {} with {max_in_flight} messages in flight",
+            message.kind, message.from
+        );
+        send_error(
+            &context.config,
+            &connection.sender,
+            "slow_down",
+            "too many messages still waiting for delivery",
+        );
+        return Routing::Done;
+    }
+
+    if matches!(
+        message.kind.as_str(),
+        "set_name"
+            | "floor_control"
+            | "floor_grant"
+            | "floor_release"
+            | "floor_request"
+            | "approve"
+            | "deny"
+    ) {
+        return Routing::Control;
+    }
+
+    // 发言权控制下，非发言人发的聊天和开麦类消息直接拦下；房主始终可以发言。
+    if let Some(floor) = &room.floor {
+        if context.config.floor_gated_types.contains(&message.kind)
+            && floor.speaker.as_deref() != Some(message.from.as_str())
+            && room.owner.as_deref() != Some(message.from.as_str())
+        {
+            let _ = connection
+                .sender
+                .send(OutboundMessage::Json(SignalMessage::server(
+                    &context.config,
+                    "floor_denied",
+                    serde_json::json!({ "type": message.kind, "speaker": floor.speaker }),
+                )));
+            return Routing::Done;
+        }
+    }
+
+    if message.kind == "relay_data" {
+        if let Err(code) = check_relay_data(&context.config, inbound, message) {
+            send_error(
+                &context.config,
+                &connection.sender,
+                code,
+                "relay_data rejected",
+            );
+            return Routing::Done;
+        }
+    }
+
+    // 画质调整请求只做单播转发，服务端不改动媒体，只按配置记住最近一次。
+    if message.kind == "quality_request" && message.to.is_none() {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "quality_request_requires_target",
+            "quality_request must name a target",
+        );
+        return Routing::Done;
+    }
+
+    // 已有成员收到 `user_joined` 后回给新成员的就绪确认，只能单播，服务端原样转发。
+    if message.kind == "join_ack" && message.to.is_none() {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "join_ack_requires_target",
+            "join_ack must name the joining member",
+        );
+        return Routing::Done;
+    }
+
+    // 一通通话由两位成员组成；双方都不在通话中的 `offer` 视为发起新通话，
+    // 房间里的通话数已到上限时拒绝，通话内的重新协商不受影响。
+    let max_calls = context.config.max_concurrent_calls_per_room;
+    if max_calls > 0 && message.kind == "offer" {
+        if let Some(target) = &message.to {
+            if !room.in_call.contains(&message.from)
+                && !room.in_call.contains(target)
+                && room.in_call.len().div_ceil(2) >= max_calls
+            {
+                send_error(
+                    &context.config,
+                    &connection.sender,
+                    "call_in_progress",
+                    "the room already has the maximum number of active calls",
+                );
+                return Routing::Done;
+            }
+        }
+    }
+
+    // 服务端只校验状态取值并记下最新状态，不强制状态之间的迁移顺序。
+    if message.kind == "call_state" && call_state_of(message).is_none() {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "invalid_call_state",
+            "unknown call state",
+        );
+        return Routing::Done;
+    }
+
+    // 聊天内容比 SDP 等信令小得多，单独用更严格的长度限制。
+    if message.kind == "chat"
+        && context.config.chat_max_bytes > 0
+        && payload_len(message) > context.config.chat_max_bytes
+    {
+        send_error(
+            &context.config,
+            &connection.sender,
+            "chat_too_large",
+            "chat message is too large",
+        );
+        return Routing::Done;
+    }
+    if message.kind == "chat" {
+        if let Err(code) = check_chat_content(&context.config.chat_content_policy, &message.payload)
+        {
+            send_error(
+                &context.config,
+                &connection.sender,
+                code,
+                "chat content is not allowed by the server policy",
+            );
+            return Routing::Done;
+        }
+    }
+
+    if is_broadcast && is_duplicate_broadcast(&context.config, inbound, message) {
+        debug!(
+            "suppressing duplicate {} broadcast from {}",
+            message.kind, message.from
+        );
+        return Routing::Done;
+    }
+
+    // 房间级处理链在落历史和转发之前执行，只影响本房间的消息。
+    let transformed = !room.transforms.is_empty();
+    if transformed && !apply_transforms(&room.transforms, message) {
+        return Routing::Done;
+    }
+
+    let mut offline_target = false;
+    let recipients = if let Some(target) = &message.to {
+        offline_target = !room.clients.contains_key(target);
+        room.clients
+            .get(target)
+            .and_then(|recipient_connection_id| state.connections.get(recipient_connection_id))
+            .map(|recipient| vec![(target.clone(), recipient.sender.clone())])
+            .unwrap_or_default()
+    } else if let Some(targets) = &message.to_many {
+        // 重复列出的成员只投递一次，不在房间里的成员直接跳过；
+        // mesh 客户端常把自己也算进列表，除非开启回环，否则不回发给发送方。
+        let self_echo = context.config.to_many_self_echo;
+        let mut seen = HashSet::new();
+        targets
+            .iter()
+            .filter(|target| {
+                (self_echo || *target != &message.from) && seen.insert(target.as_str())
+            })
+            .filter_map(|target| {
+                room.clients
+                    .get(target)
+                    .and_then(|recipient_connection_id| {
+                        state.connections.get(recipient_connection_id)
+                    })
+                    .map(|recipient| (target.clone(), recipient.sender.clone()))
+            })
+            .collect::<Vec<_>>()
+    } else {
+        room.clients
+            .iter()
+            .filter_map(|(client_id, recipient_connection_id)| {
+                if client_id == &message.from {
+                    return None;
+                }
+                state
+                    .connections
+                    .get(recipient_connection_id)
+                    // 指定了 `toGroup` 时只投递给同组成员。
+                    .filter(|recipient| match &message.to_group {
+                        Some(group) => recipient.group.as_ref() == Some(group),
+                        None => true,
+                    })
+                    // 指定了 `toRole` 时按发送时刻的角色持有者投递。
+                    .filter(|recipient| match &message.to_role {
+                        Some(role) => recipient.role.as_ref() == Some(role),
+                        None => true,
+                    })
+                    .map(|recipient| (client_id.clone(), recipient.sender.clone()))
+            })
+            .collect::<Vec<_>>()
+    };
+
+    // 房间广播再抄送一份给匹配的监控连接；单播、`toMany` 与 `toRole` 不抄送。
+    let subscriber_recipients = if is_broadcast {
+        state
+            .subscribers
+            .values()
+            .filter(|subscriber| room_matches(&subscriber.pattern, &room.id))
+            .map(|subscriber| subscriber.sender.clone())
+            .collect::<Vec<_>>()
+    } else {
+        Vec::new()
+    };
+
+    let config = &context.config;
+    let records_history =
+        is_broadcast && config.history_types.contains(&message.kind) && room.retains_messages();
+    let needs_bookkeeping = offline_target
+        || records_history
+        || config.room_activity_summary
+        || (room.message_log.is_some() && room.retains_messages())
+        || message.kind == "call_state"
+        || (message.kind == "quality_request" && config.quality_memory)
+        || (message.kind == "ack" && message.id.is_some())
+        || (config.delivery_retry_attempts > 0 && message.id.is_some() && message.to.is_some())
+        || (message.correlation_id.is_some() && message.to.is_some());
+
+    Routing::Relay(RoutePlan {
+        recipients,
+        subscriber_recipients,
+        room_id: room.id.clone(),
+        // 回执只针对房间广播，单播由 `ack` 负责确认。
+        receipt_to: (message.receipt && message.to.is_none()).then(|| connection.sender.clone()),
+        in_flight: connection.in_flight.clone(),
+        error_sender: connection.sender.clone(),
+        is_broadcast,
+        offline_target,
+        transformed,
+        needs_bookkeeping,
+    })
+}
+
+/// 在短暂的写锁里补记转发带来的状态变化；待确认数超限时回错误并返回 `None`，消息不再转发。
+fn record_routed_message(
+    context: &AppContext,
+    state: &mut AppState,
+    connection_id: Uuid,
+    plan: &RoutePlan,
+    message: &SignalMessage,
+) -> Option<PendingWaits> {
+    let config = &context.config;
+    let connection = state.connections.get_mut(&connection_id)?;
+    if let Some(call_state) = call_state_of(message) {
+        connection.call_state = Some(call_state.to_string());
+    }
+    let room = state.rooms.get_mut(&plan.room_id)?;
+
+    if config.room_activity_summary {
+        room.activity.record_message(now_ms());
+    }
+    if let Some(call_state) = call_state_of(message) {
+        if call_state == "ended" {
+            room.in_call.remove(&message.from);
+        } else {
+            room.in_call.insert(message.from.clone());
+        }
+    }
+    if message.kind == "quality_request" && config.quality_memory {
+        if let Some(target) = &message.to {
+            room.quality_requests
+                .insert((message.from.clone(), target.clone()), message.clone());
+        }
+    }
+
+    room.record_message_log(config, message);
+
+    // 只有配置的类型的房间广播才进入历史缓存，私聊与建连信令不落地。
+    if plan.is_broadcast && config.history_types.contains(&message.kind) && room.retains_messages()
+    {
+        record_history(&mut room.history, config.chat_history_limit, message);
+    }
+
+    // 确认消息先唤醒原发送方的重试任务，再照常转发给原发送方。
+    if message.kind == "ack" {
+        let original_sender = message
+            .to
+            .as_ref()
+            .and_then(|target| room.clients.get(target));
+        if let (Some(id), Some(original_sender)) = (&message.id, original_sender) {
+            if let Some(acked) = state.pending_deliveries.remove(&(
+                *original_sender,
+                message.from.clone(),
+                id.clone(),
+            )) {
+                let _ = acked.send(());
+            }
+        }
+    }
+
+    // 至少一次投递：带 `id` 的单播登记待确认状态，由后台任务负责超时重发。
+    let mut delivery = None;
+    if config.delivery_retry_attempts > 0 && message.kind != "ack" {
+        if let (Some(id), Some(target)) = (&message.id, &message.to) {
+            if state.pending_deliveries.count_for(connection_id) >= config.delivery_max_pending {
+                send_error(
+                    config,
+                    &plan.error_sender,
+                    "delivery_pending_limit",
+                    "too many messages awaiting ack",
+                );
+                return None;
+            }
+            let (acked, ack_receiver) = oneshot::channel();
+            state
+                .pending_deliveries
+                .insert((connection_id, target.clone(), id.clone()), acked);
+            delivery = Some(ack_receiver);
+        }
+    }
+
+    // 带 `correlationId` 的回复到达请求方时，撤销对应的超时等待。
+    if let (Some(correlation_id), Some(target)) = (&message.correlation_id, &message.to) {
+        if let Some(requester) = room.clients.get(target) {
+            if let Some(answered) = state.pending_responses.remove(&(
+                *requester,
+                message.from.clone(),
+                correlation_id.clone(),
+            )) {
+                let _ = answered.send(());
+            }
+        }
+    }
+
+    // 请求方声明了 `responseTimeoutMs` 时登记等待，超时后由后台任务通知请求方。
+    let mut response_wait = None;
+    let max_timeout_ms = config.response_timeout_max_ms;
+    if let (Some(correlation_id), Some(target), Some(timeout_ms)) = (
+        &message.correlation_id,
+        &message.to,
+        message.response_timeout_ms,
+    ) {
+        if max_timeout_ms > 0 && timeout_ms > 0 {
+            if state.pending_responses.count_for(connection_id) >= config.response_max_pending {
+                send_error(
+                    config,
+                    &plan.error_sender,
+                    "response_pending_limit",
+                    "too many requests awaiting a response",
+                );
+                return None;
+            }
+            let (answered, answer_receiver) = oneshot::channel();
+            state.pending_responses.insert(
+                (connection_id, target.clone(), correlation_id.clone()),
+                answered,
+            );
+            response_wait = Some((answer_receiver, timeout_ms.min(max_timeout_ms)));
+        }
+    }
+
+    if let Some(target) = message.to.as_ref().filter(|_| plan.offline_target) {
+        if !hold_for_departed(config, room, target, message) {
+            report_dead_letter(
+                context.dead_letters.as_ref(),
+                &room.id,
+                target,
+                DeadLetterReason::TargetOffline,
+                message,
+            );
+            // 房间内查不到时再按租户内的身份索引找一遍，告诉发送方是发错了房间还是对方不在线。
+            // 目标按真实身份比对，化名在别的房间里互不相同；同房间里的化名成员不算在别处。
+            if config.unicast_target_errors {
+                let tenant = room_tenant(config, &room.id);
+                let (code, text) = if state
+                    .connections
+                    .identity_in_other_room(tenant, target, &room.id)
+                {
+                    (
+                        "target_elsewhere",
+                        "the target is connected to a different room",
+                    )
+                } else {
+                    ("target_unknown", "no client with this id is connected")
+                };
+                send_error(config, &plan.error_sender, code, text);
+            }
+        }
+    }
+
+    Some(PendingWaits {
+        delivery,
+        response: response_wait,
+    })
+}
+
+/// 合法的 `call_state` 取值；其他类型的消息或未知状态返回 `None`。
+fn call_state_of(message: &SignalMessage) -> Option<&str> {
+    if message.kind != "call_state" {
+        return None;
+    }
+    message
+        .payload
+        .get("state")
+        .and_then(Value::as_str)
+        .filter(|value| CALL_STATES.contains(value))
+}
+
+/// 改名、发言权与审批指令：读锁下已经过限流等校验，这里持写锁改动房间状态并通知相关成员。
+async fn apply_control_message(context: &AppContext, connection_id: Uuid, message: &SignalMessage) {
+    let mut state = context.state.write().await;
+    let state = &mut *state;
+    let Some(connection) = state.connections.get(&connection_id) else {
+        return;
+    };
+    let Some(room) = state.rooms.get_mut(&connection.room_id) else {
+        return;
+    };
+    let sender = connection.sender.clone();
+
+    // 改名由服务端按重名策略处理后，以 `name_changed` 通知全房间（包括本人）。
+    if message.kind == "set_name" {
+        let Some(requested) = message
+            .payload
+            .get("name")
+            .and_then(Value::as_str)
+            .and_then(client_metadata)
+        else {
+            send_error(
+                &context.config,
+                &sender,
+                "invalid_name",
+                "set_name requires a non-empty name",
+            );
+            return;
+        };
+        let Ok(name) = resolve_display_name(
+            context.config.display_name_policy,
+            &room.clients,
+            &state.connections,
+            &message.from,
+            requested,
+        ) else {
+            send_error(
+                &context.config,
+                &sender,
+                "name_taken",
+                "this display name is already in use in the room",
+            );
+            return;
+        };
+        if let Some(connection) = state.connections.get_mut(&connection_id) {
+            connection.display_name = Some(name.clone());
+        }
+        let recipients = room
+            .clients
+            .values()
+            .filter_map(|member_connection_id| state.connections.get(member_connection_id))
+            .map(|member| member.sender.clone())
+            .collect::<Vec<_>>();
+        broadcast_outbound(
+            &recipients,
+            SignalMessage {
+                kind: "name_changed".to_string(),
+                payload: serde_json::json!({ "name": name }),
+                from: message.from.clone(),
+                ..Default::default()
+            },
+        );
+        return;
+    }
+
+    // 审批指令只由房主发给服务端处理，不向外转发。
+    if matches!(message.kind.as_str(), "approve" | "deny") {
+        if room.owner.as_deref() == Some(message.from.as_str()) {
+            if let Some(decision) = message
+                .to
+                .as_ref()
+                .and_then(|target| room.pending_joins.remove(target))
+            {
+                let _ = decision.send(message.kind == "approve");
+            }
+        }
+        return;
+    }
+
+    // 发言权指令由服务端处理：状态变化广播 `floor_changed`，发言申请只转给房主。
+    let notice = match apply_floor_command(room, message) {
+        Ok(notice) => notice,
+        Err(code) => {
+            send_error(&context.config, &sender, code, "floor command rejected");
+            return;
+        }
+    };
+    let recipients = match notice {
+        FloorNotice::Changed => room.clients.values().collect::<Vec<_>>(),
+        FloorNotice::Requested => room
+            .owner
+            .as_ref()
+            .and_then(|owner| room.clients.get(owner))
+            .into_iter()
+            .collect(),
+    }
+    .into_iter()
+    .filter_map(|member_connection_id| state.connections.get(member_connection_id))
+    .map(|member| member.sender.clone())
+    .collect::<Vec<_>>();
+    let kind = match notice {
+        FloorNotice::Changed => "floor_changed",
+        FloorNotice::Requested => "floor_requested",
+    };
+    broadcast_outbound(
+        &recipients,
+        SignalMessage::server(
+            &context.config,
+            kind,
+            floor_payload(room.floor.as_ref(), &message.from),
+        ),
+    );
+}
+
+/// 大房间里每条广播都会触发，按固定间隔限流，并带出期间被合并的次数。
+fn warn_broadcast_fanout(room_id: &str, kind: &str, recipients: usize) {
+    if let Some(suppressed) =
+        take_rate_limited_log_count(&FANOUT_WARN_STATE, FANOUT_WARN_INTERVAL_MS)
+    {
+        warn!(
+            room_id,
+            kind,
+            recipients,
+            suppressed,
+            "broadcast fan-out exceeded BROADCAST_FANOUT_WARN_THRESHOLD"
+        );
+    }
+}
+
+/// 等待目标回复同一 `correlationId` 的消息；超时后给请求方回 `response_timeout`。
+async fn await_response(
+    context: Arc<AppContext>,
+    requester_connection_id: Uuid,
+    request: SignalMessage,
+    answer_receiver: oneshot::Receiver<()>,
+    timeout_ms: u64,
+) {
+    let (Some(target), Some(correlation_id)) = (request.to, request.correlation_id) else {
+        return;
+    };
+    // 收到回复，或同一 correlationId 被重新登记时都直接退出。
+    if tokio::time::timeout(Duration::from_millis(timeout_ms), answer_receiver)
+        .await
+        .is_ok()
+    {
+        return;
+    }
+
+    let requester = {
+        let mut state = context.state.write().await;
+        state.pending_responses.remove(&(
+            requester_connection_id,
+            target.clone(),
+            correlation_id.clone(),
+        ));
+        state
+            .connections
+            .get(&requester_connection_id)
+            .map(|connection| connection.sender.clone())
+    };
+    if let Some(requester) = requester {
+        let _ = requester.send(OutboundMessage::Json(SignalMessage::server(
+            &context.config,
+            "response_timeout",
+            serde_json::json!({
+                "correlationId": correlation_id,
+                "type": request.kind,
+                "to": target,
+            }),
+        )));
+    }
+}
+
+/// 等待目标确认；超时就重发，重试次数用完后给发送方回 `delivery_failed`。
+async fn retry_until_acked(
+    context: Arc<AppContext>,
+    sender_connection_id: Uuid,
+    message: SignalMessage,
+    mut ack_receiver: oneshot::Receiver<()>,
+) {
+    let (Some(target), Some(id)) = (message.to.clone(), message.id.clone()) else {
+        return;
+    };
+    let key = (sender_connection_id, target.clone(), id.clone());
+    let timeout = Duration::from_millis(context.config.delivery_ack_timeout_ms);
+    let max_retries = context.config.delivery_retry_attempts;
+
+    for attempt in 0..=max_retries {
+        match tokio::time::timeout(timeout, &mut ack_receiver).await {
+            Ok(Ok(())) => return,
+            // 同一 id 被重新登记时，旧任务直接退出，由新任务接手。
+            Ok(Err(_)) => return,
+            Err(_) => {}
+        }
+
+        let state = context.state.read().await;
+        let Some(sender) = state.connections.get(&sender_connection_id) else {
+            drop(state);
+            context.state.write().await.pending_deliveries.remove(&key);
+            return;
+        };
+        if attempt == max_retries {
+            break;
+        }
+
+        // 目标可能已经重连成新连接，每次重发都按 client_id 重新查找。
+        let recipient = state
+            .rooms
+            .get(&sender.room_id)
+            .and_then(|room| room.clients.get(&target))
+            .and_then(|recipient_connection_id| state.connections.get(recipient_connection_id))
+            .map(|recipient| recipient.sender.clone());
+        drop(state);
+        if let Some(recipient) = recipient {
+            debug!(
+                "retrying {} {id} to {target} (attempt {})",
+                message.kind,
+                attempt + 1
+            );
+            let _ = recipient.send(OutboundMessage::Json(message.clone()));
+        }
+    }
+
+    let sender = {
+        let mut state = context.state.write().await;
+        state.pending_deliveries.remove(&key);
+        state
+            .connections
+            .get(&sender_connection_id)
+            .map(|connection| connection.sender.clone())
+    };
+    if let Some(sender) = sender {
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            &context.config,
+            "delivery_failed",
+            serde_json::json!({ "id": id, "to": target }),
+        )));
+    }
+}
+
+/// 转发客户端消息；开启测试延迟时放到独立任务里延后投递，不阻塞读取循环。
+async fn relay_outbound(
+    context: &Arc<AppContext>,
+    room_id: String,
+    recipients: Vec<(String, OutboundSender)>,
+    message: SignalMessage,
+    receipt_to: Option<OutboundSender>,
+    in_flight: Arc<AtomicUsize>,
+) {
+    let config = &context.config;
+    if config.relay_delay_max_ms == 0 {
+        deliver_to_recipients(
+            context,
+            &room_id,
+            &recipients,
+            message,
+            receipt_to,
+            &in_flight,
+        )
+        .await;
+        return;
+    }
+
+    let delay_ms = random_between(config.relay_delay_min_ms, config.relay_delay_max_ms);
+    let context = context.clone();
+    tokio::spawn(async move {
+        tokio::time::sleep(Duration::from_millis(delay_ms)).await;
+        deliver_to_recipients(
+            &context,
+            &room_id,
+            &recipients,
+            message,
+            receipt_to,
+            &in_flight,
+        )
+        .await;
+    });
+}
+
+/// 同时向全部接收方入队，`block` 类消息最多等各自队列的空位一个超时；
+/// 发送方要求回执时，把成功与被丢弃的数量汇总成一条 `broadcast_receipt`。
+async fn deliver_to_recipients(
+    context: &AppContext,
+    room_id: &str,
+    recipients: &[(String, OutboundSender)],
+    message: SignalMessage,
+    receipt_to: Option<OutboundSender>,
+    in_flight: &Arc<AtomicUsize>,
+) {
+    let results = join_all(recipients.iter().map(|(_, recipient)| {
+        recipient.send_or_wait(OutboundMessage::Json(SignalMessage {
+            in_flight: Some(InFlightToken::acquire(in_flight)),
+            ..message.clone()
+        }))
+    }))
+    .await;
+
+    let mut delivered = 0;
+    let mut dropped = Vec::new();
+    for ((client_id, _), result) in recipients.iter().zip(results) {
+        match result {
+            Ok(()) => delivered += 1,
+            Err(err) => {
+                // 广播丢给个别成员不算死信，只有单播目标收不到时才转交。
+                if message.to.is_some() {
+                    let reason = match err {
+                        SendError::Closed => DeadLetterReason::TargetOffline,
+                        SendError::Dropped => DeadLetterReason::QueueFull,
+                    };
+                    report_dead_letter(
+                        context.dead_letters.as_ref(),
+                        room_id,
+                        client_id,
+                        reason,
+                        &message,
+                    );
+                }
+                dropped.push(client_id.clone());
+            }
+        }
+    }
+
+    if let Some(receipt_to) = receipt_to {
+        let _ = receipt_to.send(OutboundMessage::Json(SignalMessage::server(
+            &context.config,
+            "broadcast_receipt",
+            serde_json::json!({
+                "id": message.id,
+                "type": message.kind,
+                "delivered": delivered,
+                "dropped": dropped.len(),
+                "droppedIds": dropped,
+            }),
+        )));
+    }
+}
+
+/// `relay_data` 只是数据通道建立失败时的窄口兜底：必须单播、严格限长并按连接限流，
+/// 避免信令服务被当成通用的数据中转。
+fn check_relay_data(
+    config: &AppConfig,
+    inbound: &mut InboundState,
+    message: &SignalMessage,
+) -> Result<(), &'static str> {
+    if message.to.is_none() {
+        return Err("relay_data_requires_target");
+    }
+
+    if payload_len(message) > config.relay_data_max_bytes {
+        return Err("relay_data_too_large");
+    }
+
+    if !inbound.relay_data_bucket.try_take() {
+        return Err("relay_data_rate_limited");
+    }
+
+    Ok(())
+}
+
+/// 发言权指令处理完后需要通知的对象。
+#[derive(Debug, Clone, Copy)]
+enum FloorNotice {
+    /// 全房间：发言人或开关状态变了。
+    Changed,
+    /// 只通知房主：有人申请发言。
+    Requested,
+}
+
+/// 执行一条发言权指令。开关与指定发言人只有房主能做，发言人也可以自己交还发言权。
+fn apply_floor_command(
+    room: &mut RoomState,
+    message: &SignalMessage,
+) -> Result<FloorNotice, &'static str> {
+    let is_owner = room.owner.as_deref() == Some(message.from.as_str());
+    if message.kind == "floor_control" {
+        if !is_owner {
+            return Err("floor_not_owner");
+        }
+        let enabled = message
+            .payload
+            .get("enabled")
+            .and_then(Value::as_bool)
+            .unwrap_or(true);
+        room.floor = enabled.then(FloorState::default);
+        return Ok(FloorNotice::Changed);
+    }
+
+    let Some(floor) = room.floor.as_mut() else {
+        return Err("floor_not_enabled");
+    };
+    match message.kind.as_str() {
+        "floor_grant" => {
+            if !is_owner {
+                return Err("floor_not_owner");
+            }
+            let Some(target) = message
+                .to
+                .as_ref()
+                .filter(|target| room.clients.contains_key(*target))
+            else {
+                return Err("floor_grant_requires_member");
+            };
+            floor.queue.retain(|requester| requester != target);
+            floor.speaker = Some(target.clone());
+            Ok(FloorNotice::Changed)
+        }
+        "floor_release" => {
+            if !is_owner && floor.speaker.as_deref() != Some(message.from.as_str()) {
+                return Err("floor_not_owner");
+            }
+            floor.speaker = None;
+            Ok(FloorNotice::Changed)
+        }
+        _ => {
+            if !floor.queue.contains(&message.from)
+                && floor.speaker.as_deref() != Some(message.from.as_str())
+            {
+                floor.queue.push_back(message.from.clone());
+            }
+            Ok(FloorNotice::Requested)
+        }
+    }
+}
+
+/// `floor_changed` / `floor_requested` 的 payload；关闭控制后只带 `enabled: false`。
+fn floor_payload(floor: Option<&FloorState>, from: &str) -> Value {
+    let mut payload = floor
+        .map(FloorState::snapshot)
+        .unwrap_or_else(|| serde_json::json!({ "enabled": false, "speaker": null }));
+    payload["by"] = Value::from(from);
+    payload
+}
+
+/// 按 `DISPLAY_NAME_POLICY` 确定成员在房间内的显示名；同一成员重连或改回原名不算重名。
+fn resolve_display_name(
+    policy: DisplayNamePolicy,
+    members: &HashMap<String, Uuid>,
+    connections: &HashMap<Uuid, ConnectionHandle>,
+    client_id: &str,
+    requested: String,
+) -> Result<String, &'static str> {
+    if policy == DisplayNamePolicy::Allow {
+        return Ok(requested);
+    }
+
+    let names_in_use = members
+        .iter()
+        .filter(|(member_id, _)| member_id.as_str() != client_id)
+        .filter_map(|(_, member_connection_id)| connections.get(member_connection_id))
+        .filter_map(|member| member.display_name.as_deref())
+        .map(str::to_lowercase)
+        .collect::<HashSet<_>>();
+    if !names_in_use.contains(&requested.to_lowercase()) {
+        return Ok(requested);
+    }
+    if policy == DisplayNamePolicy::Reject {
+        return Err("name_taken");
+    }
+
+    // 房间成员数有限，从 2 开始找第一个空闲的序号总能结束。
+    (2..)
+        .map(|suffix| format!("{requested} ({suffix})"))
+        .find(|candidate| !names_in_use.contains(&candidate.to_lowercase()))
+        .ok_or("name_taken")
+}
+
+/// 按 `CHAT_CONTENT_POLICY` 校验聊天 payload，不通过时返回错误码。
+fn check_chat_content(policy: &ChatContentPolicy, payload: &Value) -> Result<(), &'static str> {
+    match policy {
+        ChatContentPolicy::Any => Ok(()),
+        ChatContentPolicy::PlainText => {
+            if contains_markup(payload) {
+                Err("chat_content_rejected")
+            } else {
+                Ok(())
+            }
+        }
+        ChatContentPolicy::Fields { allowed, max_bytes } => {
+            let Some(fields) = payload.as_object() else {
+                return Err("chat_content_rejected");
+            };
+            let valid = fields.iter().all(|(name, value)| {
+                allowed.contains(name)
+                    && match value {
+                        Value::String(text) => text.len() <= *max_bytes,
+                        Value::Number(_) | Value::Bool(_) | Value::Null => true,
+                        Value::Array(_) | Value::Object(_) => false,
+                    }
+            });
+            if valid {
+                Ok(())
+            } else {
+                Err("chat_content_rejected")
+            }
+        }
+    }
+}
+
+/// 递归检查 payload 中的字符串是否像标签（`<b`、`</`、`<!`）或 `data:` / `javascript:` 链接。
+fn contains_markup(value: &Value) -> bool {
+    match value {
+        Value::String(text) => {
+            let lower = text.to_lowercase();
+            lower.contains("data:")
+                || lower.contains("javascript:")
+                || lower.as_bytes().windows(2).any(|pair| {
+                    pair[0] == b'<'
+                        && (pair[1].is_ascii_alphabetic() || pair[1] == b'/' || pair[1] == b'!')
+                })
+        }
+        Value::Array(items) => items.iter().any(contains_markup),
+        Value::Object(fields) => fields.values().any(contains_markup),
+        Value::Null | Value::Bool(_) | Value::Number(_) => false,
+    }
+}
+
+/// 目标刚掉线且仍在宽限期内时暂存单播消息；队列满时丢弃最旧的一条。
+fn hold_for_departed(
+    config: &AppConfig,
+    room: &mut RoomState,
+    target: &str,
+    message: &SignalMessage,
+) -> bool {
+    if config.offline_hold_ttl_ms == 0 || config.offline_hold_max_messages == 0 {
+        return false;
+    }
+
+    room.prune_held_messages(config.offline_hold_ttl_ms);
+    let Some(held) = room.held_messages.get_mut(target) else {
+        return false;
+    };
+
+    let now = now_ms();
+    held.messages
+        .retain(|(expires_at_ms, _)| *expires_at_ms > now);
+    while held.messages.len() >= config.offline_hold_max_messages {
+        held.messages.pop_front();
+    }
+    held.messages.push_back((
+        now.saturating_add(config.offline_hold_ttl_ms),
+        message.clone(),
+    ));
+    true
+}
+
+/// 按消息类型取一个令牌；该类型和默认规则都没有配置时不限流。
+fn take_message_token(limits: &MessageRateLimits, inbound: &mut InboundState, kind: &str) -> bool {
+    let (key, limit) = match limits.per_type.get(kind) {
+        Some(limit) => (Some(kind.to_string()), *limit),
+        None => match limits.default_limit {
+            Some(limit) => (None, limit),
+            None => return true,
+        },
+    };
+
+    inbound
+        .message_buckets
+        .entry(key)
+        .or_insert_with(|| TokenBucket::new(limit.rate_per_second, limit.burst))
+        .try_take()
+}
+
+/// 同一发送方在去重窗口内发出类型、分组和 payload 都相同的广播时返回 `true`。
+fn is_duplicate_broadcast(
+    config: &AppConfig,
+    inbound: &mut InboundState,
+    message: &SignalMessage,
+) -> bool {
+    if config.broadcast_dedup_window_ms == 0 {
+        return false;
+    }
+
+    let mut hasher = DefaultHasher::new();
+    message.kind.hash(&mut hasher);
+    message.to_group.hash(&mut hasher);
+    message.to_many.hash(&mut hasher);
+    serde_json::to_string(&message.payload)
+        .unwrap_or_default()
+        .hash(&mut hasher);
+    let digest = hasher.finish();
+
+    let now = now_ms();
+    let window_start = now.saturating_sub(config.broadcast_dedup_window_ms);
+    let recent = &mut inbound.recent_broadcasts;
+    while recent
+        .front()
+        .is_some_and(|(seen_at_ms, _)| *seen_at_ms < window_start)
+    {
+        recent.pop_front();
+    }
+    if recent.iter().any(|(_, seen)| *seen == digest) {
+        return true;
+    }
+
+    recent.push_back((now, digest));
+    while recent.len() > BROADCAST_DEDUP_MAX_ENTRIES {
+        recent.pop_front();
+    }
+    false
+}
+
+/// 按序列化后的字节数计算 payload 大小，序列化失败视为超限。
+fn payload_len(message: &SignalMessage) -> usize {
+    serde_json::to_string(&message.payload)
+        .map(|text| text.len())
+        .unwrap_or(usize::MAX)
+}
+
+/// 把达到阈值的 payload 压缩成 base64 编码的 raw DEFLATE；已经编码过或压缩后不更小时返回 `None`。
+fn compress_payload(message: &SignalMessage, min_bytes: usize, level: u8) -> Option<Arc<String>> {
+    if message.encoding.is_some() {
+        return None;
+    }
+    let plain = serde_json::to_vec(&message.payload).ok()?;
+    if plain.len() < min_bytes {
+        return None;
+    }
+
+    let encoded = STANDARD.encode(deflate_raw(&plain, level));
+    (encoded.len() < plain.len()).then(|| Arc::new(encoded))
+}
+
+/// `time` 回带客户端时间与服务端时间，客户端据此估算往返延迟和时钟偏差；
+/// `ping` 只在携带 `clientTs` 时参与偏差检查。偏差超过阈值时记日志并下发 `clock_skew`。
+fn handle_time_request(config: &AppConfig, sender: &OutboundSender, message: &SignalMessage) {
+    let client_ts = message.payload.get("clientTs").and_then(Value::as_u64);
+    let server_ts = now_ms();
+    if message.kind == "time" {
+        let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+            config,
+            "time",
+            serde_json::json!({ "clientTs": client_ts, "serverTs": server_ts }),
+        )));
+    }
+
+    let Some(client_ts) = client_ts else {
+        return;
+    };
+    let skew_ms = server_ts.abs_diff(client_ts);
+    if config.clock_skew_warn_ms == 0 || skew_ms <= config.clock_skew_warn_ms {
+        return;
+    }
+    warn!(
+        "client {} clock is skewed by {skew_ms}ms from the server",
+        message.from
+    );
+    let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+        config,
+        "clock_skew",
+        serde_json::json!({
+            "clientTs": client_ts,
+            "serverTs": server_ts,
+            "skewMs": i128::from(client_ts) - i128::from(server_ts),
+        }),
+    )));
+}
+
+/// 给单个连接回一条 `error` 消息，payload 中带稳定的错误码。
+fn send_error(config: &AppConfig, sender: &OutboundSender, code: &str, message: &str) {
+    let _ = sender.send(OutboundMessage::Json(SignalMessage::server(
+        config,
+        "error",
+        serde_json::json!({ "code": code, "message": message }),
+    )));
+}
+
+/// 追加一条历史消息，并把缓存裁剪到配置的容量以内。
+fn record_history(
+    history: &mut VecDeque<(u64, SignalMessage)>,
+    limit: usize,
+    message: &SignalMessage,
+) {
+    if limit == 0 {
+        return;
+    }
+
+    history.push_back((now_ms(), message.clone()));
+    while history.len() > limit {
+        history.pop_front();
+    }
+}
+
+/// 刷新连接的最近活跃时间，供超时回收逻辑判断。
+async fn touch_connection(context: &Arc<AppContext>, connection_id: Uuid) {
+    let state = context.state.read().await;
+    if let Some(connection) = state.connections.get(&connection_id) {
+        connection.last_seen_ms.store(now_ms(), Ordering::Relaxed);
+    }
+}
+
+/// 找出超时连接并主动关闭。
+async fn reap_stale_connections(context: &Arc<AppContext>) {
+    let now = now_ms();
+    let stale_connections = {
+        let state = context.state.read().await;
+        state
+            .connections
+            .iter()
+            .filter_map(|(connection_id, connection)| {
+                let last_seen_ms = connection.last_seen_ms.load(Ordering::Relaxed);
+                let idle_for_ms = now.saturating_sub(last_seen_ms);
+
+                if idle_for_ms >= connection.heartbeat_timeout_ms {
+                    Some((
+                        *connection_id,
+                        connection.client_id.clone(),
+                        connection.identity().to_string(),
+                        connection.room_id.clone(),
+                        idle_for_ms,
+                    ))
+                } else {
+                    None
+                }
+            })
+            .collect::<Vec<_>>()
+    };
+
+    for (connection_id, client_id, identity, room_id, idle_for_ms) in stale_connections {
+        warn!(
+            "closing stale websocket connection for client {client_id} in room {room_id} after {idle_for_ms}ms of inactivity"
+        );
+        // 反复超时的客户端多半网络或实现有问题，冷却期比普通重连限流更长。
+        if context.config.read_timeout_limit > 0
+            && context
+                .state
+                .write()
+                .await
+                .record_read_timeout(&context.config, &identity, now)
+        {
+            warn!("client {client_id} keeps timing out; refusing reconnects for a cooldown");
+        }
+        unregister_connection(context, connection_id, true).await;
+    }
+}
+
+/// 关闭只剩旁观成员、且最后一位参与者离开已超过 `SPECTATOR_ONLY_ROOM_TTL_MS` 的房间。
+async fn reap_spectator_only_rooms(context: &Arc<AppContext>) {
+    let ttl_ms = context.config.spectator_only_room_ttl_ms;
+    if ttl_ms == 0 {
+        return;
+    }
+
+    let now = now_ms();
+    let detached = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let expired_room_ids = state
+            .rooms
+            .values()
+            .filter(|room| {
+                !room.clients.is_empty()
+                    && now.saturating_sub(room.participant_left_at_ms) >= ttl_ms
+                    && room.clients.values().all(|member_connection_id| {
+                        state
+                            .connections
+                            .get(member_connection_id)
+                            .is_none_or(|member| member.spectator)
+                    })
+            })
+            .map(|room| room.id.clone())
+            .collect::<Vec<_>>();
+
+        let mut detached = Vec::new();
+        for room_id in expired_room_ids {
+            let Some(room) = state.rooms.get_mut(&room_id) else {
+                continue;
+            };
+            let members = std::mem::take(&mut room.clients);
+            if room.persistent {
+                room.owner = None;
+                if room.retention == Some(RetentionPolicy::Session) {
+                    room.purge_retained();
+                }
+                if let Some(room) = state.rooms.get(&room_id) {
+                    state.notify_lobby(&context.config, LobbyEvent::Updated, room);
+                }
+            } else if let Some(room) = state.rooms.remove(&room_id) {
+                state.notify_lobby(&context.config, LobbyEvent::Destroyed, &room);
+            }
+            info!("closing room {room_id}: only spectators left for {ttl_ms}ms");
+            detached.extend(detach_members(&mut state.connections, &members));
+        }
+        detached
+    };
+
+    for member in detached {
+        let _ = member
+            .sender
+            .send(OutboundMessage::Json(SignalMessage::server(
+                &context.config,
+                "room_closed",
+                serde_json::json!({ "reason": "no_participants" }),
+            )));
+        member.close();
+    }
+}
+
+/// 关闭超时仍等不到第二位成员的房间，唯一的成员收到 `room_closed` 后断开。
+async fn reap_unpaired_rooms(context: &Arc<AppContext>) {
+    let timeout_ms = context.config.room_pairing_timeout_ms;
+    if timeout_ms == 0 {
+        return;
+    }
+
+    let now = now_ms();
+    let detached = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let unpaired_room_ids = state
+            .rooms
+            .values()
+            .filter(|room| {
+                room.awaiting_second_member && now.saturating_sub(room.created_at_ms) >= timeout_ms
+            })
+            .map(|room| room.id.clone())
+            .collect::<Vec<_>>();
+
+        let mut detached = Vec::new();
+        for room_id in unpaired_room_ids {
+            let Some(room) = state.rooms.remove(&room_id) else {
+                continue;
+            };
+            info!("closing room {room_id}: no second member within {timeout_ms}ms");
+            detached.extend(detach_members(&mut state.connections, &room.clients));
+        }
+        detached
+    };
+
+    for member in detached {
+        let _ = member
+            .sender
+            .send(OutboundMessage::Json(SignalMessage::server(
+                &context.config,
+                "room_closed",
+                serde_json::json!({ "reason": "no_peer" }),
+            )));
+        member.close();
+    }
+}
+
+/// 按房间的保留时长清理过期的聊天历史与消息日志。
+async fn purge_expired_retention(context: &Arc<AppContext>) {
+    let now = now_ms();
+    let history_max_age_ms = context.config.chat_history_max_age_ms;
+    let room_ids = context
+        .state
+        .read()
+        .await
+        .rooms
+        .values()
+        .filter(|room| room.has_expired_retained(now, history_max_age_ms))
+        .map(|room| room.id.clone())
+        .collect::<Vec<_>>();
+    if room_ids.is_empty() {
+        return;
+    }
+
+    let mut state = context.state.write().await;
+    for room_id in room_ids {
+        if let Some(room) = state.rooms.get_mut(&room_id) {
+            room.purge_expired_retained(now, history_max_age_ms);
+        }
+    }
+}
+
+/// 聊天历史、消息日志等保留数据合计超出 `RETAINED_MEMORY_BUDGET_BYTES` 时按从旧到新的顺序裁剪。
+async fn enforce_retained_memory_budget(context: &Arc<AppContext>) {
+    let budget = context.config.retained_memory_budget_bytes;
+    if budget == 0 || context.state.read().await.retained_bytes() <= budget {
+        return;
+    }
+
+    let (shed_history, shed_log, remaining) = context
+        .state
+        .write()
+        .await
+        .shed_retained_over_budget(budget);
+    warn!(
+        "retained messages exceeded the {budget} byte budget; shed {shed_history} history and {shed_log} log entries, {remaining} bytes remain"
+    );
+}
+
+/// 关闭到达最长存活时间的房间，不论房间里是否还有人；预建房间同样移除。
+async fn reap_expired_rooms(context: &Arc<AppContext>) {
+    let now = now_ms();
+    // 绝大多数房间没有存活上限，先用读锁筛一遍，避免每个周期都抢写锁。
+    let expired_room_ids = context
+        .state
+        .read()
+        .await
+        .rooms
+        .values()
+        .filter(|room| {
+            room.expires_at_ms
+                .is_some_and(|expires_at| now >= expires_at)
+        })
+        .map(|room| room.id.clone())
+        .collect::<Vec<_>>();
+    if expired_room_ids.is_empty() {
+        return;
+    }
+
+    let detached = {
+        let mut state = context.state.write().await;
+        let state = &mut *state;
+        let mut detached = Vec::new();
+        for room_id in expired_room_ids {
+            // 释放读锁后房间可能已被改名或重建，拿到写锁后再确认一次。
+            let still_expired = state
+                .rooms
+                .get(&room_id)
+                .and_then(|room| room.expires_at_ms)
+                .is_some_and(|expires_at| now >= expires_at);
+            if !still_expired {
+                continue;
+            }
+            let Some(room) = state.rooms.remove(&room_id) else {
+                continue;
+            };
+            state.notify_lobby(&context.config, LobbyEvent::Destroyed, &room);
+            // 排空结束的房间与到期的房间一起关闭，只是通知不同。
+            let notice = if room.draining_until_ms.is_some() {
+                info!("closing room {room_id}: drain finished");
+                SignalMessage::server(
+                    &context.config,
+                    "room_closed",
+                    serde_json::json!({ "reason": "drained" }),
+                )
+            } else {
+                info!("closing room {room_id}: maximum lifetime reached");
+                SignalMessage::server(&context.config, "room_expired", Value::Null)
+            };
+            detached.extend(
+                detach_members(&mut state.connections, &room.clients)
+                    .into_iter()
+                    .map(|member| (member, notice.clone())),
+            );
+        }
+        detached
+    };
+
+    for (member, notice) in detached {
+        let _ = member.sender.send(OutboundMessage::Json(notice));
+        member.close();
+    }
+}
+
+/// 把被关闭房间的成员从连接表摘除，返回需要通知并断开的句柄。
+fn detach_members(
+    connections: &mut ConnectionTable,
+    members: &HashMap<String, Uuid>,
+) -> Vec<DetachedConnection> {
+    members
+        .values()
+        .filter_map(|member_connection_id| connections.remove(member_connection_id))
+        .map(|member| DetachedConnection {
+            sender: member.sender,
+            shutdown: member.shutdown,
+        })
+        .collect()
+}
+
+/// 将一条业务消息复制发送给多个接收方。
+pub(crate) fn broadcast_outbound(recipients: &[OutboundSender], message: SignalMessage) {
+    for recipient in recipients {
         let _ = recipient.send(OutboundMessage::Json(message.clone()));
     }
 }
+
+/// 测试用：以默认选项注册一个成员，返回连接号与出站队列；注册失败时直接 panic。
+#[cfg(test)]
+pub(crate) async fn join_for_tests(
+    context: &Arc<AppContext>,
+    client_id: &str,
+    room_id: &str,
+) -> (Uuid, OutboundSender) {
+    let (connection_id, sender, result) =
+        tests::join(context, client_id, room_id, tests::client_options(1)).await;
+    assert!(result.is_ok(), "{client_id} could not join {room_id}");
+    (connection_id, sender)
+}
+
+/// 测试用：同 `join_for_tests`，但注册失败时返回客户端会收到的拒绝通知。
+#[cfg(test)]
+pub(crate) async fn try_join_for_tests(
+    context: &Arc<AppContext>,
+    client_id: &str,
+    room_id: &str,
+) -> Result<(Uuid, OutboundSender), SignalMessage> {
+    let (connection_id, sender, result) =
+        tests::join(context, client_id, room_id, tests::client_options(1)).await;
+    match result {
+        Ok(_) => Ok((connection_id, sender)),
+        Err(err) => Err(registration_refusal(&context.config, &err)),
+    }
+}
+
+/// 测试用：把一条消息交给路由，相当于该连接的读取循环刚收到它。
+#[cfg(test)]
+pub(crate) async fn route_for_tests(
+    context: &Arc<AppContext>,
+    connection_id: Uuid,
+    message: SignalMessage,
+) {
+    route_message(
+        context,
+        connection_id,
+        &mut tests::inbound(context),
+        message,
+    )
+    .await;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        app::{test_context, Subscriber},
+        auth::{AuthorizationError, Authorizer},
+        compress::DEFAULT_COMPRESSION_LEVEL,
+        config::{
+            history_types_from, BackpressureStrategy, ChatContentPolicy, DisplayNamePolicy,
+            PingProfile, RateLimit, VirtualBot,
+        },
+    };
+
+    fn room_options() -> RoomOptions {
+        RoomOptions {
+            is_private: false,
+            owner_leave_policy: OwnerLeavePolicy::Transfer,
+            allowed_origins: Vec::new(),
+            persistent: false,
+            approval_required: false,
+            message_log: false,
+            max_lifetime_ms: None,
+            retention: None,
+        }
+    }
+
+    /// 一条测试连接的入站状态；需要跨消息累积限流或去重状态的测试自己持有同一份。
+    pub(super) fn inbound(context: &AppContext) -> InboundState {
+        InboundState::new(&context.config, &client_options(1))
+    }
+
+    pub(super) fn client_options(protocol_version: u32) -> ClientOptions {
+        ClientOptions {
+            group: None,
+            role: None,
+            display_name: None,
+            spectator: false,
+            user_agent: None,
+            client_version: None,
+            protocol_version,
+            accepts_compression: false,
+            accepts_batch: false,
+            compression_level: DEFAULT_COMPRESSION_LEVEL,
+            ping_profile: ping_profile_for(&AppConfig::for_tests(), None),
+            allowed_types: None,
+            anonymous: true,
+            real_client_id: None,
+        }
+    }
+
+    /// 按建连流程注册一个连接，返回连接号、它的出站队列与注册结果。
+    pub(super) async fn join(
+        context: &Arc<AppContext>,
+        client_id: &str,
+        room_id: &str,
+        options: ClientOptions,
+    ) -> (
+        Uuid,
+        OutboundSender,
+        Result<RegistrationResult, RegistrationError>,
+    ) {
+        join_room(context, client_id, room_id, room_options(), options).await
+    }
+
+    /// 同 `join`，但由调用方决定新建房间时的房间选项。
+    async fn join_room(
+        context: &Arc<AppContext>,
+        client_id: &str,
+        room_id: &str,
+        room: RoomOptions,
+        options: ClientOptions,
+    ) -> (
+        Uuid,
+        OutboundSender,
+        Result<RegistrationResult, RegistrationError>,
+    ) {
+        let connection_id = Uuid::new_v4();
+        let sender = OutboundQueue::new(
+            context.config.outbound_queue_capacity,
+            context.config.backpressure.clone(),
+        );
+        let (shutdown, _) = watch::channel(false);
+        let result = register_connection(
+            context,
+            connection_id,
+            client_id.to_string(),
+            room_id.to_string(),
+            room,
+            options,
+            sender.clone(),
+            shutdown,
+        )
+        .await;
+        (connection_id, sender, result)
+    }
+
+    /// 从出站队列里取出第一条指定类型的业务消息。
+    async fn next_of_kind(sender: &OutboundSender, kind: &str) -> SignalMessage {
+        loop {
+            let message = tokio::time::timeout(Duration::from_secs(1), sender.recv())
+                .await
+                .unwrap_or_else(|_| panic!("no {kind} message was queued"));
+            if let Some(OutboundMessage::Json(message)) = message {
+                if message.kind == kind {
+                    return message;
+                }
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn joined_roster_follows_the_recipient_protocol_version() {
+        let context = test_context(AppConfig::for_tests());
+        let mut alice = client_options(1);
+        alice.display_name = Some("Alice".to_string());
+        alice.role = Some("host".to_string());
+        let (_, _, result) = join(&context, "alice", "versions", alice).await;
+        assert!(result.is_ok());
+
+        let (_, bob_queue, result) = join(&context, "bob", "versions", client_options(1)).await;
+        assert!(result.is_ok());
+        let joined = next_of_kind(&bob_queue, "joined").await;
+        assert_eq!(joined.payload["members"], serde_json::json!(["alice"]));
+        assert_eq!(
+            joined.payload["names"],
+            serde_json::json!({ "alice": "Alice" })
+        );
+
+        let (_, carol_queue, result) = join(&context, "carol", "versions", client_options(2)).await;
+        assert!(result.is_ok());
+        let joined = next_of_kind(&carol_queue, "joined").await;
+        let mut members = joined.payload["members"]
+            .as_array()
+            .expect("v2 members are an array")
+            .clone();
+        members.sort_by_key(|member| member["id"].as_str().unwrap_or_default().to_string());
+        assert_eq!(
+            members,
+            vec![
+                serde_json::json!({ "id": "alice", "name": "Alice", "role": "host" }),
+                serde_json::json!({ "id": "bob" }),
+            ]
+        );
+        assert!(joined.payload.get("names").is_none());
+    }
+
+    #[tokio::test]
+    async fn late_unregister_of_replaced_connection_keeps_the_replacement() {
+        let context = test_context(AppConfig::for_tests());
+        let (old_id, _, result) = join(&context, "alice", "swap", client_options(1)).await;
+        assert!(result.is_ok());
+        let (new_id, _, result) = join(&context, "alice", "swap", client_options(1)).await;
+        let Ok(registration) = result else {
+            panic!("reconnecting with the same id must succeed");
+        };
+        assert!(registration.replaced_connection.is_some());
+
+        // 旧连接的读循环稍后才退出，它的注销不能把新连接挤出房间。
+        unregister_connection(&context, old_id, false).await;
+
+        let state = context.state.read().await;
+        assert_eq!(state.rooms["swap"].clients.get("alice"), Some(&new_id));
+        assert!(state.connections.contains_key(&new_id));
+        assert!(!state.connections.contains_key(&old_id));
+    }
+
+    #[tokio::test]
+    async fn unregister_only_removes_the_member_slot_it_still_owns() {
+        let context = test_context(AppConfig::for_tests());
+        let (old_id, _, result) = join(&context, "alice", "swap", client_options(1)).await;
+        assert!(result.is_ok());
+        // 模拟旧句柄还在连接表里、房间里的同名位置已经换成新连接的时刻。
+        let replacement_id = Uuid::new_v4();
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .get_mut("swap")
+            .expect("room exists")
+            .clients
+            .insert("alice".to_string(), replacement_id);
+
+        unregister_connection(&context, old_id, false).await;
+
+        let state = context.state.read().await;
+        assert!(!state.connections.contains_key(&old_id));
+        assert_eq!(
+            state.rooms["swap"].clients.get("alice"),
+            Some(&replacement_id)
+        );
+    }
+
+    fn writer_options(context: &AppContext) -> WriterOptions {
+        WriterOptions {
+            room_id: "shutdown".to_string(),
+            type_aliases: HashMap::new(),
+            accepts_compression: false,
+            batch_max_messages: 0,
+            batch_max_bytes: 0,
+            server_sender_id: context.config.server_sender_id.clone(),
+            dead_letters: None,
+            egress_bucket: None,
+            backpressure: context.config.backpressure.clone(),
+        }
+    }
+
+    /// 启动 writer 的测试依次执行，读写循环计数不受并行测试干扰。
+    static WRITER_TESTS: tokio::sync::Mutex<()> = tokio::sync::Mutex::const_new(());
+
+    /// 写完队列里已有的消息后让 writer 退出，返回它写出的业务消息。
+    async fn write_queued(queue: &OutboundSender, options: WriterOptions) -> Vec<SignalMessage> {
+        let _serial = WRITER_TESTS.lock().await;
+        queue.close_after_pending();
+        run_writer(Vec::<WsMessage>::new(), queue.clone(), options)
+            .await
+            .into_iter()
+            .filter_map(|frame| match frame {
+                WsMessage::Text(text) => serde_json::from_str(text.as_str()).ok(),
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn shutdown_flushes_notice_and_closes_every_queue() {
+        let _serial = WRITER_TESTS.lock().await;
+        let context = test_context(AppConfig::for_tests());
+        let mut connections = Vec::new();
+        for client_id in ["alice", "bob", "carol"] {
+            let (connection_id, queue, result) =
+                join(&context, client_id, "shutdown", client_options(1)).await;
+            assert!(result.is_ok());
+            let shutdown = context.state.read().await.connections[&connection_id]
+                .shutdown
+                .subscribe();
+            let writer = tokio::spawn(run_writer(
+                Vec::<WsMessage>::new(),
+                queue.clone(),
+                writer_options(&context),
+            ));
+            connections.push((queue, shutdown, writer));
+        }
+
+        shutdown_connections(&context, Duration::from_secs(2)).await;
+        assert_eq!(active_pump_count(), 0);
+        assert!(context.maintenance.load(Ordering::Relaxed));
+
+        for (queue, shutdown, writer) in connections {
+            assert!(*shutdown.borrow(), "the reader must be told to stop");
+            assert!(queue.is_closed());
+            assert_eq!(
+                queue.send(OutboundMessage::Json(SignalMessage::server(
+                    &context.config,
+                    "user_left",
+                    Value::Null,
+                ))),
+                Err(SendError::Closed)
+            );
+
+            let written = writer.await.expect("writer task finished");
+            let [.., WsMessage::Text(notice), WsMessage::Close(None)] = written.as_slice() else {
+                panic!("writer must end with the shutdown notice and a close frame");
+            };
+            let notice: SignalMessage =
+                serde_json::from_str(notice.as_str()).expect("notice is a signal message");
+            assert_eq!(notice.kind, "server_shutdown");
+        }
+    }
+
+    #[tokio::test]
+    async fn full_room_rejects_next_client_without_registering_it() {
+        let mut config = AppConfig::for_tests();
+        config.max_clients_per_room = 50;
+        let context = test_context(config);
+        for index in 0..50 {
+            let (_, _, result) = join(
+                &context,
+                &format!("member-{index}"),
+                "lobby",
+                client_options(1),
+            )
+            .await;
+            assert!(result.is_ok(), "member {index} should fit in the room");
+        }
+
+        let (connection_id, _, result) =
+            join(&context, "member-50", "lobby", client_options(1)).await;
+        let Err(err) = result else {
+            panic!("the 51st client must be refused");
+        };
+        assert!(matches!(err, RegistrationError::RoomFull));
+        assert_eq!(
+            registration_refusal(&context.config, &err).kind,
+            "room_full"
+        );
+
+        let state = context.state.read().await;
+        let room = &state.rooms["lobby"];
+        assert_eq!(room.clients.len(), 50);
+        assert!(!room.clients.contains_key("member-50"));
+        assert!(!state.connections.contains_key(&connection_id));
+        assert_eq!(state.connections.len(), 50);
+    }
+
+    #[tokio::test]
+    async fn full_room_still_admits_a_reconnecting_member() {
+        let mut config = AppConfig::for_tests();
+        config.max_clients_per_room = 2;
+        let context = test_context(config);
+        for client_id in ["alice", "bob"] {
+            let (_, _, result) = join(&context, client_id, "pair", client_options(1)).await;
+            assert!(result.is_ok());
+        }
+
+        let (_, _, result) = join(&context, "alice", "pair", client_options(1)).await;
+        assert!(
+            result.is_ok(),
+            "replacing an existing member keeps the count unchanged"
+        );
+        assert_eq!(context.state.read().await.rooms["pair"].clients.len(), 2);
+    }
+
+    /// 取出队列里眼下已排队的全部业务消息类型。
+    async fn queued_kinds(sender: &OutboundSender) -> Vec<String> {
+        let mut kinds = Vec::new();
+        while let Ok(Some(message)) =
+            tokio::time::timeout(Duration::from_millis(50), sender.recv()).await
+        {
+            if let OutboundMessage::Json(message) = message {
+                kinds.push(message.kind);
+            }
+        }
+        kinds
+    }
+
+    fn relay_data(to: &str, payload: Value) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({
+            "type": "relay_data",
+            "to": to,
+            "payload": payload,
+        }))
+        .expect("relay_data message")
+    }
+
+    /// 让两名成员进入同一房间，并清空各自建连时收到的通知。
+    async fn relay_pair(
+        config: AppConfig,
+    ) -> (Arc<AppContext>, Uuid, OutboundSender, OutboundSender) {
+        let context = test_context(config);
+        let (alice_id, alice_queue, result) =
+            join(&context, "alice", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, bob_queue, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&alice_queue).await;
+        queued_kinds(&bob_queue).await;
+        (context, alice_id, alice_queue, bob_queue)
+    }
+
+    #[tokio::test]
+    async fn relay_data_within_limits_reaches_its_target() {
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(AppConfig::for_tests()).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            relay_data("bob", serde_json::json!("hi")),
+        )
+        .await;
+
+        let relayed = next_of_kind(&bob_queue, "relay_data").await;
+        assert_eq!(relayed.from, "alice");
+        assert_eq!(relayed.payload, serde_json::json!("hi"));
+        assert!(!queued_kinds(&alice_queue)
+            .await
+            .contains(&"error".to_string()));
+    }
+
+    #[tokio::test]
+    async fn oversized_relay_data_is_rejected_and_not_relayed() {
+        let mut config = AppConfig::for_tests();
+        config.relay_data_max_bytes = 64;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+
+        let payload = serde_json::json!("x".repeat(64));
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            relay_data("bob", payload),
+        )
+        .await;
+
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "relay_data_too_large");
+        assert!(!queued_kinds(&bob_queue)
+            .await
+            .contains(&"relay_data".to_string()));
+    }
+
+    #[tokio::test]
+    async fn relay_data_over_the_rate_limit_is_rejected_and_not_relayed() {
+        let mut config = AppConfig::for_tests();
+        config.relay_data_rate_per_second = 0.0;
+        config.relay_data_burst = 2.0;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+
+        let mut alice_inbound = inbound(&context);
+        for _ in 0..3 {
+            route_message(
+                &context,
+                alice_id,
+                &mut alice_inbound,
+                relay_data("bob", serde_json::json!("hi")),
+            )
+            .await;
+        }
+
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "relay_data_rate_limited");
+        let relayed = queued_kinds(&bob_queue).await;
+        assert_eq!(
+            relayed.iter().filter(|kind| *kind == "relay_data").count(),
+            2,
+            "only the burst may be relayed"
+        );
+    }
+
+    #[tokio::test]
+    async fn relay_data_without_a_target_is_rejected() {
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(AppConfig::for_tests()).await;
+
+        let mut message = relay_data("bob", serde_json::json!("hi"));
+        message.to = None;
+        route_message(&context, alice_id, &mut inbound(&context), message).await;
+
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "relay_data_requires_target");
+        assert!(!queued_kinds(&bob_queue)
+            .await
+            .contains(&"relay_data".to_string()));
+    }
+
+    /// 只认 `x-api-key` 请求头的授权器，身份取自 `x-client-id`。
+    struct HeaderAuthorizer;
+
+    impl Authorizer for HeaderAuthorizer {
+        fn authorize(
+            &self,
+            _config: &AppConfig,
+            headers: &HeaderMap,
+            params: &ConnectParams,
+        ) -> Result<AuthorizedConnection, AuthorizationError> {
+            if headers
+                .get("x-api-key")
+                .and_then(|value| value.to_str().ok())
+                != Some("secret")
+            {
+                return Err(AuthorizationError::new(
+                    StatusCode::FORBIDDEN,
+                    "missing api key",
+                ));
+            }
+            let client_id = headers
+                .get("x-client-id")
+                .and_then(|value| value.to_str().ok())
+                .unwrap_or("api-client");
+            Ok(AuthorizedConnection {
+                client_id: client_id.to_string(),
+                room_id: params.room.clone().unwrap_or_default(),
+                allowed_types: None,
+                anonymous: false,
+            })
+        }
+    }
+
+    fn header_authorized_context() -> Arc<AppContext> {
+        let mut context = test_context(AppConfig::for_tests());
+        Arc::get_mut(&mut context)
+            .expect("context is not shared yet")
+            .authorizer = Arc::new(HeaderAuthorizer);
+        context
+    }
+
+    fn connect_params(room: &str) -> ConnectParams {
+        serde_json::from_value(serde_json::json!({ "room": room })).expect("connect params")
+    }
+
+    #[test]
+    fn custom_authorizer_rejects_requests_without_its_header() {
+        let context = header_authorized_context();
+
+        let Err(err) = authorize_upgrade(&context, &HeaderMap::new(), &connect_params("lobby"))
+        else {
+            panic!("a request without the api key must be rejected");
+        };
+        assert_eq!(err.status(), StatusCode::FORBIDDEN);
+        assert_eq!(err.code(), "forbidden");
+    }
+
+    #[test]
+    fn custom_authorizer_decides_the_connection_identity() {
+        let context = header_authorized_context();
+        let mut headers = HeaderMap::new();
+        headers.insert("x-api-key", "secret".parse().unwrap());
+        headers.insert("x-client-id", "alice".parse().unwrap());
+
+        let Ok(authorized) = authorize_upgrade(&context, &headers, &connect_params("lobby")) else {
+            panic!("a request with the api key must be accepted");
+        };
+        assert_eq!(authorized.client_id, "alice");
+        assert_eq!(authorized.room_id, "lobby");
+        assert!(!authorized.anonymous);
+    }
+
+    #[test]
+    fn reserved_identity_is_rejected_even_when_the_authorizer_accepts_it() {
+        let context = header_authorized_context();
+        let mut headers = HeaderMap::new();
+        headers.insert("x-api-key", "secret".parse().unwrap());
+        headers.insert(
+            "x-client-id",
+            context
+                .config
+                .server_sender_id
+                .to_ascii_uppercase()
+                .parse()
+                .unwrap(),
+        );
+
+        let Err(err) = authorize_upgrade(&context, &headers, &connect_params("lobby")) else {
+            panic!("the server sender id is reserved");
+        };
+        assert_eq!(err.status(), StatusCode::FORBIDDEN);
+        assert_eq!(err.code(), "reserved_identity");
+    }
+
+    #[test]
+    fn default_authorizer_requires_a_session_cookie() {
+        let context = test_context(AppConfig::for_tests());
+
+        let Err(err) = authorize_upgrade(&context, &HeaderMap::new(), &connect_params("lobby"))
+        else {
+            panic!("the default authorizer needs an anonymous session");
+        };
+        assert_eq!(err.status(), StatusCode::UNAUTHORIZED);
+    }
+
+    /// 先让房主建好需要审批的房间，返回房主的连接号与出站队列。
+    async fn approval_room(config: AppConfig) -> (Arc<AppContext>, Uuid, OutboundSender) {
+        let context = test_context(config);
+        let (owner_id, owner_queue, result) =
+            join(&context, "owner", "moderated", client_options(1)).await;
+        assert!(result.is_ok());
+        let mut state = context.state.write().await;
+        let room = state.rooms.get_mut("moderated").expect("room exists");
+        assert_eq!(room.owner.as_deref(), Some("owner"));
+        room.approval_required = true;
+        drop(state);
+        (context, owner_id, owner_queue)
+    }
+
+    /// 以一条不会主动断开的连接发起入房申请，等房主收到 `join_request` 后返回。
+    async fn knock(
+        context: &Arc<AppContext>,
+        owner_queue: &OutboundSender,
+        client_id: &'static str,
+    ) -> tokio::task::JoinHandle<JoinApproval> {
+        let context = context.clone();
+        let waiter = tokio::spawn(async move {
+            let mut stream = futures_util::stream::pending::<Result<WsMessage, ()>>();
+            await_join_approval(&context, &mut stream, client_id, "moderated").await
+        });
+        let request = next_of_kind(owner_queue, "join_request").await;
+        assert_eq!(request.payload["clientId"], client_id);
+        waiter
+    }
+
+    fn decision(kind: &str, target: &str) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({ "type": kind, "to": target }))
+            .expect("approval message")
+    }
+
+    #[tokio::test]
+    async fn approved_join_request_admits_the_pending_client() {
+        let (context, owner_id, owner_queue) = approval_room(AppConfig::for_tests()).await;
+        let waiter = knock(&context, &owner_queue, "guest").await;
+        {
+            let state = context.state.read().await;
+            let room = &state.rooms["moderated"];
+            assert!(room.pending_joins.contains_key("guest"));
+            assert!(!room.clients.contains_key("guest"));
+        }
+
+        route_message(
+            &context,
+            owner_id,
+            &mut inbound(&context),
+            decision("approve", "guest"),
+        )
+        .await;
+
+        assert!(matches!(waiter.await.unwrap(), JoinApproval::Approved));
+        assert!(context.state.read().await.rooms["moderated"]
+            .pending_joins
+            .is_empty());
+    }
+
+    #[tokio::test]
+    async fn denied_join_request_is_refused_and_cleared() {
+        let (context, owner_id, owner_queue) = approval_room(AppConfig::for_tests()).await;
+        let waiter = knock(&context, &owner_queue, "guest").await;
+
+        route_message(
+            &context,
+            owner_id,
+            &mut inbound(&context),
+            decision("deny", "guest"),
+        )
+        .await;
+
+        assert!(matches!(waiter.await.unwrap(), JoinApproval::Denied));
+        let state = context.state.read().await;
+        let room = &state.rooms["moderated"];
+        assert!(room.pending_joins.is_empty());
+        assert!(!room.clients.contains_key("guest"));
+    }
+
+    #[tokio::test]
+    async fn unanswered_join_request_times_out_and_is_cleared() {
+        let mut config = AppConfig::for_tests();
+        config.join_approval_timeout_ms = 50;
+        let (context, _, owner_queue) = approval_room(config).await;
+        let waiter = knock(&context, &owner_queue, "guest").await;
+
+        assert!(matches!(waiter.await.unwrap(), JoinApproval::TimedOut));
+        assert!(context.state.read().await.rooms["moderated"]
+            .pending_joins
+            .is_empty());
+    }
+
+    #[tokio::test]
+    async fn only_the_owner_can_approve_a_join_request() {
+        let mut config = AppConfig::for_tests();
+        config.join_approval_timeout_ms = 200;
+        let (context, _, owner_queue) = approval_room(config).await;
+        // 已经在房间里的普通成员，直接注册、不经过审批握手。
+        let (member_id, _, result) = join(&context, "member", "moderated", client_options(1)).await;
+        assert!(result.is_ok());
+        let waiter = knock(&context, &owner_queue, "guest").await;
+
+        route_message(
+            &context,
+            member_id,
+            &mut inbound(&context),
+            decision("approve", "guest"),
+        )
+        .await;
+
+        assert!(matches!(waiter.await.unwrap(), JoinApproval::TimedOut));
+    }
+
+    #[tokio::test]
+    async fn pending_client_that_disconnects_is_cleared() {
+        let (context, _, owner_queue) = approval_room(AppConfig::for_tests()).await;
+        let waiter = {
+            let context = context.clone();
+            tokio::spawn(async move {
+                let mut stream = futures_util::stream::iter([Ok::<_, ()>(WsMessage::Close(None))]);
+                await_join_approval(&context, &mut stream, "guest", "moderated").await
+            })
+        };
+
+        assert!(matches!(waiter.await.unwrap(), JoinApproval::Disconnected));
+        next_of_kind(&owner_queue, "join_request").await;
+        assert!(context.state.read().await.rooms["moderated"]
+            .pending_joins
+            .is_empty());
+    }
+
+    fn unicast(kind: &str, to: &str, id: &str) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({ "type": kind, "to": to, "id": id }))
+            .expect("unicast message")
+    }
+
+    fn retrying_config(attempts: u32, ack_timeout_ms: u64) -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.delivery_retry_attempts = attempts;
+        config.delivery_ack_timeout_ms = ack_timeout_ms;
+        config
+    }
+
+    #[tokio::test]
+    async fn unacked_unicast_is_retried_until_the_target_acks() {
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(retrying_config(5, 30)).await;
+        let bob_id = context.state.read().await.rooms["relay"].clients["bob"];
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+        next_of_kind(&bob_queue, "offer").await;
+        // 第一次没有确认，超时后服务端重发同一条消息。
+        let retried = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(retried.id.as_deref(), Some("m1"));
+
+        route_message(
+            &context,
+            bob_id,
+            &mut inbound(&context),
+            unicast("ack", "alice", "m1"),
+        )
+        .await;
+        next_of_kind(&alice_queue, "ack").await;
+        assert!(context.state.read().await.pending_deliveries.is_empty());
+        queued_kinds(&bob_queue).await;
+
+        // 确认之后不再重发，也不会再报投递失败。
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        assert!(!queued_kinds(&alice_queue)
+            .await
+            .contains(&"delivery_failed".to_string()));
+        assert!(queued_kinds(&bob_queue)
+            .await
+            .iter()
+            .all(|kind| kind != "offer"));
+    }
+
+    #[tokio::test]
+    async fn unicast_that_is_never_acked_fails_after_the_last_retry() {
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(retrying_config(2, 20)).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+
+        let failed = next_of_kind(&alice_queue, "delivery_failed").await;
+        assert_eq!(
+            failed.payload,
+            serde_json::json!({ "id": "m1", "to": "bob" })
+        );
+        let copies = queued_kinds(&bob_queue)
+            .await
+            .iter()
+            .filter(|kind| *kind == "offer")
+            .count();
+        assert_eq!(copies, 3, "the original delivery plus two retries");
+        assert!(context.state.read().await.pending_deliveries.is_empty());
+    }
+
+    #[tokio::test]
+    async fn pending_deliveries_per_sender_are_bounded() {
+        let mut config = retrying_config(1, 1_000);
+        config.delivery_max_pending = 1;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m2"),
+        )
+        .await;
+
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "delivery_pending_limit");
+        let delivered = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(delivered.id.as_deref(), Some("m1"));
+        assert_eq!(context.state.read().await.pending_deliveries.len(), 1);
+
+        // 确认后名额释放，同一发送方可以再登记新的投递。
+        let bob_id = context.state.read().await.rooms["relay"].clients["bob"];
+        route_message(
+            &context,
+            bob_id,
+            &mut inbound(&context),
+            unicast("ack", "alice", "m1"),
+        )
+        .await;
+        assert_eq!(
+            context
+                .state
+                .read()
+                .await
+                .pending_deliveries
+                .count_for(alice_id),
+            0
+        );
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m3"),
+        )
+        .await;
+        let delivered = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(delivered.id.as_deref(), Some("m3"));
+        assert_eq!(
+            context
+                .state
+                .read()
+                .await
+                .pending_deliveries
+                .count_for(alice_id),
+            1
+        );
+    }
+
+    fn unique_ids_config() -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.unique_client_ids = true;
+        config
+    }
+
+    #[tokio::test]
+    async fn unique_ids_refuse_an_id_already_active_in_another_room() {
+        let context = test_context(unique_ids_config());
+        let (_, _, result) = join(&context, "alice", "room-a", client_options(1)).await;
+        assert!(result.is_ok());
+
+        let (connection_id, _, result) = join(&context, "alice", "room-b", client_options(1)).await;
+        let Err(err) = result else {
+            panic!("the same id must not be active in two rooms");
+        };
+        assert!(matches!(err, RegistrationError::DuplicateId));
+        let notice = registration_refusal(&context.config, &err);
+        assert_eq!(notice.kind, "error");
+        assert_eq!(notice.payload["code"], "duplicate_id");
+
+        let state = context.state.read().await;
+        assert!(!state.connections.contains_key(&connection_id));
+        assert!(state
+            .rooms
+            .get("room-b")
+            .is_none_or(|room| !room.clients.contains_key("alice")));
+        assert_eq!(state.rooms["room-a"].clients.len(), 1);
+    }
+
+    #[tokio::test]
+    async fn unique_ids_still_allow_reconnecting_to_the_same_room() {
+        let context = test_context(unique_ids_config());
+        let (_, _, result) = join(&context, "alice", "room-a", client_options(1)).await;
+        assert!(result.is_ok());
+
+        let (_, _, result) = join(&context, "alice", "room-a", client_options(1)).await;
+        let Ok(registration) = result else {
+            panic!("a same-room reconnect replaces the old connection");
+        };
+        assert!(registration.replaced_connection.is_some());
+    }
+
+    #[tokio::test]
+    async fn unique_ids_free_the_id_once_its_connection_leaves() {
+        let context = test_context(unique_ids_config());
+        let (connection_id, _, result) = join(&context, "alice", "room-a", client_options(1)).await;
+        assert!(result.is_ok());
+        unregister_connection(&context, connection_id, false).await;
+
+        let (_, _, result) = join(&context, "alice", "room-b", client_options(1)).await;
+        assert!(result.is_ok());
+    }
+
+    #[tokio::test]
+    async fn ids_may_span_rooms_when_uniqueness_is_off() {
+        let mut config = AppConfig::for_tests();
+        config.unique_client_ids = false;
+        let context = test_context(config);
+        for room_id in ["room-a", "room-b"] {
+            let (_, _, result) = join(&context, "alice", room_id, client_options(1)).await;
+            assert!(result.is_ok());
+        }
+        assert_eq!(context.state.read().await.connections.len(), 2);
+    }
+
+    fn pseudonymous_config() -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.pseudonymous_ids = true;
+        config
+    }
+
+    /// 按建连流程换算出房间内身份后注册，返回化名与出站队列。
+    async fn join_pseudonymous(
+        context: &Arc<AppContext>,
+        real_id: &str,
+        room_id: &str,
+    ) -> (
+        String,
+        OutboundSender,
+        Result<RegistrationResult, RegistrationError>,
+    ) {
+        let (client_id, real_client_id) =
+            room_identity(&context.config, room_id, real_id.to_string());
+        let mut options = client_options(2);
+        options.real_client_id = real_client_id;
+        let (_, queue, result) = join(context, &client_id, room_id, options).await;
+        (client_id, queue, result)
+    }
+
+    #[test]
+    fn pseudonyms_are_stable_per_room_and_hide_the_real_id() {
+        let config = pseudonymous_config();
+        let (first, real) = room_identity(&config, "room-a", "alice".to_string());
+        let (again, _) = room_identity(&config, "room-a", "alice".to_string());
+        let (elsewhere, _) = room_identity(&config, "room-b", "alice".to_string());
+
+        assert_eq!(real.as_deref(), Some("alice"));
+        assert_eq!(first, again);
+        assert_ne!(first, elsewhere);
+        assert!(!first.contains("alice"));
+        assert_eq!(
+            room_identity(&AppConfig::for_tests(), "room-a", "alice".to_string()),
+            ("alice".to_string(), None)
+        );
+    }
+
+    #[tokio::test]
+    async fn peers_only_see_pseudonyms_in_rosters_and_senders() {
+        let context = test_context(pseudonymous_config());
+        let (alice, alice_queue, result) = join_pseudonymous(&context, "alice", "masked").await;
+        assert!(result.is_ok());
+        let (bob, bob_queue, result) = join_pseudonymous(&context, "bob", "masked").await;
+        assert!(result.is_ok());
+
+        let joined = next_of_kind(&bob_queue, "joined").await;
+        assert_eq!(
+            joined.payload["members"],
+            serde_json::json!([{ "id": alice }])
+        );
+        assert!(!joined.payload.to_string().contains("\"alice\""));
+        queued_kinds(&alice_queue).await;
+
+        let alice_id = context.state.read().await.rooms["masked"].clients[&alice];
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", &bob, "m1"),
+        )
+        .await;
+        let offer = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(offer.from, alice);
+
+        // 重连后仍是同一个化名，对端看到的身份不变。
+        let (again, _, result) = join_pseudonymous(&context, "alice", "masked").await;
+        assert_eq!(again, alice);
+        assert!(result.is_ok_and(|registration| registration.replaced_connection.is_some()));
+    }
+
+    #[tokio::test]
+    async fn unicast_routes_by_pseudonym_and_not_by_real_id() {
+        let context = test_context(pseudonymous_config());
+        let (alice, _, result) = join_pseudonymous(&context, "alice", "masked").await;
+        assert!(result.is_ok());
+        let (bob, bob_queue, result) = join_pseudonymous(&context, "bob", "masked").await;
+        assert!(result.is_ok());
+        queued_kinds(&bob_queue).await;
+        let alice_id = context.state.read().await.rooms["masked"].clients[&alice];
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "real"),
+        )
+        .await;
+        assert!(!queued_kinds(&bob_queue)
+            .await
+            .contains(&"offer".to_string()));
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", &bob, "masked"),
+        )
+        .await;
+        let offer = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(offer.id.as_deref(), Some("masked"));
+    }
+
+    #[tokio::test]
+    async fn unique_ids_compare_real_ids_behind_pseudonyms() {
+        let mut config = pseudonymous_config();
+        config.unique_client_ids = true;
+        let context = test_context(config);
+        let (_, _, result) = join_pseudonymous(&context, "alice", "room-a").await;
+        assert!(result.is_ok());
+
+        let (_, _, result) = join_pseudonymous(&context, "alice", "room-b").await;
+        assert!(matches!(result, Err(RegistrationError::DuplicateId)));
+    }
+
+    #[tokio::test]
+    async fn system_messages_use_the_configured_sender_id() {
+        let mut config = AppConfig::for_tests();
+        config.server_sender_id = "system".to_string();
+        let (context, alice_id, alice_queue, _) = relay_pair(config).await;
+
+        let mut message = relay_data("bob", serde_json::json!("hi"));
+        message.to = None;
+        route_message(&context, alice_id, &mut inbound(&context), message).await;
+
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.from, "system");
+    }
+
+    fn target_errors_config() -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.unicast_target_errors = true;
+        config
+    }
+
+    /// 以 `client_id` 身份在房间里发一条单播 offer，返回发送方收到的错误码。
+    async fn unicast_error(
+        context: &Arc<AppContext>,
+        room_id: &str,
+        client_id: &str,
+        queue: &OutboundSender,
+        to: &str,
+    ) -> Value {
+        let connection_id = context.state.read().await.rooms[room_id].clients[client_id];
+        route_message(
+            context,
+            connection_id,
+            &mut inbound(context),
+            unicast("offer", to, "m1"),
+        )
+        .await;
+        next_of_kind(queue, "error").await.payload["code"].clone()
+    }
+
+    #[tokio::test]
+    async fn unicast_to_a_missing_target_says_whether_it_is_in_another_room() {
+        let context = test_context(target_errors_config());
+        let (_, alice_queue, result) = join(&context, "alice", "one", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, _bob_queue, result) = join(&context, "bob", "two", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&alice_queue).await;
+
+        assert_eq!(
+            unicast_error(&context, "one", "alice", &alice_queue, "bob").await,
+            "target_elsewhere"
+        );
+        assert_eq!(
+            unicast_error(&context, "one", "alice", &alice_queue, "nobody").await,
+            "target_unknown"
+        );
+    }
+
+    #[tokio::test]
+    async fn target_elsewhere_compares_real_identities_under_pseudonyms() {
+        let mut config = pseudonymous_config();
+        config.unicast_target_errors = true;
+        let context = test_context(config);
+        let (alice, alice_queue, result) = join_pseudonymous(&context, "alice", "one").await;
+        assert!(result.is_ok());
+        let (_, _carol_queue, result) = join_pseudonymous(&context, "carol", "one").await;
+        assert!(result.is_ok());
+        let (bob, _bob_queue, result) = join_pseudonymous(&context, "bob", "two").await;
+        assert!(result.is_ok());
+        assert_ne!(bob, "bob");
+        queued_kinds(&alice_queue).await;
+
+        assert_eq!(
+            unicast_error(&context, "one", &alice, &alice_queue, "bob").await,
+            "target_elsewhere"
+        );
+        // 同房间成员的真实身份不能借此探出来。
+        assert_eq!(
+            unicast_error(&context, "one", &alice, &alice_queue, "carol").await,
+            "target_unknown"
+        );
+    }
+
+    #[tokio::test]
+    async fn target_elsewhere_only_looks_inside_the_senders_tenant() {
+        let mut config = target_errors_config();
+        config.tenancy = true;
+        let context = test_context(config);
+        let (_, alice_queue, result) = join(&context, "alice", "acme/one", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, _bob_queue, result) = join(&context, "bob", "globex/two", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&alice_queue).await;
+
+        assert_eq!(
+            unicast_error(&context, "acme/one", "alice", &alice_queue, "bob").await,
+            "target_unknown"
+        );
+
+        let (_, _bob_queue, result) = join(&context, "bob", "acme/two", client_options(1)).await;
+        assert!(result.is_ok());
+        assert_eq!(
+            unicast_error(&context, "acme/one", "alice", &alice_queue, "bob").await,
+            "target_elsewhere"
+        );
+    }
+
+    /// 按给定的房主离开策略建一个房间，房主 owner 先进入，其余成员随后加入；返回各自的连接号与队列。
+    async fn owned_room(
+        policy: OwnerLeavePolicy,
+        members: &[&str],
+    ) -> (Arc<AppContext>, Vec<(Uuid, OutboundSender)>) {
+        let context = test_context(AppConfig::for_tests());
+        let mut joined = Vec::new();
+        for client_id in std::iter::once(&"owner").chain(members) {
+            let mut options = room_options();
+            options.owner_leave_policy = policy;
+            let (connection_id, queue, result) =
+                join_room(&context, client_id, "owned", options, client_options(1)).await;
+            assert!(result.is_ok());
+            joined.push((connection_id, queue));
+            // 转交按加入时间挑人，错开毫秒时间戳。
+            tokio::time::sleep(Duration::from_millis(2)).await;
+        }
+        for (_, queue) in &joined {
+            queued_kinds(queue).await;
+        }
+        assert_eq!(
+            context.state.read().await.rooms["owned"].owner.as_deref(),
+            Some("owner")
+        );
+        (context, joined)
+    }
+
+    #[tokio::test]
+    async fn transfer_policy_hands_the_room_to_the_earliest_member() {
+        let (context, joined) = owned_room(OwnerLeavePolicy::Transfer, &["bob", "carol"]).await;
+
+        unregister_connection(&context, joined[0].0, false).await;
+
+        assert_eq!(
+            context.state.read().await.rooms["owned"].owner.as_deref(),
+            Some("bob")
+        );
+        for (_, queue) in &joined[1..] {
+            let changed = next_of_kind(queue, "owner_changed").await;
+            assert_eq!(changed.payload, Value::String("bob".to_string()));
+        }
+    }
+
+    #[tokio::test]
+    async fn close_policy_removes_the_room_and_tells_members_the_owner_left() {
+        let (context, joined) = owned_room(OwnerLeavePolicy::Close, &["bob", "carol"]).await;
+
+        unregister_connection(&context, joined[0].0, false).await;
+
+        let state = context.state.read().await;
+        assert!(!state.rooms.contains_key("owned"));
+        for (connection_id, queue) in &joined[1..] {
+            assert!(!state.connections.contains_key(connection_id));
+            let left = next_of_kind(queue, "owner_left").await;
+            assert_eq!(left.payload, Value::String("owner".to_string()));
+            assert!(matches!(queue.recv().await, Some(OutboundMessage::Close)));
+        }
+    }
+
+    #[tokio::test]
+    async fn ownerless_policy_keeps_every_member_in_a_read_only_room() {
+        let (context, joined) = owned_room(OwnerLeavePolicy::Ownerless, &["bob", "carol"]).await;
+
+        unregister_connection(&context, joined[0].0, false).await;
+
+        {
+            let state = context.state.read().await;
+            let room = &state.rooms["owned"];
+            assert_eq!(room.owner, None);
+            assert!(room.read_only);
+            assert_eq!(room.clients.len(), 2);
+        }
+        for (_, queue) in &joined[1..] {
+            let changed = next_of_kind(queue, "owner_changed").await;
+            assert_eq!(changed.payload, Value::Null);
+        }
+
+        // 只读房间不再转发成员之间的消息。
+        let (bob_id, bob_queue) = &joined[1];
+        let (_, carol_queue) = &joined[2];
+        queued_kinds(bob_queue).await;
+        queued_kinds(carol_queue).await;
+        route_message(
+            &context,
+            *bob_id,
+            &mut inbound(&context),
+            unicast("offer", "carol", "m1"),
+        )
+        .await;
+        assert!(queued_kinds(carol_queue).await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn group_broadcast_reaches_only_members_of_that_group() {
+        let context = test_context(AppConfig::for_tests());
+        let mut queues = Vec::new();
+        let mut alice_id = Uuid::nil();
+        for (client_id, group) in [
+            ("alice", Some("red")),
+            ("bob", Some("red")),
+            ("carol", Some("blue")),
+            ("dave", None),
+        ] {
+            let mut options = client_options(1);
+            options.group = group.map(str::to_string);
+            let (connection_id, queue, result) = join(&context, client_id, "groups", options).await;
+            assert!(result.is_ok());
+            if client_id == "alice" {
+                alice_id = connection_id;
+            }
+            queues.push((client_id, queue));
+        }
+        for (_, queue) in &queues {
+            queued_kinds(queue).await;
+        }
+
+        let message = serde_json::from_value(serde_json::json!({
+            "type": "chat",
+            "toGroup": "red",
+            "payload": "red team only",
+        }))
+        .expect("group chat message");
+        route_message(&context, alice_id, &mut inbound(&context), message).await;
+
+        for (client_id, queue) in &queues {
+            let kinds = queued_kinds(queue).await;
+            let expected: &[&str] = if *client_id == "bob" { &["chat"] } else { &[] };
+            assert_eq!(kinds, expected, "{client_id}");
+        }
+    }
+
+    #[tokio::test]
+    async fn connection_that_never_says_hello_is_dropped_after_the_pre_auth_timeout() {
+        let mut silent =
+            futures_util::stream::pending::<Result<WsMessage, std::convert::Infallible>>();
+        let started = tokio::time::Instant::now();
+        assert!(await_hello(&mut silent, 50).await.is_none());
+        assert!(started.elapsed() >= Duration::from_millis(50));
+    }
+
+    #[tokio::test]
+    async fn connection_that_says_hello_in_time_survives_the_pre_auth_timeout() {
+        // 握手前的其他消息被忽略，之后的 `hello` 仍然算数。
+        let mut client = futures_util::stream::iter([
+            Ok::<_, std::convert::Infallible>(WsMessage::Text(
+                r#"{"type":"chat","payload":"too early"}"#.into(),
+            )),
+            Ok(WsMessage::Text(
+                r#"{"type":"hello","payload":{"protocolVersion":2}}"#.into(),
+            )),
+        ])
+        .chain(futures_util::stream::pending());
+        let hello = await_hello(&mut client, 1_000)
+            .await
+            .expect("hello arrived before the timeout");
+        assert_eq!(hello.kind, "hello");
+        assert_eq!(hello.payload["protocolVersion"], 2);
+    }
+
+    #[tokio::test]
+    async fn fixed_relay_delay_holds_the_message_without_blocking_the_router() {
+        let mut config = AppConfig::for_tests();
+        config.relay_delay_min_ms = 150;
+        config.relay_delay_max_ms = 150;
+        let (context, alice_id, _alice_queue, bob_queue) = relay_pair(config).await;
+
+        let started = tokio::time::Instant::now();
+        for id in ["m1", "m2"] {
+            route_message(
+                &context,
+                alice_id,
+                &mut inbound(&context),
+                unicast("offer", "bob", id),
+            )
+            .await;
+        }
+        // 延迟在独立任务里等待，读取循环可以立刻处理下一条。
+        assert!(started.elapsed() < Duration::from_millis(100));
+        assert!(bob_queue.try_recv_json().is_none());
+
+        let first = next_of_kind(&bob_queue, "offer").await;
+        assert!(started.elapsed() >= Duration::from_millis(150));
+        let second = next_of_kind(&bob_queue, "offer").await;
+        let mut ids = [first.id, second.id];
+        ids.sort();
+        assert_eq!(ids, [Some("m1".to_string()), Some("m2".to_string())]);
+    }
+
+    #[tokio::test]
+    async fn welcome_tells_an_anonymous_client_the_id_it_was_assigned() {
+        let mut config = AppConfig::for_tests();
+        config.welcome_message = true;
+        let context = test_context(config);
+        let session = crate::session::existing_or_new_session(&context.config, &HeaderMap::new());
+        let cookie = crate::session::build_session_cookie(&context.config, &session, false)
+            .expect("session cookie");
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            header::COOKIE,
+            cookie.split(';').next().unwrap().parse().unwrap(),
+        );
+
+        let Ok(authorized) = authorize_upgrade(&context, &headers, &connect_params("lobby")) else {
+            panic!("a valid anonymous session must be accepted");
+        };
+        assert!(authorized.anonymous);
+        let (_, queue, result) = join(
+            &context,
+            &authorized.client_id,
+            &authorized.room_id,
+            client_options(1),
+        )
+        .await;
+        assert!(result.is_ok());
+
+        let welcome = next_of_kind(&queue, "welcome").await;
+        assert_eq!(welcome.payload["clientId"], session.client_id.as_str());
+        assert_eq!(welcome.payload["roomId"], "lobby");
+    }
+
+    #[tokio::test]
+    async fn owned_room_cap_refuses_new_rooms_but_not_joins_until_ownership_moves() {
+        let mut config = AppConfig::for_tests();
+        config.max_owned_rooms = 1;
+        let context = test_context(config);
+        let (alice_in_first, _, result) = join(&context, "alice", "first", client_options(1)).await;
+        assert!(result.is_ok());
+
+        let (_, _, result) = join(&context, "alice", "second", client_options(1)).await;
+        assert!(matches!(result, Err(RegistrationError::OwnedRoomLimit)));
+        assert!(!context.state.read().await.rooms.contains_key("second"));
+
+        // 加入别人的房间不受上限影响，也不会成为那里的房主。
+        let (_, _, result) = join(&context, "bob", "bobs", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, _, result) = join(&context, "alice", "bobs", client_options(1)).await;
+        assert!(result.is_ok());
+        assert_eq!(
+            context.state.read().await.rooms["bobs"].owner.as_deref(),
+            Some("bob")
+        );
+
+        // 房主身份转交出去之后，名额随即释放。
+        let (_, _, result) = join(&context, "carol", "first", client_options(1)).await;
+        assert!(result.is_ok());
+        unregister_connection(&context, alice_in_first, false).await;
+        assert_eq!(
+            context.state.read().await.rooms["first"].owner.as_deref(),
+            Some("carol")
+        );
+        let (_, _, result) = join(&context, "alice", "second", client_options(1)).await;
+        assert!(result.is_ok());
+        assert_eq!(
+            context.state.read().await.rooms["second"].owner.as_deref(),
+            Some("alice")
+        );
+    }
+
+    fn offline_hold_config(ttl_ms: u64) -> AppConfig {
+        let mut config = AppConfig::for_tests();
+        config.offline_hold_ttl_ms = ttl_ms;
+        config.offline_hold_max_messages = 8;
+        config
+    }
+
+    /// bob 掉线后 alice 给他发一条单播，等待 `wait` 后 bob 重连，返回他重连后收到的消息类型。
+    async fn unicast_across_reconnect(config: AppConfig, wait: Duration) -> Vec<String> {
+        let context = test_context(config);
+        let (alice_id, _alice_queue, result) =
+            join(&context, "alice", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let (bob_id, _, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        unregister_connection(&context, bob_id, false).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+        tokio::time::sleep(wait).await;
+
+        let (_, bob_queue, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&bob_queue).await
+    }
+
+    #[tokio::test]
+    async fn unicast_held_for_a_departed_member_is_delivered_when_it_reconnects() {
+        let kinds = unicast_across_reconnect(offline_hold_config(1_000), Duration::ZERO).await;
+        assert_eq!(kinds.first().map(String::as_str), Some("joined"));
+        assert!(kinds.iter().any(|kind| kind == "offer"), "{kinds:?}");
+    }
+
+    #[tokio::test]
+    async fn held_unicast_that_expired_before_the_reconnect_is_dropped() {
+        let kinds =
+            unicast_across_reconnect(offline_hold_config(100), Duration::from_millis(150)).await;
+        assert!(!kinds.iter().any(|kind| kind == "offer"), "{kinds:?}");
+    }
+
+    #[tokio::test]
+    async fn reconnecting_peer_learns_the_current_call_states_in_its_bootstrap() {
+        let (context, alice_id, _alice_queue, _bob_queue) =
+            relay_pair(AppConfig::for_tests()).await;
+        let call_state = serde_json::from_value(serde_json::json!({
+            "type": "call_state",
+            "payload": { "state": "on_hold" },
+        }))
+        .expect("call_state message");
+        route_message(&context, alice_id, &mut inbound(&context), call_state).await;
+
+        // bob 断线重连，换了新连接也能立刻知道 alice 仍在保持中。
+        let (_, bob_queue, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let states = next_of_kind(&bob_queue, "call_states").await;
+        assert_eq!(states.payload, serde_json::json!({ "alice": "on_hold" }));
+    }
+
+    #[test]
+    fn distinct_message_type_limit_trips_for_a_probing_client_only() {
+        let context = test_context(AppConfig::for_tests());
+
+        let mut normal = inbound(&context);
+        for _ in 0..20 {
+            for kind in ["offer", "answer", "candidate", "heartbeat"] {
+                assert!(!normal.exceeds_type_limit(4, kind));
+            }
+        }
+
+        let mut probing = inbound(&context);
+        for kind in ["offer", "answer", "candidate", "heartbeat"] {
+            assert!(!probing.exceeds_type_limit(4, kind));
+        }
+        assert!(probing.exceeds_type_limit(4, "probe_1"));
+        // 超限后即使回到常用类型也仍算超限。
+        assert!(probing.exceeds_type_limit(4, "offer"));
+        assert_eq!(probing.seen_message_types.len(), 5);
+
+        assert!(!inbound(&context).exceeds_type_limit(0, "anything"));
+    }
+
+    #[tokio::test]
+    async fn candidate_burst_passes_while_chat_over_its_limit_is_dropped() {
+        let mut config = AppConfig::for_tests();
+        config.message_rate_limits = Arc::new(MessageRateLimits {
+            default_limit: Some(RateLimit {
+                rate_per_second: 0.1,
+                burst: 2.0,
+            }),
+            per_type: HashMap::from([(
+                "candidate".to_string(),
+                RateLimit {
+                    rate_per_second: 0.1,
+                    burst: 20.0,
+                },
+            )]),
+        });
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+        let mut alice = inbound(&context);
+
+        // ICE 收集阶段一口气发出的候选全部放行。
+        for index in 0..15 {
+            route_message(
+                &context,
+                alice_id,
+                &mut alice,
+                unicast("candidate", "bob", &format!("c{index}")),
+            )
+            .await;
+        }
+        for index in 0..3 {
+            route_message(
+                &context,
+                alice_id,
+                &mut alice,
+                unicast("chat", "bob", &format!("t{index}")),
+            )
+            .await;
+        }
+
+        let kinds = queued_kinds(&bob_queue).await;
+        assert_eq!(kinds.iter().filter(|kind| *kind == "candidate").count(), 15);
+        assert_eq!(kinds.iter().filter(|kind| *kind == "chat").count(), 2);
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "rate_limited");
+    }
+
+    fn quality_request(to: &str, level: &str) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({
+            "type": "quality_request",
+            "to": to,
+            "payload": { "level": level },
+        }))
+        .expect("quality_request message")
+    }
+
+    #[tokio::test]
+    async fn quality_request_reaches_its_target_and_is_restored_on_reconnect() {
+        let mut config = AppConfig::for_tests();
+        config.quality_memory = true;
+        let (context, alice_id, _alice_queue, bob_queue) = relay_pair(config).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            quality_request("bob", "low"),
+        )
+        .await;
+        let relayed = next_of_kind(&bob_queue, "quality_request").await;
+        assert_eq!(relayed.from, "alice");
+        assert_eq!(relayed.payload["level"], "low");
+
+        // 后一次请求覆盖前一次，重连后只补发最新的画质。
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            quality_request("bob", "medium"),
+        )
+        .await;
+        let (_, bob_queue, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let restored = next_of_kind(&bob_queue, "quality_request").await;
+        assert_eq!(restored.from, "alice");
+        assert_eq!(restored.payload["level"], "medium");
+        assert!(!queued_kinds(&bob_queue)
+            .await
+            .contains(&"quality_request".to_string()));
+    }
+
+    #[tokio::test]
+    async fn quality_request_is_not_restored_without_memory() {
+        let (context, alice_id, _alice_queue, _bob_queue) =
+            relay_pair(AppConfig::for_tests()).await;
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            quality_request("bob", "low"),
+        )
+        .await;
+
+        let (_, bob_queue, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        assert!(!queued_kinds(&bob_queue)
+            .await
+            .contains(&"quality_request".to_string()));
+    }
+
+    #[tokio::test]
+    async fn monitor_receives_broadcasts_from_matching_rooms_only() {
+        let mut config = AppConfig::for_tests();
+        config.admin_token = Some("secret".to_string());
+        let context = test_context(config);
+        let monitor = OutboundQueue::new(0, context.config.backpressure.clone());
+        context.state.write().await.subscribers.insert(
+            Uuid::new_v4(),
+            Subscriber {
+                pattern: "team-*".to_string(),
+                sender: monitor.clone(),
+            },
+        );
+        let mut senders = Vec::new();
+        for room_id in ["team-a", "other"] {
+            let (connection_id, _, result) =
+                join(&context, "alice", room_id, client_options(1)).await;
+            assert!(result.is_ok());
+            let (_, _, result) = join(&context, "bob", room_id, client_options(1)).await;
+            assert!(result.is_ok());
+            senders.push(connection_id);
+        }
+
+        for connection_id in senders {
+            let chat = serde_json::from_value(serde_json::json!({
+                "type": "chat",
+                "payload": "hello",
+            }))
+            .expect("chat message");
+            route_message(&context, connection_id, &mut inbound(&context), chat).await;
+        }
+        // 单播不抄送给监控连接。
+        let alice_in_team = context.state.read().await.rooms["team-a"].clients["alice"];
+        route_message(
+            &context,
+            alice_in_team,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+
+        let copies = std::iter::from_fn(|| monitor.try_recv_json()).collect::<Vec<_>>();
+        assert_eq!(copies.len(), 1);
+        assert_eq!(copies[0].kind, "room_message");
+        assert_eq!(copies[0].payload["roomId"], "team-a");
+        assert_eq!(copies[0].payload["message"]["type"], "chat");
+    }
+
+    #[test]
+    fn monitor_subscription_requires_the_admin_token() {
+        let mut config = AppConfig::for_tests();
+        assert_eq!(
+            authorize_admin(&config, &HeaderMap::new()).map_err(|err| err.status()),
+            Err(StatusCode::NOT_FOUND)
+        );
+
+        config.admin_token = Some("secret".to_string());
+        let mut headers = HeaderMap::new();
+        headers.insert(header::AUTHORIZATION, "Bearer wrong".parse().unwrap());
+        assert_eq!(
+            authorize_admin(&config, &headers).map_err(|err| err.status()),
+            Err(StatusCode::UNAUTHORIZED)
+        );
+        headers.insert(header::AUTHORIZATION, "Bearer secret".parse().unwrap());
+        assert!(authorize_admin(&config, &headers).is_ok());
+    }
+
+    #[tokio::test]
+    async fn oversized_chat_is_rejected_while_a_larger_sdp_offer_passes() {
+        let mut config = AppConfig::for_tests();
+        config.chat_max_bytes = 64;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+
+        let chat = serde_json::from_value(serde_json::json!({
+            "type": "chat",
+            "payload": "x".repeat(200),
+        }))
+        .expect("chat message");
+        route_message(&context, alice_id, &mut inbound(&context), chat).await;
+        let error = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(error.payload["code"], "chat_too_large");
+
+        let offer = serde_json::from_value(serde_json::json!({
+            "type": "offer",
+            "to": "bob",
+            "payload": { "type": "offer", "sdp": "v=0\r\n".repeat(200) },
+        }))
+        .expect("offer message");
+        route_message(&context, alice_id, &mut inbound(&context), offer).await;
+        assert_eq!(queued_kinds(&bob_queue).await, ["offer"]);
+    }
+
+    #[tokio::test]
+    async fn duplicate_broadcast_is_suppressed_but_a_changed_payload_is_relayed() {
+        let mut config = AppConfig::for_tests();
+        config.broadcast_dedup_window_ms = 5_000;
+        let (context, alice_id, _alice_queue, bob_queue) = relay_pair(config).await;
+        let mut alice = inbound(&context);
+
+        for text in ["hello", "hello", "hello again"] {
+            let chat = serde_json::from_value(serde_json::json!({
+                "type": "chat",
+                "payload": text,
+            }))
+            .expect("chat message");
+            route_message(&context, alice_id, &mut alice, chat).await;
+        }
+
+        let mut relayed = Vec::new();
+        while let Some(message) = bob_queue.try_recv_json() {
+            relayed.push(message.payload);
+        }
+        assert_eq!(relayed, ["hello", "hello again"]);
+    }
+
+    #[test]
+    fn configured_sender_id_is_reserved_in_every_letter_case() {
+        let mut context = header_authorized_context();
+        Arc::get_mut(&mut context)
+            .expect("context is not shared yet")
+            .config
+            .server_sender_id = "System".to_string();
+        let authorize_as = |client_id: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert("x-api-key", "secret".parse().unwrap());
+            headers.insert("x-client-id", client_id.parse().unwrap());
+            authorize_upgrade(&context, &headers, &connect_params("lobby"))
+        };
+
+        for client_id in ["System", "system", "SYSTEM", "sYsTeM"] {
+            let Err(err) = authorize_as(client_id) else {
+                panic!("{client_id} matches the reserved sender id");
+            };
+            assert_eq!(err.code(), "reserved_identity", "{client_id}");
+        }
+        // 只是包含保留身份的 ID 不受影响。
+        for client_id in ["systems", "system-admin", "server"] {
+            assert!(authorize_as(client_id).is_ok(), "{client_id}");
+        }
+    }
+
+    fn candidate_batch(count: usize) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({
+            "type": "batch",
+            "to": "bob",
+            "payload": (0..count)
+                .map(|index| serde_json::json!({
+                    "type": "candidate",
+                    "payload": { "candidate": format!("candidate:{index}") },
+                }))
+                .collect::<Vec<_>>(),
+        }))
+        .expect("batch message")
+    }
+
+    #[tokio::test]
+    async fn batch_of_candidates_is_relayed_as_separate_messages() {
+        let mut config = AppConfig::for_tests();
+        config.batch_max_messages = 4;
+        let (context, alice_id, _alice_queue, bob_queue) = relay_pair(config).await;
+
+        let messages =
+            unpack_batch(&context.config, candidate_batch(3)).expect("batch within bounds");
+        assert_eq!(messages.len(), 3);
+        for message in messages {
+            assert_eq!(message.to.as_deref(), Some("bob"));
+            route_message(&context, alice_id, &mut inbound(&context), message).await;
+        }
+
+        let mut relayed = Vec::new();
+        while let Some(message) = bob_queue.try_recv_json() {
+            assert_eq!(message.kind, "candidate");
+            relayed.push(message.payload["candidate"].clone());
+        }
+        assert_eq!(relayed, ["candidate:0", "candidate:1", "candidate:2"]);
+    }
+
+    #[test]
+    fn batch_over_the_bound_is_rejected_whole() {
+        let mut config = AppConfig::for_tests();
+        config.batch_max_messages = 4;
+
+        assert!(matches!(
+            unpack_batch(&config, candidate_batch(5)),
+            Err("batch_too_large")
+        ));
+        assert_eq!(
+            unpack_batch(&config, candidate_batch(4))
+                .expect("batch at the bound")
+                .len(),
+            4
+        );
+    }
+
+    #[tokio::test]
+    async fn expired_message_behind_a_slow_client_is_skipped_and_a_fresh_one_delivered() {
+        let context = test_context(AppConfig::for_tests());
+        let queue = OutboundQueue::new(0, context.config.backpressure.clone());
+        for (index, expires_at) in [(1, now_ms() - 1), (2, now_ms() + 60_000)] {
+            let message = SignalMessage {
+                kind: "chat".to_string(),
+                from: "alice".to_string(),
+                payload: serde_json::json!(index),
+                expires_at: Some(expires_at),
+                ..Default::default()
+            };
+            assert_eq!(queue.send(OutboundMessage::Json(message)), Ok(()));
+        }
+
+        let written = write_queued(&queue, writer_options(&context)).await;
+        let delivered: Vec<_> = written.iter().filter_map(|m| m.payload.as_u64()).collect();
+        assert_eq!(delivered, [2]);
+    }
+
+    #[tokio::test]
+    async fn joined_is_always_the_first_bootstrap_message() {
+        let context = test_context(AppConfig::for_tests());
+        for (index, client_id) in ["alice", "bob", "carol", "dave"].into_iter().enumerate() {
+            let (_, queue, result) = join(&context, client_id, "lobby", client_options(1)).await;
+            assert!(result.is_ok());
+            let kinds = queued_kinds(&queue).await;
+            assert_eq!(
+                kinds.first().map(String::as_str),
+                Some("joined"),
+                "{kinds:?}"
+            );
+            if index > 0 {
+                let existing = kinds.iter().position(|kind| kind == "existing_users");
+                assert!(existing.is_some_and(|position| position > 0), "{kinds:?}");
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn rapid_room_creation_is_throttled_while_joins_to_existing_rooms_continue() {
+        let mut config = AppConfig::for_tests();
+        config.room_creation_rate_per_second = 0.001;
+        config.room_creation_burst = 3.0;
+        let context = test_context(config);
+        for index in 0..3 {
+            let (_, _, result) = join(
+                &context,
+                &format!("host-{index}"),
+                &format!("event-{index}"),
+                client_options(1),
+            )
+            .await;
+            assert!(result.is_ok());
+        }
+
+        let (_, _, result) = join(&context, "host-3", "event-3", client_options(1)).await;
+        let Err(err) = result else {
+            panic!("creating a room beyond the burst must be throttled");
+        };
+        assert!(matches!(err, RegistrationError::ServerBusy));
+        let refusal = registration_refusal(&context.config, &err);
+        assert_eq!(refusal.payload["code"], "server_busy");
+        assert!(!context.state.read().await.rooms.contains_key("event-3"));
+
+        for index in 0..3 {
+            let (_, _, result) = join(
+                &context,
+                &format!("guest-{index}"),
+                &format!("event-{index}"),
+                client_options(1),
+            )
+            .await;
+            assert!(result.is_ok(), "joining an existing room is not throttled");
+        }
+    }
+
+    #[tokio::test]
+    async fn broadcast_receipt_counts_a_stalled_recipient_as_dropped() {
+        let mut config = AppConfig::for_tests();
+        config.outbound_queue_capacity = 16;
+        let context = test_context(config);
+        let mut members = Vec::new();
+        for client_id in ["alice", "bob", "carol"] {
+            let (connection_id, queue, result) =
+                join(&context, client_id, "flaky", client_options(1)).await;
+            assert!(result.is_ok());
+            members.push((connection_id, queue));
+        }
+        let [(alice_id, alice_queue), (_, bob_queue), (_, carol_queue)] = members.as_slice() else {
+            unreachable!();
+        };
+        // carol 不读自己的队列，排满之后再来的消息都会被丢。
+        let typing = || {
+            OutboundMessage::Json(SignalMessage::server(
+                &context.config,
+                "typing",
+                Value::Null,
+            ))
+        };
+        while carol_queue.send(typing()).is_ok() {}
+
+        let chat = serde_json::from_value(serde_json::json!({
+            "type": "chat",
+            "id": "b1",
+            "payload": "hello",
+            "receipt": true,
+        }))
+        .expect("chat message");
+        route_message(&context, *alice_id, &mut inbound(&context), chat).await;
+
+        let receipt = next_of_kind(alice_queue, "broadcast_receipt").await;
+        assert_eq!(receipt.payload["id"], "b1");
+        assert_eq!(receipt.payload["delivered"], 1);
+        assert_eq!(receipt.payload["dropped"], 1);
+        assert_eq!(receipt.payload["droppedIds"], serde_json::json!(["carol"]));
+        next_of_kind(bob_queue, "chat").await;
+    }
+
+    #[tokio::test]
+    async fn older_client_receives_the_mapped_type_name() {
+        let mut config = AppConfig::for_tests();
+        config.message_type_aliases.insert(
+            1,
+            HashMap::from([("ice_candidate".to_string(), "candidate".to_string())]),
+        );
+        let context = test_context(config);
+        let (alice_id, _, _) = join(&context, "alice", "bridge", client_options(2)).await;
+        let (_, old_queue, _) = join(&context, "old", "bridge", client_options(1)).await;
+        let (_, new_queue, _) = join(&context, "new", "bridge", client_options(2)).await;
+        while old_queue.try_recv_json().is_some() {}
+        while new_queue.try_recv_json().is_some() {}
+
+        let candidate = serde_json::from_value(serde_json::json!({
+            "type": "ice_candidate",
+            "payload": { "candidate": "c" },
+        }))
+        .expect("candidate message");
+        route_message(&context, alice_id, &mut inbound(&context), candidate).await;
+
+        for (queue, protocol_version, expected) in [
+            (&old_queue, 1, "candidate"),
+            (&new_queue, 2, "ice_candidate"),
+        ] {
+            let mut options = writer_options(&context);
+            options.type_aliases = type_aliases_for(&context.config, protocol_version);
+            let written = write_queued(queue, options).await;
+            let kinds: Vec<_> = written
+                .iter()
+                .map(|message| message.kind.as_str())
+                .collect();
+            assert_eq!(kinds, [expected]);
+        }
+    }
+
+    #[tokio::test]
+    async fn spectator_only_room_is_reaped_but_a_room_with_a_participant_is_not() {
+        let mut config = AppConfig::for_tests();
+        config.spectator_only_room_ttl_ms = 50;
+        let context = test_context(config);
+        let spectator = || ClientOptions {
+            spectator: true,
+            ..client_options(1)
+        };
+        let (_, watcher_queue, result) = join(&context, "watcher", "watch", spectator()).await;
+        assert!(result.is_ok());
+        let (_, _, result) = join(&context, "host", "live", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, viewer_queue, result) = join(&context, "viewer", "live", spectator()).await;
+        assert!(result.is_ok());
+        while watcher_queue.try_recv_json().is_some() {}
+        while viewer_queue.try_recv_json().is_some() {}
+
+        tokio::time::sleep(Duration::from_millis(80)).await;
+        reap_spectator_only_rooms(&context).await;
+
+        let closed = next_of_kind(&watcher_queue, "room_closed").await;
+        assert_eq!(closed.payload["reason"], "no_participants");
+        let state = context.state.read().await;
+        assert!(!state.rooms.contains_key("watch"));
+        assert_eq!(state.rooms["live"].clients.len(), 2);
+        assert!(viewer_queue.try_recv_json().is_none());
+    }
+
+    fn correlated(kind: &str, to: &str, timeout_ms: Option<u64>) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({
+            "type": kind,
+            "to": to,
+            "correlationId": "req-1",
+            "responseTimeoutMs": timeout_ms,
+        }))
+        .expect("correlated message")
+    }
+
+    #[tokio::test]
+    async fn correlation_id_survives_relay_and_a_reply_cancels_the_timeout() {
+        let mut config = AppConfig::for_tests();
+        config.response_timeout_max_ms = 1_000;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+        let bob_id = context.state.read().await.rooms["relay"].clients["bob"];
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            correlated("offer", "bob", Some(50)),
+        )
+        .await;
+        let request = next_of_kind(&bob_queue, "offer").await;
+        assert_eq!(request.correlation_id.as_deref(), Some("req-1"));
+
+        route_message(
+            &context,
+            bob_id,
+            &mut inbound(&context),
+            correlated("answer", "alice", None),
+        )
+        .await;
+        let reply = next_of_kind(&alice_queue, "answer").await;
+        assert_eq!(reply.correlation_id.as_deref(), Some("req-1"));
+
+        tokio::time::sleep(Duration::from_millis(80)).await;
+        assert_eq!(queued_kinds(&alice_queue).await, Vec::<String>::new());
+    }
+
+    #[tokio::test]
+    async fn unanswered_request_gets_a_response_timeout() {
+        let mut config = AppConfig::for_tests();
+        config.response_timeout_max_ms = 1_000;
+        let (context, alice_id, alice_queue, _bob_queue) = relay_pair(config).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            correlated("offer", "bob", Some(50)),
+        )
+        .await;
+
+        let timeout = next_of_kind(&alice_queue, "response_timeout").await;
+        assert_eq!(
+            timeout.payload,
+            serde_json::json!({ "correlationId": "req-1", "type": "offer", "to": "bob" })
+        );
+        assert_eq!(context.state.read().await.pending_responses.len(), 0);
+    }
+
+    #[test]
+    fn peer_roles_are_opposite_for_each_pair() {
+        for (a, b) in [("alice", "bob"), ("zed", "amy"), ("user-10", "user-9")] {
+            let (role_a, role_b) = (peer_role(a, b), peer_role(b, a));
+            assert_ne!(role_a, role_b, "{a} and {b}");
+            assert!(["polite", "impolite"].contains(&role_a));
+            assert!(["polite", "impolite"].contains(&role_b));
+        }
+    }
+
+    #[tokio::test]
+    async fn newcomer_role_hint_is_the_opposite_of_the_existing_member_role() {
+        let mut config = AppConfig::for_tests();
+        config.peer_role_hints = true;
+        let context = test_context(config);
+        let (_, _, result) = join(&context, "bob", "pair", client_options(1)).await;
+        assert!(result.is_ok());
+
+        for (newcomer, protocol_version) in [("alice", 1), ("carol", ROSTER_OBJECTS_MIN_VERSION)] {
+            let (_, queue, result) =
+                join(&context, newcomer, "pair", client_options(protocol_version)).await;
+            assert!(result.is_ok());
+            let joined = next_of_kind(&queue, "joined").await;
+            let newcomer_role = if protocol_version >= ROSTER_OBJECTS_MIN_VERSION {
+                joined.payload["members"]
+                    .as_array()
+                    .and_then(|members| members.iter().find(|member| member["id"] == "bob"))
+                    .map(|member| member["peerRole"].clone())
+            } else {
+                Some(joined.payload["roles"]["bob"].clone())
+            };
+            // bob 收到的 `role` 通知里的角色由 `peer_role("bob", newcomer)` 给出。
+            let bob_role = peer_role("bob", newcomer);
+            let newcomer_role = newcomer_role.expect("the roster carries bob's role");
+            assert!(newcomer_role.is_string(), "{joined:?}");
+            assert_ne!(newcomer_role, bob_role, "{newcomer}");
+        }
+    }
+
+    #[tokio::test]
+    async fn client_over_its_egress_budget_has_low_priority_messages_shed() {
+        let mut config = AppConfig::for_tests();
+        let mut backpressure = (*config.backpressure).clone();
+        backpressure
+            .per_type
+            .insert("offer".to_string(), BackpressureStrategy::Block);
+        config.backpressure = Arc::new(backpressure);
+        let context = test_context(config);
+        let message = |kind: &str, text: &str| SignalMessage {
+            kind: kind.to_string(),
+            from: "alice".to_string(),
+            payload: Value::from(text),
+            ..Default::default()
+        };
+        let small = message("typing", "a");
+        let large = "x".repeat(400);
+        let small_bytes = serde_json::to_string(&small).expect("serialize").len() as f64;
+
+        let queue = OutboundQueue::new(0, context.config.backpressure.clone());
+        for queued in [
+            small,
+            message("typing", &large),
+            message("typing", &large),
+            message("offer", &large),
+        ] {
+            assert_eq!(queue.send(OutboundMessage::Json(queued)), Ok(()));
+        }
+        let mut options = writer_options(&context);
+        options.egress_bucket = Some(TokenBucket::new(0.001, small_bytes + 100.0));
+
+        let written = write_queued(&queue, options).await;
+        let kinds: Vec<_> = written
+            .iter()
+            .map(|message| message.kind.as_str())
+            .collect();
+        assert_eq!(kinds, ["typing", "offer"]);
+    }
+
+    // 只有这个测试打开了 `BROADCAST_FANOUT_WARN_THRESHOLD`，告警状态不受其他测试影响。
+    #[tokio::test]
+    async fn fan_out_warning_is_only_emitted_above_the_threshold() {
+        let mut config = AppConfig::for_tests();
+        config.broadcast_fanout_warn_threshold = 2;
+        let context = test_context(config);
+        let broadcast = || {
+            serde_json::from_value::<SignalMessage>(serde_json::json!({
+                "type": "chat",
+                "payload": "hello",
+            }))
+            .expect("chat message")
+        };
+        let mut sender = None;
+        for client_id in ["alice", "bob", "carol"] {
+            let (connection_id, _, result) =
+                join(&context, client_id, "town-hall", client_options(1)).await;
+            assert!(result.is_ok());
+            sender.get_or_insert(connection_id);
+        }
+        let sender = sender.expect("alice joined");
+
+        route_message(&context, sender, &mut inbound(&context), broadcast()).await;
+        assert!(
+            !FANOUT_WARN_STATE.has_logged(),
+            "two recipients stay under the threshold"
+        );
+
+        let (_, _, result) = join(&context, "dave", "town-hall", client_options(1)).await;
+        assert!(result.is_ok());
+        route_message(&context, sender, &mut inbound(&context), broadcast()).await;
+        assert!(FANOUT_WARN_STATE.has_logged());
+    }
+
+    #[tokio::test]
+    async fn messages_relayed_in_quick_succession_carry_strictly_increasing_server_ts() {
+        let mut config = AppConfig::for_tests();
+        config.server_timestamps = true;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+        let bob_id = context.state.read().await.rooms["relay"].clients["bob"];
+
+        // 两个发送方交替发送，按发送顺序取回各自对端收到的时间戳。
+        let mut stamps = Vec::new();
+        for index in 0..20 {
+            let (sender, to, queue) = if index % 2 == 0 {
+                (alice_id, "bob", &bob_queue)
+            } else {
+                (bob_id, "alice", &alice_queue)
+            };
+            route_message(
+                &context,
+                sender,
+                &mut inbound(&context),
+                unicast("offer", to, "m"),
+            )
+            .await;
+            stamps.push(
+                next_of_kind(queue, "offer")
+                    .await
+                    .server_ts
+                    .expect("serverTs"),
+            );
+        }
+        assert!(
+            stamps.windows(2).all(|pair| pair[0] < pair[1]),
+            "{stamps:?}"
+        );
+    }
+
+    #[tokio::test]
+    async fn busy_room_is_closed_with_room_expired_when_its_lifetime_ends() {
+        let context = test_context(AppConfig::for_tests());
+        let short_lived = RoomOptions {
+            max_lifetime_ms: Some(50),
+            ..room_options()
+        };
+        let (alice_id, alice_queue, result) =
+            join_room(&context, "alice", "webinar", short_lived, client_options(1)).await;
+        assert!(result.is_ok());
+        let (bob_id, bob_queue, result) = join(&context, "bob", "webinar", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, _, result) = join(&context, "carol", "open", client_options(1)).await;
+        assert!(result.is_ok());
+
+        tokio::time::sleep(Duration::from_millis(80)).await;
+        // 到期前后一直有消息往来，照样按存活时间关闭。
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "bob", "m1"),
+        )
+        .await;
+        reap_expired_rooms(&context).await;
+
+        for queue in [&alice_queue, &bob_queue] {
+            next_of_kind(queue, "room_expired").await;
+            assert!(matches!(queue.recv().await, Some(OutboundMessage::Close)));
+        }
+        let state = context.state.read().await;
+        assert!(!state.rooms.contains_key("webinar"));
+        assert!(!state.connections.contains_key(&alice_id));
+        assert!(!state.connections.contains_key(&bob_id));
+        assert!(state.rooms.contains_key("open"));
+    }
+
+    #[tokio::test]
+    async fn mixed_room_compresses_only_for_recipients_that_accept_it() {
+        let mut config = AppConfig::for_tests();
+        config.payload_compression_min_bytes = 16;
+        let context = test_context(config);
+        let compressing = || ClientOptions {
+            accepts_compression: true,
+            ..client_options(1)
+        };
+        let (alice_id, _, result) = join(&context, "alice", "mixed", compressing()).await;
+        assert!(result.is_ok());
+        let (_, capable_queue, result) = join(&context, "bob", "mixed", compressing()).await;
+        assert!(result.is_ok());
+        let (_, plain_queue, result) = join(&context, "carol", "mixed", client_options(1)).await;
+        assert!(result.is_ok());
+        while capable_queue.try_recv_json().is_some() {}
+        while plain_queue.try_recv_json().is_some() {}
+
+        let text = "a fairly repetitive payload ".repeat(8);
+        let chat = serde_json::from_value(serde_json::json!({ "type": "chat", "payload": text }))
+            .expect("chat message");
+        let mut alice = InboundState::new(&context.config, &compressing());
+        route_message(&context, alice_id, &mut alice, chat).await;
+
+        let mut options = writer_options(&context);
+        options.accepts_compression = true;
+        let written = write_queued(&capable_queue, options).await;
+        let [compressed] = written.as_slice() else {
+            panic!("bob gets exactly the chat: {written:?}");
+        };
+        assert_eq!(
+            compressed.encoding.as_deref(),
+            Some(PAYLOAD_ENCODING_DEFLATE_RAW)
+        );
+        assert_ne!(compressed.payload, Value::from(text.clone()));
+
+        let written = write_queued(&plain_queue, writer_options(&context)).await;
+        let [plain] = written.as_slice() else {
+            panic!("carol gets exactly the chat: {written:?}");
+        };
+        assert_eq!(plain.encoding, None);
+        assert_eq!(plain.payload, Value::from(text));
+    }
+
+    #[tokio::test]
+    async fn restricted_identity_may_only_send_its_granted_types() {
+        let context = test_context(AppConfig::for_tests());
+        let restricted = ClientOptions {
+            allowed_types: Some(HashSet::from(["offer".to_string(), "answer".to_string()])),
+            ..client_options(1)
+        };
+        let (viewer_id, viewer_queue, result) = join(&context, "viewer", "stage", restricted).await;
+        assert!(result.is_ok());
+        let (_, host_queue, result) = join(&context, "host", "stage", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&viewer_queue).await;
+        queued_kinds(&host_queue).await;
+
+        let chat = serde_json::from_value(serde_json::json!({ "type": "chat", "payload": "hi" }))
+            .expect("chat message");
+        route_message(&context, viewer_id, &mut inbound(&context), chat).await;
+        let refusal = next_of_kind(&viewer_queue, "error").await;
+        assert_eq!(refusal.payload["code"], "type_not_permitted");
+
+        route_message(
+            &context,
+            viewer_id,
+            &mut inbound(&context),
+            unicast("offer", "host", "o1"),
+        )
+        .await;
+        assert_eq!(queued_kinds(&host_queue).await, ["offer"]);
+    }
+
+    #[tokio::test]
+    async fn lobby_member_is_told_when_a_public_room_is_created() {
+        let mut config = AppConfig::for_tests();
+        config.lobby_room_id = Some("lobby".to_string());
+        let context = test_context(config);
+        let (_, lobby_queue, result) = join(&context, "watcher", "lobby", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&lobby_queue).await;
+
+        let (_, _, result) = join(&context, "alice", "standup", client_options(1)).await;
+        assert!(result.is_ok());
+        let created = next_of_kind(&lobby_queue, "room_created").await;
+        assert_eq!(created.payload["room"]["id"], "standup");
+
+        let private = RoomOptions {
+            is_private: true,
+            ..room_options()
+        };
+        let (_, _, result) = join_room(&context, "bob", "secret", private, client_options(1)).await;
+        assert!(result.is_ok());
+        assert!(!queued_kinds(&lobby_queue)
+            .await
+            .iter()
+            .any(|kind| kind == "room_created"));
+    }
+
+    fn to_many(kind: &str, targets: &[&str]) -> SignalMessage {
+        serde_json::from_value(serde_json::json!({ "type": kind, "toMany": targets }))
+            .expect("toMany message")
+    }
+
+    /// alice 与另外几位成员同在一个房间，返回 alice 的连接号与每位成员的队列（alice 在首位）。
+    async fn mesh(context: &Arc<AppContext>, members: &[&str]) -> (Uuid, Vec<OutboundSender>) {
+        let mut alice_id = None;
+        let mut queues = Vec::new();
+        for client_id in std::iter::once(&"alice").chain(members) {
+            let (connection_id, queue, result) =
+                join(context, client_id, "mesh", client_options(1)).await;
+            assert!(result.is_ok());
+            alice_id.get_or_insert(connection_id);
+            queues.push(queue);
+        }
+        for queue in &queues {
+            queued_kinds(queue).await;
+        }
+        (alice_id.expect("alice joined"), queues)
+    }
+
+    #[tokio::test]
+    async fn to_many_over_the_cap_is_rejected_and_at_the_cap_delivered() {
+        let mut config = AppConfig::for_tests();
+        config.max_recipients_per_message = 2;
+        let context = test_context(config);
+        let (alice_id, queues) = mesh(&context, &["bob", "carol", "dave"]).await;
+        let [alice_queue, bob_queue, carol_queue, dave_queue] = queues.as_slice() else {
+            unreachable!();
+        };
+
+        let over = to_many("offer", &["bob", "carol", "dave"]);
+        route_message(&context, alice_id, &mut inbound(&context), over).await;
+        let refusal = next_of_kind(alice_queue, "error").await;
+        assert_eq!(refusal.payload["code"], "too_many_recipients");
+        for queue in [bob_queue, carol_queue, dave_queue] {
+            assert!(queue.try_recv_json().is_none());
+        }
+
+        let at_cap = to_many("offer", &["bob", "carol"]);
+        route_message(&context, alice_id, &mut inbound(&context), at_cap).await;
+        assert_eq!(queued_kinds(bob_queue).await, ["offer"]);
+        assert_eq!(queued_kinds(carol_queue).await, ["offer"]);
+        assert!(dave_queue.try_recv_json().is_none());
+    }
+
+    #[tokio::test]
+    async fn lone_joiner_times_out_while_a_pair_materializes_the_room() {
+        let mut config = AppConfig::for_tests();
+        config.room_pairing_timeout_ms = 50;
+        let context = test_context(config);
+        let (lone_id, lone_queue, result) =
+            join(&context, "alice", "waiting", client_options(1)).await;
+        assert!(result.is_ok());
+        for client_id in ["bob", "carol"] {
+            let (_, _, result) = join(&context, client_id, "paired", client_options(1)).await;
+            assert!(result.is_ok());
+        }
+        assert!(!context.state.read().await.rooms["paired"].awaiting_second_member);
+
+        tokio::time::sleep(Duration::from_millis(80)).await;
+        reap_unpaired_rooms(&context).await;
+
+        let closed = next_of_kind(&lone_queue, "room_closed").await;
+        assert_eq!(closed.payload["reason"], "no_peer");
+        let state = context.state.read().await;
+        assert!(!state.rooms.contains_key("waiting"));
+        assert!(!state.connections.contains_key(&lone_id));
+        assert_eq!(state.rooms["paired"].clients.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn join_acks_from_existing_members_reach_the_newcomer() {
+        let context = test_context(AppConfig::for_tests());
+        let (alice_id, queues) = mesh(&context, &["bob"]).await;
+        let bob_id = context.state.read().await.rooms["mesh"].clients["bob"];
+        let (_, newcomer_queue, result) = join(&context, "carol", "mesh", client_options(1)).await;
+        assert!(result.is_ok());
+        queued_kinds(&newcomer_queue).await;
+
+        for peer_id in [alice_id, bob_id] {
+            route_message(
+                &context,
+                peer_id,
+                &mut inbound(&context),
+                unicast("join_ack", "carol", "a"),
+            )
+            .await;
+        }
+        let mut acked_by = Vec::new();
+        while let Some(ack) = newcomer_queue.try_recv_json() {
+            assert_eq!(ack.kind, "join_ack");
+            acked_by.push(ack.from);
+        }
+        acked_by.sort();
+        assert_eq!(acked_by, ["alice", "bob"]);
+
+        // 不指明新成员的 `join_ack` 不会被广播出去。
+        let broadcast_ack: SignalMessage =
+            serde_json::from_value(serde_json::json!({ "type": "join_ack" })).expect("join_ack");
+        route_message(&context, alice_id, &mut inbound(&context), broadcast_ack).await;
+        let refusal = next_of_kind(&queues[0], "error").await;
+        assert_eq!(refusal.payload["code"], "join_ack_requires_target");
+        assert!(newcomer_queue.try_recv_json().is_none());
+    }
+
+    #[tokio::test]
+    async fn none_retention_keeps_nothing_and_a_window_purges_after_it_elapses() {
+        let mut config = AppConfig::for_tests();
+        config.chat_history_limit = 10;
+        let context = test_context(config);
+        for (room_id, retention) in [
+            ("ephemeral", RetentionPolicy::Discard),
+            ("windowed", RetentionPolicy::Window(50)),
+        ] {
+            let retained = || RoomOptions {
+                message_log: true,
+                retention: Some(retention),
+                ..room_options()
+            };
+            let (alice_id, _, result) =
+                join_room(&context, "alice", room_id, retained(), client_options(1)).await;
+            assert!(result.is_ok());
+            let (_, _, result) = join_room(
+                &context,
+                &format!("{room_id}-peer"),
+                room_id,
+                retained(),
+                client_options(1),
+            )
+            .await;
+            assert!(result.is_ok());
+            let chat =
+                serde_json::from_value(serde_json::json!({ "type": "chat", "payload": "hi" }))
+                    .expect("chat message");
+            route_message(&context, alice_id, &mut inbound(&context), chat).await;
+        }
+
+        let retained = |state: &AppState, room_id: &str| {
+            let room = &state.rooms[room_id];
+            (
+                room.history.len(),
+                room.message_log.as_ref().map_or(0, VecDeque::len),
+            )
+        };
+        {
+            let state = context.state.read().await;
+            assert_eq!(retained(&state, "ephemeral"), (0, 0));
+            assert_eq!(retained(&state, "windowed"), (1, 1));
+        }
+
+        tokio::time::sleep(Duration::from_millis(80)).await;
+        purge_expired_retention(&context).await;
+        assert_eq!(retained(&*context.state.read().await, "windowed"), (0, 0));
+    }
+
+    #[tokio::test]
+    async fn to_role_reaches_the_current_holder_even_after_it_changes() {
+        let context = test_context(AppConfig::for_tests());
+        let presenter = || ClientOptions {
+            role: Some("presenter".to_string()),
+            ..client_options(1)
+        };
+        let (alice_id, alice_queue, result) = join(&context, "alice", "talk", presenter()).await;
+        assert!(result.is_ok());
+        let (bob_id, bob_queue, result) = join(&context, "bob", "talk", client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, dave_queue, result) = join(&context, "dave", "talk", client_options(1)).await;
+        assert!(result.is_ok());
+        for queue in [&alice_queue, &bob_queue, &dave_queue] {
+            queued_kinds(queue).await;
+        }
+        let to_presenter = || {
+            serde_json::from_value::<SignalMessage>(serde_json::json!({
+                "type": "question",
+                "toRole": "presenter",
+            }))
+            .expect("toRole message")
+        };
+
+        route_message(&context, bob_id, &mut inbound(&context), to_presenter()).await;
+        assert_eq!(queued_kinds(&alice_queue).await, ["question"]);
+        assert!(dave_queue.try_recv_json().is_none());
+
+        // alice 离开后由 carol 接任，同样的地址送到新的持有者。
+        unregister_connection(&context, alice_id, false).await;
+        let (_, carol_queue, result) = join(&context, "carol", "talk", presenter()).await;
+        assert!(result.is_ok());
+        queued_kinds(&carol_queue).await;
+        queued_kinds(&dave_queue).await;
+        route_message(&context, bob_id, &mut inbound(&context), to_presenter()).await;
+        assert_eq!(queued_kinds(&carol_queue).await, ["question"]);
+        assert!(alice_queue.try_recv_json().is_none());
+        assert!(dave_queue.try_recv_json().is_none());
+    }
+
+    #[tokio::test]
+    async fn active_pump_count_rises_and_falls_with_connections() {
+        let _serial = WRITER_TESTS.lock().await;
+        let context = test_context(AppConfig::for_tests());
+        assert_eq!(active_pump_count(), 0);
+
+        let mut writers = Vec::new();
+        for client_id in ["alice", "bob"] {
+            let (_, queue, result) = join(&context, client_id, "pumps", client_options(1)).await;
+            assert!(result.is_ok());
+            let writer = tokio::spawn(run_writer(
+                Vec::<WsMessage>::new(),
+                queue.clone(),
+                writer_options(&context),
+            ));
+            writers.push((queue, writer));
+        }
+        tokio::time::timeout(Duration::from_secs(1), async {
+            while active_pump_count() < 2 {
+                tokio::task::yield_now().await;
+            }
+        })
+        .await
+        .expect("both writers are running");
+        assert_eq!(active_pump_count(), 2);
+
+        for (queue, writer) in writers {
+            queue.close();
+            writer.await.expect("writer task finished");
+        }
+        assert_eq!(active_pump_count(), 0);
+    }
+
+    #[tokio::test]
+    async fn unicast_to_an_offline_target_becomes_a_target_offline_dead_letter() {
+        let mut config = AppConfig::for_tests();
+        config.dead_letters = true;
+        let mut context = test_context(config);
+        let (sink, letters) =
+            crate::dead_letter::dead_letter_queue(&context.config).expect("dead letters are on");
+        Arc::get_mut(&mut context)
+            .expect("the context is not shared yet")
+            .dead_letters = Some(sink);
+        tokio::spawn(crate::dead_letter::run_dead_letter_forwarder(
+            context.clone(),
+            letters,
+        ));
+        let monitor = OutboundQueue::new(0, context.config.backpressure.clone());
+        context.state.write().await.subscribers.insert(
+            Uuid::new_v4(),
+            Subscriber {
+                pattern: "relay".to_string(),
+                sender: monitor.clone(),
+            },
+        );
+        let (alice_id, _, result) = join(&context, "alice", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            unicast("offer", "ghost", "o1"),
+        )
+        .await;
+
+        let letter = next_of_kind(&monitor, "dead_letter").await;
+        assert_eq!(letter.payload["roomId"], "relay");
+        assert_eq!(letter.payload["target"], "ghost");
+        assert_eq!(letter.payload["reason"], "target_offline");
+        assert_eq!(letter.payload["message"]["id"], "o1");
+    }
+
+    #[tokio::test]
+    async fn html_chat_is_rejected_while_plain_text_passes() {
+        let mut config = AppConfig::for_tests();
+        config.chat_content_policy = ChatContentPolicy::PlainText;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+        let mut alice = inbound(&context);
+
+        for text in ["<img src=x onerror=alert(1)>", "see you at five"] {
+            let chat =
+                serde_json::from_value(serde_json::json!({ "type": "chat", "payload": text }))
+                    .expect("chat message");
+            route_message(&context, alice_id, &mut alice, chat).await;
+        }
+
+        let refusal = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(refusal.payload["code"], "chat_content_rejected");
+        let relayed: Vec<_> = std::iter::from_fn(|| bob_queue.try_recv_json())
+            .map(|message| message.payload)
+            .collect();
+        assert_eq!(relayed, ["see you at five"]);
+    }
+
+    #[test]
+    fn field_allowlist_rejects_unknown_or_oversized_fields() {
+        let policy = ChatContentPolicy::Fields {
+            allowed: HashSet::from(["text".to_string()]),
+            max_bytes: 8,
+        };
+        for (payload, allowed) in [
+            (serde_json::json!({ "text": "hi" }), true),
+            (serde_json::json!({ "text": "far too long" }), false),
+            (serde_json::json!({ "html": "hi" }), false),
+            (serde_json::json!({ "text": { "nested": "hi" } }), false),
+            (serde_json::json!("hi"), false),
+        ] {
+            assert_eq!(
+                check_chat_content(&policy, &payload).is_ok(),
+                allowed,
+                "{payload}"
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn display_name_policies_handle_a_second_client_choosing_an_in_use_name() {
+        for (policy, joined_as, renamed_to) in [
+            (DisplayNamePolicy::Allow, Some("ALICE"), Some("alice")),
+            (DisplayNamePolicy::Reject, None, None),
+            // carol 已经占了 `(2)`，bob 顺延到下一个空闲序号。
+            (
+                DisplayNamePolicy::Suffix,
+                Some("ALICE (2)"),
+                Some("alice (3)"),
+            ),
+        ] {
+            let mut config = AppConfig::for_tests();
+            config.display_name_policy = policy;
+            let context = test_context(config);
+            let named = |name: &str| ClientOptions {
+                display_name: Some(name.to_string()),
+                ..client_options(1)
+            };
+            let (_, _, result) = join(&context, "alice", "names", named("Alice")).await;
+            assert!(result.is_ok());
+
+            // 建连时选了已被占用的名字。
+            let (carol_id, _, result) = join(&context, "carol", "names", named("ALICE")).await;
+            match joined_as {
+                Some(expected) => {
+                    assert!(result.is_ok(), "{policy:?}");
+                    let state = context.state.read().await;
+                    assert_eq!(
+                        state.connections[&carol_id].display_name.as_deref(),
+                        Some(expected)
+                    );
+                }
+                None => assert!(matches!(result, Err(RegistrationError::NameTaken))),
+            }
+
+            // 已在房间里的成员改成被占用的名字。
+            let (bob_id, bob_queue, result) = join(&context, "bob", "names", named("Bob")).await;
+            assert!(result.is_ok());
+            queued_kinds(&bob_queue).await;
+            let set_name = serde_json::from_value(serde_json::json!({
+                "type": "set_name",
+                "payload": { "name": "alice" },
+            }))
+            .expect("set_name message");
+            route_message(&context, bob_id, &mut inbound(&context), set_name).await;
+            let reply = bob_queue.try_recv_json().expect("bob hears back");
+            match renamed_to {
+                Some(expected) => {
+                    assert_eq!(reply.kind, "name_changed", "{policy:?}");
+                    assert_eq!(reply.payload["name"], expected);
+                }
+                None => {
+                    assert_eq!(reply.payload["code"], "name_taken");
+                    let state = context.state.read().await;
+                    assert_eq!(
+                        state.connections[&bob_id].display_name.as_deref(),
+                        Some("Bob")
+                    );
+                }
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn only_the_current_speaker_is_relayed_while_others_get_floor_denied() {
+        let context = test_context(AppConfig::for_tests());
+        let (alice_id, queues) = mesh(&context, &["bob", "carol"]).await;
+        let [alice_queue, bob_queue, carol_queue] = queues.as_slice() else {
+            unreachable!();
+        };
+        let (bob_id, carol_id) = {
+            let state = context.state.read().await;
+            let room = &state.rooms["mesh"];
+            (room.clients["bob"], room.clients["carol"])
+        };
+        let control = |value: Value| -> SignalMessage {
+            serde_json::from_value(value).expect("floor message")
+        };
+
+        // alice 是房主：打开发言权控制并把发言权交给 bob。
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            control(serde_json::json!({ "type": "floor_control", "payload": { "enabled": true } })),
+        )
+        .await;
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            control(serde_json::json!({ "type": "floor_grant", "to": "bob" })),
+        )
+        .await;
+        for queue in [alice_queue, bob_queue, carol_queue] {
+            queued_kinds(queue).await;
+        }
+
+        let chat = |text: &str| control(serde_json::json!({ "type": "chat", "payload": text }));
+        route_message(&context, bob_id, &mut inbound(&context), chat("speaker")).await;
+        let relayed = next_of_kind(carol_queue, "chat").await;
+        assert_eq!(relayed.from, "bob");
+        assert_eq!(queued_kinds(alice_queue).await, ["chat"]);
+
+        route_message(&context, carol_id, &mut inbound(&context), chat("audience")).await;
+        let denied = next_of_kind(carol_queue, "floor_denied").await;
+        assert_eq!(denied.payload["type"], "chat");
+        assert_eq!(denied.payload["speaker"], "bob");
+        assert!(queued_kinds(alice_queue).await.is_empty());
+        assert!(queued_kinds(bob_queue).await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn sender_at_the_in_flight_cap_is_told_to_slow_down_until_delivery_catches_up() {
+        let mut config = AppConfig::for_tests();
+        config.max_in_flight_per_sender = 2;
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+        let offer = || -> SignalMessage {
+            serde_json::from_value(serde_json::json!({ "type": "offer", "to": "bob" }))
+                .expect("offer message")
+        };
+
+        // bob 还没写出任何副本，第三条就顶到了上限。
+        for _ in 0..3 {
+            route_message(&context, alice_id, &mut inbound(&context), offer()).await;
+        }
+        let refusal = next_of_kind(&alice_queue, "error").await;
+        assert_eq!(refusal.payload["code"], "slow_down");
+        assert_eq!(queued_kinds(&bob_queue).await, ["offer", "offer"]);
+
+        // 副本写出后计数归还，同一发送方又能继续发。
+        route_message(&context, alice_id, &mut inbound(&context), offer()).await;
+        assert_eq!(queued_kinds(&bob_queue).await, ["offer"]);
+        assert!(queued_kinds(&alice_queue).await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn quick_reconnect_suppresses_user_left_while_a_real_departure_emits_it() {
+        let mut config = AppConfig::for_tests();
+        config.leave_grace_ms = 100;
+        let (context, _alice_id, alice_queue, _bob_queue) = relay_pair(config).await;
+        let bob_id = context.state.read().await.rooms["relay"].clients["bob"];
+
+        // 宽限期内重连：对 alice 来说 bob 从未离开。
+        unregister_connection(&context, bob_id, false).await;
+        let (bob_id, _, result) = join(&context, "bob", "relay", client_options(1)).await;
+        assert!(result.is_ok_and(|registration| registration.resumed));
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        assert!(!queued_kinds(&alice_queue)
+            .await
+            .contains(&"user_left".to_string()));
+
+        // 真正离开：宽限期内不广播，过后补发一次。
+        unregister_connection(&context, bob_id, false).await;
+        assert!(alice_queue.try_recv_json().is_none());
+        let left = next_of_kind(&alice_queue, "user_left").await;
+        assert_eq!(left.from, "bob");
+        assert!(!context.state.read().await.rooms["relay"]
+            .pending_leaves
+            .contains_key("bob"));
+    }
+
+    #[tokio::test]
+    async fn history_older_than_the_max_age_is_not_replayed_to_a_new_joiner() {
+        let mut config = AppConfig::for_tests();
+        config.chat_history_limit = 10;
+        config.chat_history_max_age_ms = 60_000;
+        let (context, alice_id, _alice_queue, _bob_queue) = relay_pair(config).await;
+        for text in ["stale", "fresh"] {
+            let chat =
+                serde_json::from_value(serde_json::json!({ "type": "chat", "payload": text }))
+                    .expect("chat message");
+            route_message(&context, alice_id, &mut inbound(&context), chat).await;
+        }
+        // 数量上限远没到，只把第一条的时间戳拨回到窗口之外。
+        context
+            .state
+            .write()
+            .await
+            .rooms
+            .get_mut("relay")
+            .expect("room exists")
+            .history[0]
+            .0 -= 120_000;
+
+        let (_, carol_queue, result) = join(&context, "carol", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let history = next_of_kind(&carol_queue, "chat_history").await;
+        let payloads = history
+            .payload
+            .as_array()
+            .expect("history is an array")
+            .iter()
+            .map(|message| message["payload"].clone())
+            .collect::<Vec<_>>();
+        assert_eq!(payloads, [serde_json::json!("fresh")]);
+    }
+
+    #[tokio::test]
+    async fn configured_announcement_is_replayed_while_an_offer_never_is() {
+        let mut config = AppConfig::for_tests();
+        config.chat_history_limit = 10;
+        config.history_types = history_types_from(vec!["announcement".into(), "offer".into()]);
+        assert!(!config.history_types.contains("offer"));
+        let (context, alice_id, _alice_queue, _bob_queue) = relay_pair(config).await;
+        for kind in ["announcement", "offer", "chat"] {
+            let message = serde_json::from_value(serde_json::json!({ "type": kind }))
+                .expect("broadcast message");
+            route_message(&context, alice_id, &mut inbound(&context), message).await;
+        }
+
+        let (_, carol_queue, result) = join(&context, "carol", "relay", client_options(1)).await;
+        assert!(result.is_ok());
+        let history = next_of_kind(&carol_queue, "chat_history").await;
+        let kinds = history
+            .payload
+            .as_array()
+            .expect("history is an array")
+            .iter()
+            .map(|message| message["type"].clone())
+            .collect::<Vec<_>>();
+        assert_eq!(kinds, [serde_json::json!("announcement")]);
+    }
+
+    #[tokio::test]
+    async fn second_call_is_refused_while_one_is_active() {
+        let mut config = AppConfig::for_tests();
+        config.max_concurrent_calls_per_room = 1;
+        let context = test_context(config);
+        let (alice_id, queues) = mesh(&context, &["bob", "carol", "dave"]).await;
+        let [_, bob_queue, carol_queue, dave_queue] = queues.as_slice() else {
+            unreachable!();
+        };
+        let (bob_id, carol_id) = {
+            let state = context.state.read().await;
+            let room = &state.rooms["mesh"];
+            (room.clients["bob"], room.clients["carol"])
+        };
+        let message = |value: Value| -> SignalMessage {
+            serde_json::from_value(value).expect("call message")
+        };
+        let call_state = |state: &str| {
+            message(serde_json::json!({ "type": "call_state", "payload": { "state": state } }))
+        };
+        let offer = |to: &str| message(serde_json::json!({ "type": "offer", "to": to }));
+
+        // alice 与 bob 的通话占满了房间唯一的名额。
+        for connection_id in [alice_id, bob_id] {
+            route_message(
+                &context,
+                connection_id,
+                &mut inbound(&context),
+                call_state("connected"),
+            )
+            .await;
+        }
+        for queue in &queues {
+            queued_kinds(queue).await;
+        }
+
+        route_message(&context, carol_id, &mut inbound(&context), offer("dave")).await;
+        let refusal = next_of_kind(carol_queue, "error").await;
+        assert_eq!(refusal.payload["code"], "call_in_progress");
+        assert!(dave_queue.try_recv_json().is_none());
+
+        // 通话内的重新协商不受影响。
+        route_message(&context, alice_id, &mut inbound(&context), offer("bob")).await;
+        assert_eq!(queued_kinds(bob_queue).await, ["offer"]);
+
+        // 通话结束后名额空出来。
+        for connection_id in [alice_id, bob_id] {
+            route_message(
+                &context,
+                connection_id,
+                &mut inbound(&context),
+                call_state("ended"),
+            )
+            .await;
+        }
+        queued_kinds(dave_queue).await;
+        route_message(&context, carol_id, &mut inbound(&context), offer("dave")).await;
+        assert_eq!(queued_kinds(dave_queue).await, ["offer"]);
+    }
+
+    #[tokio::test]
+    async fn skewed_client_timestamp_triggers_a_clock_skew_advisory() {
+        let mut config = AppConfig::for_tests();
+        config.clock_skew_warn_ms = 5_000;
+        let (context, alice_id, alice_queue, _bob_queue) = relay_pair(config).await;
+        let time_request = |kind: &str, client_ts: u64| -> SignalMessage {
+            serde_json::from_value(serde_json::json!({
+                "type": kind,
+                "payload": { "clientTs": client_ts },
+            }))
+            .expect("time request")
+        };
+
+        let skewed = now_ms() - 3_600_000;
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            time_request("time", skewed),
+        )
+        .await;
+        assert_eq!(queued_kinds(&alice_queue).await, ["time", "clock_skew"]);
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            time_request("ping", skewed),
+        )
+        .await;
+        let advisory = next_of_kind(&alice_queue, "clock_skew").await;
+        assert_eq!(advisory.payload["clientTs"], skewed);
+        assert!(advisory.payload["skewMs"].as_i64().expect("skew") <= -3_600_000);
+        assert!(advisory.payload["serverTs"].as_u64().expect("server time") > skewed);
+
+        // 在阈值内的时钟不会收到提醒。
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            time_request("time", now_ms()),
+        )
+        .await;
+        assert_eq!(queued_kinds(&alice_queue).await, ["time"]);
+    }
+
+    #[tokio::test]
+    async fn burst_is_coalesced_into_batches_while_a_single_message_goes_out_directly() {
+        let context = test_context(AppConfig::for_tests());
+        let batching = || WriterOptions {
+            batch_max_messages: 3,
+            batch_max_bytes: 64 * 1024,
+            ..writer_options(&context)
+        };
+        let candidate = |index: u64| SignalMessage {
+            kind: "candidate".to_string(),
+            from: "alice".to_string(),
+            payload: serde_json::json!(index),
+            ..Default::default()
+        };
+
+        let burst = OutboundQueue::new(0, context.config.backpressure.clone());
+        for index in 0..5 {
+            assert_eq!(burst.send(OutboundMessage::Json(candidate(index))), Ok(()));
+        }
+        let written = write_queued(&burst, batching()).await;
+        let frames = written
+            .iter()
+            .map(|frame| {
+                assert_eq!(frame.kind, "batch");
+                frame
+                    .payload
+                    .as_array()
+                    .expect("batch payload is an array")
+                    .iter()
+                    .map(|inner| inner["payload"].as_u64().expect("candidate index"))
+                    .collect::<Vec<_>>()
+            })
+            .collect::<Vec<_>>();
+        assert_eq!(frames, [vec![0, 1, 2], vec![3, 4]]);
+
+        let single = OutboundQueue::new(0, context.config.backpressure.clone());
+        assert_eq!(single.send(OutboundMessage::Json(candidate(7))), Ok(()));
+        let written = write_queued(&single, batching()).await;
+        assert_eq!(written.len(), 1);
+        assert_eq!(written[0].kind, "candidate");
+        assert_eq!(written[0].payload, 7);
+    }
+
+    #[tokio::test]
+    async fn over_budget_sheds_history_before_logs_without_touching_live_relay() {
+        let mut config = AppConfig::for_tests();
+        config.chat_history_limit = 10;
+        let context = test_context(config);
+        let logged = || RoomOptions {
+            message_log: true,
+            ..room_options()
+        };
+        let (alice_id, _, result) =
+            join_room(&context, "alice", "budget", logged(), client_options(1)).await;
+        assert!(result.is_ok());
+        let (_, bob_queue, result) =
+            join_room(&context, "bob", "budget", logged(), client_options(1)).await;
+        assert!(result.is_ok());
+        let chat = |index: u64| -> SignalMessage {
+            serde_json::from_value(serde_json::json!({ "type": "chat", "payload": index }))
+                .expect("chat message")
+        };
+        for index in 0..4 {
+            route_message(&context, alice_id, &mut inbound(&context), chat(index)).await;
+        }
+        queued_kinds(&bob_queue).await;
+
+        let retained = |state: &AppState| {
+            let room = &state.rooms["budget"];
+            (
+                room.history
+                    .iter()
+                    .map(|(_, message)| message.payload.clone())
+                    .collect::<Vec<_>>(),
+                room.message_log.as_ref().map_or(0, VecDeque::len),
+            )
+        };
+        {
+            let mut state = context.state.write().await;
+            // 只超出一个字节：丢掉最旧的一条历史就够了，日志原样保留。
+            let budget = state.retained_bytes() - 1;
+            let (shed_history, shed_log, remaining) = state.shed_retained_over_budget(budget);
+            assert_eq!((shed_history, shed_log), (1, 0));
+            assert!(remaining <= budget);
+            assert_eq!(
+                retained(&state),
+                (vec![Value::from(1), Value::from(2), Value::from(3)], 4)
+            );
+
+            // 预算连日志都装不下时，历史先清空，再从最旧的日志开始丢。
+            let room = state.rooms.get_mut("budget").expect("room exists");
+            let history = std::mem::take(&mut room.history);
+            let log_bytes = room.retained_bytes();
+            room.history = history;
+            let (shed_history, shed_log, _) = state.shed_retained_over_budget(log_bytes - 1);
+            assert_eq!((shed_history, shed_log), (3, 1));
+            assert_eq!(retained(&state), (Vec::new(), 3));
+        }
+
+        // 在线转发不受裁剪影响。
+        route_message(&context, alice_id, &mut inbound(&context), chat(9)).await;
+        let relayed = next_of_kind(&bob_queue, "chat").await;
+        assert_eq!(relayed.payload, 9);
+    }
+
+    #[test]
+    fn requested_compression_level_is_applied_and_out_of_range_levels_are_clamped() {
+        let config = AppConfig::for_tests();
+        let payload_message = SignalMessage {
+            kind: "chat".to_string(),
+            payload: Value::from(
+                (0..400)
+                    .map(|index| format!("token-{} ", index % 37))
+                    .collect::<String>(),
+            ),
+            ..Default::default()
+        };
+
+        let mut sizes = HashMap::new();
+        for (requested, applied) in [(1, 1), (7, 7), (0, 1), (99, 9)] {
+            let options = ClientOptions {
+                accepts_compression: true,
+                compression_level: clamp_compression_level(requested),
+                ..client_options(1)
+            };
+            let inbound = InboundState::new(&config, &options);
+            assert_eq!(inbound.compression_level, applied, "requested {requested}");
+            let compressed = compress_payload(&payload_message, 1, inbound.compression_level)
+                .expect("repetitive payload compresses");
+            sizes.insert(applied, compressed.len());
+        }
+        // 级别越高回溯越深，结果不会比低级别更大。
+        assert!(sizes[&9] <= sizes[&7]);
+        assert!(sizes[&7] <= sizes[&1]);
+    }
+
+    #[tokio::test]
+    async fn sender_listed_in_its_own_to_many_is_skipped_unless_self_echo_is_on() {
+        for (self_echo, alice_hears) in [(false, Vec::<&str>::new()), (true, vec!["offer"])] {
+            let mut config = AppConfig::for_tests();
+            config.to_many_self_echo = self_echo;
+            let context = test_context(config);
+            let (alice_id, queues) = mesh(&context, &["bob", "carol"]).await;
+            let [alice_queue, bob_queue, carol_queue] = queues.as_slice() else {
+                unreachable!();
+            };
+
+            let offer = to_many("offer", &["alice", "bob", "carol"]);
+            route_message(&context, alice_id, &mut inbound(&context), offer).await;
+            assert_eq!(queued_kinds(bob_queue).await, ["offer"]);
+            assert_eq!(queued_kinds(carol_queue).await, ["offer"]);
+            assert_eq!(queued_kinds(alice_queue).await, alice_hears, "{self_echo}");
+        }
+    }
+
+    #[test]
+    fn flushed_chain_tells_the_sender_where_the_gap_is() {
+        let config = AppConfig::for_tests();
+        let sender = OutboundQueue::new(0, config.backpressure.clone());
+        let mut buffer = ReorderBuffer::new(1, 1_000);
+        let chained = |seq: u64| SignalMessage {
+            kind: "candidate".to_string(),
+            correlation_id: Some("call".to_string()),
+            seq: Some(seq),
+            ..Default::default()
+        };
+
+        assert!(buffer.accept(chained(2), 0).is_empty());
+        for message in buffer.accept(chained(3), 0) {
+            notify_sequence_gap(&config, &sender, &message);
+        }
+        let notice = sender
+            .try_recv_json()
+            .expect("the sender hears about the gap");
+        assert_eq!(notice.kind, "sequence_gap");
+        assert_eq!(
+            notice.payload,
+            serde_json::json!({ "correlationId": "call", "expected": 0, "resumedAt": 2 })
+        );
+        assert!(sender.try_recv_json().is_none());
+    }
+
+    #[tokio::test]
+    async fn virtual_bot_answers_a_roster_query_like_a_member() {
+        let mut config = AppConfig::for_tests();
+        config.virtual_bots = vec![VirtualBot {
+            id: "scribe".to_string(),
+            rooms: "rel*".to_string(),
+        }];
+        let (context, alice_id, alice_queue, bob_queue) = relay_pair(config).await;
+
+        route_message(
+            &context,
+            alice_id,
+            &mut inbound(&context),
+            correlated("get_roster", "scribe", None),
+        )
+        .await;
+        let roster = next_of_kind(&alice_queue, "roster").await;
+        assert_eq!(roster.from, "scribe");
+        assert_eq!(roster.to.as_deref(), Some("alice"));
+        assert_eq!(roster.correlation_id.as_deref(), Some("req-1"));
+        assert_eq!(
+            roster.payload,
+            serde_json::json!({ "members": ["alice", "bob", "scribe"] })
+        );
+        // 查询由服务端代答，不会转发给房间里的其他成员。
+        assert!(queued_kinds(&bob_queue).await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn each_client_class_gets_its_own_ping_profile() {
+        let mut config = AppConfig::for_tests();
+        let mobile = PingProfile {
+            interval_ms: 60_000,
+            timeout_ms: 150_000,
+        };
+        let desktop = PingProfile {
+            interval_ms: 10_000,
+            timeout_ms: 25_000,
+        };
+        config.ping_profiles = HashMap::from([
+            ("mobile".to_string(), mobile),
+            ("desktop".to_string(), desktop),
+        ]);
+        let context = test_context(config);
+        let default = ping_profile_for(&context.config, None);
+        assert_eq!(default.interval_ms, WS_SERVER_PING_INTERVAL_MS);
+
+        let mut joined = Vec::new();
+        for (client_id, class, expected) in [
+            ("phone", Some(" Mobile "), mobile),
+            ("laptop", Some("desktop"), desktop),
+            ("fridge", Some("appliance"), default),
+            ("legacy", None, default),
+        ] {
+            let profile = ping_profile_for(&context.config, class);
+            assert_eq!(profile, expected, "{class:?}");
+            let options = ClientOptions {
+                ping_profile: profile,
+                ..client_options(1)
+            };
+            let (connection_id, _, result) = join(&context, client_id, "classes", options).await;
+            assert!(result.is_ok());
+            // 建连流程按 profile 设定 Ping 间隔，掉线判定用同一 profile 的超时。
+            assert_eq!(
+                context.state.read().await.connections[&connection_id].heartbeat_timeout_ms,
+                expected.timeout_ms,
+                "{class:?}"
+            );
+            joined.push((client_id, connection_id));
+        }
+
+        // 都静默 30 秒后，只有按移动端 profile 心跳的连接还没到超时。
+        for connection in context.state.read().await.connections.values() {
+            connection
+                .last_seen_ms
+                .store(now_ms() - 30_000, Ordering::Relaxed);
+        }
+        reap_stale_connections(&context).await;
+        let state = context.state.read().await;
+        let alive = joined
+            .iter()
+            .filter(|(_, connection_id)| state.connections.contains_key(connection_id))
+            .map(|(client_id, _)| *client_id)
+            .collect::<Vec<_>>();
+        assert_eq!(alive, ["phone"]);
+    }
+
+    #[tokio::test]
+    async fn anonymous_cap_refuses_anonymous_clients_while_identified_users_continue() {
+        let mut config = AppConfig::for_tests();
+        config.max_anonymous_connections = 2;
+        config.max_connections = 4;
+        let context = test_context(config);
+        let identified = || ClientOptions {
+            anonymous: false,
+            ..client_options(1)
+        };
+        let limit = |identity: &str, anonymous: bool| {
+            let context = context.clone();
+            let identity = identity.to_string();
+            async move {
+                context.state.read().await.connection_limit_reached(
+                    &context.config,
+                    &identity,
+                    anonymous,
+                )
+            }
+        };
+
+        for client_id in ["guest-1", "guest-2"] {
+            let (_, _, result) = join(&context, client_id, "lobby", client_options(1)).await;
+            assert!(result.is_ok());
+        }
+        assert_eq!(
+            limit("guest-3", true).await,
+            Some("anonymous_connection_limit")
+        );
+        // 已在线的匿名身份重连时顶替自己的旧连接，不算新增。
+        assert_eq!(limit("guest-1", true).await, None);
+
+        for client_id in ["alice", "bob"] {
+            assert_eq!(limit(client_id, false).await, None);
+            let (_, _, result) = join(&context, client_id, "lobby", identified()).await;
+            assert!(result.is_ok());
+        }
+        // 带凭证的用户只受全局上限约束。
+        assert_eq!(limit("carol", false).await, Some("connection_limit"));
+    }
+}